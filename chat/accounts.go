@@ -0,0 +1,459 @@
+package chat
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	passwordIterations = 600000
+	passwordMinLength  = 8
+
+	// passwordQueue is how many passwords can wait to be hashed before
+	// more are turned away.
+	passwordQueue = 32
+
+	// After each wrong password in a row, an account, and the address it
+	// came from, wait twice as long before the next try, up to the most.
+	// Mistakes older than passwordForget are forgiven.
+	passwordBackoff    = time.Second
+	passwordMaxBackoff = 5 * time.Minute
+	passwordForget     = time.Hour
+)
+
+type Account struct {
+	Nick       string    `json:"nick"`
+	Salt       []byte    `json:"salt"`
+	Hash       []byte    `json:"hash"`
+	Iterations int       `json:"iterations"`
+	Created    time.Time `json:"created"`
+	Tokens     []*Token  `json:"tokens,omitempty"`
+	Ignored    []string  `json:"ignored,omitempty"`
+	LastSeen   time.Time `json:"last_seen,omitempty"`
+	Protect    string    `json:"protect,omitempty"`
+	Role       string    `json:"role,omitempty"`
+	Mailbox    []*Mail   `json:"mailbox,omitempty"`
+}
+
+func hashPassword(password string, salt []byte, iterations int) []byte {
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+
+	if err != nil {
+		// Only possible for parameters we never pass.
+		panic(err)
+	}
+
+	return key
+}
+
+func NewAccount(nick, password string) *Account {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+
+	return &Account{
+		Nick:       nick,
+		Salt:       salt,
+		Hash:       hashPassword(password, salt, passwordIterations),
+		Iterations: passwordIterations,
+		Created:    time.Now(),
+	}
+}
+
+func (account *Account) CheckPassword(password string) bool {
+	hash := hashPassword(password, account.Salt, account.Iterations)
+	return subtle.ConstantTimeCompare(hash, account.Hash) == 1
+}
+
+// PasswordChecker hashes passwords off the dispatcher, a few at a time so
+// a flood of logins can't take every CPU, and keeps track of wrong
+// passwords to slow down guessing. It is safe for concurrent use.
+type PasswordChecker struct {
+	slots   chan struct{}
+	waiting atomic.Int64
+
+	mu       sync.Mutex
+	failures map[string]*passwordFailures
+	pruned   time.Time
+}
+
+type passwordFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+func NewPasswordChecker() *PasswordChecker {
+	return &PasswordChecker{
+		slots:    make(chan struct{}, max(1, runtime.GOMAXPROCS(0)/2)),
+		failures: make(map[string]*passwordFailures),
+	}
+}
+
+// Go runs fn, which hashes a password, once a slot is free, and reports
+// false without running it if too many are waiting already.
+func (checker *PasswordChecker) Go(fn func()) bool {
+	if checker.waiting.Add(1) > passwordQueue {
+		checker.waiting.Add(-1)
+		return false
+	}
+
+	go func() {
+		checker.slots <- struct{}{}
+		checker.waiting.Add(-1)
+		fn()
+		<-checker.slots
+	}()
+
+	return true
+}
+
+// Wait is how long until any of keys may try a password again.
+func (checker *PasswordChecker) Wait(keys ...string) time.Duration {
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+
+	var wait time.Duration
+
+	for _, key := range keys {
+		if failures := checker.failures[key]; failures != nil {
+			wait = max(wait, time.Until(failures.until))
+		}
+	}
+
+	return wait
+}
+
+// Failed counts a wrong password against each of keys.
+func (checker *PasswordChecker) Failed(keys ...string) {
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(checker.pruned) > time.Minute {
+		for key, failures := range checker.failures {
+			if now.Sub(failures.last) > passwordForget {
+				delete(checker.failures, key)
+			}
+		}
+
+		checker.pruned = now
+	}
+
+	for _, key := range keys {
+		failures := checker.failures[key]
+
+		if failures == nil || now.Sub(failures.last) > passwordForget {
+			failures = &passwordFailures{}
+			checker.failures[key] = failures
+		}
+
+		backoff := min(passwordBackoff<<min(failures.count, 20), passwordMaxBackoff)
+
+		failures.count++
+		failures.last = now
+		failures.until = now.Add(backoff)
+	}
+}
+
+// Succeeded forgets the wrong passwords counted against keys.
+func (checker *PasswordChecker) Succeeded(keys ...string) {
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+
+	for _, key := range keys {
+		delete(checker.failures, key)
+	}
+}
+
+// passwordKeys are what wrong passwords for account from client count
+// against: the account, and the address client connected from.
+func passwordKeys(client *Client, account string) []string {
+	return []string{"account " + foldName(account), "addr " + remoteIP(client.conn)}
+}
+
+// checkPassword hashes password for client trying account, off the
+// dispatcher, then has the dispatcher run done with the answer. Clients
+// that have had too many wrong passwords lately, or that find the checker
+// too busy, are told to try again later.
+func (server *Server) checkPassword(client *Client, account *Account, password string, done func(ok bool) Command) {
+	keys := passwordKeys(client, account.Nick)
+
+	if wait := server.passwords.Wait(keys...); wait > 0 {
+		client.Error(fmt.Sprintf("Too many wrong passwords, try again in %v", wait.Round(time.Second)+time.Second))
+		return
+	}
+
+	busy := !server.passwords.Go(func() {
+		ok := account.CheckPassword(password)
+
+		if ok {
+			server.passwords.Succeeded(keys...)
+		} else {
+			server.passwords.Failed(keys...)
+		}
+
+		server.incoming <- done(ok)
+	})
+
+	if busy {
+		client.Error("The server is busy checking passwords, try again shortly")
+	}
+}
+
+// AccountStore holds registered nicks, saved as a single JSON file. Only
+// the dispatcher changes it, apart from mail left for users who are
+// offline, which server.mailMu guards; the slow password hashing happens
+// elsewhere.
+type AccountStore struct {
+	path     string
+	accounts map[string]*Account
+	tokens   map[string]*Account
+}
+
+func LoadAccountStore(path string) (*AccountStore, error) {
+	store := &AccountStore{
+		path:     path,
+		accounts: make(map[string]*Account),
+		tokens:   make(map[string]*Account),
+	}
+
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var accounts []*Account
+
+	err = json.Unmarshal(data, &accounts)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for _, account := range accounts {
+		store.accounts[foldName(account.Nick)] = account
+
+		for _, token := range account.Tokens {
+			store.tokens[token.Hash] = account
+		}
+	}
+
+	return store, nil
+}
+
+func (store *AccountStore) Get(nick string) (*Account, bool) {
+	account, exists := store.accounts[foldName(nick)]
+	return account, exists
+}
+
+func (store *AccountStore) Put(account *Account) error {
+	store.accounts[foldName(account.Nick)] = account
+	return store.save()
+}
+
+func (store *AccountStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+
+	accounts := make([]*Account, 0, len(store.accounts))
+
+	for _, account := range store.accounts {
+		accounts = append(accounts, account)
+	}
+
+	data, err := json.MarshalIndent(accounts, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp := store.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, store.path)
+}
+
+type RegisterCommand struct {
+	client   *Client
+	password string
+}
+
+func (cmd *RegisterCommand) Run(server *Server) {
+	nick := cmd.client.nick()
+
+	if nick == "" {
+		cmd.client.Error("Must set NICK first")
+		return
+	}
+
+	if _, exists := server.accounts.Get(nick); exists {
+		cmd.client.Error("Nick is already registered")
+		return
+	}
+
+	if len(cmd.password) < passwordMinLength {
+		cmd.client.Error(fmt.Sprintf("Password must be at least %d characters", passwordMinLength))
+		return
+	}
+
+	// Hashing takes a noticeable fraction of a second, so do it off the
+	// dispatcher and come back with the result.
+	busy := !server.passwords.Go(func() {
+		server.incoming <- &registeredCommand{
+			client:  cmd.client,
+			account: NewAccount(nick, cmd.password),
+		}
+	})
+
+	if busy {
+		cmd.client.Error("The server is busy checking passwords, try again shortly")
+	}
+}
+
+type registeredCommand struct {
+	client  *Client
+	account *Account
+}
+
+func (cmd *registeredCommand) Run(server *Server) {
+	if !server.clients.Has(cmd.client) {
+		return
+	}
+
+	if _, exists := server.accounts.Get(cmd.account.Nick); exists {
+		cmd.client.Error("Nick is already registered")
+		return
+	}
+
+	if cmd.client.nick() != cmd.account.Nick {
+		cmd.client.Error("Nick changed before registration finished")
+		return
+	}
+
+	err := server.accounts.Put(cmd.account)
+
+	if err != nil {
+		slog.Error("saving accounts", "err", err)
+		cmd.client.Error("Registration failed")
+		return
+	}
+
+	cmd.client.logger().Info("registered account")
+
+	cmd.client.account = cmd.account.Nick
+	cmd.client.role = cmd.account.role()
+
+	if len(cmd.client.ignored) > 0 {
+		server.saveIgnored(cmd.client)
+	}
+
+	cmd.client.Reply("Registered " + cmd.account.Nick)
+}
+
+type LoginCommand struct {
+	client   *Client
+	nick     string
+	password string
+}
+
+func (cmd *LoginCommand) Run(server *Server) {
+	account, exists := server.accounts.Get(cmd.nick)
+
+	if !exists {
+		cmd.client.Error("No such account")
+		return
+	}
+
+	server.checkPassword(cmd.client, account, cmd.password, func(ok bool) Command {
+		return &loggedInCommand{client: cmd.client, account: account, ok: ok}
+	})
+}
+
+type loggedInCommand struct {
+	client  *Client
+	account *Account
+	ok      bool
+}
+
+func (cmd *loggedInCommand) Run(server *Server) {
+	if !server.clients.Has(cmd.client) {
+		return
+	}
+
+	if !cmd.ok {
+		cmd.client.logger().Warn("failed login", "account", cmd.account.Nick)
+		cmd.client.Error("Wrong password")
+		return
+	}
+
+	server.LogIn(cmd.client, cmd.account)
+}
+
+// LogIn makes client the owner of account's nick, taking it back from
+// whoever is holding it.
+func (server *Server) LogIn(client *Client, account *Account) {
+	nick := account.Nick
+
+	if holder, taken := server.LookupNick(nick); taken && holder != client {
+		server.ChangeNick(holder, "")
+		holder.Notice("", nick+" is registered; you are now "+holder.Name())
+	}
+
+	client.logger().Info("logged in", "account", nick)
+	client.account = nick
+	client.role = account.role()
+
+	for _, ignored := range account.Ignored {
+		client.ignored[foldName(ignored)] = true
+	}
+
+	for _, room := range client.rooms {
+		if room.opAccounts[nick] {
+			room.ops[client] = true
+		}
+	}
+
+	server.ChangeNick(client, nick)
+	client.Reply("Logged in as " + nick)
+	server.deliverMail(client, account)
+}
+
+func parseRegister(client *Client, args []string) Command {
+	return &RegisterCommand{
+		client:   client,
+		password: args[0],
+	}
+}
+
+func parseLogin(client *Client, args []string) Command {
+	return &LoginCommand{
+		client:   client,
+		nick:     args[0],
+		password: args[1],
+	}
+}
@@ -0,0 +1,43 @@
+package chat
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager gets certificates for the -acme-domain names from Let's
+// Encrypt, and renews them before they expire, keeping them in the cache
+// directory so a restart doesn't ask for new ones. Let's Encrypt checks
+// the server holds a name either over TLS, which needs a TLS listener on
+// port 443, or over HTTP on port 80, which ServeACME answers.
+func newACMEManager(config *Config) *autocert.Manager {
+	var domains []string
+
+	for _, domain := range strings.Split(config.ACMEDomain, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(config.ACMECache),
+		Email:      config.ACMEEmail,
+	}
+}
+
+// ServeACME answers Let's Encrypt's HTTP challenges for manager, and
+// redirects anything else to HTTPS.
+func ServeACME(listener net.Listener, manager *autocert.Manager) error {
+	httpServer := &http.Server{
+		Handler:           manager.HTTPHandler(nil),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return httpServer.Serve(listener)
+}
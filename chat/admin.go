@@ -0,0 +1,246 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServeAdmin answers the operational HTTP API on its own listener. Every
+// request needs "Authorization: Bearer <admin token>". Handlers run on
+// HTTP goroutines, so anything touching server state goes through call.
+func (server *Server) ServeAdmin(listener net.Listener) error {
+	httpServer := &http.Server{
+		Handler:           server.adminAuth(http.HandlerFunc(server.adminRoute)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return httpServer.Serve(listener)
+}
+
+// adminRoute dispatches by hand rather than with ServeMux method patterns,
+// which depend on the module's Go version to be turned on.
+func (server *Server) adminRoute(w http.ResponseWriter, r *http.Request) {
+	resource, arg, _ := strings.Cut(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && resource == "clients" && arg == "":
+		server.adminListClients(w, r)
+	case r.Method == http.MethodDelete && resource == "clients" && arg != "":
+		server.adminDisconnect(w, r, arg)
+	case r.Method == http.MethodGet && resource == "rooms" && arg == "":
+		server.adminListRooms(w, r)
+	case r.Method == http.MethodDelete && resource == "rooms" && arg != "":
+		server.adminCloseRoom(w, r, arg)
+	case r.Method == http.MethodPost && resource == "notice" && arg == "":
+		server.adminNotice(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (server *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(server.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		server.audit("admin API", r.Method+" "+r.URL.Path, "", "", "from "+host)
+		next.ServeHTTP(w, r)
+	})
+}
+
+type callCommand struct {
+	fn   func()
+	done chan struct{}
+}
+
+func (cmd *callCommand) Run(server *Server) {
+	cmd.fn()
+	close(cmd.done)
+}
+
+// call runs fn on the dispatcher and waits for it to finish.
+func (server *Server) call(fn func()) {
+	server.dispatchOnce.Do(func() {
+		go server.dispatch()
+	})
+
+	done := make(chan struct{})
+	server.incoming <- &callCommand{fn: fn, done: done}
+	<-done
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type adminClient struct {
+	ID      uint64   `json:"id"`
+	Nick    string   `json:"nick"`
+	Addr    string   `json:"addr"`
+	Account string   `json:"account,omitempty"`
+	Rooms   []string `json:"rooms"`
+}
+
+type adminRoom struct {
+	Name    string   `json:"name"`
+	Topic   string   `json:"topic,omitempty"`
+	Members []string `json:"members"`
+}
+
+func (server *Server) adminListClients(w http.ResponseWriter, r *http.Request) {
+	clients := []adminClient{}
+
+	server.call(func() {
+		for _, client := range server.clients.Sorted() {
+			rooms := make([]string, 0, len(client.rooms))
+
+			for name := range client.rooms {
+				rooms = append(rooms, name)
+			}
+
+			sort.Strings(rooms)
+
+			clients = append(clients, adminClient{
+				ID:      client.id,
+				Nick:    client.Name(),
+				Addr:    client.conn.RemoteAddr().String(),
+				Account: client.account,
+				Rooms:   rooms,
+			})
+		}
+	})
+
+	writeJSON(w, http.StatusOK, clients)
+}
+
+func (server *Server) adminDisconnect(w http.ResponseWriter, r *http.Request, arg string) {
+	id, err := strconv.ParseUint(arg, 10, 64)
+
+	if err != nil {
+		http.Error(w, "bad client id", http.StatusBadRequest)
+		return
+	}
+
+	var found bool
+
+	server.call(func() {
+		client, exists := server.clients.Get(id)
+
+		if exists {
+			found = true
+			client.logger().Info("disconnected by admin API")
+			server.evict(client, "Disconnected by an administrator")
+		}
+	})
+
+	if !found {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) adminListRooms(w http.ResponseWriter, r *http.Request) {
+	rooms := []adminRoom{}
+
+	server.call(func() {
+		for _, room := range server.Rooms() {
+			members := make([]string, len(room.clients))
+
+			for i, client := range room.clients {
+				members[i] = client.Name()
+			}
+
+			rooms = append(rooms, adminRoom{
+				Name:    room.name,
+				Topic:   room.topic,
+				Members: members,
+			})
+		}
+	})
+
+	writeJSON(w, http.StatusOK, rooms)
+}
+
+func (server *Server) adminCloseRoom(w http.ResponseWriter, r *http.Request, name string) {
+	var found bool
+
+	server.call(func() {
+		room, exists := server.LookupRoom(name)
+
+		if exists {
+			found = true
+			slog.Info("room closed by admin API", "room", room.name)
+			server.CloseRoom(room, "Room closed by an administrator")
+		}
+	})
+
+	if !found {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminNoticeRequest struct {
+	Room string `json:"room"`
+	Text string `json:"text"`
+}
+
+func (server *Server) adminNotice(w http.ResponseWriter, r *http.Request) {
+	var req adminNoticeRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil || req.Text == "" {
+		http.Error(w, "expected {\"text\": ..., \"room\": optional}", http.StatusBadRequest)
+		return
+	}
+
+	var found bool
+
+	server.call(func() {
+		slog.Info("notice sent by admin API", "room", req.Room, "text", req.Text)
+
+		if req.Room == "" {
+			found = true
+
+			for _, client := range server.clients.Sorted() {
+				client.Notice("", "Server notice: "+req.Text)
+			}
+
+			return
+		}
+
+		room, exists := server.LookupRoom(req.Room)
+
+		if exists {
+			found = true
+			room.Notice("Server notice: " + req.Text)
+		}
+	})
+
+	if !found {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
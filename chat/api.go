@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"context"
+	"net"
+	"sort"
+)
+
+// Serve accepts clients on listener, speaking the native protocol, until
+// ctx is done or listener is closed, returning ctx's error or nil. Clients
+// already connected stay on; Drain waits for them. Temporary accept errors
+// are retried; any other error closes listener and is returned.
+func (server *Server) Serve(ctx context.Context, listener net.Listener) error {
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+
+	defer stop()
+
+	err := server.HandleConnections(listener)
+
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	return ctx.Err()
+}
+
+// Do runs fn on the dispatcher and waits for it to finish. Nothing else
+// changes rooms and clients while fn runs, so code outside the server's own
+// commands and plugins looks at them from inside fn.
+func (server *Server) Do(fn func()) {
+	server.call(fn)
+}
+
+// Rooms returns the open rooms, sorted by name. Call it from the
+// dispatcher.
+func (server *Server) Rooms() []*Room {
+	rooms := server.rooms.Values()
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return foldName(rooms[i].name) < foldName(rooms[j].name)
+	})
+
+	return rooms
+}
+
+// Clients returns everyone connected, in the order they connected. Call it
+// from the dispatcher.
+func (server *Server) Clients() []*Client {
+	return server.clients.Sorted()
+}
+
+// The accessors below read state the dispatcher owns, so they are for use
+// on the dispatcher too.
+
+func (room *Room) Name() string {
+	return room.name
+}
+
+func (room *Room) Topic() string {
+	return room.topic
+}
+
+// Members returns the clients in room, in the order they joined.
+func (room *Room) Members() []*Client {
+	return append([]*Client(nil), room.clients...)
+}
+
+func (client *Client) ID() uint64 {
+	return client.id
+}
+
+// Account is the account client is logged in to, or "" for a guest.
+func (client *Client) Account() string {
+	return client.account
+}
+
+// Rooms returns the names of the rooms client is in, sorted.
+func (client *Client) Rooms() []string {
+	rooms := make([]string, 0, len(client.rooms))
+
+	for name := range client.rooms {
+		rooms = append(rooms, name)
+	}
+
+	sort.Strings(rooms)
+
+	return rooms
+}
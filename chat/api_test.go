@@ -0,0 +1,230 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeListener is a net.Listener whose connections are in-process pipes.
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *pipeListener) Dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- server
+
+	return client
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// testClient is the far end of a connection to a test server.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTest(t *testing.T, l *pipeListener) *testClient {
+	t.Helper()
+
+	conn := l.Dial()
+	t.Cleanup(func() { conn.Close() })
+
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(line string) {
+	c.t.Helper()
+
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatalf("sending %q: %v", line, err)
+	}
+}
+
+// expect reads lines until one contains want.
+func (c *testClient) expect(want string) string {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		line, err := c.reader.ReadString('\n')
+
+		if err != nil {
+			c.t.Fatalf("waiting for %q: %v", want, err)
+		}
+
+		if strings.Contains(line, want) {
+			return line
+		}
+	}
+}
+
+func newTestServer(t *testing.T, config *Config) (*Server, *pipeListener, chan error, context.CancelFunc) {
+	t.Helper()
+
+	if config == nil {
+		config = DefaultConfig()
+	}
+
+	server, err := NewServer(Options{Config: config})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := newPipeListener()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+
+	go func() {
+		served <- server.Serve(ctx, l)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+	})
+
+	return server, l, served, cancel
+}
+
+func TestServePipe(t *testing.T) {
+	server, l, served, cancel := newTestServer(t, nil)
+
+	alice := dialTest(t, l)
+	alice.send("nick alice")
+	alice.expect("is now known as alice")
+	alice.send("join lobby")
+	alice.expect("alice joined lobby")
+
+	bob := dialTest(t, l)
+	bob.send("nick bob")
+	bob.expect("is now known as bob")
+	bob.send("join lobby")
+	bob.expect("bob joined lobby")
+
+	alice.send("msg lobby hello")
+	bob.expect("alice: hello")
+
+	var members []string
+
+	server.Do(func() {
+		room, _ := server.LookupRoom("lobby")
+
+		for _, client := range room.Members() {
+			members = append(members, client.Name())
+		}
+	})
+
+	if strings.Join(members, ",") != "alice,bob" {
+		t.Errorf("lobby members = %v, want alice and bob", members)
+	}
+
+	cancel()
+
+	select {
+	case err := <-served:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Serve returned %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after its context was canceled")
+	}
+}
+
+// failingListener fails every Accept with err until it is closed.
+type failingListener struct {
+	*pipeListener
+	err     error
+	accepts int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts++
+
+	if l.accepts > 3 {
+		l.Close()
+	}
+
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+		return nil, l.err
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestServeAcceptErrors(t *testing.T) {
+	server, err := NewServer(Options{Config: DefaultConfig()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	temporary := &failingListener{pipeListener: newPipeListener(), err: temporaryError{}}
+
+	if err := server.Serve(context.Background(), temporary); err != nil {
+		t.Errorf("Serve with temporary errors returned %v, want nil once closed", err)
+	}
+
+	if temporary.accepts < 4 {
+		t.Errorf("Serve gave up after %d accepts, want it to retry", temporary.accepts)
+	}
+
+	broken := errors.New("broken")
+	failing := &failingListener{pipeListener: newPipeListener(), err: broken}
+
+	if err := server.Serve(context.Background(), failing); !errors.Is(err, broken) {
+		t.Errorf("Serve returned %v, want %v", err, broken)
+	}
+}
@@ -0,0 +1,188 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The audit command looks back over this many of the latest entries.
+	maxAuditRecent = 1000
+	auditPage      = 50
+)
+
+// An AuditEntry records one moderation or admin action: who did it, what
+// it was, the room and nick or address it was done to, and why.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Room   string    `json:"room,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func (entry *AuditEntry) String() string {
+	line := fmt.Sprintf("%s %s %s", entry.Time.Format(time.DateTime), entry.Actor, entry.Action)
+
+	for _, field := range []string{entry.Room, entry.Target} {
+		if field != "" {
+			line += " " + field
+		}
+	}
+
+	if entry.Reason != "" {
+		line += ": " + entry.Reason
+	}
+
+	return line
+}
+
+// matches reports whether the entry involves name as its actor, room or
+// target.
+func (entry *AuditEntry) matches(name string) bool {
+	return name == "" || sameName(entry.Actor, name) || sameName(entry.Room, name) || sameName(entry.Target, name)
+}
+
+// AuditLog appends entries to a file of JSON lines, which it only ever
+// adds to, and keeps the latest in memory to answer the audit command.
+// Without a file they are only kept in memory. Admin API handlers record
+// entries from their own goroutines, so it is locked.
+type AuditLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	recent []*AuditEntry
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	log := &AuditLog{}
+
+	if path == "" {
+		return log, nil
+	}
+
+	existing, err := os.Open(path)
+
+	if err == nil {
+		defer existing.Close()
+		scanner := bufio.NewScanner(existing)
+		scanner.Buffer(nil, 1<<20)
+
+		for scanner.Scan() {
+			var entry AuditEntry
+
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+				log.remember(&entry)
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return log, nil
+}
+
+func (log *AuditLog) remember(entry *AuditEntry) {
+	log.recent = append(log.recent, entry)
+
+	if len(log.recent) > maxAuditRecent {
+		log.recent = log.recent[len(log.recent)-maxAuditRecent:]
+	}
+}
+
+func (log *AuditLog) Record(entry *AuditEntry) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	log.remember(entry)
+
+	if log.file == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = log.file.Write(append(data, '\n'))
+	return err
+}
+
+// Recent returns the latest n entries involving name, or all entries if
+// name is empty, oldest first.
+func (log *AuditLog) Recent(name string, n int) []*AuditEntry {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	var entries []*AuditEntry
+
+	for i := len(log.recent) - 1; i >= 0 && len(entries) < n; i-- {
+		if log.recent[i].matches(name) {
+			entries = append(entries, log.recent[i])
+		}
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	return entries
+}
+
+// audit records an action in the audit log.
+func (server *Server) audit(actor, action, room, target, reason string) {
+	err := server.auditLog.Record(&AuditEntry{
+		Time:   time.Now().In(server.timeLocation),
+		Actor:  actor,
+		Action: action,
+		Room:   room,
+		Target: target,
+		Reason: reason,
+	})
+
+	if err != nil {
+		slog.Error("writing audit log", "action", action, "err", err)
+	}
+}
+
+// AuditCommand shows moderators and admins the latest moderation and admin actions,
+// optionally only those involving one nick or room.
+type AuditCommand struct {
+	client *Client
+	name   string
+}
+
+func (cmd *AuditCommand) Run(server *Server) {
+	entries := server.auditLog.Recent(cmd.name, auditPage)
+
+	if len(entries) == 0 {
+		cmd.client.Reply("No audit entries")
+		return
+	}
+
+	lines := make([]string, len(entries))
+
+	for i, entry := range entries {
+		lines[i] = entry.String()
+	}
+
+	cmd.client.Reply("Audit log:\n" + strings.Join(lines, "\n"))
+}
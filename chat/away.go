@@ -0,0 +1,36 @@
+package chat
+
+import (
+	"fmt"
+)
+
+type AwayCommand struct {
+	client  *Client
+	message string
+}
+
+func (cmd *AwayCommand) Run(server *Server) {
+	cmd.client.away = cmd.message
+
+	if cmd.message == "" {
+		cmd.client.Reply("You are no longer away")
+	} else {
+		cmd.client.Reply("You are now away")
+	}
+}
+
+// awayName is a nick as shown in who, marked if its owner is away.
+func awayName(client *Client, name string) string {
+	if client.away == "" {
+		return name
+	}
+
+	return fmt.Sprintf("%s (away)", name)
+}
+
+func parseAway(client *Client, args []string) Command {
+	return &AwayCommand{
+		client:  client,
+		message: args[0],
+	}
+}
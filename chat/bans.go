@@ -0,0 +1,267 @@
+package chat
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BanList is the set of addresses refused at accept time. Entries are
+// single IPs or CIDR ranges, kept one per line in a file so they survive a
+// restart. It is read by the accept loops and changed by the dispatcher.
+type BanList struct {
+	mu       sync.RWMutex
+	path     string
+	prefixes map[netip.Prefix]bool
+}
+
+func LoadBanList(path string) (*BanList, error) {
+	bans := &BanList{
+		path:     path,
+		prefixes: make(map[netip.Prefix]bool),
+	}
+
+	if path == "" {
+		return bans, nil
+	}
+
+	file, err := os.Open(path)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return bans, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		prefix, err := parseBan(text)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+
+		bans.prefixes[prefix] = true
+	}
+
+	return bans, scanner.Err()
+}
+
+// parseBan accepts an IP address or a CIDR range.
+func parseBan(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (bans *BanList) Banned(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+
+	bans.mu.RLock()
+	defer bans.mu.RUnlock()
+
+	for prefix := range bans.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (bans *BanList) Add(prefix netip.Prefix) error {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	bans.prefixes[prefix] = true
+	return bans.save()
+}
+
+// Remove reports whether prefix was on the list.
+func (bans *BanList) Remove(prefix netip.Prefix) (bool, error) {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	if !bans.prefixes[prefix] {
+		return false, nil
+	}
+
+	delete(bans.prefixes, prefix)
+	return true, bans.save()
+}
+
+func (bans *BanList) List() []string {
+	bans.mu.RLock()
+	defer bans.mu.RUnlock()
+
+	list := make([]string, 0, len(bans.prefixes))
+
+	for prefix := range bans.prefixes {
+		list = append(list, prefix.String())
+	}
+
+	sort.Strings(list)
+
+	return list
+}
+
+// save rewrites the file through a temporary one so a crash never leaves
+// it half written. The caller holds the lock.
+func (bans *BanList) save() error {
+	if bans.path == "" {
+		return nil
+	}
+
+	list := make([]string, 0, len(bans.prefixes))
+
+	for prefix := range bans.prefixes {
+		list = append(list, prefix.String()+"\n")
+	}
+
+	sort.Strings(list)
+
+	tmp := bans.path + ".tmp"
+	err := os.WriteFile(tmp, []byte(strings.Join(list, "")), 0600)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, bans.path)
+}
+
+type OperCommand struct {
+	client   *Client
+	password string
+}
+
+func (cmd *OperCommand) Run(server *Server) {
+	if server.operPassword == "" || subtle.ConstantTimeCompare([]byte(cmd.password), []byte(server.operPassword)) != 1 {
+		cmd.client.logger().Warn("failed oper attempt")
+		cmd.client.Error("Wrong operator password")
+		return
+	}
+
+	cmd.client.logger().Info("became server operator")
+	server.audit(cmd.client.Name(), "oper", "", "", "")
+	cmd.client.oper = true
+	cmd.client.Reply("You are now a server operator")
+}
+
+type BanIPCommand struct {
+	client *Client
+	ban    string
+}
+
+func (cmd *BanIPCommand) Run(server *Server) {
+	prefix, err := parseBan(cmd.ban)
+
+	if err != nil {
+		cmd.client.Error("Invalid address: " + cmd.ban)
+		return
+	}
+
+	cmd.client.logger().Info("banned address", "ban", prefix.String())
+	server.audit(cmd.client.Name(), "ban-ip", "", prefix.String(), "")
+
+	err = server.bans.Add(prefix)
+
+	if err != nil {
+		slog.Error("saving bans", "err", err)
+		cmd.client.Error("Ban added but could not be saved")
+	} else {
+		cmd.client.Reply("Banned " + prefix.String())
+	}
+
+	for _, client := range server.clients.Sorted() {
+		if client != cmd.client && server.bans.Banned(remoteIP(client.conn)) {
+			server.evict(client, "Banned")
+		}
+	}
+}
+
+type UnbanIPCommand struct {
+	client *Client
+	ban    string
+}
+
+func (cmd *UnbanIPCommand) Run(server *Server) {
+	prefix, err := parseBan(cmd.ban)
+
+	if err != nil {
+		cmd.client.Error("Invalid address: " + cmd.ban)
+		return
+	}
+
+	removed, err := server.bans.Remove(prefix)
+
+	if !removed {
+		cmd.client.Error("No such ban")
+		return
+	}
+
+	cmd.client.logger().Info("unbanned address", "ban", prefix.String())
+	server.audit(cmd.client.Name(), "unban-ip", "", prefix.String(), "")
+
+	if err != nil {
+		slog.Error("saving bans", "err", err)
+		cmd.client.Error("Ban removed but could not be saved")
+		return
+	}
+
+	cmd.client.Reply("Unbanned " + prefix.String())
+}
+
+type ListBansCommand struct {
+	client *Client
+}
+
+func (cmd *ListBansCommand) Run(server *Server) {
+	list := server.bans.List()
+
+	if len(list) == 0 {
+		cmd.client.Reply("No bans")
+		return
+	}
+
+	cmd.client.Reply("Bans: " + strings.Join(list, ", "))
+}
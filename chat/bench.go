@@ -0,0 +1,234 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchPrefix marks messages the load generator sends. The rest of the
+// text is when it was sent, in nanoseconds since the epoch, so whichever
+// client receives it can tell how long delivery took.
+const benchPrefix = "bench "
+
+// benchSettle is how long the load generator waits after connecting for
+// joins to go through, and after sending for the last messages to arrive.
+const benchSettle = time.Second
+
+// Bench connects simulated clients to a running server and measures how
+// long room messages take to reach their recipients.
+type Bench struct {
+	addr     string
+	clients  int
+	rooms    int
+	rate     float64
+	duration time.Duration
+
+	mu        sync.Mutex
+	sent      int
+	latencies []time.Duration
+}
+
+// RunBench is the "chatserver bench" subcommand. Every client joins one of
+// the rooms, and they all send at the given rate. The server's own limits
+// still apply, so it needs raising them to measure anything but those:
+// -max-conns-per-ip, -churn-limit and -rate-limit in particular.
+func RunBench(name string, args []string) {
+	bench := &Bench{}
+
+	flags := flag.NewFlagSet(name+" bench", flag.ExitOnError)
+	flags.StringVar(&bench.addr, "addr", "localhost:12345", "address of the server's plaintext listener")
+	flags.IntVar(&bench.clients, "clients", 50, "number of simulated clients")
+	flags.IntVar(&bench.rooms, "rooms", 5, "number of rooms the clients are spread across")
+	flags.Float64Var(&bench.rate, "rate", 1, "messages a second each client sends")
+	flags.DurationVar(&bench.duration, "duration", 30*time.Second, "how long to send messages for")
+	flags.Parse(args)
+
+	if bench.clients < 1 || bench.rooms < 1 || bench.rate <= 0 {
+		fatal("starting bench", fmt.Errorf("clients, rooms and rate must all be positive"))
+	}
+
+	conns := make([]net.Conn, bench.clients)
+	var reading sync.WaitGroup
+
+	for i := range conns {
+		conn, err := bench.connect(i)
+
+		if err != nil {
+			fatal("connecting bench client", err)
+		}
+
+		conns[i] = conn
+		reading.Add(1)
+
+		go func() {
+			defer reading.Done()
+			bench.read(conn)
+		}()
+	}
+
+	time.Sleep(benchSettle)
+
+	start := time.Now()
+	var sending sync.WaitGroup
+
+	for i, conn := range conns {
+		sending.Add(1)
+
+		go func() {
+			defer sending.Done()
+			bench.send(conn, benchRoom(i%bench.rooms), start.Add(bench.duration))
+		}()
+	}
+
+	sending.Wait()
+	time.Sleep(benchSettle)
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	reading.Wait()
+	bench.report(os.Stdout, time.Since(start))
+}
+
+func benchRoom(i int) string {
+	return fmt.Sprintf("bench%d", i)
+}
+
+// connect logs a client in as benchN, in JSON mode, and joins its room.
+func (bench *Bench) connect(i int) (net.Conn, error) {
+	conn, err := net.Dial("tcp", bench.addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(conn, "proto json\n")
+
+	for _, cmd := range []*jsonCommand{
+		{Cmd: "nick", Nick: fmt.Sprintf("bench%d", i)},
+		{Cmd: "accept"},
+		{Cmd: "join", Room: benchRoom(i % bench.rooms)},
+	} {
+		if err == nil {
+			err = writeJSONCommand(conn, cmd)
+		}
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func writeJSONCommand(conn net.Conn, cmd *jsonCommand) error {
+	data, err := json.Marshal(cmd)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
+
+// send posts to room at the bench's rate until deadline.
+func (bench *Bench) send(conn net.Conn, room string, deadline time.Time) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / bench.rate))
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if now.After(deadline) {
+			return
+		}
+
+		text := benchPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+		if err := writeJSONCommand(conn, &jsonCommand{Cmd: "msg", Room: room, Text: text}); err != nil {
+			slog.Warn("bench client stopped sending", "err", err)
+			return
+		}
+
+		bench.mu.Lock()
+		bench.sent++
+		bench.mu.Unlock()
+	}
+}
+
+// read records the latency of every bench message conn receives until it
+// is closed. The first error the server sends is logged, since it usually
+// means a limit got in the way.
+func (bench *Bench) read(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, 1<<20)
+	warned := false
+
+	for scanner.Scan() {
+		var event Event
+
+		if json.Unmarshal(scanner.Bytes(), &event) != nil {
+			continue
+		}
+
+		if event.Type == EventError && !warned {
+			slog.Warn("bench client got an error", "text", event.Text)
+			warned = true
+		}
+
+		sent, ok := strings.CutPrefix(event.Text, benchPrefix)
+
+		if event.Type != EventMessage || !ok {
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(sent, 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		latency := time.Since(time.Unix(0, nanos))
+
+		bench.mu.Lock()
+		bench.latencies = append(bench.latencies, latency)
+		bench.mu.Unlock()
+	}
+}
+
+func (bench *Bench) report(w io.Writer, elapsed time.Duration) {
+	bench.mu.Lock()
+	defer bench.mu.Unlock()
+
+	slices.Sort(bench.latencies)
+
+	fmt.Fprintf(w, "%d clients in %d rooms, %d messages sent, %d delivered in %v\n", bench.clients, bench.rooms, bench.sent, len(bench.latencies), elapsed.Truncate(time.Millisecond))
+
+	if len(bench.latencies) == 0 {
+		return
+	}
+
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		fmt.Fprintf(w, "p%g %v\n", p, percentile(bench.latencies, p))
+	}
+
+	fmt.Fprintf(w, "max %v\n", bench.latencies[len(bench.latencies)-1])
+}
+
+// percentile picks the pth percentile of sorted by the nearest rank.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p / 100 * float64(len(sorted)))
+	return sorted[min(rank, len(sorted)-1)]
+}
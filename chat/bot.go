@@ -0,0 +1,139 @@
+package chat
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventHandler is implemented by plugins that act as bots. HandleEvent is
+// called with every room message, join and part and every nick change,
+// using the same Event types clients get, shortly after each happens. It
+// runs on the dispatcher, so it must not block, and it may only act on the
+// server through bot.
+type EventHandler interface {
+	// Nick is the name the bot's messages appear from.
+	Nick() string
+	HandleEvent(bot *Bot, event *Event)
+}
+
+// Bot is what an EventHandler uses to talk back. What a bot says doesn't
+// reach other bots, which keeps two bots from answering each other forever.
+type Bot struct {
+	server  *Server
+	handler EventHandler
+}
+
+func (bot *Bot) Nick() string {
+	return bot.handler.Nick()
+}
+
+// Say sends a message to room as the bot.
+func (bot *Bot) Say(room, text string) error {
+	r, exists := bot.server.LookupRoom(room)
+
+	if !exists {
+		return fmt.Errorf("no such room %q", room)
+	}
+
+	bot.server.Post(r, bot.Nick(), text)
+	return nil
+}
+
+// Tell sends a private message to nick as the bot.
+func (bot *Bot) Tell(nick, text string) error {
+	client, exists := bot.server.LookupNick(nick)
+
+	if !exists {
+		return fmt.Errorf("no such nick %q", nick)
+	}
+
+	client.Send(&Event{
+		Type: EventPrivate,
+		Nick: bot.Nick(),
+		Text: text,
+		Time: time.Now(),
+	})
+
+	return nil
+}
+
+// Notice sends a notice to everyone in room.
+func (bot *Bot) Notice(room, text string) error {
+	r, exists := bot.server.LookupRoom(room)
+
+	if !exists {
+		return fmt.Errorf("no such room %q", room)
+	}
+
+	r.Notice(text)
+	return nil
+}
+
+// notifyBots hands event to every bot, unless a bot caused it. Room
+// messages are posted off the dispatcher, where bots can't run, so events
+// are queued and handed over on the dispatcher afterwards, in the order
+// they happened.
+func (server *Server) notifyBots(event *Event) {
+	if server.inBotHooks || len(server.bots) == 0 {
+		return
+	}
+
+	server.botEvents.push(server, event)
+}
+
+// botQueue holds events on their way to the bots. It grows as needed
+// rather than blocking, since events are pushed by the dispatcher and by
+// commands that hold the lock the dispatcher needs to take them off.
+type botQueue struct {
+	mu     sync.Mutex
+	events []*Event
+	ready  chan struct{}
+	once   sync.Once
+}
+
+func (queue *botQueue) push(server *Server, event *Event) {
+	queue.once.Do(func() {
+		queue.ready = make(chan struct{}, 1)
+		go queue.forward(server)
+	})
+
+	queue.mu.Lock()
+	queue.events = append(queue.events, event)
+	queue.mu.Unlock()
+
+	select {
+	case queue.ready <- struct{}{}:
+	default:
+	}
+}
+
+// forward hands queued events to the dispatcher as they come.
+func (queue *botQueue) forward(server *Server) {
+	for range queue.ready {
+		queue.mu.Lock()
+		events := queue.events
+		queue.events = nil
+		queue.mu.Unlock()
+
+		if len(events) > 0 {
+			server.incoming <- &botEventsCommand{events: events}
+		}
+	}
+}
+
+// botEventsCommand runs the bots' hooks for events on the dispatcher.
+type botEventsCommand struct {
+	events []*Event
+}
+
+func (cmd *botEventsCommand) Run(server *Server) {
+	server.inBotHooks = true
+	defer func() { server.inBotHooks = false }()
+
+	for _, event := range cmd.events {
+		for _, bot := range server.bots {
+			bot.handler.HandleEvent(bot, event)
+		}
+	}
+}
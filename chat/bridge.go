@@ -0,0 +1,219 @@
+package chat
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	bridgeQueueSize  = 1024
+	bridgeMaxBackoff = 5 * time.Minute
+
+	// IRC networks disconnect clients that flood, so the bridge keeps to
+	// a couple of lines a second after a short burst.
+	bridgeRate  = 2
+	bridgeBurst = 5
+)
+
+// IRCBridge connects to an IRC network as an ordinary client and mirrors
+// channels there with local rooms. Messages from IRC appear here as
+// nick@irc, and messages from here are sent to IRC as "<nick> text".
+type IRCBridge struct {
+	addr     string
+	tls      bool
+	nick     string
+	channels map[string]string // IRC channel to room
+	rooms    map[string]string // room to IRC channel
+	outgoing chan string
+}
+
+// NewIRCBridge maps channels given as "#channel=room" or just "#channel"
+// for a room of the same name, separated by commas.
+func NewIRCBridge(addr string, useTLS bool, nick, mapping string) (*IRCBridge, error) {
+	bridge := &IRCBridge{
+		addr:     addr,
+		tls:      useTLS,
+		nick:     nick,
+		channels: make(map[string]string),
+		rooms:    make(map[string]string),
+		outgoing: make(chan string, bridgeQueueSize),
+	}
+
+	for _, entry := range strings.Split(mapping, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		channel, room, found := strings.Cut(entry, "=")
+
+		if !found {
+			room = ircRoom(channel)
+		}
+
+		if !strings.HasPrefix(channel, "#") || !validName(room) {
+			return nil, fmt.Errorf("bad IRC bridge channel %q, expected #channel=room", entry)
+		}
+
+		bridge.channels[strings.ToLower(channel)] = room
+		bridge.rooms[foldName(room)] = channel
+	}
+
+	if nick == "" || strings.ContainsAny(nick, " :!@\r\n") {
+		return nil, fmt.Errorf("bad IRC bridge nick %q", nick)
+	}
+
+	if len(bridge.channels) == 0 {
+		return nil, fmt.Errorf("the IRC bridge needs at least one channel")
+	}
+
+	return bridge, nil
+}
+
+// Message sends a local room message to the IRC channel bridged with the
+// room, if there is one. It never blocks.
+func (bridge *IRCBridge) Message(message *Message) {
+	if bridge == nil {
+		return
+	}
+
+	channel, bridged := bridge.rooms[foldName(message.room)]
+
+	if !bridged {
+		return
+	}
+
+	bridge.send(fmt.Sprintf("PRIVMSG %s :<%s> %s", channel, message.nick, message.text))
+}
+
+func (bridge *IRCBridge) send(line string) {
+	select {
+	case bridge.outgoing <- line:
+	default:
+		slog.Warn("IRC bridge queue full, dropping line", "irc", bridge.addr)
+	}
+}
+
+// Run stays connected to the IRC network until the process exits.
+func (bridge *IRCBridge) Run(server *Server) {
+	backoff := 10 * time.Second
+
+	for {
+		start := time.Now()
+		err := bridge.session(server)
+
+		if time.Since(start) > bridgeMaxBackoff {
+			backoff = 10 * time.Second
+		}
+
+		slog.Error("IRC bridge disconnected", "irc", bridge.addr, "err", err, "retry", backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, bridgeMaxBackoff)
+	}
+}
+
+func (bridge *IRCBridge) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	if !bridge.tls {
+		return dialer.Dial("tcp", bridge.addr)
+	}
+
+	return tls.DialWithDialer(dialer, "tcp", bridge.addr, &tls.Config{MinVersion: tls.VersionTLS12})
+}
+
+func (bridge *IRCBridge) session(server *Server) error {
+	conn, err := bridge.dial()
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Registration goes out straight away; everything else is paced.
+	nick := bridge.nick
+	fmt.Fprintf(conn, "NICK %s\r\nUSER %s 0 * :chatserver bridge\r\n", nick, nick)
+
+	go bridge.write(conn, done)
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		line, err := reader.ReadString('\n')
+
+		if err != nil {
+			return err
+		}
+
+		sender := ""
+
+		if prefix, ok := strings.CutPrefix(line, ":"); ok {
+			prefix, _, _ = strings.Cut(prefix, " ")
+			sender, _, _ = strings.Cut(prefix, "!")
+		}
+
+		command, params := parseIRCLine(line)
+
+		switch command {
+		case "PING":
+			fmt.Fprintf(conn, "PONG :%s\r\n", strings.Join(params, " "))
+		case "001":
+			slog.Info("IRC bridge connected", "irc", bridge.addr, "nick", nick)
+
+			for _, channel := range bridge.rooms {
+				fmt.Fprintf(conn, "JOIN %s\r\n", channel)
+			}
+		case "433":
+			nick += "_"
+			fmt.Fprintf(conn, "NICK %s\r\n", nick)
+		case "PRIVMSG":
+			if len(params) < 2 || params[1] == "" || sender == "" || strings.HasPrefix(params[1], "\x01") {
+				continue
+			}
+
+			room, bridged := bridge.channels[strings.ToLower(params[0])]
+
+			if !bridged {
+				continue
+			}
+
+			msg := &clusterMessage{Room: room, Nick: sender + "@irc", Text: params[1], Time: time.Now()}
+
+			server.call(func() {
+				server.DeliverRemote(msg)
+			})
+		}
+	}
+}
+
+func (bridge *IRCBridge) write(conn net.Conn, done chan struct{}) {
+	bucket := NewTokenBucket(bridgeRate, bridgeBurst)
+
+	for {
+		select {
+		case line := <-bridge.outgoing:
+			for !bucket.Allow(time.Now()) {
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			_, err := fmt.Fprintf(conn, "%s\r\n", line)
+
+			if err != nil {
+				conn.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
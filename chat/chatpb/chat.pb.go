@@ -0,0 +1,650 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.10
+// 	protoc        (unknown)
+// source: chat.proto
+
+package chatpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Request struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Request:
+	//
+	//	*Request_Nick
+	//	*Request_Join
+	//	*Request_Leave
+	//	*Request_Send
+	//	*Request_Command
+	Request       isRequest_Request `protobuf_oneof:"request"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Request) Reset() {
+	*x = Request{}
+	mi := &file_chat_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Request) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Request) ProtoMessage() {}
+
+func (x *Request) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Request.ProtoReflect.Descriptor instead.
+func (*Request) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Request) GetRequest() isRequest_Request {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+func (x *Request) GetNick() *SetNick {
+	if x != nil {
+		if x, ok := x.Request.(*Request_Nick); ok {
+			return x.Nick
+		}
+	}
+	return nil
+}
+
+func (x *Request) GetJoin() *JoinRoom {
+	if x != nil {
+		if x, ok := x.Request.(*Request_Join); ok {
+			return x.Join
+		}
+	}
+	return nil
+}
+
+func (x *Request) GetLeave() *LeaveRoom {
+	if x != nil {
+		if x, ok := x.Request.(*Request_Leave); ok {
+			return x.Leave
+		}
+	}
+	return nil
+}
+
+func (x *Request) GetSend() *SendMessage {
+	if x != nil {
+		if x, ok := x.Request.(*Request_Send); ok {
+			return x.Send
+		}
+	}
+	return nil
+}
+
+func (x *Request) GetCommand() string {
+	if x != nil {
+		if x, ok := x.Request.(*Request_Command); ok {
+			return x.Command
+		}
+	}
+	return ""
+}
+
+type isRequest_Request interface {
+	isRequest_Request()
+}
+
+type Request_Nick struct {
+	Nick *SetNick `protobuf:"bytes,1,opt,name=nick,proto3,oneof"`
+}
+
+type Request_Join struct {
+	Join *JoinRoom `protobuf:"bytes,2,opt,name=join,proto3,oneof"`
+}
+
+type Request_Leave struct {
+	Leave *LeaveRoom `protobuf:"bytes,3,opt,name=leave,proto3,oneof"`
+}
+
+type Request_Send struct {
+	Send *SendMessage `protobuf:"bytes,4,opt,name=send,proto3,oneof"`
+}
+
+type Request_Command struct {
+	// Command is any other command, written as a line of the text
+	// protocol, like "topic lobby Welcome".
+	Command string `protobuf:"bytes,5,opt,name=command,proto3,oneof"`
+}
+
+func (*Request_Nick) isRequest_Request() {}
+
+func (*Request_Join) isRequest_Request() {}
+
+func (*Request_Leave) isRequest_Request() {}
+
+func (*Request_Send) isRequest_Request() {}
+
+func (*Request_Command) isRequest_Request() {}
+
+type SetNick struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Nick          string                 `protobuf:"bytes,1,opt,name=nick,proto3" json:"nick,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetNick) Reset() {
+	*x = SetNick{}
+	mi := &file_chat_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetNick) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetNick) ProtoMessage() {}
+
+func (x *SetNick) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetNick.ProtoReflect.Descriptor instead.
+func (*SetNick) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *SetNick) GetNick() string {
+	if x != nil {
+		return x.Nick
+	}
+	return ""
+}
+
+type JoinRoom struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Room  string                 `protobuf:"bytes,1,opt,name=room,proto3" json:"room,omitempty"`
+	// Key is the room's key, if it has one.
+	Key           string `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *JoinRoom) Reset() {
+	*x = JoinRoom{}
+	mi := &file_chat_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *JoinRoom) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*JoinRoom) ProtoMessage() {}
+
+func (x *JoinRoom) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use JoinRoom.ProtoReflect.Descriptor instead.
+func (*JoinRoom) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *JoinRoom) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *JoinRoom) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+type LeaveRoom struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Room          string                 `protobuf:"bytes,1,opt,name=room,proto3" json:"room,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LeaveRoom) Reset() {
+	*x = LeaveRoom{}
+	mi := &file_chat_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LeaveRoom) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LeaveRoom) ProtoMessage() {}
+
+func (x *LeaveRoom) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LeaveRoom.ProtoReflect.Descriptor instead.
+func (*LeaveRoom) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *LeaveRoom) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+type SendMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Room  string                 `protobuf:"bytes,1,opt,name=room,proto3" json:"room,omitempty"`
+	Text  string                 `protobuf:"bytes,2,opt,name=text,proto3" json:"text,omitempty"`
+	// Parent makes the message a reply to the room's message with that ID.
+	Parent        uint64 `protobuf:"varint,3,opt,name=parent,proto3" json:"parent,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SendMessage) Reset() {
+	*x = SendMessage{}
+	mi := &file_chat_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SendMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SendMessage) ProtoMessage() {}
+
+func (x *SendMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SendMessage.ProtoReflect.Descriptor instead.
+func (*SendMessage) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *SendMessage) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *SendMessage) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *SendMessage) GetParent() uint64 {
+	if x != nil {
+		return x.Parent
+	}
+	return 0
+}
+
+// Event mirrors the JSON events of the text protocol. Type says which of
+// the other fields are set: "message", "join", "error" and so on.
+type Event struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Type          string                 `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Id            uint64                 `protobuf:"varint,2,opt,name=id,proto3" json:"id,omitempty"`
+	Time          *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=time,proto3" json:"time,omitempty"`
+	Room          string                 `protobuf:"bytes,4,opt,name=room,proto3" json:"room,omitempty"`
+	Nick          string                 `protobuf:"bytes,5,opt,name=nick,proto3" json:"nick,omitempty"`
+	Text          string                 `protobuf:"bytes,6,opt,name=text,proto3" json:"text,omitempty"`
+	History       bool                   `protobuf:"varint,7,opt,name=history,proto3" json:"history,omitempty"`
+	Edited        bool                   `protobuf:"varint,8,opt,name=edited,proto3" json:"edited,omitempty"`
+	Parent        uint64                 `protobuf:"varint,9,opt,name=parent,proto3" json:"parent,omitempty"`
+	Reactions     map[string]int64       `protobuf:"bytes,10,rep,name=reactions,proto3" json:"reactions,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	Removed       bool                   `protobuf:"varint,11,opt,name=removed,proto3" json:"removed,omitempty"`
+	NewNick       string                 `protobuf:"bytes,12,opt,name=new_nick,json=newNick,proto3" json:"new_nick,omitempty"`
+	Topic         string                 `protobuf:"bytes,13,opt,name=topic,proto3" json:"topic,omitempty"`
+	Reason        string                 `protobuf:"bytes,14,opt,name=reason,proto3" json:"reason,omitempty"`
+	Names         []string               `protobuf:"bytes,15,rep,name=names,proto3" json:"names,omitempty"`
+	Target        string                 `protobuf:"bytes,16,opt,name=target,proto3" json:"target,omitempty"`
+	Mode          string                 `protobuf:"bytes,17,opt,name=mode,proto3" json:"mode,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	mi := &file_chat_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_chat_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_chat_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Event) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Event) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Event) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *Event) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *Event) GetNick() string {
+	if x != nil {
+		return x.Nick
+	}
+	return ""
+}
+
+func (x *Event) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *Event) GetHistory() bool {
+	if x != nil {
+		return x.History
+	}
+	return false
+}
+
+func (x *Event) GetEdited() bool {
+	if x != nil {
+		return x.Edited
+	}
+	return false
+}
+
+func (x *Event) GetParent() uint64 {
+	if x != nil {
+		return x.Parent
+	}
+	return 0
+}
+
+func (x *Event) GetReactions() map[string]int64 {
+	if x != nil {
+		return x.Reactions
+	}
+	return nil
+}
+
+func (x *Event) GetRemoved() bool {
+	if x != nil {
+		return x.Removed
+	}
+	return false
+}
+
+func (x *Event) GetNewNick() string {
+	if x != nil {
+		return x.NewNick
+	}
+	return ""
+}
+
+func (x *Event) GetTopic() string {
+	if x != nil {
+		return x.Topic
+	}
+	return ""
+}
+
+func (x *Event) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *Event) GetNames() []string {
+	if x != nil {
+		return x.Names
+	}
+	return nil
+}
+
+func (x *Event) GetTarget() string {
+	if x != nil {
+		return x.Target
+	}
+	return ""
+}
+
+func (x *Event) GetMode() string {
+	if x != nil {
+		return x.Mode
+	}
+	return ""
+}
+
+var File_chat_proto protoreflect.FileDescriptor
+
+const file_chat_proto_rawDesc = "" +
+	"\n" +
+	"\n" +
+	"chat.proto\x12\achat.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\xd9\x01\n" +
+	"\aRequest\x12&\n" +
+	"\x04nick\x18\x01 \x01(\v2\x10.chat.v1.SetNickH\x00R\x04nick\x12'\n" +
+	"\x04join\x18\x02 \x01(\v2\x11.chat.v1.JoinRoomH\x00R\x04join\x12*\n" +
+	"\x05leave\x18\x03 \x01(\v2\x12.chat.v1.LeaveRoomH\x00R\x05leave\x12*\n" +
+	"\x04send\x18\x04 \x01(\v2\x14.chat.v1.SendMessageH\x00R\x04send\x12\x1a\n" +
+	"\acommand\x18\x05 \x01(\tH\x00R\acommandB\t\n" +
+	"\arequest\"\x1d\n" +
+	"\aSetNick\x12\x12\n" +
+	"\x04nick\x18\x01 \x01(\tR\x04nick\"0\n" +
+	"\bJoinRoom\x12\x12\n" +
+	"\x04room\x18\x01 \x01(\tR\x04room\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\tR\x03key\"\x1f\n" +
+	"\tLeaveRoom\x12\x12\n" +
+	"\x04room\x18\x01 \x01(\tR\x04room\"M\n" +
+	"\vSendMessage\x12\x12\n" +
+	"\x04room\x18\x01 \x01(\tR\x04room\x12\x12\n" +
+	"\x04text\x18\x02 \x01(\tR\x04text\x12\x16\n" +
+	"\x06parent\x18\x03 \x01(\x04R\x06parent\"\x81\x04\n" +
+	"\x05Event\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\tR\x04type\x12\x0e\n" +
+	"\x02id\x18\x02 \x01(\x04R\x02id\x12.\n" +
+	"\x04time\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12\x12\n" +
+	"\x04room\x18\x04 \x01(\tR\x04room\x12\x12\n" +
+	"\x04nick\x18\x05 \x01(\tR\x04nick\x12\x12\n" +
+	"\x04text\x18\x06 \x01(\tR\x04text\x12\x18\n" +
+	"\ahistory\x18\a \x01(\bR\ahistory\x12\x16\n" +
+	"\x06edited\x18\b \x01(\bR\x06edited\x12\x16\n" +
+	"\x06parent\x18\t \x01(\x04R\x06parent\x12;\n" +
+	"\treactions\x18\n" +
+	" \x03(\v2\x1d.chat.v1.Event.ReactionsEntryR\treactions\x12\x18\n" +
+	"\aremoved\x18\v \x01(\bR\aremoved\x12\x19\n" +
+	"\bnew_nick\x18\f \x01(\tR\anewNick\x12\x14\n" +
+	"\x05topic\x18\r \x01(\tR\x05topic\x12\x16\n" +
+	"\x06reason\x18\x0e \x01(\tR\x06reason\x12\x14\n" +
+	"\x05names\x18\x0f \x03(\tR\x05names\x12\x16\n" +
+	"\x06target\x18\x10 \x01(\tR\x06target\x12\x12\n" +
+	"\x04mode\x18\x11 \x01(\tR\x04mode\x1a<\n" +
+	"\x0eReactionsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x03R\x05value:\x028\x0127\n" +
+	"\x04Chat\x12/\n" +
+	"\aConnect\x12\x10.chat.v1.Request\x1a\x0e.chat.v1.Event(\x010\x01B0Z.github.com/davidbalbert/chatserver/chat/chatpbb\x06proto3"
+
+var (
+	file_chat_proto_rawDescOnce sync.Once
+	file_chat_proto_rawDescData []byte
+)
+
+func file_chat_proto_rawDescGZIP() []byte {
+	file_chat_proto_rawDescOnce.Do(func() {
+		file_chat_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_chat_proto_rawDesc), len(file_chat_proto_rawDesc)))
+	})
+	return file_chat_proto_rawDescData
+}
+
+var file_chat_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_chat_proto_goTypes = []any{
+	(*Request)(nil),               // 0: chat.v1.Request
+	(*SetNick)(nil),               // 1: chat.v1.SetNick
+	(*JoinRoom)(nil),              // 2: chat.v1.JoinRoom
+	(*LeaveRoom)(nil),             // 3: chat.v1.LeaveRoom
+	(*SendMessage)(nil),           // 4: chat.v1.SendMessage
+	(*Event)(nil),                 // 5: chat.v1.Event
+	nil,                           // 6: chat.v1.Event.ReactionsEntry
+	(*timestamppb.Timestamp)(nil), // 7: google.protobuf.Timestamp
+}
+var file_chat_proto_depIdxs = []int32{
+	1, // 0: chat.v1.Request.nick:type_name -> chat.v1.SetNick
+	2, // 1: chat.v1.Request.join:type_name -> chat.v1.JoinRoom
+	3, // 2: chat.v1.Request.leave:type_name -> chat.v1.LeaveRoom
+	4, // 3: chat.v1.Request.send:type_name -> chat.v1.SendMessage
+	7, // 4: chat.v1.Event.time:type_name -> google.protobuf.Timestamp
+	6, // 5: chat.v1.Event.reactions:type_name -> chat.v1.Event.ReactionsEntry
+	0, // 6: chat.v1.Chat.Connect:input_type -> chat.v1.Request
+	5, // 7: chat.v1.Chat.Connect:output_type -> chat.v1.Event
+	7, // [7:8] is the sub-list for method output_type
+	6, // [6:7] is the sub-list for method input_type
+	6, // [6:6] is the sub-list for extension type_name
+	6, // [6:6] is the sub-list for extension extendee
+	0, // [0:6] is the sub-list for field type_name
+}
+
+func init() { file_chat_proto_init() }
+func file_chat_proto_init() {
+	if File_chat_proto != nil {
+		return
+	}
+	file_chat_proto_msgTypes[0].OneofWrappers = []any{
+		(*Request_Nick)(nil),
+		(*Request_Join)(nil),
+		(*Request_Leave)(nil),
+		(*Request_Send)(nil),
+		(*Request_Command)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_chat_proto_rawDesc), len(file_chat_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   7,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_chat_proto_goTypes,
+		DependencyIndexes: file_chat_proto_depIdxs,
+		MessageInfos:      file_chat_proto_msgTypes,
+	}.Build()
+	File_chat_proto = out.File
+	file_chat_proto_goTypes = nil
+	file_chat_proto_depIdxs = nil
+}
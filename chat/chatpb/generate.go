@@ -0,0 +1,4 @@
+// Package chatpb is the generated code for the gRPC API in chat.proto.
+package chatpb
+
+//go:generate buf generate
@@ -0,0 +1,153 @@
+package chat
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type ChurnGuard struct {
+	mu sync.Mutex
+
+	limit   int
+	window  time.Duration
+	penalty time.Duration
+
+	recent    map[string][]time.Time
+	blocked   map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewChurnGuard(limit int, window, penalty time.Duration) *ChurnGuard {
+	return &ChurnGuard{
+		limit:   limit,
+		window:  window,
+		penalty: penalty,
+		recent:  make(map[string][]time.Time),
+		blocked: make(map[string]time.Time),
+	}
+}
+
+// Allow records a connection from ip and reports whether it should be
+// accepted. An ip that connects more than limit times within window is
+// refused outright until penalty has passed.
+func (guard *ChurnGuard) Allow(ip string, now time.Time) bool {
+	if guard.limit <= 0 {
+		return true
+	}
+
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	guard.sweep(now)
+
+	if until, exists := guard.blocked[ip]; exists {
+		if now.Before(until) {
+			return false
+		}
+
+		delete(guard.blocked, ip)
+	}
+
+	times := append(guard.expire(guard.recent[ip], now), now)
+	guard.recent[ip] = times
+
+	if len(times) > guard.limit {
+		delete(guard.recent, ip)
+		guard.blocked[ip] = now.Add(guard.penalty)
+		return false
+	}
+
+	return true
+}
+
+func (guard *ChurnGuard) expire(times []time.Time, now time.Time) []time.Time {
+	i := 0
+
+	for i < len(times) && now.Sub(times[i]) > guard.window {
+		i++
+	}
+
+	return times[i:]
+}
+
+func (guard *ChurnGuard) sweep(now time.Time) {
+	if now.Sub(guard.lastSweep) < guard.window {
+		return
+	}
+
+	guard.lastSweep = now
+
+	for ip, times := range guard.recent {
+		times = guard.expire(times, now)
+
+		if len(times) == 0 {
+			delete(guard.recent, ip)
+		} else {
+			guard.recent[ip] = times
+		}
+	}
+
+	for ip, until := range guard.blocked {
+		if !now.Before(until) {
+			delete(guard.blocked, ip)
+		}
+	}
+}
+
+// ConnLimit caps how many connections a single IP may hold open at once.
+type ConnLimit struct {
+	mu     sync.Mutex
+	limit  int
+	counts map[string]int
+}
+
+func NewConnLimit(limit int) *ConnLimit {
+	return &ConnLimit{
+		limit:  limit,
+		counts: make(map[string]int),
+	}
+}
+
+// Acquire reports whether ip may open another connection, and if so counts
+// it until Release is called.
+func (cl *ConnLimit) Acquire(ip string) bool {
+	if cl.limit <= 0 {
+		return true
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.counts[ip] >= cl.limit {
+		return false
+	}
+
+	cl.counts[ip]++
+	return true
+}
+
+func (cl *ConnLimit) Release(ip string) {
+	if cl.limit <= 0 {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.counts[ip]--
+
+	if cl.counts[ip] <= 0 {
+		delete(cl.counts, ip)
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
@@ -0,0 +1,164 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChurnGuard(t *testing.T) {
+	guard := NewChurnGuard(3, time.Second, 5*time.Second)
+	start := time.Now()
+
+	for i := range 3 {
+		if !guard.Allow("192.0.2.1", start) {
+			t.Fatalf("connection %d refused, want the first 3 allowed", i+1)
+		}
+	}
+
+	if guard.Allow("192.0.2.1", start) {
+		t.Fatal("connection 4 allowed, want it refused")
+	}
+
+	if !guard.Allow("192.0.2.2", start) {
+		t.Error("another IP was refused")
+	}
+
+	if guard.Allow("192.0.2.1", start.Add(4*time.Second)) {
+		t.Error("connection allowed before the penalty was up")
+	}
+
+	if !guard.Allow("192.0.2.1", start.Add(6*time.Second)) {
+		t.Error("connection refused after the penalty was up")
+	}
+
+	// A sweep a window later forgets everyone who has gone quiet.
+	guard.Allow("192.0.2.3", start.Add(time.Minute))
+
+	if len(guard.recent) != 1 || len(guard.blocked) != 0 {
+		t.Errorf("after a sweep, guard tracks %d recent and %d blocked IPs, want 1 and 0", len(guard.recent), len(guard.blocked))
+	}
+}
+
+// TestAcceptChurnStorm opens and closes connections from many goroutines
+// as fast as it can, then checks that the churn guard refused the excess,
+// that every client accepted was cleaned up, and that the server accepts
+// connections again once the penalty is up.
+func TestAcceptChurnStorm(t *testing.T) {
+	if testing.Short() {
+		t.Skip("opens hundreds of connections")
+	}
+
+	config := DefaultConfig()
+	config.ChurnLimit = 20
+	config.ChurnWindow = Duration{time.Minute}
+	config.ChurnPenalty = Duration{300 * time.Millisecond}
+	config.MaxConnsPerIP = 0
+
+	server, err := NewServer(Options{Config: config})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Skipf("can't listen on loopback: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+
+	go func() {
+		served <- server.Serve(ctx, l)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+	})
+
+	const workers, dials = 16, 25
+	var wg sync.WaitGroup
+
+	for range workers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for range dials {
+				conn, err := net.Dial("tcp", l.Addr().String())
+
+				if err != nil {
+					continue
+				}
+
+				conn.Close()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if refused := server.metrics.refusedChurn.Load(); refused == 0 {
+		t.Errorf("no connections refused for churn out of %d", workers*dials)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		var clients int
+		server.Do(func() {
+			clients = len(server.Clients())
+		})
+
+		if clients == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients still connected after the storm", clients)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.churn.mu.Lock()
+	tracked := len(server.churn.recent) + len(server.churn.blocked)
+	server.churn.mu.Unlock()
+
+	if tracked > 1 {
+		t.Errorf("churn guard tracks %d IPs, want at most the one connecting", tracked)
+	}
+
+	time.Sleep(config.ChurnPenalty.Duration + 100*time.Millisecond)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+
+	if err != nil || !strings.HasPrefix(line, "chatserver") {
+		t.Errorf("after the penalty, got %q, %v, want the greeting", line, err)
+	}
+
+	cancel()
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after its context was canceled")
+	}
+}
@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const certHandshakeTimeout = 10 * time.Second
+
+// loadClientCAs reads the PEM bundle of CAs that client certificates on the
+// TLS listener must be signed by.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+
+	return pool, nil
+}
+
+// certIdentity finishes the TLS handshake on conn and returns the nick its
+// client certificate names, if it presented a verified one. The common name
+// is used if it is a valid nick, and otherwise the first DNS or email
+// subject alternative name that is.
+func certIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+
+	if !ok {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), certHandshakeTimeout)
+	defer cancel()
+
+	// A failed handshake also fails the client's first read, which
+	// disconnects it.
+	if tlsConn.HandshakeContext(ctx) != nil {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+
+	if len(state.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := state.PeerCertificates[0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+
+	for _, name := range names {
+		if linkNameRegexp.MatchString(name) && !guestRegexp.MatchString(name) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// certLogIn gives client the nick its certificate names. If the nick is a
+// registered account, the certificate stands in for its password.
+func (server *Server) certLogIn(client *Client, nick string) {
+	if account, registered := server.accounts.Get(nick); registered {
+		client.logger().Info("logged in with client certificate", "account", nick)
+		server.LogIn(client, account)
+		return
+	}
+
+	if _, taken := server.LookupNick(nick); taken {
+		client.Error("Your certificate's nick " + nick + " is in use")
+		return
+	}
+
+	client.logger().Info("nick from client certificate", "target", nick)
+	server.ChangeNick(client, nick)
+}
@@ -0,0 +1,1137 @@
+package chat
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusterChannelPrefix = "chatserver:room:"
+	clusterEventsChannel = "chatserver:events"
+	clusterNodesKey      = "chatserver:nodes"
+	clusterNodeKeyPrefix = "chatserver:node:"
+	clusterMembersPrefix = "chatserver:members:"
+	clusterNickPrefix    = "chatserver:nick:"
+	clusterBansKey       = "chatserver:bans"
+
+	clusterQueueSize      = 1024
+	clusterMaxBackoff     = 30 * time.Second
+	clusterDialTimeout    = 10 * time.Second
+	clusterCommandTimeout = 2 * time.Second
+	clusterHeartbeat      = 10 * time.Second
+	clusterTimeout        = 3 * clusterHeartbeat
+)
+
+// Cluster joins this server to other chatserver nodes through Redis, so
+// that together they act as one server. Each node publishes what its own
+// clients do, and applies what the others publish: room messages, joins,
+// parts, nick changes, kicks and bans.
+//
+// Nicks are claimed with a key each in Redis, so no two nodes hand out the
+// same one, and who and list show everyone in the cluster. Each node keeps
+// the set of who is in which of its rooms in Redis too, for nodes that
+// start later, along with the cluster's bans.
+// Claims and sets expire unless their node refreshes them every
+// clusterHeartbeat, and a node not heard from for clusterTimeout is taken
+// to be gone, along with its users. Room operators, topics and modes stay
+// local to each node.
+//
+// If Redis can't be reached, nodes carry on alone, and nick claims are
+// checked only locally until it comes back.
+type Cluster struct {
+	addr     string
+	password string
+	node     string
+	outgoing chan clusterOp
+
+	// pending is the op the publisher was sending when its connection
+	// dropped, sent again first once it reconnects.
+	pending clusterOp
+
+	// commands is the connection for the few commands a client waits on
+	// the answer to, such as nick claims.
+	commandMu sync.Mutex
+	commands  *redisConn
+
+	// What the other nodes have told this one, by node and by room and
+	// nick. Only the dispatcher changes these.
+	nodes map[string]*clusterNode
+	bans  map[string]*roomBan
+}
+
+// clusterNode is another node: when it was last heard from, and who is in
+// its rooms, by folded room name.
+type clusterNode struct {
+	seen  time.Time
+	rooms map[string]*clusterRoom
+}
+
+// clusterRoom is who is in a room on another node, by folded nick.
+type clusterRoom struct {
+	name  string
+	nicks map[string]string
+}
+
+// A clusterOp sends something to Redis. The publisher sends it again after
+// reconnecting if the connection drops partway, so it must be safe to
+// repeat.
+type clusterOp func(redis *redisConn) error
+
+// clusterMessage is what nodes publish. Type is empty for room messages.
+type clusterMessage struct {
+	Type    string    `json:"type,omitempty"`
+	Node    string    `json:"node"`
+	Room    string    `json:"room"`
+	Nick    string    `json:"nick"`
+	NewNick string    `json:"new_nick,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+func NewCluster(addr, password string) *Cluster {
+	return &Cluster{
+		addr:     addr,
+		password: password,
+		node:     newSecret(9),
+		outgoing: make(chan clusterOp, clusterQueueSize),
+		nodes:    make(map[string]*clusterNode),
+		bans:     make(map[string]*roomBan),
+	}
+}
+
+// send queues op for the publisher. It never blocks; if Redis can't keep
+// up, op is dropped.
+func (cluster *Cluster) send(what string, op clusterOp) {
+	select {
+	case cluster.outgoing <- op:
+	default:
+		slog.Warn("cluster queue full, " + what + " not published")
+	}
+}
+
+// publishOp publishes msg from this node on channel.
+func (cluster *Cluster) publishOp(channel string, msg *clusterMessage) clusterOp {
+	msg.Node = cluster.node
+	data, _ := json.Marshal(msg)
+
+	return func(redis *redisConn) error {
+		_, err := redis.Do("PUBLISH", channel, string(data))
+		return err
+	}
+}
+
+// commandsOp sends each of commands in turn.
+func commandsOp(commands ...[]string) clusterOp {
+	return func(redis *redisConn) error {
+		for _, command := range commands {
+			_, err := redis.Do(command...)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func thenOp(ops ...clusterOp) clusterOp {
+	return func(redis *redisConn) error {
+		for _, op := range ops {
+			err := op(redis)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func (cluster *Cluster) membersKey() string {
+	return clusterMembersPrefix + cluster.node
+}
+
+func clusterNickKey(nick string) string {
+	return clusterNickPrefix + foldName(nick)
+}
+
+// clusterEntry is how a member of a room is kept in a node's members set,
+// and a ban in the bans hash.
+func clusterEntry(room, nick string) string {
+	return room + "\t" + nick
+}
+
+func clusterTTL() string {
+	return strconv.FormatInt(clusterTimeout.Milliseconds(), 10)
+}
+
+// Publish queues message for the other nodes. It never blocks; if Redis
+// can't keep up the message is only delivered locally.
+func (cluster *Cluster) Publish(message *Message) {
+	if cluster == nil {
+		return
+	}
+
+	cluster.send("message", cluster.publishOp(clusterChannelPrefix+message.room, &clusterMessage{
+		Room: message.room,
+		Nick: message.nick,
+		Text: message.text,
+		Time: message.time,
+	}))
+}
+
+// Joined, Parted and Renamed tell the other nodes about changes made by
+// local clients, and keep this node's members set up to date.
+func (cluster *Cluster) Joined(room, nick string) {
+	if cluster == nil {
+		return
+	}
+
+	cluster.send("join", thenOp(
+		commandsOp([]string{"SADD", cluster.membersKey(), clusterEntry(room, nick)}),
+		cluster.publishOp(clusterChannelPrefix+room, &clusterMessage{Type: "join", Room: room, Nick: nick, Time: time.Now()}),
+	))
+}
+
+func (cluster *Cluster) Parted(room, nick string) {
+	if cluster == nil {
+		return
+	}
+
+	cluster.send("part", thenOp(
+		commandsOp([]string{"SREM", cluster.membersKey(), clusterEntry(room, nick)}),
+		cluster.publishOp(clusterChannelPrefix+room, &clusterMessage{Type: "part", Room: room, Nick: nick, Time: time.Now()}),
+	))
+}
+
+func (cluster *Cluster) Renamed(nick, newNick string, rooms []string) {
+	if cluster == nil {
+		return
+	}
+
+	var commands [][]string
+
+	for _, room := range rooms {
+		commands = append(commands,
+			[]string{"SREM", cluster.membersKey(), clusterEntry(room, nick)},
+			[]string{"SADD", cluster.membersKey(), clusterEntry(room, newNick)})
+	}
+
+	cluster.send("nick change", thenOp(
+		commandsOp(commands...),
+		cluster.publishOp(clusterEventsChannel, &clusterMessage{Type: "nick", Nick: nick, NewNick: newNick, Time: time.Now()}),
+	))
+}
+
+// Kicked tells the other nodes that by kicked target out of room. The node
+// target is on removes them.
+func (cluster *Cluster) Kicked(room, by, target, reason string) {
+	if cluster == nil {
+		return
+	}
+
+	cluster.send("kick", cluster.publishOp(clusterChannelPrefix+room, &clusterMessage{
+		Type:   "kick",
+		Room:   room,
+		Nick:   by,
+		Target: target,
+		Reason: reason,
+		Time:   time.Now(),
+	}))
+}
+
+// Banned and Unbanned keep the cluster's bans in Redis and tell the other
+// nodes.
+func (cluster *Cluster) Banned(room string, ban *roomBan) {
+	if cluster == nil {
+		return
+	}
+
+	msg := &clusterMessage{
+		Type:    "ban",
+		Room:    room,
+		Nick:    ban.by,
+		Target:  ban.nick,
+		Time:    ban.set,
+		Expires: ban.expires,
+	}
+
+	publish := cluster.publishOp(clusterChannelPrefix+room, msg)
+	data, _ := json.Marshal(msg)
+
+	cluster.bans[clusterEntry(foldName(room), foldName(ban.nick))] = ban
+	cluster.send("ban", thenOp(
+		commandsOp([]string{"HSET", clusterBansKey, clusterEntry(foldName(room), foldName(ban.nick)), string(data)}),
+		publish,
+	))
+}
+
+func (cluster *Cluster) Unbanned(room, nick, by string) {
+	if cluster == nil {
+		return
+	}
+
+	delete(cluster.bans, clusterEntry(foldName(room), foldName(nick)))
+	cluster.send("unban", thenOp(
+		commandsOp([]string{"HDEL", clusterBansKey, clusterEntry(foldName(room), foldName(nick))}),
+		cluster.publishOp(clusterChannelPrefix+room, &clusterMessage{Type: "unban", Room: room, Nick: by, Target: nick, Time: time.Now()}),
+	))
+}
+
+// IsBanned reports whether a ban set anywhere in the cluster keeps nick out
+// of room.
+func (cluster *Cluster) IsBanned(room, nick string) bool {
+	if cluster == nil {
+		return false
+	}
+
+	ban := cluster.bans[clusterEntry(foldName(room), foldName(nick))]
+	return ban != nil && !ban.expired(time.Now())
+}
+
+// RoomBans lists the bans in room set anywhere in the cluster.
+func (cluster *Cluster) RoomBans(room string) []*roomBan {
+	if cluster == nil {
+		return nil
+	}
+
+	var bans []*roomBan
+
+	for key, ban := range cluster.bans {
+		if name, _, _ := strings.Cut(key, "\t"); name == foldName(room) {
+			bans = append(bans, ban)
+		}
+	}
+
+	return bans
+}
+
+// ClaimNick takes nick for this node in Redis, and reports whether it was
+// free or already this node's. A client waits on the answer, so if Redis
+// doesn't give one in time the claim is allowed, and only checked locally.
+func (cluster *Cluster) ClaimNick(nick string) bool {
+	if cluster == nil {
+		return true
+	}
+
+	reply, err := cluster.do("SET", clusterNickKey(nick), cluster.node, "NX", "PX", clusterTTL())
+
+	if err == nil && reply == nil {
+		reply, err = cluster.do("GET", clusterNickKey(nick))
+
+		if err == nil {
+			return reply == nil || reply == cluster.node
+		}
+	}
+
+	if err != nil {
+		slog.Warn("claiming nick in the cluster", "nick", nick, "err", err)
+	}
+
+	return true
+}
+
+// TookNick claims nick for this node whoever has it, and has any other
+// node holding it take it back from its client. Logging in does that, as
+// it does locally.
+func (cluster *Cluster) TookNick(nick string) {
+	if cluster == nil {
+		return
+	}
+
+	cluster.send("nick claim", thenOp(
+		commandsOp([]string{"SET", clusterNickKey(nick), cluster.node, "PX", clusterTTL()}),
+		cluster.publishOp(clusterEventsChannel, &clusterMessage{Type: "take", Nick: nick, Time: time.Now()}),
+	))
+}
+
+// ReleasedNick gives up this node's claim on nick. Queued ops run in
+// order, so if a client here claims it again in the meantime, its claim is
+// made after this.
+func (cluster *Cluster) ReleasedNick(nick string) {
+	if cluster == nil {
+		return
+	}
+
+	cluster.send("nick release", func(redis *redisConn) error {
+		owner, err := redis.Do("GET", clusterNickKey(nick))
+
+		if err != nil || owner != cluster.node {
+			return err
+		}
+
+		_, err = redis.Do("DEL", clusterNickKey(nick))
+		return err
+	})
+}
+
+// Member finds nick in room on another node, and gives the name it goes
+// by there.
+func (cluster *Cluster) Member(room, nick string) (string, bool) {
+	if cluster == nil {
+		return "", false
+	}
+
+	for _, node := range cluster.nodes {
+		if members := node.rooms[foldName(room)]; members != nil {
+			if name, exists := members.nicks[foldName(nick)]; exists {
+				return name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// Members lists who is in room on the other nodes.
+func (cluster *Cluster) Members(room string) []string {
+	if cluster == nil {
+		return nil
+	}
+
+	var names []string
+
+	for _, node := range cluster.nodes {
+		if members := node.rooms[foldName(room)]; members != nil {
+			for _, nick := range members.nicks {
+				names = append(names, nick)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Rooms counts who is in each room on the other nodes, by the room's
+// name.
+func (cluster *Cluster) Rooms() map[string]int {
+	counts := make(map[string]int)
+
+	if cluster == nil {
+		return counts
+	}
+
+	names := make(map[string]string)
+
+	for _, node := range cluster.nodes {
+		for key, members := range node.rooms {
+			if _, exists := names[key]; !exists {
+				names[key] = members.name
+			}
+
+			counts[names[key]] += len(members.nicks)
+		}
+	}
+
+	return counts
+}
+
+// add and remove change who node has in room, reporting whether that made
+// a difference.
+func (node *clusterNode) add(room, nick string) bool {
+	members := node.rooms[foldName(room)]
+
+	if members == nil {
+		members = &clusterRoom{name: room, nicks: make(map[string]string)}
+		node.rooms[foldName(room)] = members
+	}
+
+	if _, exists := members.nicks[foldName(nick)]; exists {
+		return false
+	}
+
+	members.nicks[foldName(nick)] = nick
+	return true
+}
+
+func (node *clusterNode) remove(room, nick string) bool {
+	members := node.rooms[foldName(room)]
+
+	if members == nil {
+		return false
+	}
+
+	if _, exists := members.nicks[foldName(nick)]; !exists {
+		return false
+	}
+
+	delete(members.nicks, foldName(nick))
+
+	if len(members.nicks) == 0 {
+		delete(node.rooms, foldName(room))
+	}
+
+	return true
+}
+
+// forget removes nick from room on whichever node has them there.
+func (cluster *Cluster) forget(room, nick string) {
+	if cluster == nil {
+		return
+	}
+
+	for _, node := range cluster.nodes {
+		node.remove(room, nick)
+	}
+}
+
+func newClusterNode(seen time.Time) *clusterNode {
+	return &clusterNode{seen: seen, rooms: make(map[string]*clusterRoom)}
+}
+
+// Run publishes and subscribes until the process exits, reconnecting to
+// Redis whenever the connection drops.
+func (cluster *Cluster) Run(server *Server) {
+	go cluster.retry("publishing", cluster.publish)
+	go cluster.heartbeat(server)
+	cluster.retry("subscribing", func() error {
+		return cluster.subscribe(server)
+	})
+}
+
+func (cluster *Cluster) retry(what string, run func() error) {
+	backoff := time.Second
+
+	for {
+		start := time.Now()
+		err := run()
+
+		if time.Since(start) > clusterMaxBackoff {
+			backoff = time.Second
+		}
+
+		slog.Error("cluster "+what+" failed", "redis", cluster.addr, "err", err, "retry", backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, clusterMaxBackoff)
+	}
+}
+
+func (cluster *Cluster) dial(timeout time.Duration) (*redisConn, error) {
+	return dialRedis(cluster.addr, cluster.password, timeout)
+}
+
+// do sends a command on the connection for commands a client waits on,
+// giving up after clusterCommandTimeout. If the connection has dropped
+// since it was last used, it connects again and has another go.
+func (cluster *Cluster) do(args ...string) (any, error) {
+	cluster.commandMu.Lock()
+	defer cluster.commandMu.Unlock()
+
+	fresh := false
+
+	for {
+		if cluster.commands == nil {
+			redis, err := cluster.dial(clusterCommandTimeout)
+
+			if err != nil {
+				return nil, err
+			}
+
+			cluster.commands = redis
+			fresh = true
+		}
+
+		cluster.commands.conn.SetDeadline(time.Now().Add(clusterCommandTimeout))
+		reply, err := cluster.commands.Do(args...)
+
+		if _, refused := err.(redisError); err == nil || refused {
+			return reply, err
+		}
+
+		cluster.commands.Close()
+		cluster.commands = nil
+
+		if fresh {
+			return nil, err
+		}
+	}
+}
+
+func (cluster *Cluster) publish() error {
+	redis, err := cluster.dial(clusterDialTimeout)
+
+	if err != nil {
+		return err
+	}
+
+	defer redis.Close()
+
+	for {
+		if cluster.pending == nil {
+			cluster.pending = <-cluster.outgoing
+		}
+
+		err := cluster.pending(redis)
+
+		if _, refused := err.(redisError); refused {
+			slog.Warn("redis refused a cluster update", "err", err)
+		} else if err != nil {
+			return err
+		}
+
+		cluster.pending = nil
+	}
+}
+
+// heartbeat refreshes this node's claims and members in Redis, tells the
+// other nodes it is still up, and forgets the ones that have gone quiet.
+func (cluster *Cluster) heartbeat(server *Server) {
+	for {
+		server.call(server.clusterHeartbeat)
+		time.Sleep(clusterHeartbeat)
+	}
+}
+
+// clusterHeartbeat runs on the dispatcher, so what it queues is up to date
+// and goes ahead of any later change.
+func (server *Server) clusterHeartbeat() {
+	cluster := server.cluster
+	now := time.Now()
+
+	var members, nicks []string
+
+	for _, room := range server.Rooms() {
+		for _, client := range room.clients {
+			members = append(members, clusterEntry(room.name, client.Name()))
+		}
+	}
+
+	for _, client := range server.nicks.Values() {
+		if nick := client.nick(); nick != "" {
+			nicks = append(nicks, nick)
+		}
+	}
+
+	cluster.send("heartbeat", thenOp(
+		cluster.refreshOp(members, nicks),
+		cluster.publishOp(clusterEventsChannel, &clusterMessage{Type: "hello", Time: now}),
+	))
+
+	for id, node := range cluster.nodes {
+		if now.Sub(node.seen) < clusterTimeout {
+			continue
+		}
+
+		slog.Warn("lost touch with cluster node", "node", id)
+		delete(cluster.nodes, id)
+
+		for _, members := range node.rooms {
+			room, exists := server.LookupRoom(members.name)
+
+			if !exists {
+				continue
+			}
+
+			for _, nick := range members.nicks {
+				room.SendPresence(&Event{
+					Type:   EventPart,
+					Nick:   nick,
+					Reason: "Lost touch with their node",
+					Text:   fmt.Sprintf("%s left %s (lost touch with their node)", plainName(nick), plainName(room.name)),
+				})
+			}
+		}
+	}
+}
+
+// refreshOp renews this node's key, replaces its members set and renews
+// its claims on nicks, leaving alone any claim another node has made since.
+func (cluster *Cluster) refreshOp(members, nicks []string) clusterOp {
+	return func(redis *redisConn) error {
+		ttl := clusterTTL()
+		building := cluster.membersKey() + ":new"
+
+		commands := [][]string{
+			{"SET", clusterNodeKeyPrefix + cluster.node, "1", "PX", ttl},
+			{"SADD", clusterNodesKey, cluster.node},
+			{"DEL", building},
+		}
+
+		if len(members) > 0 {
+			commands = append(commands,
+				append([]string{"SADD", building}, members...),
+				[]string{"RENAME", building, cluster.membersKey()},
+				[]string{"PEXPIRE", cluster.membersKey(), ttl})
+		} else {
+			commands = append(commands, []string{"DEL", cluster.membersKey()})
+		}
+
+		_, err := redis.Pipeline(commands)
+
+		if err != nil || len(nicks) == 0 {
+			return err
+		}
+
+		claims := make([][]string, len(nicks))
+
+		for i, nick := range nicks {
+			claims[i] = []string{"SET", clusterNickKey(nick), cluster.node, "NX", "PX", ttl}
+		}
+
+		replies, err := redis.Pipeline(claims)
+
+		if err != nil {
+			return err
+		}
+
+		var owners [][]string
+
+		for i, reply := range replies {
+			if reply == nil {
+				owners = append(owners, []string{"GET", clusterNickKey(nicks[i])})
+			}
+		}
+
+		replies, err = redis.Pipeline(owners)
+
+		if err != nil {
+			return err
+		}
+
+		var renewals [][]string
+
+		for i, owner := range replies {
+			if owner == cluster.node {
+				renewals = append(renewals, []string{"PEXPIRE", owners[i][1], ttl})
+			}
+		}
+
+		_, err = redis.Pipeline(renewals)
+		return err
+	}
+}
+
+func (cluster *Cluster) subscribe(server *Server) error {
+	redis, err := cluster.dial(clusterDialTimeout)
+
+	if err != nil {
+		return err
+	}
+
+	defer redis.Close()
+
+	_, err = redis.Do("PSUBSCRIBE", clusterChannelPrefix+"*", clusterEventsChannel)
+
+	if err != nil {
+		return err
+	}
+
+	// Anything published while the snapshot is read waits on the
+	// connection, and is applied after it.
+	nodes, bans, err := cluster.snapshot()
+
+	if err != nil {
+		return err
+	}
+
+	server.call(func() {
+		cluster.nodes = nodes
+		cluster.bans = bans
+	})
+
+	slog.Info("joined cluster", "redis", cluster.addr, "node", cluster.node, "nodes", len(nodes)+1)
+
+	for {
+		reply, err := redis.Receive()
+
+		if err != nil {
+			return err
+		}
+
+		parts, ok := reply.([]any)
+
+		if !ok || len(parts) != 4 || parts[0] != "pmessage" {
+			continue
+		}
+
+		payload, _ := parts[3].(string)
+
+		var msg clusterMessage
+
+		if json.Unmarshal([]byte(payload), &msg) != nil || msg.Node == "" || msg.Node == cluster.node {
+			continue
+		}
+
+		server.call(func() {
+			server.handleCluster(&msg)
+		})
+	}
+}
+
+// snapshot reads who is in which room on the other live nodes, and the
+// cluster's bans, tidying away nodes that have gone.
+func (cluster *Cluster) snapshot() (map[string]*clusterNode, map[string]*roomBan, error) {
+	now := time.Now()
+	nodes := make(map[string]*clusterNode)
+	bans := make(map[string]*roomBan)
+
+	reply, err := cluster.do("SMEMBERS", clusterNodesKey)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, id := range redisStrings(reply) {
+		if id == cluster.node {
+			continue
+		}
+
+		alive, err := cluster.do("EXISTS", clusterNodeKeyPrefix+id)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if alive == int64(0) {
+			cluster.do("SREM", clusterNodesKey, id)
+			continue
+		}
+
+		reply, err := cluster.do("SMEMBERS", clusterMembersPrefix+id)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		node := newClusterNode(now)
+
+		for _, entry := range redisStrings(reply) {
+			if room, nick, ok := strings.Cut(entry, "\t"); ok {
+				node.add(room, nick)
+			}
+		}
+
+		nodes[id] = node
+	}
+
+	reply, err = cluster.do("HGETALL", clusterBansKey)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields := redisStrings(reply)
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		var msg clusterMessage
+
+		if json.Unmarshal([]byte(fields[i+1]), &msg) != nil {
+			continue
+		}
+
+		ban := &roomBan{nick: msg.Target, by: msg.Nick, set: msg.Time, expires: msg.Expires}
+
+		if !ban.expired(now) {
+			bans[fields[i]] = ban
+		}
+	}
+
+	return nodes, bans, nil
+}
+
+// handleCluster applies a change another node published.
+func (server *Server) handleCluster(msg *clusterMessage) {
+	cluster := server.cluster
+	node := cluster.nodes[msg.Node]
+
+	if node == nil {
+		node = newClusterNode(time.Now())
+		cluster.nodes[msg.Node] = node
+	}
+
+	node.seen = time.Now()
+
+	if msg.Type == "" {
+		server.DeliverRemote(msg)
+		return
+	}
+
+	if (msg.Room != "" && !validName(msg.Room)) || (msg.Nick != "" && !validName(msg.Nick)) {
+		return
+	}
+
+	room, _ := server.LookupRoom(msg.Room)
+
+	switch msg.Type {
+	case "join":
+		if node.add(msg.Room, msg.Nick) && room != nil {
+			room.SendPresence(&Event{
+				Type: EventJoin,
+				Nick: msg.Nick,
+				Text: fmt.Sprintf("%s joined %s", plainName(msg.Nick), plainName(room.name)),
+			})
+		}
+	case "part":
+		if node.remove(msg.Room, msg.Nick) && room != nil {
+			room.SendPresence(&Event{
+				Type: EventPart,
+				Nick: msg.Nick,
+				Text: fmt.Sprintf("%s left %s", plainName(msg.Nick), plainName(room.name)),
+			})
+		}
+	case "nick":
+		if !validName(msg.NewNick) {
+			return
+		}
+
+		for _, members := range node.rooms {
+			if !node.remove(members.name, msg.Nick) {
+				continue
+			}
+
+			node.add(members.name, msg.NewNick)
+
+			if room, exists := server.LookupRoom(members.name); exists {
+				room.SendPresence(&Event{
+					Type:    EventNick,
+					Nick:    msg.Nick,
+					NewNick: msg.NewNick,
+					Text:    fmt.Sprintf("%s is now known as %s", plainName(msg.Nick), plainName(msg.NewNick)),
+				})
+			}
+		}
+	case "take":
+		if holder, taken := server.LookupNick(msg.Nick); taken {
+			server.ChangeNick(holder, "")
+			holder.Notice("", msg.Nick+" was taken on another node; you are now "+holder.Name())
+		}
+	case "kick":
+		if !validName(msg.Target) {
+			return
+		}
+
+		server.kickOut(msg.Room, msg.Nick, msg.Target, msg.Reason)
+	case "ban":
+		if !validName(msg.Target) {
+			return
+		}
+
+		cluster.bans[clusterEntry(foldName(msg.Room), foldName(msg.Target))] = &roomBan{
+			nick:    msg.Target,
+			by:      msg.Nick,
+			set:     msg.Time,
+			expires: msg.Expires,
+		}
+
+		if room != nil {
+			room.Notice(fmt.Sprintf("%s was banned by %s", plainName(msg.Target), plainName(msg.Nick)))
+		}
+	case "unban":
+		if !validName(msg.Target) {
+			return
+		}
+
+		delete(cluster.bans, clusterEntry(foldName(msg.Room), foldName(msg.Target)))
+
+		if room != nil {
+			room.Notice(fmt.Sprintf("%s was unbanned by %s", plainName(msg.Target), plainName(msg.Nick)))
+		}
+	}
+}
+
+// DeliverRemote hands a message from another node to the room's local
+// members, if there are any.
+func (server *Server) DeliverRemote(msg *clusterMessage) {
+	room, exists := server.LookupRoom(msg.Room)
+
+	if !exists {
+		return
+	}
+
+	server.deliver(room, &Message{
+		id:   room.nextMessageID(),
+		room: room.name,
+		nick: msg.Nick,
+		text: msg.Text,
+		time: msg.Time,
+	})
+}
+
+// redisConn speaks just enough of the Redis protocol (RESP) for the
+// cluster.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// A redisError is an error reply from Redis, rather than trouble with the
+// connection.
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+// dialRedis connects to Redis, and logs in with password if it is set.
+func dialRedis(addr, password string, timeout time.Duration) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	redis := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if password != "" {
+		conn.SetDeadline(time.Now().Add(timeout))
+		_, err = redis.Do("AUTH", password)
+		conn.SetDeadline(time.Time{})
+
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return redis, nil
+}
+
+func (redis *redisConn) Close() error {
+	return redis.conn.Close()
+}
+
+// Do sends a command and reads its reply.
+func (redis *redisConn) Do(args ...string) (any, error) {
+	replies, err := redis.Pipeline([][]string{args})
+
+	if replies == nil {
+		return nil, err
+	}
+
+	return replies[0], err
+}
+
+// Pipeline sends commands all at once and reads their replies. If Redis
+// refuses any of them, the first refusal is returned along with every
+// reply.
+func (redis *redisConn) Pipeline(commands [][]string) ([]any, error) {
+	if len(commands) == 0 {
+		return nil, nil
+	}
+
+	var b strings.Builder
+
+	for _, args := range commands {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+
+	_, err := io.WriteString(redis.conn, b.String())
+
+	if err != nil {
+		return nil, err
+	}
+
+	var refused error
+	replies := make([]any, len(commands))
+
+	for i := range replies {
+		replies[i], err = redis.Receive()
+
+		if _, ok := err.(redisError); ok {
+			refused = cmp.Or(refused, err)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return replies, refused
+}
+
+// Receive reads one reply. Errors from Redis come back as redisErrors and
+// arrays as []any of the other types.
+func (redis *redisConn) Receive() (any, error) {
+	line, err := redis.reader.ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	kind, rest := line[0], line[1:]
+
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		data := make([]byte, n+2)
+
+		_, err = io.ReadFull(redis.reader, data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		parts := make([]any, n)
+
+		for i := range parts {
+			parts[i], err = redis.Receive()
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return parts, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// redisStrings picks the strings out of an array reply.
+func redisStrings(reply any) []string {
+	parts, _ := reply.([]any)
+	strs := make([]string, 0, len(parts))
+
+	for _, part := range parts {
+		if str, ok := part.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+
+	return strs
+}
@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"hash/fnv"
+	"strings"
+)
+
+// ANSI escape codes for clients that turn on color.
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+	ansiCyan   = "\x1b[36m"
+)
+
+// nickColors are what nicks are drawn in, leaving out the colors used for
+// rooms, notices and errors.
+var nickColors = [...]string{
+	"\x1b[32m", "\x1b[34m", "\x1b[35m",
+	"\x1b[92m", "\x1b[94m", "\x1b[95m", "\x1b[96m", "\x1b[93m",
+}
+
+// nickColor picks the color for nick. It depends only on the nick, so
+// someone looks the same to everyone, every time.
+func nickColor(nick string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(foldName(nick)))
+
+	return nickColors[hash.Sum32()%uint32(len(nickColors))]
+}
+
+// Colored is Plain with ANSI colors for terminals: room names in bold cyan
+// and nicks in their own color in messages, notices in yellow and errors in
+// red. Replies to commands are left alone. Control characters are taken
+// out of text others wrote, so it can't recolor or rewrite the terminal.
+func (event *Event) Colored(stampFormat string) string {
+	e := *event
+	e.Text = stripControls(e.Text)
+
+	if len(e.Reactions) > 0 {
+		e.Reactions = make(map[string]int, len(event.Reactions))
+
+		for emoji, count := range event.Reactions {
+			e.Reactions[stripControls(emoji)] += count
+		}
+	}
+
+	switch e.Type {
+	case EventMessage, EventPrivate:
+		room := ansiBold + ansiCyan + plainName(e.Room) + ansiReset
+		nick := nickColor(e.Nick) + plainName(e.Nick) + ansiReset
+
+		return e.plain(stampFormat, room, nick)
+	case EventReply, EventPing:
+		return e.Plain(stampFormat)
+	case EventError:
+		return paint(ansiRed, e.Plain(stampFormat))
+	default:
+		return paint(ansiYellow, e.Plain(stampFormat))
+	}
+}
+
+// stripControls removes C0 and C1 control characters and DEL from text,
+// apart from newlines and tabs, which multi-line replies use.
+func stripControls(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+
+		if r < 0x20 || (r >= 0x7f && r <= 0x9f) {
+			return -1
+		}
+
+		return r
+	}, text)
+}
+
+// paint colors line, keeping its newline after the reset.
+func paint(color, line string) string {
+	return color + strings.TrimSuffix(line, "\n") + ansiReset + "\n"
+}
+
+// ColorCommand turns colored output on or off for a plain text client.
+type ColorCommand struct {
+	client *Client
+	on     bool
+}
+
+func (cmd *ColorCommand) Run(server *Server) {
+	_, isWS := cmd.client.conn.(*wsConn)
+	_, isGRPC := cmd.client.conn.(*grpcConn)
+
+	if cmd.client.irc != nil || cmd.client.json.Load() || isWS || isGRPC {
+		cmd.client.Error("Color is only for plain text clients")
+		return
+	}
+
+	cmd.client.color.Store(cmd.on)
+
+	if cmd.on {
+		cmd.client.Reply("Color on")
+	} else {
+		cmd.client.Reply("Color off")
+	}
+}
+
+func parseColor(client *Client, args []string) Command {
+	return &ColorCommand{
+		client: client,
+		on:     args[0] == "on",
+	}
+}
@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"bufio"
+	"compress/gzip"
+	"strings"
+)
+
+// Compression is switched on from the reader goroutine rather than the
+// dispatcher: everything the client sends after "compress on" is already
+// compressed, so the reader has to start inflating before it reads another
+// line. The reply is the last thing the client gets uncompressed, and the
+// writer starts deflating once it has sent it.
+
+// compressible reports whether the client's connection can be compressed.
+// IRC clients wouldn't expect it, WebSocket frames carry text and gRPC
+// streams carry messages.
+func (client *Client) compressible() bool {
+	_, isWS := client.conn.(*wsConn)
+	_, isGRPC := client.conn.(*grpcConn)
+	return client.irc == nil && !isWS && !isGRPC
+}
+
+// wantsCompression reports whether line is a compress on command, in
+// either plain text or JSON, that the client is able to start.
+func (client *Client) wantsCompression(line string) bool {
+	if client.compressed.Load() || !client.compressible() {
+		return false
+	}
+
+	if client.json.Load() {
+		decoded, err := decodeJSONCommand(line)
+
+		if err != nil {
+			return false
+		}
+
+		line = decoded
+	}
+
+	verb, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	return strings.EqualFold(verb, "compress") && strings.Trim(rest, " ") == "on"
+}
+
+// inflate replies to compress on and reads the rest of the connection
+// through gzip. The end of the client's gzip stream is the end of the
+// connection. It must be called on the reader goroutine.
+func (client *Client) inflate() error {
+	client.compressed.Store(true)
+	client.Send(&Event{Type: EventReply, Text: "Compression on", compress: true})
+
+	gz, err := gzip.NewReader(client.reader)
+
+	if err != nil {
+		return err
+	}
+
+	gz.Multistream(false)
+	client.reader = bufio.NewReaderSize(gz, client.reader.Size())
+	return nil
+}
+
+// deflate writes the rest of the connection through gzip, flushed after
+// every batch of lines. It must be called on the writer goroutine.
+func (client *Client) deflate() {
+	deflater, _ := gzip.NewWriterLevel(client.conn, gzip.BestSpeed)
+	client.deflater = deflater
+	client.writer = bufio.NewWriter(deflater)
+}
+
+// CompressCommand only runs when the reader didn't start compression
+// itself, so all it does is say why.
+type CompressCommand struct {
+	client *Client
+}
+
+func (cmd *CompressCommand) Run(server *Server) {
+	switch {
+	case !cmd.client.compressible():
+		cmd.client.Error("Compression isn't available on this connection")
+	case cmd.client.compressed.Load():
+		cmd.client.Error("Compression is already on")
+	default:
+		cmd.client.Error("Send compress on by itself to turn on compression")
+	}
+}
@@ -0,0 +1,225 @@
+package chat
+
+import (
+	"hash/maphash"
+	"sort"
+	"sync"
+)
+
+// The commands clients send most, room and private messages, joins, parts
+// and nick changes, run straight away on the sender's reading goroutine,
+// in parallel with each other. The rest run one at a time on the
+// dispatcher. The dispatcher holds server.mu while it runs a command and
+// concurrent commands share it, so a dispatcher command has the server to
+// itself, and only concurrent commands need to guard what they touch from
+// each other:
+//
+//   - clients, nicks and rooms are sharded maps, each shard with its own
+//     lock, so lookups of different names don't wait for each other.
+//   - room.mu guards a room's members, operators and voiced members, and
+//     its message IDs, so joins and messages in one room don't hold up
+//     another.
+//   - a client's nick is atomic, since anyone may look at it.
+//   - quotaMu guards daily message counts, and mailMu mailboxes.
+//
+// Everything else they change belongs to the client running them, like the
+// rooms it is in. Closing a room needs the dispatcher, so a room a
+// concurrent command leaves empty is closed there before the next command,
+// unless someone has joined it again. Bots only run on the dispatcher too,
+// so what a concurrent command has to tell them is queued and handed over
+// there in order, a little after the fact.
+
+// A concurrentCommand may run off the dispatcher when concurrent says so.
+type concurrentCommand interface {
+	Command
+	concurrent(server *Server) bool
+}
+
+func (server *Server) isConcurrent(cmd Command) bool {
+	if guarded, ok := cmd.(*guardedCommand); ok {
+		cmd = guarded.cmd
+	}
+
+	concurrent, ok := cmd.(concurrentCommand)
+
+	return ok && concurrent.concurrent(server)
+}
+
+// runConcurrently runs cmd alongside other concurrent commands. It mustn't
+// be called with commands still waiting on the dispatcher that cmd depends
+// on.
+func (server *Server) runConcurrently(cmd Command) {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+
+	cmd.Run(server)
+}
+
+// roomEmptied notes that a concurrent command has left room empty, for the
+// dispatcher to close.
+func (server *Server) roomEmptied(room *Room) {
+	server.emptyMu.Lock()
+	server.emptyRooms = append(server.emptyRooms, room)
+	server.emptyMu.Unlock()
+}
+
+// closeEmptyRooms closes the rooms concurrent commands left empty that are
+// still empty. It runs on the dispatcher.
+func (server *Server) closeEmptyRooms() {
+	server.emptyMu.Lock()
+	rooms := server.emptyRooms
+	server.emptyRooms = nil
+	server.emptyMu.Unlock()
+
+	for _, room := range rooms {
+		if current, exists := server.LookupRoom(room.name); exists && current == room && len(room.clients) == 0 {
+			server.DeleteRoom(room)
+		}
+	}
+}
+
+// mapShards is how many pieces a shardedMap is split into.
+const mapShards = 32
+
+// shardedMap is a map split into shards, each with its own lock, so
+// goroutines working with different keys rarely wait for each other. The
+// locks are only held inside its methods.
+type shardedMap[K comparable, V comparable] struct {
+	seed   maphash.Seed
+	shards [mapShards]mapShard[K, V]
+}
+
+type mapShard[K comparable, V comparable] struct {
+	mu sync.RWMutex
+	m  map[K]V
+}
+
+func newShardedMap[K comparable, V comparable]() *shardedMap[K, V] {
+	sharded := &shardedMap[K, V]{seed: maphash.MakeSeed()}
+
+	for i := range sharded.shards {
+		sharded.shards[i].m = make(map[K]V)
+	}
+
+	return sharded
+}
+
+func (sharded *shardedMap[K, V]) shard(key K) *mapShard[K, V] {
+	return &sharded.shards[maphash.Comparable(sharded.seed, key)%mapShards]
+}
+
+func (sharded *shardedMap[K, V]) Get(key K) (V, bool) {
+	shard := sharded.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	value, exists := shard.m[key]
+	return value, exists
+}
+
+func (sharded *shardedMap[K, V]) Set(key K, value V) {
+	shard := sharded.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.m[key] = value
+}
+
+// GetOrAdd returns the value for key, adding the one add makes if there
+// isn't one. It reports whether it added it. add runs with the shard
+// locked, so it must be quick and mustn't use the map.
+func (sharded *shardedMap[K, V]) GetOrAdd(key K, add func() V) (V, bool) {
+	shard := sharded.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if value, exists := shard.m[key]; exists {
+		return value, false
+	}
+
+	value := add()
+	shard.m[key] = value
+
+	return value, true
+}
+
+// DeleteIf removes key if its value is value, and reports whether it did.
+func (sharded *shardedMap[K, V]) DeleteIf(key K, value V) bool {
+	shard := sharded.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if current, exists := shard.m[key]; !exists || current != value {
+		return false
+	}
+
+	delete(shard.m, key)
+
+	return true
+}
+
+func (sharded *shardedMap[K, V]) Len() int {
+	n := 0
+
+	for i := range sharded.shards {
+		shard := &sharded.shards[i]
+		shard.mu.RLock()
+		n += len(shard.m)
+		shard.mu.RUnlock()
+	}
+
+	return n
+}
+
+// Values returns what is in the map, in no particular order. Shards are
+// read one after another, so it is only a snapshot of the whole map if
+// nothing is changing it, as on the dispatcher.
+func (sharded *shardedMap[K, V]) Values() []V {
+	var values []V
+
+	for i := range sharded.shards {
+		shard := &sharded.shards[i]
+		shard.mu.RLock()
+
+		for _, value := range shard.m {
+			values = append(values, value)
+		}
+
+		shard.mu.RUnlock()
+	}
+
+	return values
+}
+
+// clientMap holds the connected clients by ID.
+type clientMap struct {
+	*shardedMap[uint64, *Client]
+}
+
+func newClientMap() clientMap {
+	return clientMap{newShardedMap[uint64, *Client]()}
+}
+
+func (clients clientMap) Add(client *Client) {
+	clients.Set(client.id, client)
+}
+
+func (clients clientMap) Remove(client *Client) {
+	clients.DeleteIf(client.id, client)
+}
+
+func (clients clientMap) Has(client *Client) bool {
+	current, exists := clients.Get(client.id)
+	return exists && current == client
+}
+
+// Sorted returns the clients in the order they connected.
+func (clients clientMap) Sorted() []*Client {
+	sorted := clients.Values()
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].id < sorted[j].id
+	})
+
+	return sorted
+}
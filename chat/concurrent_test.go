@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardedMap(t *testing.T) {
+	sharded := newShardedMap[string, int]()
+
+	if value, added := sharded.GetOrAdd("a", func() int { return 1 }); !added || value != 1 {
+		t.Errorf("GetOrAdd on an empty map = %d, %v, want 1, true", value, added)
+	}
+
+	if value, added := sharded.GetOrAdd("a", func() int { return 2 }); added || value != 1 {
+		t.Errorf("GetOrAdd on a present key = %d, %v, want 1, false", value, added)
+	}
+
+	if sharded.DeleteIf("a", 2) {
+		t.Error("DeleteIf removed a key whose value didn't match")
+	}
+
+	sharded.Set("b", 3)
+
+	if sharded.Len() != 2 || len(sharded.Values()) != 2 {
+		t.Errorf("map has %d entries and %d values, want 2", sharded.Len(), len(sharded.Values()))
+	}
+
+	if !sharded.DeleteIf("a", 1) {
+		t.Error("DeleteIf didn't remove a key whose value matched")
+	}
+
+	if _, exists := sharded.Get("a"); exists {
+		t.Error("deleted key is still there")
+	}
+}
+
+// TestConcurrentCommands has clients join, talk, change nicks and leave all
+// at once, all of them trying for the same nick along the way, then checks
+// that the server's maps agree with its clients.
+func TestConcurrentCommands(t *testing.T) {
+	config := DefaultConfig()
+	config.RateLimit = 0
+
+	server, l, _, _ := newTestServer(t, config)
+
+	const clients = 20
+	var wg sync.WaitGroup
+
+	for i := range clients {
+		conn := l.Dial()
+		t.Cleanup(func() { conn.Close() })
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			lines := []string{
+				fmt.Sprintf("nick user%d", i),
+				"join shared",
+				fmt.Sprintf("join room%d", i),
+				fmt.Sprintf("msg shared hello from %d", i),
+				fmt.Sprintf("pm user%d hello", (i+1)%clients),
+				"nick racer",
+				fmt.Sprintf("msg room%d still here", i),
+				fmt.Sprintf("leave room%d", i),
+				"list",
+			}
+
+			go func() {
+				for _, line := range lines {
+					fmt.Fprintln(conn, line)
+				}
+			}()
+
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			reader := bufio.NewReader(conn)
+
+			for {
+				line, err := reader.ReadString('\n')
+
+				if err != nil {
+					t.Errorf("client %d: %v", i, err)
+					return
+				}
+
+				if strings.Contains(line, "Rooms:") {
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	server.Do(func() {
+		nicks := make(map[string]*Client)
+
+		for _, client := range server.Clients() {
+			if client.nick() == "" {
+				t.Errorf("client %d has no nick", client.id)
+				continue
+			}
+
+			if other, taken := nicks[foldName(client.nick())]; taken {
+				t.Errorf("clients %d and %d are both %s", other.id, client.id, client.nick())
+			}
+
+			nicks[foldName(client.nick())] = client
+
+			if holder, _ := server.LookupNick(client.nick()); holder != client {
+				t.Errorf("%s doesn't look up client %d", client.nick(), client.id)
+			}
+
+			if len(client.rooms) != 1 || !client.rooms["shared"].HasClient(client) {
+				t.Errorf("client %d is in %v, want only shared", client.id, client.rooms)
+			}
+		}
+
+		if holder, taken := server.LookupNick("racer"); !taken || nicks["racer"] != holder {
+			t.Error("nobody won the race for racer")
+		}
+
+		if server.nicks.Len() != clients {
+			t.Errorf("%d nicks in use, want %d", server.nicks.Len(), clients)
+		}
+
+		if rooms := server.Rooms(); len(rooms) != 1 || len(rooms[0].clients) != clients {
+			t.Errorf("open rooms are %v, want only shared, with everyone in it", rooms)
+		}
+	})
+}
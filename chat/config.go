@@ -0,0 +1,427 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config holds everything the server reads at startup. It is filled from
+// defaults, then an optional JSON or TOML file given with -config, then any
+// flags set explicitly on the command line, which win over the file.
+type Config struct {
+	Addr     string `json:"addr"`
+	TLSAddr  string `json:"tls_addr"`
+	UnixPath string `json:"unix_path"`
+	TLSCert  string `json:"tls_cert"`
+	TLSKey   string `json:"tls_key"`
+	WSAddr   string `json:"ws_addr"`
+	IRCAddr  string `json:"irc_addr"`
+	GRPCAddr string `json:"grpc_addr"`
+
+	Listeners []ListenerConfig `json:"listeners"`
+
+	TLSClientCA          string `json:"tls_client_ca"`
+	TLSRequireClientCert bool   `json:"tls_require_client_cert"`
+
+	ACMEDomain   string `json:"acme_domain"`
+	ACMECache    string `json:"acme_cache"`
+	ACMEEmail    string `json:"acme_email"`
+	ACMEHTTPAddr string `json:"acme_http_addr"`
+
+	ProxyProtocol bool `json:"proxy_protocol"`
+
+	AdminAddr  string `json:"admin_addr"`
+	AdminToken string `json:"admin_token"`
+
+	ConsoleAddr string `json:"console"`
+
+	MetricsAddr string `json:"metrics_addr"`
+
+	RedisAddr     string `json:"redis_addr"`
+	RedisPassword string `json:"redis_password"`
+
+	ServerName   string `json:"server_name"`
+	LinkAddr     string `json:"link_addr"`
+	Links        string `json:"links"`
+	LinkPassword string `json:"link_password"`
+
+	BridgeAddr     string `json:"bridge_addr"`
+	BridgeTLS      bool   `json:"bridge_tls"`
+	BridgeNick     string `json:"bridge_nick"`
+	BridgeChannels string `json:"bridge_channels"`
+
+	Webhooks     string `json:"webhooks"`
+	NotifyURL    string `json:"notify_url"`
+	InboundAddr  string `json:"inbound_addr"`
+	InboundToken string `json:"inbound_token"`
+	InboundNick  string `json:"inbound_nick"`
+	StreamAddr   string `json:"stream_addr"`
+	StreamToken  string `json:"stream_token"`
+
+	UploadAddr      string   `json:"upload_addr"`
+	UploadDir       string   `json:"upload_dir"`
+	UploadURL       string   `json:"upload_url"`
+	MaxUpload       int64    `json:"max_upload"`
+	UploadRetention Duration `json:"upload_retention"`
+
+	MatrixAddr       string `json:"matrix_addr"`
+	MatrixHomeserver string `json:"matrix_homeserver"`
+	MatrixUser       string `json:"matrix_user"`
+	MatrixASToken    string `json:"matrix_as_token"`
+	MatrixHSToken    string `json:"matrix_hs_token"`
+	MatrixRooms      string `json:"matrix_rooms"`
+
+	Handoff      bool     `json:"handoff"`
+	DrainTimeout Duration `json:"drain_timeout"`
+
+	RulesPath string     `json:"rules"`
+	MOTDPath  string     `json:"motd"`
+	LogLevel  slog.Level `json:"log_level"`
+	LogFormat string     `json:"log_format"`
+
+	FilterPath   string `json:"filter"`
+	FilterAction string `json:"filter_action"`
+
+	ScriptsDir    string   `json:"scripts"`
+	ScriptTimeout Duration `json:"script_timeout"`
+
+	ChurnLimit   int      `json:"churn_limit"`
+	ChurnWindow  Duration `json:"churn_window"`
+	ChurnPenalty Duration `json:"churn_penalty"`
+
+	MaxConnsPerIP int `json:"max_conns_per_ip"`
+
+	AllowCIDRs     string `json:"allow_cidrs"`
+	DenyCIDRs      string `json:"deny_cidrs"`
+	GeoIPPath      string `json:"geoip"`
+	AllowCountries string `json:"allow_countries"`
+	DenyCountries  string `json:"deny_countries"`
+
+	BansPath     string `json:"bans"`
+	AccountsPath string `json:"accounts"`
+	RoomsPath    string `json:"rooms"`
+	AuditPath    string `json:"audit"`
+	OperPassword string `json:"oper_password"`
+
+	TimeFormat  string `json:"time_format"`
+	StampFormat string `json:"stamp_format"`
+	Timezone    string `json:"timezone"`
+
+	PollDuration Duration `json:"poll_duration"`
+	NickGrace    Duration `json:"nick_grace"`
+
+	ConfusableNicks bool `json:"confusable_nicks"`
+
+	SessionGrace Duration `json:"session_grace"`
+	EditWindow   Duration `json:"edit_window"`
+	HistorySize  int      `json:"history"`
+	StorePath    string   `json:"store"`
+
+	OutgoingBuffer int    `json:"outgoing_buffer"`
+	SlowClients    string `json:"slow_clients"`
+
+	MaxLine    int `json:"max_line"`
+	MaxMessage int `json:"max_message"`
+
+	RateLimit  float64 `json:"rate_limit"`
+	RateBurst  int     `json:"rate_burst"`
+	FloodLimit int     `json:"flood_limit"`
+
+	RoleLimits map[string]RoleLimit `json:"role_limits"`
+
+	SpamWindow  Duration `json:"spam_window"`
+	SpamRepeats int      `json:"spam_repeats"`
+	SpamRooms   int      `json:"spam_rooms"`
+	SpamStrikes int      `json:"spam_strikes"`
+	SpamMute    Duration `json:"spam_mute"`
+
+	PingInterval Duration `json:"ping_interval"`
+	PingTimeout  Duration `json:"ping_timeout"`
+	IdleTimeout  Duration `json:"idle_timeout"`
+}
+
+// Duration is a time.Duration written as a string like "30s" in config
+// files.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+
+	if err != nil {
+		return err
+	}
+
+	d.Duration = parsed
+	return nil
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Addr: ":12345",
+
+		ACMECache: "acme-cache",
+
+		ServerName:  defaultServerName(),
+		BridgeNick:  "chatbridge",
+		InboundNick: "bot",
+
+		MaxUpload:       10 << 20,
+		UploadRetention: Duration{7 * 24 * time.Hour},
+
+		DrainTimeout: Duration{time.Minute},
+
+		FilterAction: FilterMask,
+
+		ScriptTimeout: Duration{100 * time.Millisecond},
+
+		LogLevel:  slog.LevelInfo,
+		LogFormat: "text",
+
+		ChurnLimit:   20,
+		ChurnWindow:  Duration{10 * time.Second},
+		ChurnPenalty: Duration{30 * time.Second},
+
+		MaxConnsPerIP: 10,
+
+		TimeFormat:  time.RFC1123Z,
+		StampFormat: time.TimeOnly,
+		Timezone:    "Local",
+
+		PollDuration: Duration{5 * time.Minute},
+		NickGrace:    Duration{30 * time.Second},
+		SessionGrace: Duration{2 * time.Minute},
+		EditWindow:   Duration{15 * time.Minute},
+		HistorySize:  20,
+
+		OutgoingBuffer: 256,
+		SlowClients:    "disconnect",
+
+		MaxLine:    4096,
+		MaxMessage: 1000,
+
+		RateLimit:  5,
+		RateBurst:  10,
+		FloodLimit: 50,
+
+		SpamWindow:  Duration{30 * time.Second},
+		SpamRepeats: 3,
+		SpamRooms:   5,
+		SpamStrikes: 3,
+		SpamMute:    Duration{5 * time.Minute},
+
+		PingInterval: Duration{time.Minute},
+		PingTimeout:  Duration{30 * time.Second},
+	}
+}
+
+func (config *Config) flagSet(name string, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, errorHandling)
+
+	flags.String("config", "", "JSON config file, or TOML if it ends in .toml; flags given on the command line override it. Reloaded on SIGHUP, though listener changes need a restart")
+
+	flags.StringVar(&config.Addr, "addr", config.Addr, "address for the plaintext listener")
+	flags.StringVar(&config.UnixPath, "unix", config.UnixPath, "path of a Unix socket to listen on as well, e.g. /run/chatserver.sock")
+	flags.Var(&listenersFlag{listeners: &config.Listeners}, "listen", "an extra listener as name=addr, optionally followed by ,tls ,require-account, ,opers-only and ,quiet; may be given more than once")
+	flags.StringVar(&config.TLSAddr, "tls-addr", config.TLSAddr, "address for an additional TLS listener, e.g. :12346")
+	flags.StringVar(&config.TLSCert, "tls-cert", config.TLSCert, "TLS certificate file (PEM)")
+	flags.StringVar(&config.TLSKey, "tls-key", config.TLSKey, "TLS private key file (PEM)")
+	flags.StringVar(&config.ACMEDomain, "acme-domain", config.ACMEDomain, "domain, or comma separated domains, to get TLS certificates for from Let's Encrypt instead of -tls-cert and -tls-key")
+	flags.StringVar(&config.ACMECache, "acme-cache", config.ACMECache, "directory to keep ACME certificates and account keys in")
+	flags.StringVar(&config.ACMEEmail, "acme-email", config.ACMEEmail, "contact address for the ACME account, for expiry warnings")
+	flags.StringVar(&config.ACMEHTTPAddr, "acme-http-addr", config.ACMEHTTPAddr, "address to answer ACME HTTP challenges on, e.g. :80")
+	flags.StringVar(&config.TLSClientCA, "tls-client-ca", config.TLSClientCA, "CA bundle (PEM) for client certificates on the TLS listener; a verified certificate logs its holder in as the nick it names")
+	flags.BoolVar(&config.TLSRequireClientCert, "tls-require-client-cert", config.TLSRequireClientCert, "refuse TLS clients without a certificate signed by the client CA")
+	flags.StringVar(&config.WSAddr, "ws-addr", config.WSAddr, "address for a WebSocket gateway for browser clients, e.g. :8080")
+	flags.StringVar(&config.IRCAddr, "irc-addr", config.IRCAddr, "address for an IRC compatible listener, e.g. :6667")
+	flags.StringVar(&config.GRPCAddr, "grpc-addr", config.GRPCAddr, "address for the gRPC API, e.g. :9090")
+	flags.BoolVar(&config.ProxyProtocol, "proxy-protocol", config.ProxyProtocol, "expect a PROXY protocol v1 or v2 header on every client connection, as sent by HAProxy and most load balancers")
+	flags.StringVar(&config.AdminAddr, "admin-addr", config.AdminAddr, "address for the admin HTTP API, e.g. 127.0.0.1:8081")
+	flags.StringVar(&config.AdminToken, "admin-token", config.AdminToken, "bearer token required by the admin HTTP API")
+	flags.StringVar(&config.ConsoleAddr, "console", config.ConsoleAddr, "Unix socket path or loopback address for the admin console, e.g. /run/chatserver-console.sock or 127.0.0.1:8090")
+	flags.StringVar(&config.MetricsAddr, "metrics-addr", config.MetricsAddr, "address to serve Prometheus metrics on at /metrics, and health checks at /healthz and /readyz, e.g. 127.0.0.1:9100")
+	flags.StringVar(&config.RedisAddr, "redis-addr", config.RedisAddr, "Redis server for sharing rooms, nicks and bans with other nodes, e.g. 127.0.0.1:6379")
+	flags.StringVar(&config.RedisPassword, "redis-password", config.RedisPassword, "password to send Redis with AUTH")
+	flags.StringVar(&config.ServerName, "server-name", config.ServerName, "name linked servers show this server's users under, as nick@name")
+	flags.StringVar(&config.LinkAddr, "link-addr", config.LinkAddr, "address to accept links from other servers on, e.g. :12350")
+	flags.StringVar(&config.Links, "links", config.Links, "comma separated addresses of servers to link to; set each pair up from one side only")
+	flags.StringVar(&config.LinkPassword, "link-password", config.LinkPassword, "password linked servers must share")
+	flags.StringVar(&config.BridgeAddr, "bridge-addr", config.BridgeAddr, "IRC server to bridge rooms with, e.g. irc.libera.chat:6697")
+	flags.BoolVar(&config.BridgeTLS, "bridge-tls", config.BridgeTLS, "connect to the IRC bridge server over TLS")
+	flags.StringVar(&config.BridgeNick, "bridge-nick", config.BridgeNick, "nick the IRC bridge uses on the IRC server")
+	flags.StringVar(&config.BridgeChannels, "bridge-channels", config.BridgeChannels, "comma separated IRC channels to bridge, as #channel=room or #room")
+	flags.StringVar(&config.Webhooks, "webhooks", config.Webhooks, "comma separated room=url webhooks POSTed a JSON event for every message, join and part in the room (* for every room)")
+	flags.StringVar(&config.NotifyURL, "notify-url", config.NotifyURL, "URL POSTed a JSON notification when a registered user who is offline is mentioned or sent a private message, for push notifications")
+	flags.StringVar(&config.InboundAddr, "inbound-addr", config.InboundAddr, "address for an HTTP endpoint that posts into rooms with POST /rooms/<room>/messages, e.g. 127.0.0.1:8082")
+	flags.StringVar(&config.InboundToken, "inbound-token", config.InboundToken, "bearer token required by the inbound HTTP endpoint")
+	flags.StringVar(&config.InboundNick, "inbound-nick", config.InboundNick, "nick messages posted over HTTP appear from")
+	flags.StringVar(&config.StreamAddr, "stream-addr", config.StreamAddr, "address for an HTTP endpoint that streams a room's messages as server-sent events with GET /rooms/<room>/stream and searches them with GET /rooms/<room>/search?q=, e.g. 127.0.0.1:8083")
+	flags.StringVar(&config.StreamToken, "stream-token", config.StreamToken, "token required by the stream endpoint, as a bearer token or ?token=; empty means anyone can read public rooms")
+	flags.StringVar(&config.UploadAddr, "upload-addr", config.UploadAddr, "address for an HTTP endpoint that takes file uploads with POST /files?name=<filename> and serves them at /files/<id>, e.g. :8084")
+	flags.StringVar(&config.UploadDir, "upload-dir", config.UploadDir, "directory uploaded files are kept in")
+	flags.StringVar(&config.UploadURL, "upload-url", config.UploadURL, "public URL of the upload endpoint links are made from, e.g. https://files.example.org (defaults to http://<upload addr>)")
+	flags.Int64Var(&config.MaxUpload, "max-upload", config.MaxUpload, "largest file in bytes that can be uploaded")
+	flags.DurationVar(&config.UploadRetention.Duration, "upload-retention", config.UploadRetention.Duration, "how long uploaded files are kept (0 keeps them forever)")
+	flags.StringVar(&config.MatrixAddr, "matrix-addr", config.MatrixAddr, "address for the Matrix application service API the homeserver pushes to, e.g. 127.0.0.1:9009")
+	flags.StringVar(&config.MatrixHomeserver, "matrix-homeserver", config.MatrixHomeserver, "URL of the Matrix homeserver, e.g. https://matrix.example.org")
+	flags.StringVar(&config.MatrixUser, "matrix-user", config.MatrixUser, "Matrix user ID the bridge posts as, e.g. @chatbridge:example.org")
+	flags.StringVar(&config.MatrixASToken, "matrix-as-token", config.MatrixASToken, "application service token the bridge sends to the homeserver")
+	flags.StringVar(&config.MatrixHSToken, "matrix-hs-token", config.MatrixHSToken, "token the homeserver must send to the bridge")
+	flags.StringVar(&config.MatrixRooms, "matrix-rooms", config.MatrixRooms, "comma separated Matrix rooms to bridge, as !roomid:server=room")
+	flags.BoolVar(&config.Handoff, "handoff", config.Handoff, "on SIGUSR2, pass the listeners to a new process and drain (Unix only)")
+	flags.DurationVar(&config.DrainTimeout.Duration, "drain-timeout", config.DrainTimeout.Duration, "how long to wait for clients to leave after a handoff")
+	flags.StringVar(&config.RulesPath, "rules", config.RulesPath, "file with rules clients must accept before joining rooms")
+	flags.StringVar(&config.MOTDPath, "motd", config.MOTDPath, "file with a message of the day sent to clients when they connect, reloaded on SIGHUP")
+	flags.StringVar(&config.FilterPath, "filter", config.FilterPath, "file of words and /regexps/ to filter from room messages, reloaded on SIGHUP")
+	flags.StringVar(&config.FilterAction, "filter-action", config.FilterAction, "what to do with filtered messages: mask, reject or flag (tell operators)")
+	flags.StringVar(&config.ScriptsDir, "scripts", config.ScriptsDir, "directory of Lua scripts that hook room messages and add commands")
+	flags.DurationVar(&config.ScriptTimeout.Duration, "script-timeout", config.ScriptTimeout.Duration, "how long a script hook or command may run")
+	flags.TextVar(&config.LogLevel, "log-level", config.LogLevel, "minimum level to log: debug, info, warn or error")
+	flags.StringVar(&config.LogFormat, "log-format", config.LogFormat, "log output format: text or json")
+	flags.IntVar(&config.ChurnLimit, "churn-limit", config.ChurnLimit, "connections allowed from one IP per churn window (0 disables)")
+	flags.DurationVar(&config.ChurnWindow.Duration, "churn-window", config.ChurnWindow.Duration, "window for counting connections from one IP")
+	flags.DurationVar(&config.ChurnPenalty.Duration, "churn-penalty", config.ChurnPenalty.Duration, "how long to refuse an IP that exceeds the churn limit")
+	flags.IntVar(&config.MaxConnsPerIP, "max-conns-per-ip", config.MaxConnsPerIP, "connections one IP may hold open at once (0 disables)")
+	flags.StringVar(&config.AllowCIDRs, "allow-cidrs", config.AllowCIDRs, "comma separated IPs and CIDR ranges connections may come from; if this or -allow-countries is set, everywhere else is refused")
+	flags.StringVar(&config.DenyCIDRs, "deny-cidrs", config.DenyCIDRs, "comma separated IPs and CIDR ranges to refuse connections from, even if allowed otherwise")
+	flags.StringVar(&config.GeoIPPath, "geoip", config.GeoIPPath, "MaxMind country database (.mmdb) for -allow-countries and -deny-countries")
+	flags.StringVar(&config.AllowCountries, "allow-countries", config.AllowCountries, "comma separated ISO country codes connections may come from, e.g. US,CA")
+	flags.StringVar(&config.DenyCountries, "deny-countries", config.DenyCountries, "comma separated ISO country codes to refuse connections from")
+	flags.StringVar(&config.BansPath, "bans", config.BansPath, "file of banned IPs and CIDR ranges, kept up to date by ban-ip and unban-ip")
+	flags.StringVar(&config.AccountsPath, "accounts", config.AccountsPath, "file of registered nicks and password hashes (kept in memory only if empty)")
+	flags.StringVar(&config.RoomsPath, "rooms", config.RoomsPath, "file of registered rooms and their settings (kept in memory only if empty)")
+	flags.StringVar(&config.AuditPath, "audit", config.AuditPath, "file to append kicks, bans, mode changes and other moderation and admin actions to (kept in memory only if empty)")
+	flags.StringVar(&config.OperPassword, "oper-password", config.OperPassword, "password for the oper command (operators disabled if empty)")
+	flags.StringVar(&config.TimeFormat, "time-format", config.TimeFormat, "Go time layout used by the time command")
+	flags.StringVar(&config.StampFormat, "stamp-format", config.StampFormat, "Go time layout for the timestamp on plain text room messages (none if empty)")
+	flags.StringVar(&config.Timezone, "timezone", config.Timezone, "IANA time zone for times shown to clients, e.g. UTC or Local")
+	flags.DurationVar(&config.PollDuration.Duration, "poll-duration", config.PollDuration.Duration, "how long polls stay open")
+	flags.DurationVar(&config.NickGrace.Duration, "nick-grace", config.NickGrace.Duration, "how long someone using a protected registered nick has to log in")
+	flags.BoolVar(&config.ConfusableNicks, "confusable-nicks", config.ConfusableNicks, "refuse nicks that look like one in use or registered, such as a Cyrillic а for a Latin a; costs a pass over every nick on each nick change")
+	flags.DurationVar(&config.SessionGrace.Duration, "session-grace", config.SessionGrace.Duration, "how long a dropped client has to reconnect and resume its session (0 disables)")
+	flags.DurationVar(&config.EditWindow.Duration, "edit-window", config.EditWindow.Duration, "how long after sending a message its sender can edit or delete it; 0 turns editing off")
+	flags.IntVar(&config.HistorySize, "history", config.HistorySize, "number of recent messages per room replayed to clients when they join")
+	flags.StringVar(&config.StorePath, "store", config.StorePath, "file to persist room messages in: a SQLite database if it ends in .db, .sqlite or .sqlite3, otherwise JSON lines (disabled if empty)")
+
+	flags.IntVar(&config.OutgoingBuffer, "outgoing-buffer", config.OutgoingBuffer, "events queued per client before it counts as too slow")
+	flags.StringVar(&config.SlowClients, "slow-clients", config.SlowClients, "what to do when a client's buffer is full: drop events or disconnect")
+	flags.IntVar(&config.MaxLine, "max-line", config.MaxLine, "longest line in bytes a client may send; longer ones are refused, and clients that keep sending them are disconnected")
+	flags.IntVar(&config.MaxMessage, "max-message", config.MaxMessage, "longest message in characters a client may send (0 for no limit)")
+	flags.Float64Var(&config.RateLimit, "rate-limit", config.RateLimit, "lines per second each client may send on average (0 disables)")
+	flags.IntVar(&config.RateBurst, "rate-burst", config.RateBurst, "lines a client may send at once before the rate limit applies")
+	flags.IntVar(&config.FloodLimit, "flood-limit", config.FloodLimit, "throttled lines in a row before a client is disconnected (0 never)")
+	flags.Var(&roleLimitsFlag{limits: &config.RoleLimits}, "role-limit", "messages a minute, and optionally a day, clients with a role may send, as role=per_minute[/daily], e.g. guest=10/500; may be given once for each role")
+	flags.DurationVar(&config.SpamWindow.Duration, "spam-window", config.SpamWindow.Duration, "window for spotting repeated and bulk messages (0 disables)")
+	flags.IntVar(&config.SpamRepeats, "spam-repeats", config.SpamRepeats, "identical messages a client may send in the spam window (0 for no limit)")
+	flags.IntVar(&config.SpamRooms, "spam-rooms", config.SpamRooms, "rooms a client may send to in the spam window (0 for no limit)")
+	flags.IntVar(&config.SpamStrikes, "spam-strikes", config.SpamStrikes, "spam messages dropped in a row before a client is muted")
+	flags.DurationVar(&config.SpamMute.Duration, "spam-mute", config.SpamMute.Duration, "how long spammers are muted for (0 never mutes)")
+	flags.DurationVar(&config.PingInterval.Duration, "ping-interval", config.PingInterval.Duration, "ping clients that have sent nothing for this long (0 disables)")
+	flags.DurationVar(&config.PingTimeout.Duration, "ping-timeout", config.PingTimeout.Duration, "disconnect clients that don't answer a ping within this long")
+	flags.DurationVar(&config.IdleTimeout.Duration, "idle-timeout", config.IdleTimeout.Duration, "disconnect clients that send no commands but pong for this long (0 disables)")
+
+	return flags
+}
+
+// LoadConfig builds a Config from command line arguments, reading the file
+// named by -config if there is one.
+func LoadConfig(name string, args []string) (*Config, error) {
+	config := DefaultConfig()
+	flags := config.flagSet(name, flag.ExitOnError)
+
+	flags.Parse(args)
+
+	path := flags.Lookup("config").Value.String()
+
+	if path == "" {
+		return config, nil
+	}
+
+	fromFile := DefaultConfig()
+	err := fromFile.load(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Replay the flags that were actually given on top of the file.
+	overrides := fromFile.flagSet(name, flag.ContinueOnError)
+
+	flags.Visit(func(f *flag.Flag) {
+		if err == nil {
+			err = overrides.Set(f.Name, f.Value.String())
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fromFile, nil
+}
+
+// load reads the config file at path over config. A TOML file uses the
+// same keys as a JSON one; it is turned into JSON first, so both are
+// decoded, and checked for unknown keys, the same way.
+func (config *Config) load(path string) error {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	if filepath.Ext(path) == ".toml" {
+		var settings map[string]any
+
+		_, err = toml.Decode(string(data), &settings)
+
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		data, err = json.Marshal(settings)
+
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(config)
+
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+// defaultServerName is the first part of the host name, which is usually
+// enough to tell linked servers apart.
+func defaultServerName() string {
+	host, err := os.Hostname()
+
+	if err != nil {
+		return "chatserver"
+	}
+
+	host, _, _ = strings.Cut(host, ".")
+
+	return host
+}
@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// confusables maps characters that look like a Latin letter or digit to the
+// one they look like. It is the part of Unicode's confusables.txt that
+// matters most for nicks: Cyrillic and Greek letters that are drawn the
+// same as Latin ones, and the digits and letters easily mistaken for each
+// other. NFKC already takes care of fullwidth, mathematical and other
+// compatibility forms.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'г': 'r', 'е': 'e', 'ё': 'e', 'з': '3',
+	'і': 'l', 'ї': 'l', 'ј': 'j', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'п': 'n', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's',
+	'ԁ': 'd', 'һ': 'h', 'ӏ': 'l', 'ԛ': 'q', 'ԝ': 'w', 'ь': 'b', 'ү': 'y',
+
+	// Greek
+	'α': 'a', 'β': 'b', 'γ': 'y', 'ε': 'e', 'η': 'n', 'ι': 'l', 'κ': 'k',
+	'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+	'ϲ': 'c', 'ϳ': 'j',
+
+	// Latin and digits
+	'0': 'o', '1': 'l', 'i': 'l', 'ı': 'l', '5': 's', 'ɡ': 'g',
+}
+
+// skeleton is what name looks like, for telling whether two names could be
+// mistaken for each other: its NFKC form, lower case, with lookalike
+// characters replaced by the one they imitate and rn read as m.
+func skeleton(name string) string {
+	name = strings.ToLower(norm.NFKC.String(name))
+
+	name = strings.Map(func(r rune) rune {
+		if to, ok := confusables[r]; ok {
+			return to
+		}
+
+		return r
+	}, name)
+
+	return strings.ReplaceAll(name, "rn", "m")
+}
+
+// confusableNick finds a nick in use, or a registered one, that nick could
+// be mistaken for, other than client's own. It returns "" if there isn't
+// one. Names that fold the same are left to the usual checks.
+func (server *Server) confusableNick(client *Client, nick string) string {
+	want := skeleton(nick)
+
+	for _, holder := range server.nicks.Values() {
+		if holder != client && !sameName(holder.nick(), nick) && skeleton(holder.nick()) == want {
+			return holder.nick()
+		}
+	}
+
+	for _, account := range server.accounts.accounts {
+		if !sameName(account.Nick, nick) && !sameName(account.Nick, client.account) && skeleton(account.Nick) == want {
+			return account.Nick
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,260 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const consoleHelp = `Commands:
+clients - list connections with their addresses and rooms
+kill <id> [reason] - disconnect a client
+wall <message> - send a notice to every client
+close <room> [reason] - close a room, removing everyone in it
+reload - reload the config, message of the day and word filter, as SIGHUP does
+quit - leave the console`
+
+// The console is a plain text admin interface for whoever runs the server.
+// It has no password: it is only reachable on a Unix socket, which file
+// permissions protect, or on a loopback address, so being able to connect
+// means being on the machine.
+
+// checkConsoleAddr makes sure a TCP console address can't be reached from
+// other machines.
+func checkConsoleAddr(addr string) error {
+	if addrNetwork(addr) == "unix" {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return fmt.Errorf("console address: %v", err)
+	}
+
+	ip := net.ParseIP(host)
+
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("console address %q must be a Unix socket path or a loopback address", addr)
+	}
+
+	return nil
+}
+
+// ServeConsole runs an admin console for each connection to listener. A
+// Unix socket is made accessible only to the user running the server.
+func (server *Server) ServeConsole(listener net.Listener) error {
+	if listener.Addr().Network() == "unix" {
+		err := os.Chmod(listener.Addr().String(), 0600)
+
+		if err != nil {
+			slog.Error("restricting console socket", "err", err)
+		}
+	}
+
+	return server.acceptLoop(listener, func(conn net.Conn) {
+		if conn.LocalAddr().Network() != "unix" {
+			ip := net.ParseIP(remoteIP(conn))
+
+			if ip == nil || !ip.IsLoopback() {
+				slog.Info("refusing console connection", "addr", conn.RemoteAddr().String())
+				conn.Close()
+				return
+			}
+		}
+
+		go server.runConsole(conn)
+	})
+}
+
+func (server *Server) runConsole(conn net.Conn) {
+	defer conn.Close()
+
+	slog.Info("console opened", "addr", conn.RemoteAddr().String())
+	defer slog.Info("console closed", "addr", conn.RemoteAddr().String())
+
+	scanner := bufio.NewScanner(conn)
+	io.WriteString(conn, "chatserver "+version+" console. Type help for commands\n")
+
+	for scanner.Scan() {
+		verb, rest, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		rest = strings.TrimSpace(rest)
+
+		if verb == "" {
+			continue
+		}
+
+		if strings.EqualFold(verb, "quit") {
+			return
+		}
+
+		reply := server.consoleCommand(strings.ToLower(verb), rest)
+		_, err := io.WriteString(conn, reply+"\n")
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// consoleCommand runs one console command and returns what to print.
+func (server *Server) consoleCommand(verb, rest string) string {
+	switch verb {
+	case "help":
+		return consoleHelp
+	case "clients":
+		return server.consoleClients()
+	case "kill":
+		return server.consoleKill(rest)
+	case "wall":
+		return server.consoleWall(rest)
+	case "close":
+		return server.consoleClose(rest)
+	case "reload":
+		return server.consoleReload()
+	default:
+		return "Unknown command " + verb + ". Type help for commands"
+	}
+}
+
+func (server *Server) consoleClients() string {
+	var lines []string
+
+	server.call(func() {
+		for _, client := range server.clients.Sorted() {
+			rooms := make([]string, 0, len(client.rooms))
+
+			for name := range client.rooms {
+				rooms = append(rooms, name)
+			}
+
+			sort.Strings(rooms)
+
+			line := fmt.Sprintf("%d %s %s", client.id, client.Name(), client.conn.RemoteAddr())
+
+			if client.account != "" {
+				line += " account=" + client.account
+			}
+
+			if len(rooms) > 0 {
+				line += " in " + strings.Join(rooms, ", ")
+			}
+
+			lines = append(lines, line)
+		}
+	})
+
+	if len(lines) == 0 {
+		return "No clients connected"
+	}
+
+	return fmt.Sprintf("%d connected:\n%s", len(lines), strings.Join(lines, "\n"))
+}
+
+func (server *Server) consoleKill(rest string) string {
+	arg, reason, _ := strings.Cut(rest, " ")
+	id, err := strconv.ParseUint(arg, 10, 64)
+
+	if err != nil {
+		return "Usage: kill <id> [reason]"
+	}
+
+	reason = strings.TrimSpace(reason)
+
+	if reason == "" {
+		reason = "Disconnected by an administrator"
+	}
+
+	var nick string
+
+	server.call(func() {
+		client, exists := server.clients.Get(id)
+
+		if exists {
+			nick = client.Name()
+			client.logger().Info("disconnected from the console")
+			server.audit("console", "kill", "", nick, reason)
+			server.evict(client, reason)
+		}
+	})
+
+	if nick == "" {
+		return "No client with id " + arg
+	}
+
+	return "Disconnected " + nick
+}
+
+func (server *Server) consoleWall(text string) string {
+	if text == "" {
+		return "Usage: wall <message>"
+	}
+
+	var count int
+
+	server.call(func() {
+		slog.Info("wall sent from the console", "text", text)
+		server.audit("console", "wall", "", "", text)
+
+		for _, client := range server.clients.Sorted() {
+			client.Notice("", "Server notice: "+text)
+			count++
+		}
+	})
+
+	return fmt.Sprintf("Sent to %d clients", count)
+}
+
+func (server *Server) consoleClose(rest string) string {
+	name, reason, _ := strings.Cut(rest, " ")
+
+	if name == "" {
+		return "Usage: close <room> [reason]"
+	}
+
+	reason = strings.TrimSpace(reason)
+
+	if reason == "" {
+		reason = "Room closed by an administrator"
+	}
+
+	var closed string
+
+	server.call(func() {
+		room, exists := server.LookupRoom(name)
+
+		if exists {
+			closed = room.name
+			slog.Info("room closed from the console", "room", room.name)
+			server.audit("console", "close", room.name, "", reason)
+			server.CloseRoom(room, reason)
+		}
+	})
+
+	if closed == "" {
+		return "No room named " + name
+	}
+
+	return "Closed " + closed
+}
+
+func (server *Server) consoleReload() string {
+	var err error
+
+	server.call(func() {
+		server.audit("console", "reload", "", "", "")
+		err = server.reload()
+	})
+
+	if err != nil {
+		return "Reload failed: " + err.Error()
+	}
+
+	return "Reloaded"
+}
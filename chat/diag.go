@@ -0,0 +1,81 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// DiagCommand shows how messages to a room would get through to each of
+// its members, to find the slow or stuck client holding up a room. It
+// only looks: nothing is sent to the members.
+type DiagCommand struct {
+	client *Client
+	room   string
+}
+
+func (cmd *DiagCommand) Run(server *Server) {
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		cmd.client.Error("Room doesn't exist")
+		return
+	}
+
+	now := time.Now()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d members, %d/%d tasks queued for the room\n", room.name, len(room.clients), len(room.incoming), cap(room.incoming))
+
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NICK\tQUEUE\tDROPPED\tLAST READ\tIDLE\tDELIVERY")
+
+	for _, member := range room.clients {
+		fmt.Fprintf(w, "%s\t%d/%d\t%d\t%v\t%v\t%s\n",
+			plainName(member.Name()),
+			len(member.outgoing), cap(member.outgoing),
+			member.dropped.Load(),
+			now.Sub(time.Unix(0, member.lastRead.Load())).Truncate(time.Second),
+			now.Sub(time.Unix(0, member.lastActive.Load())).Truncate(time.Second),
+			server.delivery(member, now))
+	}
+
+	w.Flush()
+
+	cmd.client.Reply(strings.TrimSuffix(b.String(), "\n"))
+}
+
+// delivery says what would happen to a message sent to client now.
+func (server *Server) delivery(client *Client, now time.Time) string {
+	select {
+	case <-client.done:
+		return "closed"
+	default:
+	}
+
+	if reason := client.evicted.Load(); reason != nil {
+		return "disconnecting: " + *reason
+	}
+
+	if len(client.outgoing) >= cap(client.outgoing) {
+		if server.dropSlow {
+			return "would drop, queue full"
+		}
+
+		return "would disconnect, queue full"
+	}
+
+	if !client.pinged.IsZero() {
+		return fmt.Sprintf("queued, ping unanswered for %v", now.Sub(client.pinged).Truncate(time.Second))
+	}
+
+	return "ok"
+}
+
+func parseDiag(client *Client, args []string) Command {
+	return &DiagCommand{
+		client: client,
+		room:   args[0],
+	}
+}
@@ -0,0 +1,202 @@
+package chat
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// EditCommand replaces the text of a message its sender sent to a room,
+// if it is recent enough. Members are sent an edit event with the new
+// text, and history keeps the edited version.
+type EditCommand struct {
+	client *Client
+	room   string
+	id     uint64
+	text   string
+}
+
+func (cmd *EditCommand) Run(server *Server) {
+	client := cmd.client
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		client.Error("Room doesn't exist")
+		return
+	}
+
+	if !room.HasClient(client) {
+		client.Error("You are not in that room")
+		return
+	}
+
+	if !server.CheckLength(client, cmd.text) {
+		return
+	}
+
+	if server.editWindow <= 0 {
+		client.Error("Editing messages is turned off")
+		return
+	}
+
+	text, ok := server.FilterMessage(room, client, cmd.text)
+
+	if !ok {
+		return
+	}
+
+	nick, window := client.nick(), server.editWindow
+	ignoring := server.ignoring(room, nick)
+
+	room.do(func() {
+		msg := room.history.Find(cmd.id)
+
+		if msg == nil || !sameName(msg.nick, nick) {
+			client.Error("You can only edit your own recent messages")
+			return
+		}
+
+		if time.Since(msg.time) > window {
+			client.Error("That message is too old to edit")
+			return
+		}
+
+		edited := *msg
+		edited.text = text
+		edited.edited = true
+		room.history.Replace(&edited)
+
+		if server.store != nil {
+			err := server.store.EditMessage(&edited)
+
+			if err != nil {
+				slog.Error("saving edit", "room", room.name, "err", err)
+			}
+		}
+
+		room.sendChange(&Event{
+			Type:   EventEdit,
+			ID:     edited.id,
+			Time:   time.Now().In(server.timeLocation),
+			Room:   room.name,
+			Nick:   edited.nick,
+			Text:   edited.text,
+			Edited: true,
+		}, ignoring)
+	})
+}
+
+// DeleteCommand removes a message from a room's history. Senders can
+// delete their own messages within the edit window, and room operators
+// any message still in history.
+type DeleteCommand struct {
+	client *Client
+	room   string
+	id     uint64
+}
+
+func (cmd *DeleteCommand) Run(server *Server) {
+	client := cmd.client
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		client.Error("Room doesn't exist")
+		return
+	}
+
+	if !room.HasClient(client) {
+		client.Error("You are not in that room")
+		return
+	}
+
+	op := room.IsOp(client)
+
+	if server.editWindow <= 0 && !op {
+		client.Error("Deleting messages is turned off")
+		return
+	}
+
+	nick, window := client.nick(), server.editWindow
+
+	room.do(func() {
+		msg := room.history.Find(cmd.id)
+		own := msg != nil && sameName(msg.nick, nick)
+
+		if msg == nil || (!own && !op) {
+			client.Error("You can only delete your own recent messages")
+			return
+		}
+
+		if !op && time.Since(msg.time) > window {
+			client.Error("That message is too old to delete")
+			return
+		}
+
+		room.history.Remove(msg.id)
+
+		if server.store != nil {
+			err := server.store.DeleteMessages(room.name, msg.id)
+
+			if err != nil {
+				slog.Error("saving deletion", "room", room.name, "err", err)
+			}
+		}
+
+		slog.Info("deleted message", "room", room.name, "id", msg.id, "by", nick)
+
+		if !own {
+			server.audit(nick, "delete message", room.name, msg.nick, fmt.Sprintf("message %d: %s", msg.id, msg.text))
+		}
+
+		room.sendChange(&Event{
+			Type: EventDelete,
+			ID:   msg.id,
+			Time: time.Now().In(server.timeLocation),
+			Room: room.name,
+			Nick: nick,
+		}, nil)
+	})
+}
+
+// sendChange tells the room's members and streams about a change to a
+// message, leaving out anyone ignoring its sender. It must be called on
+// the room's goroutine.
+func (room *Room) sendChange(event *Event, ignoring map[*Client]bool) {
+	for _, member := range room.recipients {
+		if !ignoring[member] {
+			member.Send(event)
+		}
+	}
+
+	room.sendStreams(event)
+}
+
+func parseEdit(client *Client, args []string) Command {
+	id, err := strconv.ParseUint(args[1], 10, 64)
+
+	if err != nil {
+		return nil
+	}
+
+	return &EditCommand{
+		client: client,
+		room:   args[0],
+		id:     id,
+		text:   args[2],
+	}
+}
+
+func parseDelete(client *Client, args []string) Command {
+	id, err := strconv.ParseUint(args[1], 10, 64)
+
+	if err != nil {
+		return nil
+	}
+
+	return &DeleteCommand{
+		client: client,
+		room:   args[0],
+		id:     id,
+	}
+}
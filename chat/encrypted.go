@@ -0,0 +1,154 @@
+package chat
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// maxKeyBundle is the longest key bundle, in base64, a client can publish.
+const maxKeyBundle = 8192
+
+// In an encrypted room the server can't read what members send. Message
+// text has to be a base64 payload, which is passed on exactly as it
+// arrived: the word filter and mentions leave it alone. The server's only
+// part in the encryption is passing on the key bundles members publish,
+// which are just as opaque to it.
+
+// EncryptedCommand turns a room's encrypted mode on or off.
+type EncryptedCommand struct {
+	client *Client
+	room   string
+	on     bool
+}
+
+func (cmd *EncryptedCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil || room.encrypted == cmd.on {
+		return
+	}
+
+	room.encrypted = cmd.on
+	server.saveRoom(room)
+
+	mode, text := "+E", "%s made %s an encrypted room; messages must be base64 payloads"
+
+	if !cmd.on {
+		mode, text = "-E", "%s made %s a plain room again"
+	}
+
+	cmd.client.logger().Info("changed room mode", "room", room.name, "mode", mode)
+	server.audit(cmd.client.Name(), "mode "+mode, room.name, "", "")
+
+	room.Send(&Event{
+		Type: EventMode,
+		Nick: cmd.client.Name(),
+		Mode: mode,
+		Text: fmt.Sprintf(text, plainName(cmd.client.Name()), plainName(room.name)),
+	})
+}
+
+// checkPayload reports whether text can be sent to an encrypted room.
+func checkPayload(room *Room, client *Client, text string) bool {
+	if !validBase64(text) {
+		client.Error("Messages in " + room.name + " must be base64 encrypted payloads")
+		return false
+	}
+
+	return true
+}
+
+func validBase64(text string) bool {
+	_, err := base64.StdEncoding.DecodeString(text)
+	return text != "" && err == nil
+}
+
+// keyEvent passes on the key bundle client published to a room.
+func (client *Client) keyEvent(room *Room) *Event {
+	return &Event{
+		Type: EventKey,
+		Room: room.name,
+		Nick: client.Name(),
+		Text: client.keyBundle,
+	}
+}
+
+// PublishKeysCommand sets the key bundle other members of encrypted rooms
+// use to encrypt to the client, and hands it out to the encrypted rooms
+// it is in. Rooms it joins later get it then.
+type PublishKeysCommand struct {
+	client *Client
+	bundle string
+}
+
+func (cmd *PublishKeysCommand) Run(server *Server) {
+	cmd.client.keyBundle = cmd.bundle
+
+	for _, room := range cmd.client.rooms {
+		if room.encrypted {
+			room.Send(cmd.client.keyEvent(room))
+		}
+	}
+
+	cmd.client.Reply("Published your key bundle")
+}
+
+// KeysCommand sends a client the key bundles of the members of an
+// encrypted room who have published one.
+type KeysCommand struct {
+	client *Client
+	room   string
+}
+
+func (cmd *KeysCommand) Run(server *Server) {
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		cmd.client.Error("Room doesn't exist")
+		return
+	}
+
+	if !room.HasClient(cmd.client) {
+		cmd.client.Error("You are not in that room")
+		return
+	}
+
+	if !room.encrypted {
+		cmd.client.Error(room.name + " is not an encrypted room")
+		return
+	}
+
+	for _, member := range room.clients {
+		if member.keyBundle != "" {
+			cmd.client.Send(member.keyEvent(room))
+		}
+	}
+
+	cmd.client.Notice(room.name, "End of keys")
+}
+
+func parseEncrypted(client *Client, args []string) Command {
+	return &EncryptedCommand{
+		client: client,
+		room:   args[0],
+		on:     args[1] == "on",
+	}
+}
+
+func parsePublishKeys(client *Client, args []string) Command {
+	if len(args[0]) > maxKeyBundle || !validBase64(args[0]) {
+		return nil
+	}
+
+	return &PublishKeysCommand{
+		client: client,
+		bundle: args[0],
+	}
+}
+
+func parseKeys(client *Client, args []string) Command {
+	return &KeysCommand{
+		client: client,
+		room:   args[0],
+	}
+}
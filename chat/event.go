@@ -0,0 +1,269 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EventMessage = "message"
+	EventPrivate = "pm"
+	EventNotice  = "notice"
+	EventReply   = "reply"
+	EventError   = "error"
+	EventJoin    = "join"
+	EventPart    = "part"
+	EventQuit    = "quit"
+	EventNick    = "nick"
+	EventTopic   = "topic"
+	EventNames   = "names"
+	EventKick    = "kick"
+	EventMode    = "mode"
+	EventInvite  = "invite"
+	EventPing    = "ping"
+	EventMention = "mention"
+	EventTyping  = "typing"
+	EventAck     = "ack"
+	EventEdit    = "edit"
+	EventDelete  = "delete"
+	EventReact   = "react"
+	EventKey     = "key"
+	EventSession = "session"
+	EventMigrate = "migrate"
+)
+
+type Event struct {
+	Type    string    `json:"type"`
+	Seq     uint64    `json:"seq,omitempty"`
+	ID      uint64    `json:"id,omitempty"`
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room,omitempty"`
+	Nick    string    `json:"nick,omitempty"`
+	Text    string    `json:"text"`
+	History bool      `json:"history,omitempty"`
+	Edited  bool      `json:"edited,omitempty"`
+	Parent  uint64    `json:"parent,omitempty"`
+
+	// Reactions counts each emoji reacted to a message with.
+	Reactions map[string]int `json:"reactions,omitempty"`
+	Removed   bool           `json:"removed,omitempty"`
+
+	NewNick string   `json:"new_nick,omitempty"`
+	Topic   string   `json:"topic,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+	Names   []string `json:"names,omitempty"`
+	Target  string   `json:"target,omitempty"`
+	Mode    string   `json:"mode,omitempty"`
+
+	// compress tells the writer to compress everything after this event.
+	compress bool
+
+	// renumber tells the writer to carry on numbering lines from Seq,
+	// rather than to send the event.
+	renumber bool
+}
+
+// Plain renders event as a line of text. Room messages are prefixed with
+// the time they were sent in stampFormat, or with the full date if they are
+// from history. Room names and nicks with spaces or quotes are quoted, so
+// the line can still be split into its parts.
+func (event *Event) Plain(stampFormat string) string {
+	return event.plain(stampFormat, plainName(event.Room), plainName(event.Nick))
+}
+
+// plain renders event with room and nick written as given.
+func (event *Event) plain(stampFormat, room, nick string) string {
+	switch event.Type {
+	case EventMessage:
+		text := event.Text
+
+		if event.Edited {
+			text += " (edited)"
+		}
+
+		if len(event.Reactions) > 0 {
+			text += " " + formatReactions(event.Reactions)
+		}
+
+		if event.Parent != 0 {
+			text = fmt.Sprintf("(re %d) %s", event.Parent, text)
+		}
+
+		line := fmt.Sprintf("%s / %s: %s\n", room, nick, text)
+
+		if event.History {
+			line = fmt.Sprintf("[%s] %s", event.Time.Format(time.DateTime), line)
+		} else if stampFormat != "" {
+			line = fmt.Sprintf("[%s] %s", event.Time.Format(stampFormat), line)
+		}
+
+		return line
+	case EventPrivate:
+		line := fmt.Sprintf("pm / %s: %s\n", nick, event.Text)
+
+		if event.History {
+			line = fmt.Sprintf("[%s] %s", event.Time.Format(time.DateTime), line)
+		}
+
+		return line
+	case EventKey:
+		return fmt.Sprintf("%s *** key %s %s\n", room, nick, event.Text)
+	case EventSession:
+		return fmt.Sprintf("*** To pick up where you left off if your connection drops, reconnect and send: resume %s\n", event.Text)
+	case EventMigrate:
+		return fmt.Sprintf("*** Please reconnect to %s\n", event.Text)
+	case EventEdit:
+		return fmt.Sprintf("%s *** %s edited message %d: %s\n", room, nick, event.ID, event.Text)
+	case EventDelete:
+		return fmt.Sprintf("%s *** %s deleted message %d\n", room, nick, event.ID)
+	case EventReact:
+		verb := "reacted with"
+
+		if event.Removed {
+			verb = "took back"
+		}
+
+		line := fmt.Sprintf("%s *** %s %s %s on message %d", room, nick, verb, event.Text, event.ID)
+
+		if len(event.Reactions) > 0 {
+			line += " " + formatReactions(event.Reactions)
+		}
+
+		return line + "\n"
+	case EventNotice, EventJoin, EventPart, EventQuit, EventNick, EventTopic, EventKick, EventMode, EventInvite, EventMention:
+		if event.Room == "" {
+			return fmt.Sprintf("*** %s\n", event.Text)
+		}
+
+		return fmt.Sprintf("%s *** %s\n", room, event.Text)
+	case EventError:
+		return fmt.Sprintf("Error: %s\n", event.Text)
+	case EventPing:
+		return fmt.Sprintf("PING %s\n", event.Text)
+	default:
+		return event.Text + "\n"
+	}
+}
+
+func (event *Event) JSON() string {
+	data, err := json.Marshal(event)
+
+	if err != nil {
+		return fmt.Sprintf("{\"type\":%q,\"text\":%q}\n", EventError, err.Error())
+	}
+
+	return string(data) + "\n"
+}
+
+type jsonCommand struct {
+	Cmd  string   `json:"cmd"`
+	Room string   `json:"room"`
+	Nick string   `json:"nick"`
+	Args []string `json:"args"`
+	Text string   `json:"text"`
+}
+
+// decodeJSONCommand turns a structured command into the equivalent text
+// line, ordering its fields the way the text commands take them: room,
+// nick, any other arguments, then free text.
+func decodeJSONCommand(line string) (string, error) {
+	var cmd jsonCommand
+
+	err := json.Unmarshal([]byte(line), &cmd)
+
+	if err != nil {
+		return "", err
+	}
+
+	if cmd.Cmd == "" {
+		return "", fmt.Errorf("missing cmd")
+	}
+
+	parts := []string{cmd.Cmd}
+
+	for _, name := range []string{cmd.Room, cmd.Nick} {
+		if name != "" {
+			parts = append(parts, quoteName(name))
+		}
+	}
+
+	for _, part := range cmd.Args {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	if cmd.Text != "" {
+		parts = append(parts, cmd.Text)
+	}
+
+	text := strings.Join(parts, " ")
+
+	if strings.ContainsAny(text, "\r\n") {
+		return "", fmt.Errorf("fields may not contain newlines")
+	}
+
+	return text + "\n", nil
+}
+
+// A Codec translates between a connection's wire format and the server's
+// commands and events. Decode runs on the client's reader goroutine and
+// Encode on its writer goroutine.
+type Codec interface {
+	Decode(server *Server, client *Client, line string) ([]Command, error)
+	Encode(client *Client, event *Event) string
+}
+
+// nativeCodec speaks the server's own protocol, as plain text lines or as
+// JSON once the client asks for it with proto json. JSON events always carry
+// their time as an RFC 3339 string.
+type nativeCodec struct {
+	stampFormat string
+}
+
+func (codec nativeCodec) Decode(server *Server, client *Client, line string) ([]Command, error) {
+	if strings.TrimSpace(line) == "" {
+		return nil, nil
+	}
+
+	cmd, err := server.parse(client, line)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []Command{cmd}, nil
+}
+
+func (codec nativeCodec) Encode(client *Client, event *Event) string {
+	if client.json.Load() {
+		e := *event
+
+		if client.sequenced.Load() {
+			e.Seq = client.seq
+		}
+
+		return e.JSON()
+	}
+
+	// Plain text clients see their own messages come back, so they
+	// don't need acks.
+	if event.Type == EventTyping || event.Type == EventAck {
+		return ""
+	}
+
+	line := event.Plain(codec.stampFormat)
+
+	if client.color.Load() {
+		line = event.Colored(codec.stampFormat)
+	}
+
+	if client.sequenced.Load() {
+		return strconv.FormatUint(client.seq, 10) + " " + line
+	}
+
+	return line
+}
@@ -0,0 +1,424 @@
+package chat
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	linkQueueSize        = 1024
+	linkMaxLine          = 64 << 10
+	linkHandshakeTimeout = 10 * time.Second
+	linkMaxBackoff       = 30 * time.Second
+)
+
+var linkNameRegexp, _ = regexp.Compile("^" + bareNamePattern + "$")
+
+// Federation links this server to other chatservers. Linked servers tell
+// each other who is in which room and pass on room messages, and remote
+// users show up locally as nick@server. Nothing is relayed on beyond the
+// server it came from, so every server should link to every other one.
+// Only the dispatcher adds and removes links, but concurrent commands send
+// on them too.
+type Federation struct {
+	name     string
+	password string
+	links    map[string]*Link
+}
+
+// Link is a connection to one other server. Its rooms are who is in them
+// over there.
+type Link struct {
+	name     string
+	conn     net.Conn
+	outgoing chan *linkMessage
+	rooms    map[string]map[string]bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type linkMessage struct {
+	Type     string    `json:"type"`
+	Server   string    `json:"server,omitempty"`
+	Password string    `json:"password,omitempty"`
+	Room     string    `json:"room,omitempty"`
+	Nick     string    `json:"nick,omitempty"`
+	NewNick  string    `json:"new_nick,omitempty"`
+	Text     string    `json:"text,omitempty"`
+	Time     time.Time `json:"time,omitempty"`
+}
+
+func NewFederation(name, password string) *Federation {
+	return &Federation{
+		name:     name,
+		password: password,
+		links:    make(map[string]*Link),
+	}
+}
+
+func newLink(name string, conn net.Conn) *Link {
+	return &Link{
+		name:     name,
+		conn:     conn,
+		outgoing: make(chan *linkMessage, linkQueueSize),
+		rooms:    make(map[string]map[string]bool),
+		done:     make(chan struct{}),
+	}
+}
+
+// Send queues msg for the other server. A link that can't keep up is
+// dropped rather than left to hold everything up.
+func (link *Link) Send(msg *linkMessage) {
+	select {
+	case link.outgoing <- msg:
+	default:
+		slog.Warn("link too slow, dropping it", "server", link.name)
+		link.Close()
+	}
+}
+
+func (link *Link) Close() {
+	link.closeOnce.Do(func() {
+		close(link.done)
+		link.conn.Close()
+	})
+}
+
+func (link *Link) write() {
+	encoder := json.NewEncoder(link.conn)
+
+	for {
+		select {
+		case msg := <-link.outgoing:
+			if encoder.Encode(msg) != nil {
+				link.Close()
+				return
+			}
+		case <-link.done:
+			return
+		}
+	}
+}
+
+// Display is how a user on the other end of link is named here.
+func (link *Link) Display(nick string) string {
+	return nick + "@" + link.name
+}
+
+// Members lists the remote users in room across every link.
+func (fed *Federation) Members(room string) []string {
+	if fed == nil {
+		return nil
+	}
+
+	var names []string
+
+	for _, link := range fed.links {
+		for nick := range link.rooms[room] {
+			names = append(names, link.Display(nick))
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (fed *Federation) send(msg *linkMessage) {
+	if fed == nil {
+		return
+	}
+
+	for _, link := range fed.links {
+		link.Send(msg)
+	}
+}
+
+// Joined, Parted, Renamed and Message tell the linked servers about
+// changes made by local clients.
+func (fed *Federation) Joined(room, nick string) {
+	fed.send(&linkMessage{Type: "join", Room: room, Nick: nick})
+}
+
+func (fed *Federation) Parted(room, nick string) {
+	fed.send(&linkMessage{Type: "part", Room: room, Nick: nick})
+}
+
+func (fed *Federation) Renamed(nick, newNick string) {
+	fed.send(&linkMessage{Type: "nick", Nick: nick, NewNick: newNick})
+}
+
+func (fed *Federation) Message(message *Message) {
+	fed.send(&linkMessage{Type: "msg", Room: message.room, Nick: message.nick, Text: message.text, Time: message.time})
+}
+
+// ServeLinks accepts links from other servers.
+func (server *Server) ServeLinks(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			fatal("accepting links", err)
+		}
+
+		go func() {
+			err := server.runLink(conn, false)
+			slog.Info("link closed", "addr", conn.RemoteAddr().String(), "err", err)
+		}()
+	}
+}
+
+// DialLink keeps a link to the server at addr up, reconnecting whenever
+// it drops.
+func (server *Server) DialLink(addr string) {
+	backoff := time.Second
+
+	for {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, linkHandshakeTimeout)
+
+		if err == nil {
+			err = server.runLink(conn, true)
+		}
+
+		if time.Since(start) > linkMaxBackoff {
+			backoff = time.Second
+		}
+
+		slog.Info("link closed", "addr", addr, "err", err, "retry", backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, linkMaxBackoff)
+	}
+}
+
+func (server *Server) runLink(conn net.Conn, dialed bool) error {
+	defer conn.Close()
+
+	fed := server.federation
+	reader := bufio.NewReaderSize(conn, linkMaxLine)
+	hello := &linkMessage{Type: "hello", Server: fed.name, Password: fed.password}
+
+	conn.SetDeadline(time.Now().Add(linkHandshakeTimeout))
+
+	// Whoever dialed introduces itself first, so a server never gives the
+	// password away to something that doesn't know it.
+	if dialed {
+		err := json.NewEncoder(conn).Encode(hello)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	line, err := reader.ReadSlice('\n')
+
+	if err != nil {
+		return err
+	}
+
+	var theirs linkMessage
+
+	err = json.Unmarshal(line, &theirs)
+
+	if err != nil || theirs.Type != "hello" {
+		return fmt.Errorf("bad hello")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(theirs.Password), []byte(fed.password)) != 1 {
+		return fmt.Errorf("wrong link password from %q", theirs.Server)
+	}
+
+	if !linkNameRegexp.MatchString(theirs.Server) || theirs.Server == fed.name {
+		return fmt.Errorf("bad server name %q", theirs.Server)
+	}
+
+	if !dialed {
+		err := json.NewEncoder(conn).Encode(hello)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	link := newLink(theirs.Server, conn)
+	defer link.Close()
+
+	go link.write()
+
+	var added bool
+
+	server.call(func() {
+		added = server.addLink(link)
+	})
+
+	if !added {
+		return fmt.Errorf("already linked to %s", link.name)
+	}
+
+	defer server.call(func() {
+		server.removeLink(link)
+	})
+
+	for {
+		line, err := reader.ReadSlice('\n')
+
+		if err != nil {
+			return err
+		}
+
+		var msg linkMessage
+
+		if json.Unmarshal(line, &msg) != nil {
+			continue
+		}
+
+		server.call(func() {
+			server.handleLink(link, &msg)
+		})
+	}
+}
+
+// addLink starts using link and tells the other server who is here.
+func (server *Server) addLink(link *Link) bool {
+	fed := server.federation
+
+	if _, exists := fed.links[link.name]; exists {
+		return false
+	}
+
+	fed.links[link.name] = link
+	slog.Info("linked", "server", link.name, "addr", link.conn.RemoteAddr().String())
+
+	for _, room := range server.Rooms() {
+		for _, client := range room.clients {
+			link.Send(&linkMessage{Type: "join", Room: room.name, Nick: client.Name()})
+		}
+	}
+
+	return true
+}
+
+func (server *Server) removeLink(link *Link) {
+	fed := server.federation
+
+	if fed.links[link.name] != link {
+		return
+	}
+
+	delete(fed.links, link.name)
+
+	for name, nicks := range link.rooms {
+		room, exists := server.LookupRoom(name)
+
+		if !exists {
+			continue
+		}
+
+		for nick := range nicks {
+			room.SendPresence(&Event{
+				Type:   EventPart,
+				Nick:   link.Display(nick),
+				Reason: "Lost link to " + link.name,
+				Text:   fmt.Sprintf("%s left %s (lost link to %s)", plainName(link.Display(nick)), plainName(room.name), link.name),
+			})
+		}
+	}
+}
+
+// handleLink applies a change the other end of link sent us.
+func (server *Server) handleLink(link *Link, msg *linkMessage) {
+	if (msg.Room != "" && !validName(msg.Room)) || !validName(msg.Nick) {
+		return
+	}
+
+	room, _ := server.LookupRoom(msg.Room)
+	nick := link.Display(msg.Nick)
+
+	switch msg.Type {
+	case "join":
+		if link.rooms[msg.Room] == nil {
+			link.rooms[msg.Room] = make(map[string]bool)
+		}
+
+		link.rooms[msg.Room][msg.Nick] = true
+
+		if room != nil {
+			room.SendPresence(&Event{
+				Type: EventJoin,
+				Nick: nick,
+				Text: fmt.Sprintf("%s joined %s", plainName(nick), plainName(room.name)),
+			})
+		}
+	case "part":
+		delete(link.rooms[msg.Room], msg.Nick)
+
+		if len(link.rooms[msg.Room]) == 0 {
+			delete(link.rooms, msg.Room)
+		}
+
+		if room != nil {
+			room.SendPresence(&Event{
+				Type: EventPart,
+				Nick: nick,
+				Text: fmt.Sprintf("%s left %s", plainName(nick), plainName(room.name)),
+			})
+		}
+	case "nick":
+		if !validName(msg.NewNick) {
+			return
+		}
+
+		newNick := link.Display(msg.NewNick)
+
+		for name, nicks := range link.rooms {
+			if !nicks[msg.Nick] {
+				continue
+			}
+
+			delete(nicks, msg.Nick)
+			nicks[msg.NewNick] = true
+
+			if room, exists := server.LookupRoom(name); exists {
+				room.SendPresence(&Event{
+					Type:    EventNick,
+					Nick:    nick,
+					NewNick: newNick,
+					Text:    fmt.Sprintf("%s is now known as %s", plainName(nick), plainName(newNick)),
+				})
+			}
+		}
+	case "msg":
+		if room == nil || msg.Text == "" || strings.ContainsAny(msg.Text, "\r\n") {
+			return
+		}
+
+		if msg.Time.IsZero() {
+			msg.Time = time.Now()
+		}
+
+		server.deliver(room, &Message{
+			id:   room.nextMessageID(),
+			room: room.name,
+			nick: nick,
+			text: msg.Text,
+			time: msg.Time,
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package chat
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	FilterMask   = "mask"
+	FilterReject = "reject"
+	FilterFlag   = "flag"
+)
+
+// WordFilter checks room messages against a list of words and patterns.
+// The list file has one entry a line: a word, matched in any case but only
+// as a whole word, or a regular expression between slashes, matched
+// anywhere. Blank lines and lines starting with # are skipped.
+type WordFilter struct {
+	path    string
+	action  string
+	entries []filterEntry
+}
+
+type filterEntry struct {
+	pattern *regexp.Regexp
+	word    bool
+}
+
+func NewWordFilter(path, action string) (*WordFilter, error) {
+	switch action {
+	case FilterMask, FilterReject, FilterFlag:
+	default:
+		return nil, fmt.Errorf("filter action must be mask, reject or flag, not %q", action)
+	}
+
+	filter := &WordFilter{path: path, action: action}
+
+	return filter, filter.Reload()
+}
+
+// Reload reads the list file again. On error the old list is kept.
+func (filter *WordFilter) Reload() error {
+	text, err := loadTextFile(filter.path)
+
+	if err != nil {
+		return err
+	}
+
+	var entries []filterEntry
+
+	for n, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry := filterEntry{word: true}
+		expr := regexp.QuoteMeta(line)
+
+		if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+			entry.word = false
+			expr = line[1 : len(line)-1]
+		}
+
+		entry.pattern, err = regexp.Compile("(?i)" + expr)
+
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", filter.path, n+1, err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	filter.entries = entries
+	return nil
+}
+
+// Matches finds the parts of text the filter objects to, as start and end
+// byte offsets.
+func (filter *WordFilter) Matches(text string) [][]int {
+	var matches [][]int
+
+	for _, entry := range filter.entries {
+		for _, match := range entry.pattern.FindAllStringIndex(text, -1) {
+			if entry.word && !wholeWord(text, match[0], match[1]) {
+				continue
+			}
+
+			matches = append(matches, match)
+		}
+	}
+
+	return matches
+}
+
+// wholeWord reports whether text[start:end] isn't part of a longer word.
+// The regexp package's \b only knows ASCII, so this is done by hand.
+func wholeWord(text string, start, end int) bool {
+	before, _ := utf8.DecodeLastRuneInString(text[:start])
+	after, _ := utf8.DecodeRuneInString(text[end:])
+
+	return !isWordRune(before) && !isWordRune(after)
+}
+
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_')
+}
+
+// mask replaces every rune inside matches with an asterisk.
+func mask(text string, matches [][]int) string {
+	hidden := make([]bool, len(text))
+
+	for _, match := range matches {
+		for i := match[0]; i < match[1]; i++ {
+			hidden[i] = true
+		}
+	}
+
+	var b strings.Builder
+
+	for i, r := range text {
+		if hidden[i] {
+			b.WriteRune('*')
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// FilterMessage applies the filter, then any scripts, to a message client
+// is sending to room. It returns the text to send, and false if the
+// message shouldn't be sent at all.
+func (server *Server) FilterMessage(room *Room, client *Client, text string) (string, bool) {
+	if room.encrypted {
+		return text, checkPayload(room, client, text)
+	}
+
+	text, ok := server.filterWords(room, client, text)
+
+	if !ok {
+		return "", false
+	}
+
+	return server.scripts.Filter(room, client, text)
+}
+
+func (server *Server) filterWords(room *Room, client *Client, text string) (string, bool) {
+	if server.filter == nil || room.unfiltered {
+		return text, true
+	}
+
+	matches := server.filter.Matches(text)
+
+	if len(matches) == 0 {
+		return text, true
+	}
+
+	switch server.filter.action {
+	case FilterReject:
+		client.logger().Info("message rejected by filter", "room", room.name)
+		client.Error("Your message was blocked by the word filter")
+		return "", false
+	case FilterFlag:
+		client.logger().Warn("message flagged by filter", "room", room.name, "text", text)
+
+		for _, peer := range server.clients.Sorted() {
+			if peer.Role() >= RoleModerator {
+				peer.Notice("", fmt.Sprintf("Filter flagged a message from %s in %s: %s", plainName(client.Name()), plainName(room.name), text))
+			}
+		}
+
+		return text, true
+	default:
+		return mask(text, matches), true
+	}
+}
+
+// ReloadFilter reads the filter's list file again, if there is a filter.
+func (server *Server) ReloadFilter() error {
+	if server.filter == nil {
+		return nil
+	}
+
+	err := server.filter.Reload()
+
+	if err != nil {
+		return err
+	}
+
+	slog.Info("reloaded filter", "path", server.filter.path, "entries", len(server.filter.entries))
+	return nil
+}
+
+// FilterCommand turns the filter on or off for a room, or reloads the
+// list.
+type FilterCommand struct {
+	client *Client
+	reload bool
+	room   string
+	on     bool
+}
+
+func (cmd *FilterCommand) Run(server *Server) {
+	if cmd.reload {
+		if !server.CheckRole(cmd.client, RoleAdmin, "Reloading the word filter") {
+			return
+		}
+
+		err := server.ReloadFilter()
+
+		if err != nil {
+			cmd.client.logger().Error("reloading filter", "err", err)
+			cmd.client.Error("Could not reload the word filter")
+			return
+		}
+
+		cmd.client.Reply("Reloaded the word filter")
+		return
+	}
+
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil || room.unfiltered == !cmd.on {
+		return
+	}
+
+	room.unfiltered = !cmd.on
+	server.saveRoom(room)
+
+	mode, text := "+f", "%s turned the word filter on in %s"
+
+	if !cmd.on {
+		mode, text = "-f", "%s turned the word filter off in %s"
+	}
+
+	cmd.client.logger().Info("changed room mode", "room", room.name, "mode", mode)
+	server.audit(cmd.client.Name(), "mode "+mode, room.name, "", "")
+
+	room.Send(&Event{
+		Type: EventMode,
+		Nick: cmd.client.Name(),
+		Mode: mode,
+		Text: fmt.Sprintf(text, plainName(cmd.client.Name()), plainName(room.name)),
+	})
+}
+
+func parseFilter(client *Client, args []string) Command {
+	if args[1] == "" {
+		if args[0] != "reload" {
+			return nil
+		}
+
+		return &FilterCommand{client: client, reload: true}
+	}
+
+	return &FilterCommand{
+		client: client,
+		room:   args[0],
+		on:     args[1] == "on",
+	}
+}
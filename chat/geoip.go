@@ -0,0 +1,327 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// GeoIP looks up the country of an address in a MaxMind DB file, such as
+// GeoLite2-Country.mmdb. It reads just enough of the format to walk the
+// search tree and decode the record it leads to, which is all a country
+// lookup needs. The file is read into memory once and never changes, so
+// lookups are safe from any goroutine.
+type GeoIP struct {
+	path       string
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func LoadGeoIP(path string) (*GeoIP, error) {
+	file, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	start := bytes.LastIndex(file, mmdbMetadataMarker)
+
+	if start < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+
+	metadata, _, err := mmdbDecode(file[start+len(mmdbMetadataMarker):], 0)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading metadata: %v", path, err)
+	}
+
+	fields, _ := metadata.(map[string]any)
+	nodeCount, _ := fields["node_count"].(uint64)
+	recordSize, _ := fields["record_size"].(uint64)
+	ipVersion, _ := fields["ip_version"].(uint64)
+
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+
+	treeSize := nodeCount * recordSize / 4
+
+	// The data section follows the tree after 16 bytes of zeros.
+	if treeSize+16 > uint64(start) {
+		return nil, fmt.Errorf("%s: search tree runs past the end of the file", path)
+	}
+
+	return &GeoIP{
+		path:       path,
+		tree:       file[:treeSize],
+		data:       file[treeSize+16 : start],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}, nil
+}
+
+// Country returns the ISO 3166 code of the country addr is in, or "" if
+// the database doesn't know.
+func (geoip *GeoIP) Country(addr netip.Addr) string {
+	record, err := geoip.lookup(addr)
+
+	if err != nil || record == nil {
+		return ""
+	}
+
+	fields, _ := record.(map[string]any)
+
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := fields[key].(map[string]any)
+
+		if code, ok := country["iso_code"].(string); ok {
+			return code
+		}
+	}
+
+	return ""
+}
+
+func (geoip *GeoIP) lookup(addr netip.Addr) (any, error) {
+	addr = addr.Unmap()
+
+	var ip []byte
+	node := uint(0)
+
+	if addr.Is4() {
+		ip = addr.AsSlice()
+
+		// IPv4 addresses live under ::/96 in an IPv6 tree.
+		if geoip.ipVersion == 6 {
+			for i := 0; i < 96 && node < geoip.nodeCount; i++ {
+				node = geoip.record(node, 0)
+			}
+		}
+	} else if geoip.ipVersion == 6 {
+		ip = addr.AsSlice()
+	} else {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < geoip.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-i%8)) & 1
+		node = geoip.record(node, bit)
+	}
+
+	if node == geoip.nodeCount {
+		return nil, nil
+	} else if node < geoip.nodeCount {
+		return nil, errors.New("search tree ended inside the tree")
+	}
+
+	value, _, err := mmdbDecode(geoip.data, int(node-geoip.nodeCount-16))
+
+	return value, err
+}
+
+// record reads the left (bit 0) or right (bit 1) record of node.
+func (geoip *GeoIP) record(node, bit uint) uint {
+	switch geoip.recordSize {
+	case 24:
+		b := geoip.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := geoip.tree[node*7:]
+
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(geoip.tree[node*8+bit*4:]))
+	}
+}
+
+// Types in the MaxMind DB data section.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+var errMMDBTruncated = errors.New("data section truncated")
+
+// mmdbDecode decodes the value at offset in data, returning it and the
+// offset just past it. Integers come back as uint64 or int64 and floats as
+// float64; 128 bit integers, which country databases don't use, come back
+// as their bytes.
+func mmdbDecode(data []byte, offset int) (any, int, error) {
+	if offset < 0 || offset >= len(data) {
+		return nil, 0, errMMDBTruncated
+	}
+
+	control := data[offset]
+	offset++
+	kind := int(control >> 5)
+
+	if kind == mmdbPointer {
+		size := int(control>>3) & 3
+
+		if offset+size+1 > len(data) {
+			return nil, 0, errMMDBTruncated
+		}
+
+		b := data[offset : offset+size+1]
+		var pointer int
+
+		switch size {
+		case 0:
+			pointer = int(control&7)<<8 | int(b[0])
+		case 1:
+			pointer = (int(control&7)<<16 | int(b[0])<<8 | int(b[1])) + 2048
+		case 2:
+			pointer = (int(control&7)<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+		default:
+			pointer = int(binary.BigEndian.Uint32(b))
+		}
+
+		value, _, err := mmdbDecode(data, pointer)
+		return value, offset + size + 1, err
+	}
+
+	if kind == mmdbExtended {
+		if offset >= len(data) {
+			return nil, 0, errMMDBTruncated
+		}
+
+		kind = 7 + int(data[offset])
+		offset++
+	}
+
+	size := int(control & 0x1f)
+
+	if size >= 29 {
+		extra := size - 28
+
+		if offset+extra > len(data) {
+			return nil, 0, errMMDBTruncated
+		}
+
+		n := 0
+
+		for _, b := range data[offset : offset+extra] {
+			n = n<<8 | int(b)
+		}
+
+		size = []int{29, 285, 65821}[extra-1] + n
+		offset += extra
+	}
+
+	switch kind {
+	case mmdbMap:
+		fields := make(map[string]any, size)
+
+		for range size {
+			key, next, err := mmdbDecode(data, offset)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			value, next, err := mmdbDecode(data, next)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			name, _ := key.(string)
+			fields[name] = value
+			offset = next
+		}
+
+		return fields, offset, nil
+	case mmdbArray:
+		values := make([]any, 0, size)
+
+		for range size {
+			value, next, err := mmdbDecode(data, offset)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			values = append(values, value)
+			offset = next
+		}
+
+		return values, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > len(data) {
+		return nil, 0, errMMDBTruncated
+	}
+
+	b := data[offset : offset+size]
+	offset += size
+
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double of %d bytes", size)
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float of %d bytes", size)
+		}
+
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var n uint64
+
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+
+		return n, offset, nil
+	case mmdbInt32:
+		var n uint32
+
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+
+		return int64(int32(n)), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return b, offset, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown data type %d", kind)
+	}
+}
@@ -0,0 +1,371 @@
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidbalbert/chatserver/chat/chatpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ServeGRPC serves the Chat gRPC service defined in chatpb/chat.proto. Each
+// Connect call is a client like any other, so rate limits, bans and every
+// command apply to it the same way; requests are turned into commands and
+// events into Event messages by grpcCodec.
+func (server *Server) ServeGRPC(listener net.Listener) error {
+	grpcServer := grpc.NewServer()
+	chatpb.RegisterChatServer(grpcServer, &grpcService{server: server})
+
+	return grpcServer.Serve(listener)
+}
+
+type grpcService struct {
+	chatpb.UnimplementedChatServer
+	server *Server
+}
+
+// Connect runs a session until the server closes it or the caller goes
+// away.
+func (service *grpcService) Connect(stream chatpb.Chat_ConnectServer) error {
+	conn := newGRPCConn(stream)
+	service.server.serve(conn, grpcCodec{}, nil)
+
+	select {
+	case <-conn.closed:
+	case <-stream.Context().Done():
+		conn.Close()
+	}
+
+	return nil
+}
+
+// grpcCodec reads each request as the protojson of a chatpb.Request, which
+// is how grpcConn passes them on, and writes events the same way.
+type grpcCodec struct{}
+
+func (grpcCodec) Decode(server *Server, client *Client, line string) ([]Command, error) {
+	var req chatpb.Request
+
+	if err := protojson.Unmarshal([]byte(line), &req); err != nil {
+		return nil, fmt.Errorf("Invalid request: %v", err)
+	}
+
+	text, err := requestLine(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := server.registry.Parse(client, text)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []Command{cmd}, nil
+}
+
+// requestLine turns req into the equivalent text command.
+func requestLine(req *chatpb.Request) (string, error) {
+	var line string
+
+	switch r := req.Request.(type) {
+	case *chatpb.Request_Nick:
+		line = "nick " + quoteName(r.Nick.Nick)
+	case *chatpb.Request_Join:
+		line = "join " + quoteName(r.Join.Room)
+
+		if r.Join.Key != "" {
+			line += " " + r.Join.Key
+		}
+	case *chatpb.Request_Leave:
+		line = "leave " + quoteName(r.Leave.Room)
+	case *chatpb.Request_Send:
+		if r.Send.Parent != 0 {
+			line = "reply " + quoteName(r.Send.Room) + " " + strconv.FormatUint(r.Send.Parent, 10) + " " + r.Send.Text
+		} else {
+			line = "msg " + quoteName(r.Send.Room) + " " + r.Send.Text
+		}
+	case *chatpb.Request_Command:
+		line = r.Command
+	default:
+		return "", errors.New("Empty request")
+	}
+
+	if strings.ContainsAny(line, "\r\n") {
+		return "", errors.New("Fields may not contain newlines")
+	}
+
+	return line, nil
+}
+
+func (grpcCodec) Encode(client *Client, event *Event) string {
+	data, err := protojson.Marshal(eventProto(event))
+
+	if err != nil {
+		data, _ = protojson.Marshal(&chatpb.Event{Type: EventError, Text: err.Error()})
+	}
+
+	return string(data) + "\n"
+}
+
+func eventProto(event *Event) *chatpb.Event {
+	msg := &chatpb.Event{
+		Type:    event.Type,
+		Id:      event.ID,
+		Room:    event.Room,
+		Nick:    event.Nick,
+		Text:    event.Text,
+		History: event.History,
+		Edited:  event.Edited,
+		Parent:  event.Parent,
+		Removed: event.Removed,
+		NewNick: event.NewNick,
+		Topic:   event.Topic,
+		Reason:  event.Reason,
+		Names:   event.Names,
+		Target:  event.Target,
+		Mode:    event.Mode,
+	}
+
+	if !event.Time.IsZero() {
+		msg.Time = timestamppb.New(event.Time)
+	}
+
+	if len(event.Reactions) > 0 {
+		msg.Reactions = make(map[string]int64, len(event.Reactions))
+
+		for emoji, count := range event.Reactions {
+			msg.Reactions[emoji] = int64(count)
+		}
+	}
+
+	return msg
+}
+
+// grpcConn is a net.Conn over a Connect stream, so the usual reader and
+// writer goroutines can serve it: each request received reads as one line,
+// and each line written is sent as one event.
+type grpcConn struct {
+	stream chatpb.Chat_ConnectServer
+	local  net.Addr
+	remote net.Addr
+
+	requests chan []byte
+	pending  []byte
+	partial  []byte
+
+	readDeadline  connDeadline
+	writeDeadline connDeadline
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newGRPCConn(stream chatpb.Chat_ConnectServer) *grpcConn {
+	conn := &grpcConn{
+		stream:   stream,
+		local:    grpcAddr{},
+		remote:   grpcAddr{},
+		requests: make(chan []byte),
+		closed:   make(chan struct{}),
+	}
+
+	conn.readDeadline.init()
+	conn.writeDeadline.init()
+
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		conn.remote = p.Addr
+
+		if p.LocalAddr != nil {
+			conn.local = p.LocalAddr
+		}
+	}
+
+	go conn.receive()
+
+	return conn
+}
+
+// receive passes requests to Read until the stream ends.
+func (conn *grpcConn) receive() {
+	defer close(conn.requests)
+
+	for {
+		req, err := conn.stream.Recv()
+
+		if err != nil {
+			return
+		}
+
+		data, err := protojson.Marshal(req)
+
+		if err != nil {
+			continue
+		}
+
+		select {
+		case conn.requests <- append(data, '\n'):
+		case <-conn.closed:
+			return
+		}
+	}
+}
+
+func (conn *grpcConn) Read(b []byte) (int, error) {
+	if len(conn.pending) == 0 {
+		select {
+		case line, ok := <-conn.requests:
+			if !ok {
+				return 0, io.EOF
+			}
+
+			conn.pending = line
+		case <-conn.closed:
+			return 0, net.ErrClosed
+		case <-conn.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(b, conn.pending)
+	conn.pending = conn.pending[n:]
+
+	return n, nil
+}
+
+func (conn *grpcConn) Write(b []byte) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	case <-conn.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	conn.partial = append(conn.partial, b...)
+
+	for {
+		i := bytes.IndexByte(conn.partial, '\n')
+
+		if i < 0 {
+			break
+		}
+
+		var event chatpb.Event
+		err := protojson.Unmarshal(conn.partial[:i], &event)
+		conn.partial = conn.partial[i+1:]
+
+		if err != nil {
+			continue
+		}
+
+		if err := conn.stream.Send(&event); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+func (conn *grpcConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+
+	return nil
+}
+
+func (conn *grpcConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *grpcConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *grpcConn) SetDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
+	conn.writeDeadline.set(t)
+	return nil
+}
+
+func (conn *grpcConn) SetReadDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
+	return nil
+}
+
+func (conn *grpcConn) SetWriteDeadline(t time.Time) error {
+	conn.writeDeadline.set(t)
+	return nil
+}
+
+type grpcAddr struct{}
+
+func (grpcAddr) Network() string { return "grpc" }
+func (grpcAddr) String() string  { return "grpc" }
+
+// connDeadline is a deadline for a net.Conn that isn't backed by a socket.
+// The channel wait returns is closed once the deadline passes.
+type connDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func (d *connDeadline) init() {
+	d.expired = make(chan struct{})
+}
+
+func (d *connDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// A timer that has already fired has closed, or is about to close, the
+	// old channel.
+	if d.timer != nil && !d.timer.Stop() {
+		d.expired = make(chan struct{})
+	}
+
+	d.timer = nil
+
+	select {
+	case <-d.expired:
+		d.expired = make(chan struct{})
+	default:
+	}
+
+	if t.IsZero() {
+		return
+	}
+
+	wait := time.Until(t)
+
+	if wait <= 0 {
+		close(d.expired)
+		return
+	}
+
+	expired := d.expired
+	d.timer = time.AfterFunc(wait, func() {
+		close(expired)
+	})
+}
+
+func (d *connDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.expired
+}
@@ -0,0 +1,212 @@
+//go:build unix
+
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const listenFDsEnv = "CHATSERVER_LISTEN_FDS"
+
+// systemd passes sockets starting at fd 3, after stdin, stdout and stderr.
+const systemdFirstFD = 3
+
+// Older servers handed off a single plaintext listener this way.
+const listenFDEnv = "CHATSERVER_LISTEN_FD"
+
+// inherited reads the environment the first time Run listens, not when the
+// package is loaded, so a program embedding the server keeps its own
+// systemd sockets and the warnings go to the configured logger.
+var inherited = sync.OnceValue(inheritedListeners)
+
+// inheritedListeners parses the name=fd pairs a previous process left in
+// the environment during a handoff, or the sockets systemd passed in.
+func inheritedListeners() map[string]int {
+	fds := systemdListeners()
+	spec := os.Getenv(listenFDsEnv)
+
+	if legacy := os.Getenv(listenFDEnv); legacy != "" && spec == "" {
+		spec = "tcp=" + legacy
+		os.Unsetenv(listenFDEnv)
+	}
+
+	if spec == "" {
+		return fds
+	}
+
+	os.Unsetenv(listenFDsEnv)
+
+	for _, pair := range strings.Split(spec, ",") {
+		name, fd, _ := strings.Cut(pair, "=")
+		n, err := strconv.Atoi(fd)
+
+		if err != nil {
+			slog.Warn("ignoring bad inherited listener", "env", listenFDsEnv, "entry", pair)
+			continue
+		}
+
+		fds[name] = n
+	}
+
+	return fds
+}
+
+// systemdListeners picks up sockets passed with systemd socket activation.
+// Each is named after the listener it replaces (tcp, tls, ws, irc and so
+// on) with FileDescriptorName= in the socket unit; a lone unnamed socket is
+// the plaintext listener. The address for each listener must still be set
+// so the server knows to serve it.
+func systemdListeners() map[string]int {
+	fds := make(map[string]int)
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+
+	if pid != os.Getpid() || count <= 0 {
+		return fds
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := range count {
+		name := "tcp"
+
+		// systemd calls sockets without a FileDescriptorName= "unknown".
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name = names[i]
+		} else if count > 1 {
+			slog.Warn("ignoring unnamed socket from systemd", "fd", systemdFirstFD+i)
+			continue
+		}
+
+		fds[name] = systemdFirstFD + i
+	}
+
+	return fds
+}
+
+// listen returns the listening socket called name that was passed down by
+// a previous process during a handoff, or a fresh listener on address if
+// there isn't one.
+func listen(name, network, address string) (net.Listener, error) {
+	fd, exists := inherited()[name]
+
+	if !exists {
+		return freshListener(network, address)
+	}
+
+	file := os.NewFile(uintptr(fd), name)
+
+	if file == nil {
+		return nil, fmt.Errorf("%s: invalid fd %d for %s", listenFDsEnv, fd, name)
+	}
+
+	defer file.Close()
+
+	return net.FileListener(file)
+}
+
+// handoffOnSignal starts a replacement process when SIGUSR2 arrives,
+// passing it the listening sockets so no connections are refused during
+// the swap. Once the replacement is running, the listeners are closed and
+// the caller's accept loops return.
+func handoffOnSignal(listeners map[string]net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		for range signals {
+			err := handoff(listeners)
+
+			if err != nil {
+				slog.Error("handoff failed", "err", err)
+				continue
+			}
+
+			signal.Stop(signals)
+			return
+		}
+	}()
+}
+
+func handoff(listeners map[string]net.Listener) error {
+	names := make([]string, 0, len(listeners))
+
+	for name := range listeners {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var files []*os.File
+	var pairs []string
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for _, name := range names {
+		filer, ok := listeners[name].(interface{ File() (*os.File, error) })
+
+		if !ok {
+			return errors.New("listener " + name + " cannot be shared")
+		}
+
+		file, err := filer.File()
+
+		if err != nil {
+			return err
+		}
+
+		// ExtraFiles start at fd 3 in the child.
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, 3+len(files)))
+		files = append(files, file)
+	}
+
+	exe, err := os.Executable()
+
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), listenFDsEnv+"="+strings.Join(pairs, ","))
+	cmd.ExtraFiles = files
+
+	err = cmd.Start()
+
+	if err != nil {
+		return err
+	}
+
+	slog.Info("handed listeners off", "pid", cmd.Process.Pid)
+
+	for _, name := range names {
+		// The replacement is listening on the same socket file now.
+		if unix, ok := listeners[name].(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+
+		listeners[name].Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package chat
+
+import (
+	"log/slog"
+	"net"
+)
+
+func listen(name, network, address string) (net.Listener, error) {
+	return freshListener(network, address)
+}
+
+func handoffOnSignal(listeners map[string]net.Listener) {
+	slog.Warn("listener handoff is only supported on Unix")
+}
@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// healthTimeout is how long the dispatcher has to answer a health check
+// before it counts as stuck.
+const healthTimeout = 2 * time.Second
+
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// serveHealth answers /healthz, which fails only when the dispatcher has
+// stopped answering and the process should be restarted, and /readyz,
+// which also fails while no listener is accepting connections or the
+// message store can't be reached, so load balancers send clients
+// elsewhere.
+func (server *Server) serveHealth(w http.ResponseWriter, ready bool) {
+	checks := map[string]error{
+		"dispatcher": server.checkDispatcher(),
+	}
+
+	if ready {
+		checks["listeners"] = server.checkListeners()
+		checks["store"] = server.checkStore()
+	}
+
+	report := healthReport{Status: "ok", Checks: make(map[string]string)}
+	status := http.StatusOK
+
+	for name, err := range checks {
+		if err != nil {
+			report.Status = "failing"
+			report.Checks[name] = err.Error()
+			status = http.StatusServiceUnavailable
+		} else {
+			report.Checks[name] = "ok"
+		}
+	}
+
+	writeJSON(w, status, report)
+}
+
+// checkDispatcher waits for the dispatcher to run an empty command. Only
+// one check waits at a time, so a stuck dispatcher doesn't pile up
+// goroutines behind it.
+func (server *Server) checkDispatcher() error {
+	if !server.healthProbe.CompareAndSwap(false, true) {
+		return errors.New("not answering")
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		server.call(func() {})
+		server.healthProbe.Store(false)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(healthTimeout):
+		return errors.New("not answering")
+	}
+}
+
+func (server *Server) checkListeners() error {
+	if server.accepting.Load() == 0 {
+		return errors.New("not accepting connections")
+	}
+
+	return nil
+}
+
+func (server *Server) checkStore() error {
+	if server.store == nil {
+		return nil
+	}
+
+	return server.store.Ping()
+}
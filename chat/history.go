@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"time"
+)
+
+type Message struct {
+	id     uint64
+	room   string
+	nick   string
+	text   string
+	time   time.Time
+	edited bool
+	parent uint64
+
+	// reactions lists who reacted to the message with each emoji, in the
+	// order they did.
+	reactions map[string][]string
+}
+
+func (msg *Message) Event(location *time.Location, history bool) *Event {
+	return &Event{
+		Type:    EventMessage,
+		ID:      msg.id,
+		Time:    msg.time.In(location),
+		Room:    msg.room,
+		Nick:    msg.nick,
+		Text:    msg.text,
+		History: history,
+		Edited:  msg.edited,
+		Parent:  msg.parent,
+
+		Reactions: msg.reactionCounts(),
+	}
+}
+
+type History struct {
+	messages []*Message
+	start    int
+	size     int
+}
+
+func NewHistory(capacity int) *History {
+	if capacity < 0 {
+		capacity = 0
+	}
+
+	return &History{
+		messages: make([]*Message, capacity),
+	}
+}
+
+func (history *History) Add(msg *Message) {
+	if len(history.messages) == 0 {
+		return
+	}
+
+	end := (history.start + history.size) % len(history.messages)
+	history.messages[end] = msg
+
+	if history.size < len(history.messages) {
+		history.size++
+	} else {
+		history.start = (history.start + 1) % len(history.messages)
+	}
+}
+
+func (history *History) Messages() []*Message {
+	messages := make([]*Message, history.size)
+
+	for i := range messages {
+		messages[i] = history.messages[(history.start+i)%len(history.messages)]
+	}
+
+	return messages
+}
+
+// Find returns the message with the given ID, if it is still in history.
+func (history *History) Find(id uint64) *Message {
+	for i := history.size - 1; i >= 0; i-- {
+		msg := history.messages[(history.start+i)%len(history.messages)]
+
+		if msg.id == id {
+			return msg
+		}
+	}
+
+	return nil
+}
+
+// Replace swaps the message with msg's ID for msg. Messages are shared
+// with whoever else was handed them, so changes are made to a copy rather
+// than in place.
+func (history *History) Replace(msg *Message) {
+	for i := 0; i < history.size; i++ {
+		j := (history.start + i) % len(history.messages)
+
+		if history.messages[j].id == msg.id {
+			history.messages[j] = msg
+		}
+	}
+}
+
+// Remove drops the message with the given ID.
+func (history *History) Remove(id uint64) {
+	messages := history.Messages()
+	history.start, history.size = 0, 0
+
+	for _, msg := range messages {
+		if msg.id != id {
+			history.Add(msg)
+		}
+	}
+}
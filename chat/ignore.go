@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Ignores reports whether client has asked not to hear from nick.
+func (client *Client) Ignores(nick string) bool {
+	return client.ignored[foldName(nick)]
+}
+
+// SetIgnored replaces the ignore list on account with client's, so it
+// follows the account to its next login.
+func (store *AccountStore) SetIgnored(account *Account, ignored map[string]bool) error {
+	account.Ignored = make([]string, 0, len(ignored))
+
+	for nick := range ignored {
+		account.Ignored = append(account.Ignored, nick)
+	}
+
+	sort.Strings(account.Ignored)
+
+	return store.save()
+}
+
+// saveIgnored keeps a logged in client's ignore list on its account.
+func (server *Server) saveIgnored(client *Client) {
+	account, exists := server.accounts.Get(client.account)
+
+	if client.account == "" || !exists {
+		return
+	}
+
+	err := server.accounts.SetIgnored(account, client.ignored)
+
+	if err != nil {
+		slog.Error("saving accounts", "err", err)
+		client.Error("Your ignore list could not be saved")
+	}
+}
+
+type IgnoreCommand struct {
+	client *Client
+	nick   string
+}
+
+func (cmd *IgnoreCommand) Run(server *Server) {
+	client := cmd.client
+
+	if cmd.nick == "" {
+		if len(client.ignored) == 0 {
+			client.Reply("You aren't ignoring anyone")
+			return
+		}
+
+		nicks := make([]string, 0, len(client.ignored))
+
+		for nick := range client.ignored {
+			nicks = append(nicks, nick)
+		}
+
+		sort.Strings(nicks)
+
+		client.Reply("Ignoring: " + strings.Join(nicks, ", "))
+		return
+	}
+
+	if sameName(cmd.nick, client.Name()) {
+		client.Error("You can't ignore yourself")
+		return
+	}
+
+	client.ignored[foldName(cmd.nick)] = true
+	server.saveIgnored(client)
+	client.Reply("Ignoring " + cmd.nick)
+}
+
+type UnignoreCommand struct {
+	client *Client
+	nick   string
+}
+
+func (cmd *UnignoreCommand) Run(server *Server) {
+	client := cmd.client
+
+	if !client.ignored[foldName(cmd.nick)] {
+		client.Error("You aren't ignoring them")
+		return
+	}
+
+	delete(client.ignored, foldName(cmd.nick))
+	server.saveIgnored(client)
+	client.Reply("No longer ignoring " + cmd.nick)
+}
+
+func parseIgnore(client *Client, args []string) Command {
+	return &IgnoreCommand{
+		client: client,
+		nick:   args[0],
+	}
+}
+
+func parseUnignore(client *Client, args []string) Command {
+	return &UnignoreCommand{
+		client: client,
+		nick:   args[0],
+	}
+}
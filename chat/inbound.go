@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ServeInbound lets other systems, such as CI or monitoring, post into a
+// room over HTTP with "POST /rooms/<room>/messages" and a JSON body of
+// {"text": ...}. Messages show up from the configured bot nick. Every
+// request needs "Authorization: Bearer <inbound token>".
+func (server *Server) ServeInbound(listener net.Listener) error {
+	httpServer := &http.Server{
+		Handler:           http.HandlerFunc(server.inboundRoute),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return httpServer.Serve(listener)
+}
+
+func (server *Server) inboundRoute(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(server.inboundToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if r.Method != http.MethodPost || len(parts) != 3 || parts[0] != "rooms" || parts[2] != "messages" {
+		http.NotFound(w, r)
+		return
+	}
+
+	server.inboundMessage(w, r, parts[1])
+}
+
+type inboundMessageRequest struct {
+	Text string `json:"text"`
+}
+
+func (server *Server) inboundMessage(w http.ResponseWriter, r *http.Request, name string) {
+	var req inboundMessageRequest
+
+	err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req)
+
+	if err != nil || req.Text == "" || strings.ContainsAny(req.Text, "\r\n") {
+		http.Error(w, "expected {\"text\": ...} on one line", http.StatusBadRequest)
+		return
+	}
+
+	if server.maxMessage > 0 && utf8.RuneCountInString(req.Text) > server.maxMessage {
+		http.Error(w, "message too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var found bool
+
+	server.call(func() {
+		room, exists := server.LookupRoom(name)
+
+		if !exists {
+			return
+		}
+
+		found = true
+		slog.Info("message posted over HTTP", "room", name, "nick", server.inboundNick)
+		server.Post(room, server.inboundNick, req.Text)
+	})
+
+	if !found {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
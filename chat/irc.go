@@ -0,0 +1,540 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const ircServerName = "chatserver"
+
+// eventIRC carries a line that is already in IRC form, such as a numeric
+// reply. Only IRC sessions ever receive it.
+const eventIRC = "irc"
+
+var ircErrors = map[string]string{
+	"Nick already in use":      "433 %s * :Nickname is already in use",
+	"Nick is reserved":         "432 %s * :Erroneous nickname",
+	"No such nick":             "401 %s * :No such nick/channel",
+	"Room doesn't exist":       "403 %s * :No such channel",
+	"You are not in that room": "442 %s * :You're not on that channel",
+	"Must set NICK first":      "451 %s :You have not registered",
+
+	"Nick is registered, use login": "433 %s * :Nickname is registered",
+	"You are not a room operator":   "482 %s * :You're not channel operator",
+	"You are banned from that room": "474 %s * :Cannot join channel (+b)",
+	"That room needs a key":         "475 %s * :Cannot join channel (+k)",
+	"Wrong room key":                "475 %s * :Cannot join channel (+k)",
+	"That room is invite only":      "473 %s * :Cannot join channel (+i)",
+	"That room is full":             "471 %s * :Cannot join channel (+l)",
+	moderatedError:                  "404 %s * :Cannot send to channel",
+}
+
+func (server *Server) HandleIRCConnections(listener net.Listener) error {
+	return server.acceptLoop(listener, server.HandleIRCConnection)
+}
+
+func (server *Server) HandleIRCConnection(conn net.Conn) {
+	server.serve(conn, &ircSession{}, nil)
+}
+
+// ircSession is the Codec for a client connected through the IRC listener.
+// It maps RFC 1459 commands onto the native ones, and renders events as the
+// lines an IRC client expects. Rooms appear as channels named #room.
+type ircSession struct {
+	nick       atomic.Value
+	registered atomic.Bool
+
+	// Set from CAP LS or CAP REQ until CAP END, so the welcome waits for
+	// the capabilities the client asks for to take effect.
+	negotiating atomic.Bool
+
+	// Only set on the dispatcher goroutine.
+	user bool
+}
+
+func (session *ircSession) Nick() string {
+	if nick, ok := session.nick.Load().(string); ok {
+		return ircName(nick)
+	}
+
+	return "*"
+}
+
+func (session *ircSession) NickChanged(server *Server, client *Client) {
+	session.nick.Store(client.Name())
+	session.welcome(client)
+}
+
+func (session *ircSession) welcome(client *Client) {
+	if !session.user || client.nick() == "" || session.negotiating.Load() || !session.registered.CompareAndSwap(false, true) {
+		return
+	}
+
+	nick := client.nick()
+	client.Send(ircReply("001 %s :Welcome to the chat server, %s", nick, nick))
+	client.Send(ircReply("002 %s :Your host is %s", nick, ircServerName))
+	client.Send(ircReply("003 %s :This server speaks a subset of RFC 1459", nick))
+	client.Send(ircReply("004 %s %s chatserver-1 o o", nick, ircServerName))
+	client.Send(ircReply("422 %s :MOTD File is missing", nick))
+}
+
+func ircReply(format string, args ...any) *Event {
+	return &Event{
+		Type: eventIRC,
+		Text: fmt.Sprintf(":%s "+format, append([]any{ircServerName}, args...)...),
+	}
+}
+
+func ircMask(nick string) string {
+	nick = ircName(nick)
+	return fmt.Sprintf("%s!%s@%s", nick, nick, ircServerName)
+}
+
+// ircName writes a nick or room name for IRC, which has no way to put a
+// space in either, so spaces are sent as no-break spaces. fromIRC turns
+// them back.
+func ircName(name string) string {
+	return strings.ReplaceAll(name, " ", "\u00a0")
+}
+
+func fromIRC(name string) string {
+	return strings.ReplaceAll(name, "\u00a0", " ")
+}
+
+func ircChannel(room string) string {
+	return "#" + ircName(room)
+}
+
+func ircRoom(channel string) string {
+	return fromIRC(strings.TrimLeft(channel, "#&"))
+}
+
+// ircRoomArg and ircNickArg write an IRC channel or nick as an argument to
+// a native command.
+func ircRoomArg(channel string) string {
+	return quoteName(ircRoom(channel))
+}
+
+func ircNickArg(nick string) string {
+	return quoteName(fromIRC(nick))
+}
+
+// parseIRCLine splits a line into its command and parameters, dropping any
+// prefix. A parameter starting with ':' takes the rest of the line.
+func parseIRCLine(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	var params []string
+
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+
+		if strings.HasPrefix(line, ":") {
+			params = append(params, line[1:])
+			break
+		}
+
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+
+	if len(params) == 0 {
+		return "", nil
+	}
+
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+func (session *ircSession) Decode(server *Server, client *Client, line string) ([]Command, error) {
+	command, params := parseIRCLine(line)
+
+	var lines []string
+	var welcomes []Command
+
+	switch command {
+	case "":
+		return nil, nil
+	case "NICK":
+		if len(params) < 1 {
+			client.Send(ircReply("431 %s :No nickname given", session.Nick()))
+			return nil, nil
+		}
+
+		lines = append(lines, "nick "+ircNickArg(params[0]))
+	case "USER":
+		return []Command{&ircUserCommand{client: client, session: session}}, nil
+	case "PING":
+		token := ircServerName
+
+		if len(params) > 0 {
+			token = params[0]
+		}
+
+		client.Send(ircReply("PONG %s :%s", ircServerName, token))
+		return nil, nil
+	case "PONG", "NOTICE":
+		return nil, nil
+	case "CAP":
+		if len(params) == 0 {
+			return nil, nil
+		}
+
+		switch strings.ToUpper(params[0]) {
+		case "LS":
+			session.negotiating.Store(true)
+			client.Send(ircReply("CAP %s LS :%s", session.Nick(), quietCapability))
+		case "REQ":
+			session.negotiating.Store(true)
+
+			if len(params) > 1 && strings.EqualFold(strings.TrimSpace(params[1]), quietCapability) {
+				// IRC clients keep track of who is in a channel by
+				// JOIN, PART and QUIT, so they still get those.
+				client.quiet.Store(true)
+				client.Send(ircReply("CAP %s ACK :%s", session.Nick(), quietCapability))
+			} else if len(params) > 1 {
+				client.Send(ircReply("CAP %s NAK :%s", session.Nick(), params[1]))
+			}
+		case "END":
+			if session.negotiating.Swap(false) {
+				return []Command{&ircCapEndCommand{client: client, session: session}}, nil
+			}
+		}
+
+		return nil, nil
+	case "JOIN":
+		if len(params) < 1 {
+			return nil, fmt.Errorf("JOIN requires a channel")
+		}
+
+		var keys []string
+
+		if len(params) > 1 {
+			keys = strings.Split(params[1], ",")
+		}
+
+		for i, channel := range strings.Split(params[0], ",") {
+			join := "join " + ircRoomArg(channel)
+
+			if i < len(keys) && keys[i] != "" {
+				join += " " + keys[i]
+			}
+
+			lines = append(lines, join, "who "+ircRoomArg(channel))
+			welcomes = append(welcomes, &welcomeCommand{client: client, room: ircRoom(channel)})
+		}
+	case "PART":
+		if len(params) < 1 {
+			return nil, fmt.Errorf("PART requires a channel")
+		}
+
+		for _, channel := range strings.Split(params[0], ",") {
+			lines = append(lines, "leave "+ircRoomArg(channel))
+		}
+	case "PRIVMSG":
+		if len(params) < 2 {
+			client.Send(ircReply("412 %s :No text to send", session.Nick()))
+			return nil, nil
+		}
+
+		target, text := params[0], params[1]
+
+		if strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&") {
+			lines = append(lines, fmt.Sprintf("msg %s %s", ircRoomArg(target), text))
+		} else {
+			lines = append(lines, fmt.Sprintf("pm %s %s", ircNickArg(target), text))
+		}
+	case "TOPIC":
+		if len(params) < 1 {
+			return nil, fmt.Errorf("TOPIC requires a channel")
+		}
+
+		if len(params) > 1 {
+			lines = append(lines, fmt.Sprintf("topic %s %s", ircRoomArg(params[0]), params[1]))
+		} else {
+			lines = append(lines, "topic "+ircRoomArg(params[0]))
+		}
+	case "NAMES":
+		if len(params) < 1 {
+			return nil, nil
+		}
+
+		for _, channel := range strings.Split(params[0], ",") {
+			lines = append(lines, "who "+ircRoomArg(channel))
+		}
+	case "LIST":
+		return []Command{&ircListCommand{client: client, session: session}}, nil
+	case "INVITE":
+		if len(params) < 2 {
+			return nil, fmt.Errorf("INVITE requires a nick and a channel")
+		}
+
+		lines = append(lines, fmt.Sprintf("invite %s %s", ircRoomArg(params[1]), ircNickArg(params[0])))
+	case "KICK":
+		if len(params) < 2 {
+			return nil, fmt.Errorf("KICK requires a channel and a nick")
+		}
+
+		line := fmt.Sprintf("kick %s %s", ircRoomArg(params[0]), ircNickArg(params[1]))
+
+		if len(params) > 2 {
+			line += " " + params[2]
+		}
+
+		lines = append(lines, line)
+	case "MODE":
+		if len(params) > 1 && strings.HasPrefix(params[0], "#") && (params[1] == "+i" || params[1] == "-i") {
+			on := "on"
+
+			if params[1] == "-i" {
+				on = "off"
+			}
+
+			lines = append(lines, fmt.Sprintf("invite-only %s %s", ircRoomArg(params[0]), on))
+			break
+		}
+
+		if len(params) > 1 && strings.HasPrefix(params[0], "#") && (params[1] == "+m" || params[1] == "-m") {
+			on := "on"
+
+			if params[1] == "-m" {
+				on = "off"
+			}
+
+			lines = append(lines, fmt.Sprintf("moderated %s %s", ircRoomArg(params[0]), on))
+			break
+		}
+
+		if len(params) > 2 && strings.HasPrefix(params[0], "#") && (params[1] == "+o" || params[1] == "-o") {
+			verb := "op"
+
+			if params[1] == "-o" {
+				verb = "deop"
+			}
+
+			lines = append(lines, fmt.Sprintf("%s %s %s", verb, ircRoomArg(params[0]), ircNickArg(params[2])))
+			break
+		}
+
+		if len(params) > 2 && strings.HasPrefix(params[0], "#") && (params[1] == "+v" || params[1] == "-v") {
+			verb := "voice"
+
+			if params[1] == "-v" {
+				verb = "devoice"
+			}
+
+			lines = append(lines, fmt.Sprintf("%s %s %s", verb, ircRoomArg(params[0]), ircNickArg(params[2])))
+			break
+		}
+
+		if len(params) > 0 && strings.HasPrefix(params[0], "#") {
+			client.Send(ircReply("324 %s %s +", session.Nick(), params[0]))
+		} else {
+			client.Send(ircReply("221 %s +", session.Nick()))
+		}
+
+		return nil, nil
+	case "WHO":
+		mask := "*"
+
+		if len(params) > 0 {
+			mask = params[0]
+		}
+
+		client.Send(ircReply("315 %s %s :End of /WHO list.", session.Nick(), mask))
+		return nil, nil
+	case "QUIT":
+		if len(params) > 0 {
+			lines = append(lines, "quit "+params[0])
+		} else {
+			lines = append(lines, "quit")
+		}
+	default:
+		// Anything else is passed through as a native command, so IRC
+		// users can reach the rest of the server with /quote.
+		lines = append(lines, strings.ToLower(command)+" "+strings.Join(params, " "))
+	}
+
+	var cmds []Command
+
+	for _, l := range lines {
+		cmd, err := server.registry.Parse(client, l)
+
+		if errors.Is(err, ErrUnknownCommand) {
+			client.Send(ircReply("421 %s %s :Unknown command", session.Nick(), command))
+			continue
+		} else if err != nil {
+			client.Error(err.Error())
+			continue
+		}
+
+		cmds = append(cmds, cmd)
+	}
+
+	return append(cmds, welcomes...), nil
+}
+
+func (session *ircSession) Encode(client *Client, event *Event) string {
+	me := session.Nick()
+	var line string
+
+	switch event.Type {
+	case eventIRC:
+		line = event.Text
+	case EventMessage:
+		if ircName(event.Nick) == me && !event.History {
+			return ""
+		}
+
+		text := event.Text
+
+		if event.Parent != 0 {
+			text = fmt.Sprintf("(re %d) %s", event.Parent, text)
+		}
+
+		if event.History {
+			text = fmt.Sprintf("[%s] %s", event.Time.Format(time.DateTime), text)
+		}
+
+		line = fmt.Sprintf(":%s PRIVMSG %s :%s", ircMask(event.Nick), ircChannel(event.Room), text)
+	case EventPrivate:
+		text := event.Text
+
+		if event.History {
+			text = fmt.Sprintf("[%s] %s", event.Time.Format(time.DateTime), text)
+		}
+
+		line = fmt.Sprintf(":%s PRIVMSG %s :%s", ircMask(event.Nick), me, text)
+	case EventJoin:
+		line = fmt.Sprintf(":%s JOIN %s", ircMask(event.Nick), ircChannel(event.Room))
+	case EventPart:
+		line = fmt.Sprintf(":%s PART %s", ircMask(event.Nick), ircChannel(event.Room))
+	case EventQuit:
+		line = fmt.Sprintf(":%s QUIT :%s", ircMask(event.Nick), event.Reason)
+	case EventNick:
+		// The welcome already told the client its first nick.
+		if !session.registered.Load() || (ircName(event.NewNick) == me && guestRegexp.MatchString(event.Nick)) {
+			return ""
+		}
+
+		line = fmt.Sprintf(":%s NICK :%s", ircMask(event.Nick), ircName(event.NewNick))
+	case EventKick:
+		line = fmt.Sprintf(":%s KICK %s %s :%s", ircMask(event.Nick), ircChannel(event.Room), ircName(event.Target), event.Reason)
+	case EventMode:
+		line = strings.TrimRight(fmt.Sprintf(":%s MODE %s %s %s", ircMask(event.Nick), ircChannel(event.Room), event.Mode, ircName(event.Target)), " ")
+	case EventInvite:
+		line = fmt.Sprintf(":%s INVITE %s :%s", ircMask(event.Nick), ircName(event.Target), ircChannel(event.Room))
+	case EventPing:
+		line = "PING :" + event.Text
+	case EventMention:
+		// IRC clients spot their own nick in the PRIVMSG.
+		return ""
+	case EventTyping, EventAck, EventKey, EventSession:
+		return ""
+	case EventMigrate:
+		line = fmt.Sprintf(":%s NOTICE %s :Please reconnect to %s", ircServerName, me, event.Text)
+	case EventEdit:
+		line = fmt.Sprintf(":%s NOTICE %s :edited message %d: %s", ircMask(event.Nick), ircChannel(event.Room), event.ID, event.Text)
+	case EventDelete:
+		line = fmt.Sprintf(":%s NOTICE %s :deleted message %d", ircMask(event.Nick), ircChannel(event.Room), event.ID)
+	case EventReact:
+		verb := "reacted with"
+
+		if event.Removed {
+			verb = "took back"
+		}
+
+		line = fmt.Sprintf(":%s NOTICE %s :%s %s on message %d", ircMask(event.Nick), ircChannel(event.Room), verb, event.Text, event.ID)
+	case EventTopic:
+		switch {
+		case event.Nick != "":
+			line = fmt.Sprintf(":%s TOPIC %s :%s", ircMask(event.Nick), ircChannel(event.Room), event.Topic)
+		case event.Topic != "":
+			line = fmt.Sprintf(":%s 332 %s %s :%s", ircServerName, me, ircChannel(event.Room), event.Topic)
+		default:
+			line = fmt.Sprintf(":%s 331 %s %s :No topic is set", ircServerName, me, ircChannel(event.Room))
+		}
+	case EventNames:
+		names := make([]string, len(event.Names))
+
+		for i, name := range event.Names {
+			names[i] = ircName(name)
+		}
+
+		line = fmt.Sprintf(":%s 353 %s = %s :%s\r\n:%s 366 %s %s :End of /NAMES list.",
+			ircServerName, me, ircChannel(event.Room), strings.Join(names, " "),
+			ircServerName, me, ircChannel(event.Room))
+	case EventNotice:
+		target := me
+
+		if event.Room != "" {
+			target = ircChannel(event.Room)
+		}
+
+		line = fmt.Sprintf(":%s NOTICE %s :%s", ircServerName, target, event.Text)
+	case EventError:
+		if format, exists := ircErrors[event.Text]; exists {
+			line = fmt.Sprintf(":%s "+format, ircServerName, me)
+		} else {
+			line = fmt.Sprintf(":%s NOTICE %s :Error: %s", ircServerName, me, event.Text)
+		}
+	default:
+		lines := strings.Split(event.Text, "\n")
+
+		for i, text := range lines {
+			lines[i] = fmt.Sprintf(":%s NOTICE %s :%s", ircServerName, me, text)
+		}
+
+		line = strings.Join(lines, "\r\n")
+	}
+
+	return line + "\r\n"
+}
+
+type ircUserCommand struct {
+	client  *Client
+	session *ircSession
+}
+
+func (cmd *ircUserCommand) Run(server *Server) {
+	cmd.session.user = true
+	cmd.session.welcome(cmd.client)
+}
+
+// ircCapEndCommand finishes registering a client that held it up to
+// negotiate capabilities.
+type ircCapEndCommand struct {
+	client  *Client
+	session *ircSession
+}
+
+func (cmd *ircCapEndCommand) Run(server *Server) {
+	cmd.session.welcome(cmd.client)
+}
+
+type ircListCommand struct {
+	client  *Client
+	session *ircSession
+}
+
+func (cmd *ircListCommand) Run(server *Server) {
+	me := cmd.session.Nick()
+	cmd.client.Send(ircReply("321 %s Channel :Users Name", me))
+
+	for _, room := range server.Rooms() {
+		cmd.client.Send(ircReply("322 %s %s %d :%s", me, ircChannel(room.name), len(room.clients), room.topic))
+	}
+
+	cmd.client.Send(ircReply("323 %s :End of /LIST", me))
+}
@@ -0,0 +1,76 @@
+package chat
+
+import (
+	"strconv"
+	"time"
+)
+
+// keepaliveInterval is how often the dispatcher checks for clients that
+// need a ping or have gone quiet for too long.
+const keepaliveInterval = time.Second
+
+// keepalive wakes the dispatcher up to check on connections. Dead peers
+// never send anything and often never make a write fail either, so without
+// this a half-open connection would hang around forever.
+func (server *Server) keepalive() {
+	ticker := time.NewTicker(keepaliveInterval)
+
+	for now := range ticker.C {
+		server.incoming <- &keepaliveCommand{now: now}
+	}
+}
+
+type keepaliveCommand struct {
+	now time.Time
+}
+
+func (cmd *keepaliveCommand) Run(server *Server) {
+	for _, client := range server.clients.Sorted() {
+		server.checkAlive(client, cmd.now)
+	}
+}
+
+// checkAlive pings client once it has been silent for the ping interval,
+// and disconnects it if the ping goes unanswered or it has sent nothing
+// but pongs for the idle timeout.
+func (server *Server) checkAlive(client *Client, now time.Time) {
+	if server.idleTimeout > 0 && now.Sub(time.Unix(0, client.lastActive.Load())) > server.idleTimeout {
+		server.evict(client, "Idle timeout")
+		return
+	}
+
+	if server.pingInterval <= 0 {
+		return
+	}
+
+	if now.Sub(time.Unix(0, client.lastRead.Load())) < server.pingInterval {
+		client.pinged = time.Time{}
+		return
+	}
+
+	if client.pinged.IsZero() {
+		client.pinged = now
+		client.Send(&Event{Type: EventPing, Text: strconv.FormatInt(now.Unix(), 10)})
+		return
+	}
+
+	if now.Sub(client.pinged) > server.pingTimeout {
+		server.evict(client, "Ping timeout")
+	}
+}
+
+// PongCommand answers a ping. Reading the line is what counts, so there is
+// nothing left to do but forget the ping.
+type PongCommand struct {
+	client *Client
+}
+
+func (cmd *PongCommand) Run(server *Server) {
+	cmd.client.pinged = time.Time{}
+}
+
+func parsePong(client *Client, args []string) Command {
+	return &PongCommand{
+		client: client,
+	}
+}
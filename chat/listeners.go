@@ -0,0 +1,270 @@
+package chat
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// A ListenerConfig describes one of any number of extra listeners for
+// chat clients, each named so its connections can be told apart in logs
+// and given their own policies. In a config file they are objects in the
+// "listeners" list; on the command line each -listen flag takes
+// name=addr followed by any of ,tls ,require-account, ,opers-only and
+// ,quiet.
+type ListenerConfig struct {
+	Name string `json:"name"`
+
+	// Addr is a path for a Unix socket, or else a TCP address.
+	Addr string `json:"addr"`
+	TLS  bool   `json:"tls"`
+
+	// RequireAccount keeps clients from doing anything but log in or
+	// register until they are logged in to an account.
+	RequireAccount bool `json:"require_account"`
+
+	// OpersOnly keeps clients from doing anything but become server
+	// operators, or log in to a moderator or admin account, until they
+	// have.
+	OpersOnly bool `json:"opers_only"`
+
+	// Quiet makes clients quiet from the start, for bots; see quiet.go.
+	Quiet bool `json:"quiet"`
+}
+
+func (listener ListenerConfig) String() string {
+	spec := listener.Name + "=" + listener.Addr
+
+	if listener.TLS {
+		spec += ",tls"
+	}
+
+	if listener.RequireAccount {
+		spec += ",require-account"
+	}
+
+	if listener.OpersOnly {
+		spec += ",opers-only"
+	}
+
+	if listener.Quiet {
+		spec += ",quiet"
+	}
+
+	return spec
+}
+
+func parseListenerSpec(spec string) (ListenerConfig, error) {
+	var listener ListenerConfig
+
+	name, rest, ok := strings.Cut(spec, "=")
+
+	if !ok {
+		return listener, fmt.Errorf("listener %q should look like name=addr[,tls][,require-account][,opers-only][,quiet]", spec)
+	}
+
+	options := strings.Split(rest, ",")
+	listener.Name, listener.Addr = name, options[0]
+
+	for _, option := range options[1:] {
+		switch option {
+		case "tls":
+			listener.TLS = true
+		case "require-account":
+			listener.RequireAccount = true
+		case "opers-only":
+			listener.OpersOnly = true
+		case "quiet":
+			listener.Quiet = true
+		default:
+			return listener, fmt.Errorf("listener %s: unknown option %q", name, option)
+		}
+	}
+
+	return listener, nil
+}
+
+// listenersFlag adds to a config's listeners with each -listen flag. When
+// LoadConfig replays the flags on top of a config file it sets them all
+// at once, so String separates them with spaces and Set takes several.
+type listenersFlag struct {
+	listeners *[]ListenerConfig
+	given     []string
+}
+
+func (f *listenersFlag) String() string {
+	if f == nil {
+		return ""
+	}
+
+	return strings.Join(f.given, " ")
+}
+
+func (f *listenersFlag) Set(value string) error {
+	for _, spec := range strings.Fields(value) {
+		listener, err := parseListenerSpec(spec)
+
+		if err != nil {
+			return err
+		}
+
+		*f.listeners = append(*f.listeners, listener)
+		f.given = append(f.given, spec)
+	}
+
+	return nil
+}
+
+// addrNetwork says which network addr is on. A path is a Unix socket;
+// anything else is a TCP address.
+func addrNetwork(addr string) string {
+	if strings.Contains(addr, "/") {
+		return "unix"
+	}
+
+	return "tcp"
+}
+
+func checkListeners(config *Config) error {
+	if config.ACMEHTTPAddr != "" && config.ACMEDomain == "" {
+		return fmt.Errorf("the ACME HTTP listener needs an ACME domain")
+	}
+
+	seen := make(map[string]bool)
+
+	for _, listener := range config.Listeners {
+		if !linkNameRegexp.MatchString(listener.Name) {
+			return fmt.Errorf("listener name %q can only have letters, digits, _ and -", listener.Name)
+		}
+
+		if seen[listener.Name] {
+			return fmt.Errorf("there is more than one listener named %s", listener.Name)
+		}
+
+		seen[listener.Name] = true
+
+		if listener.Addr == "" {
+			return fmt.Errorf("listener %s needs an address", listener.Name)
+		}
+
+		if listener.TLS && config.ACMEDomain == "" && (config.TLSCert == "" || config.TLSKey == "") {
+			return fmt.Errorf("listener %s uses TLS, which needs a TLS certificate and key or an ACME domain", listener.Name)
+		}
+	}
+
+	return nil
+}
+
+// usesTLS reports whether any listener needs the TLS certificate.
+func (config *Config) usesTLS() bool {
+	if config.TLSAddr != "" {
+		return true
+	}
+
+	for _, listener := range config.Listeners {
+		if listener.TLS {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newTLSConfig is the TLS setup shared by every TLS listener. With an
+// ACME manager, certificates come from it rather than the certificate and
+// key files.
+func newTLSConfig(config *Config, acme *autocert.Manager) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+
+	if acme != nil {
+		tlsConfig = acme.TLSConfig()
+	} else {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	tlsConfig.MinVersion = tls.VersionTLS12
+
+	if config.TLSClientCA != "" {
+		clientCAs, err := loadClientCAs(config.TLSClientCA)
+
+		if err != nil {
+			return nil, fmt.Errorf("loading client CAs: %w", err)
+		}
+
+		tlsConfig.ClientCAs = clientCAs
+
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+
+		if config.TLSRequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// ServeListener handles chat clients on one of the configured extra
+// listeners.
+func (server *Server) ServeListener(listener net.Listener, config *ListenerConfig) error {
+	return server.acceptLoop(listener, func(conn net.Conn) {
+		server.serve(conn, nativeCodec{stampFormat: server.stampFormat}, config)
+	})
+}
+
+// greet tells a client that has just connected what the listener needs
+// of it before it can chat.
+func (listener *ListenerConfig) greet(client *Client) {
+	if listener.RequireAccount {
+		client.Reply("This server requires an account: log in with 'login <nick> <password>' or 'auth <token>'")
+	}
+
+	if listener.OpersOnly {
+		client.Reply("This server is for operators only: send 'oper <password>' first")
+	}
+}
+
+// guardedCommand runs a command from a client on a listener with policies
+// once the client meets them. The check has to happen on the dispatcher,
+// which owns the account and operator state.
+type guardedCommand struct {
+	client   *Client
+	listener *ListenerConfig
+	cmd      Command
+}
+
+func (cmd *guardedCommand) Run(server *Server) {
+	refusal := cmd.listener.refuse(cmd.client, cmd.cmd)
+
+	if refusal != "" {
+		cmd.client.Error(refusal)
+		return
+	}
+
+	cmd.cmd.Run(server)
+}
+
+func (listener *ListenerConfig) refuse(client *Client, cmd Command) string {
+	switch cmd.(type) {
+	case *LoginCommand, *AuthCommand, *RegisterCommand, *NickCommand, *QuitCommand, *PongCommand, *HelpCommand, *ProtoCommand, *SeqCommand, *CompressCommand, *LagCommand, *TimeCommand:
+		return ""
+	}
+
+	if listener.RequireAccount && client.account == "" {
+		return "You must log in to an account first"
+	}
+
+	if _, oper := cmd.(*OperCommand); listener.OpersOnly && client.Role() < RoleModerator && !oper {
+		return "Only server operators may use this server; send 'oper <password>' first"
+	}
+
+	return ""
+}
@@ -0,0 +1,53 @@
+package chat
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel is the minimum level logged. Reloading the config can change it
+// while the server runs.
+var logLevel = new(slog.LevelVar)
+
+// NewLogger builds the server's logger from the configured level and
+// format.
+func NewLogger(w io.Writer, config *Config) (*slog.Logger, error) {
+	logLevel.Set(config.LogLevel)
+	options := &slog.HandlerOptions{Level: logLevel}
+
+	switch config.LogFormat {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("log format must be text or json, not %q", config.LogFormat)
+	}
+}
+
+// fatal logs err and exits, for errors the server can't start or keep
+// running without.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// connAttr identifies a client's connection in log lines. It is safe to use
+// from any goroutine.
+func (client *Client) connAttr() slog.Attr {
+	return slog.Group("client", "id", client.id, "addr", client.conn.RemoteAddr().String())
+}
+
+// logger also names the client's nick.
+func (client *Client) logger() *slog.Logger {
+	return slog.With(slog.Group("client", "id", client.id, "addr", client.conn.RemoteAddr().String(), "nick", client.Name()))
+}
+
+// commandName is how commands are named in debug logs: their type, which
+// says what was asked for without logging arguments like passwords.
+func commandName(cmd Command) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", cmd), "*main.")
+}
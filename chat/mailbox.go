@@ -0,0 +1,251 @@
+package chat
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Private messages to a registered nick that is offline wait in the
+// account's mailbox. Those not yet delivered are sent when the owner next
+// logs in, and all of them stay there to look back over until the owner
+// clears them. A full mailbox makes room by dropping its oldest mail.
+
+const (
+	mailboxSize = 100
+
+	// Each sender can mail mailRate messages a minute, in bursts of up to
+	// mailBurst, so nobody can flood a mailbox out from under its owner.
+	mailRate  = 5
+	mailBurst = 10
+
+	// Mail is saved mailSaveDelay after it arrives, along with whatever
+	// else arrives in the meantime.
+	mailSaveDelay = 2 * time.Second
+)
+
+type Mail struct {
+	From      string    `json:"from"`
+	Text      string    `json:"text"`
+	Time      time.Time `json:"time"`
+	Delivered bool      `json:"delivered,omitempty"`
+}
+
+// Event renders mail as the private message it was.
+func (mail *Mail) Event() *Event {
+	return &Event{
+		Type:    EventPrivate,
+		Time:    mail.Time,
+		Nick:    mail.From,
+		Text:    mail.Text,
+		History: true,
+	}
+}
+
+// Deliver adds mail to account's mailbox without saving it. If the mailbox
+// is full, the oldest mail the owner has already seen goes, or failing
+// that the oldest of all.
+func (store *AccountStore) Deliver(account *Account, mail *Mail) {
+	if len(account.Mailbox) >= mailboxSize {
+		oldest := slices.IndexFunc(account.Mailbox, func(mail *Mail) bool {
+			return mail.Delivered
+		})
+
+		account.Mailbox = slices.Delete(account.Mailbox, max(oldest, 0), max(oldest, 0)+1)
+	}
+
+	account.Mailbox = append(account.Mailbox, mail)
+}
+
+// SetMailbox replaces account's mailbox.
+func (store *AccountStore) SetMailbox(account *Account, mailbox []*Mail) error {
+	account.Mailbox = mailbox
+	return store.save()
+}
+
+// mailOffline leaves a private message from from in the mailbox of the
+// registered nick, who isn't online.
+func (server *Server) mailOffline(nick string, from *Client, text string) {
+	account, registered := server.accounts.Get(nick)
+
+	if !registered {
+		from.Error("No such nick")
+		return
+	}
+
+	if !server.CheckQuota(from) {
+		return
+	}
+
+	// As with an online client, the sender isn't told they are ignored.
+	reply := fmt.Sprintf("%s is offline; they'll get your message when they next log in", account.Nick)
+
+	if slices.Contains(account.Ignored, foldName(from.nick())) || server.isShadowMuted(from) {
+		from.Reply(reply)
+		return
+	}
+
+	// Private messages are sent off the dispatcher, so two could be
+	// mailed at once.
+	server.mailMu.Lock()
+	defer server.mailMu.Unlock()
+
+	now := time.Now()
+
+	if bucket := server.mailSender(from, now); !bucket.Allow(now) {
+		from.Error(fmt.Sprintf("You're mailing too fast, try again in %v", bucket.Wait(now).Round(time.Second)+time.Second))
+		return
+	}
+
+	mail := &Mail{
+		From: from.nick(),
+		Text: text,
+		Time: now,
+	}
+
+	server.accounts.Deliver(account, mail)
+	server.saveMailSoon()
+
+	server.notifyPrivate(account, mail)
+	from.Reply(reply)
+}
+
+// mailSender finds the bucket limiting how fast from can mail, by account
+// if from is logged in and by address if not, so changing nick doesn't
+// start afresh. Call it with mailMu held.
+func (server *Server) mailSender(from *Client, now time.Time) *TokenBucket {
+	key := "addr " + remoteIP(from.conn)
+
+	if from.account != "" {
+		key = "account " + foldName(from.account)
+	}
+
+	// Buckets that have had time to fill up again are as good as new.
+	if now.Sub(server.mailPruned) > time.Minute {
+		for key, bucket := range server.mailSenders {
+			if now.Sub(bucket.last) > mailBurst*time.Minute/mailRate {
+				delete(server.mailSenders, key)
+			}
+		}
+
+		server.mailPruned = now
+	}
+
+	bucket := server.mailSenders[key]
+
+	if bucket == nil {
+		bucket = NewTokenBucket(mailRate/60.0, mailBurst)
+		server.mailSenders[key] = bucket
+	}
+
+	return bucket
+}
+
+// saveMailSoon saves the accounts in a little while, unless that is already
+// on its way, so that mail arriving together is written out once. Call it
+// with mailMu held.
+func (server *Server) saveMailSoon() {
+	if server.mailUnsaved {
+		return
+	}
+
+	server.mailUnsaved = true
+
+	time.AfterFunc(mailSaveDelay, server.saveMail)
+}
+
+// saveMail saves mail that has arrived since the last save. Call it off the
+// dispatcher.
+func (server *Server) saveMail() {
+	// The dispatcher changes accounts with server.mu held, and concurrent
+	// mailers with mailMu.
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+
+	server.mailMu.Lock()
+	defer server.mailMu.Unlock()
+
+	if !server.mailUnsaved {
+		return
+	}
+
+	server.mailUnsaved = false
+
+	if err := server.accounts.save(); err != nil {
+		slog.Error("saving accounts", "err", err)
+	}
+}
+
+// deliverMail sends a client that has just logged in the mail it hasn't
+// seen yet.
+func (server *Server) deliverMail(client *Client, account *Account) {
+	waiting := 0
+
+	for _, mail := range account.Mailbox {
+		if !mail.Delivered {
+			client.Send(mail.Event())
+			mail.Delivered = true
+			waiting++
+		}
+	}
+
+	if waiting == 0 {
+		return
+	}
+
+	client.Reply(fmt.Sprintf("You got %d private messages while you were offline; see 'mailbox' to look over them and 'mailbox clear' to clear them", waiting))
+
+	if err := server.accounts.save(); err != nil {
+		slog.Error("saving accounts", "err", err)
+	}
+}
+
+// MailboxCommand lists or clears the messages in a client's mailbox.
+type MailboxCommand struct {
+	client *Client
+	clear  bool
+}
+
+func (cmd *MailboxCommand) Run(server *Server) {
+	account, exists := server.accounts.Get(cmd.client.account)
+
+	if cmd.client.account == "" || !exists {
+		cmd.client.Error("Only registered nicks have mailboxes, log in first")
+		return
+	}
+
+	if cmd.clear {
+		err := server.accounts.SetMailbox(account, nil)
+
+		if err != nil {
+			slog.Error("saving accounts", "err", err)
+			cmd.client.Error("Your mailbox could not be cleared")
+			return
+		}
+
+		cmd.client.Reply("Cleared your mailbox")
+		return
+	}
+
+	if len(account.Mailbox) == 0 {
+		cmd.client.Reply("Your mailbox is empty")
+		return
+	}
+
+	lines := make([]string, 0, len(account.Mailbox))
+
+	for _, mail := range account.Mailbox {
+		lines = append(lines, fmt.Sprintf("[%s] %s: %s", server.formatTime(mail.Time), mail.From, mail.Text))
+	}
+
+	cmd.client.Reply(strings.Join(lines, "\n"))
+}
+
+func parseMailbox(client *Client, args []string) Command {
+	return &MailboxCommand{
+		client: client,
+		clear:  len(args) > 0 && args[0] == "clear",
+	}
+}
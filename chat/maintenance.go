@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// The minutes before a maintenance shutdown at which everyone is warned,
+// on top of the warning when it is scheduled.
+var maintenanceWarnings = []int{10, 5, 1}
+
+// The longest a maintenance countdown can run.
+const maxMaintenanceMinutes = 24 * 60
+
+// maintenance is a scheduled shutdown counting down. The dispatcher owns it.
+type maintenance struct {
+	by    string
+	at    time.Time
+	timer *time.Timer
+}
+
+// MaintenanceCommand schedules a shutdown for maintenance, warning everyone
+// as it gets closer, or cancels the one scheduled. At zero the server stops
+// accepting connections and disconnects everyone, and Run drains and exits
+// as it does after a handoff.
+type MaintenanceCommand struct {
+	client  *Client
+	minutes int
+	cancel  bool
+}
+
+func (cmd *MaintenanceCommand) Run(server *Server) {
+	if cmd.cancel {
+		if server.maintenance == nil {
+			cmd.client.Error("No maintenance is scheduled")
+			return
+		}
+
+		server.maintenance.timer.Stop()
+		server.maintenance = nil
+
+		cmd.client.logger().Info("cancelled maintenance")
+		server.audit(cmd.client.Name(), "maintenance", "", "", "cancelled")
+		server.noticeAll("Scheduled maintenance has been cancelled")
+		return
+	}
+
+	if server.maintenance != nil {
+		server.maintenance.timer.Stop()
+	}
+
+	m := &maintenance{
+		by: cmd.client.Name(),
+		at: time.Now().Add(time.Duration(cmd.minutes) * time.Minute),
+	}
+
+	server.maintenance = m
+
+	cmd.client.logger().Info("scheduled maintenance", "minutes", cmd.minutes)
+	server.audit(cmd.client.Name(), "maintenance", "", "", fmt.Sprintf("in %d minutes", cmd.minutes))
+	server.maintenanceTick(m, cmd.minutes)
+}
+
+// maintenanceTick warns everyone that m is minutes away, or shuts down if
+// it is due, and sets a timer for the next warning.
+func (server *Server) maintenanceTick(m *maintenance, minutes int) {
+	if minutes == 0 {
+		server.shutDownForMaintenance()
+		return
+	}
+
+	server.noticeAll(fmt.Sprintf("The server will shut down for maintenance in %s", minutesText(minutes)))
+
+	next := 0
+
+	for _, warning := range maintenanceWarnings {
+		if warning < minutes {
+			next = warning
+			break
+		}
+	}
+
+	m.timer = time.AfterFunc(time.Until(m.at.Add(-time.Duration(next)*time.Minute)), func() {
+		server.incoming <- &maintenanceTickCommand{maintenance: m, minutes: next}
+	})
+}
+
+type maintenanceTickCommand struct {
+	maintenance *maintenance
+	minutes     int
+}
+
+func (cmd *maintenanceTickCommand) Run(server *Server) {
+	// Cancelled, or replaced by a newer schedule.
+	if server.maintenance != cmd.maintenance {
+		return
+	}
+
+	server.maintenanceTick(cmd.maintenance, cmd.minutes)
+}
+
+func (server *Server) shutDownForMaintenance() {
+	server.maintenance = nil
+
+	clients := server.clients.Sorted()
+
+	slog.Info("shutting down for maintenance", "clients", len(clients))
+	server.audit("server", "maintenance", "", "", "shutting down")
+
+	if server.stopListening != nil {
+		server.stopListening()
+	}
+
+	for _, client := range clients {
+		client.Notice("", "The server is shutting down for maintenance")
+		server.dismiss(client, "Server maintenance")
+	}
+}
+
+func minutesText(minutes int) string {
+	if minutes == 1 {
+		return "1 minute"
+	}
+
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+// noticeAll sends a server notice to every connected client.
+func (server *Server) noticeAll(text string) {
+	for _, client := range server.clients.Sorted() {
+		client.Notice("", text)
+	}
+}
+
+func parseMaintenance(client *Client, args []string) Command {
+	if args[0] == "cancel" {
+		return &MaintenanceCommand{client: client, cancel: true}
+	}
+
+	minutes, err := strconv.Atoi(args[0])
+
+	if err != nil || minutes <= 0 || minutes > maxMaintenanceMinutes {
+		return nil
+	}
+
+	return &MaintenanceCommand{
+		client:  client,
+		minutes: minutes,
+	}
+}
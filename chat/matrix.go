@@ -0,0 +1,304 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	matrixQueueSize   = 1024
+	matrixMaxBody     = 1 << 20
+	matrixSendRetries = 3
+	matrixSeenTxns    = 1000
+)
+
+// MatrixBridge is a Matrix application service that mirrors rooms here with
+// Matrix rooms. The homeserver pushes events to it over HTTP, which appear
+// here as localpart@matrix, and messages from here are sent to Matrix by
+// the bridge user as "<nick> text".
+type MatrixBridge struct {
+	homeserver string
+	user       string
+	asToken    string
+	hsToken    string
+
+	rooms       map[string]string // Matrix room ID to room
+	matrixRooms map[string]string // room to Matrix room ID
+	outgoing    chan *matrixSend
+	client      *http.Client
+
+	// The homeserver retries a transaction until it gets an answer, so the
+	// same one can arrive more than once.
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+type matrixSend struct {
+	roomID string
+	body   string
+}
+
+type matrixTransaction struct {
+	Events []struct {
+		Type    string `json:"type"`
+		RoomID  string `json:"room_id"`
+		Sender  string `json:"sender"`
+		Content struct {
+			MsgType string `json:"msgtype"`
+			Body    string `json:"body"`
+		} `json:"content"`
+	} `json:"events"`
+}
+
+// NewMatrixBridge maps rooms given as "!roomid:server=room", separated by
+// commas.
+func NewMatrixBridge(homeserver, user, asToken, hsToken, mapping string) (*MatrixBridge, error) {
+	bridge := &MatrixBridge{
+		homeserver:  strings.TrimRight(homeserver, "/"),
+		user:        user,
+		asToken:     asToken,
+		hsToken:     hsToken,
+		rooms:       make(map[string]string),
+		matrixRooms: make(map[string]string),
+		outgoing:    make(chan *matrixSend, matrixQueueSize),
+		client:      &http.Client{Timeout: 30 * time.Second},
+		seen:        make(map[string]bool),
+	}
+
+	if bridge.homeserver == "" || user == "" || asToken == "" || hsToken == "" {
+		return nil, fmt.Errorf("the Matrix bridge needs a homeserver, a user and both tokens")
+	}
+
+	for _, entry := range strings.Split(mapping, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		roomID, room, _ := strings.Cut(entry, "=")
+
+		if !strings.HasPrefix(roomID, "!") || !validName(room) {
+			return nil, fmt.Errorf("bad Matrix bridge room %q, expected !roomid:server=room", entry)
+		}
+
+		bridge.rooms[roomID] = room
+		bridge.matrixRooms[foldName(room)] = roomID
+	}
+
+	if len(bridge.rooms) == 0 {
+		return nil, fmt.Errorf("the Matrix bridge needs at least one room")
+	}
+
+	return bridge, nil
+}
+
+// Message sends a local room message to the Matrix room bridged with the
+// room, if there is one. It never blocks.
+func (bridge *MatrixBridge) Message(message *Message) {
+	if bridge == nil {
+		return
+	}
+
+	roomID, bridged := bridge.matrixRooms[foldName(message.room)]
+
+	if !bridged {
+		return
+	}
+
+	select {
+	case bridge.outgoing <- &matrixSend{roomID: roomID, body: fmt.Sprintf("<%s> %s", message.nick, message.text)}:
+	default:
+		slog.Warn("Matrix bridge queue full, dropping message", "room", message.room)
+	}
+}
+
+// Run joins the bridged Matrix rooms and sends messages to them until the
+// process exits.
+func (bridge *MatrixBridge) Run() {
+	for roomID := range bridge.rooms {
+		err := bridge.request(http.MethodPost, "/_matrix/client/v3/join/"+url.PathEscape(roomID), struct{}{})
+
+		if err != nil {
+			slog.Error("joining Matrix room", "matrix_room", roomID, "err", err)
+		}
+	}
+
+	txn := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	for i := 0; ; i++ {
+		send := <-bridge.outgoing
+		path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%s.%d", url.PathEscape(send.roomID), txn, i)
+		content := map[string]string{"msgtype": "m.text", "body": send.body}
+
+		// Reusing the transaction ID makes retries safe: the homeserver
+		// only posts the message once.
+		backoff := time.Second
+
+		for attempt := 1; ; attempt++ {
+			err := bridge.request(http.MethodPut, path, content)
+
+			if err == nil {
+				break
+			}
+
+			if attempt == matrixSendRetries {
+				slog.Error("sending to Matrix, dropping message", "matrix_room", send.roomID, "err", err)
+				break
+			}
+
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (bridge *MatrixBridge) request(method, path string, body any) error {
+	data, err := json.Marshal(body)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, bridge.homeserver+path, bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+bridge.asToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := bridge.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, matrixMaxBody))
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("homeserver answered %s", resp.Status)
+	}
+
+	return nil
+}
+
+// ServeMatrix answers the application service API the homeserver pushes
+// events to.
+func (server *Server) ServeMatrix(listener net.Listener) error {
+	httpServer := &http.Server{
+		Handler:           server.matrix.auth(http.HandlerFunc(server.matrixRoute)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return httpServer.Serve(listener)
+}
+
+func (server *Server) matrixRoute(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1")
+	resource, arg, _ := strings.Cut(strings.Trim(path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodPut && resource == "transactions" && arg != "":
+		server.matrixTransaction(w, r, arg)
+	default:
+		// The bridge doesn't create users or rooms on demand, so user and
+		// alias queries are all answered with not found.
+		writeJSON(w, http.StatusNotFound, map[string]string{"errcode": "M_NOT_FOUND"})
+	}
+}
+
+// auth accepts the homeserver's token as a bearer token or, from older
+// homeservers, as the access_token parameter.
+func (bridge *MatrixBridge) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if !ok {
+			token = r.URL.Query().Get("access_token")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(bridge.hsToken)) != 1 {
+			writeJSON(w, http.StatusForbidden, map[string]string{"errcode": "M_FORBIDDEN"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (server *Server) matrixTransaction(w http.ResponseWriter, r *http.Request, txn string) {
+	bridge := server.matrix
+
+	var transaction matrixTransaction
+
+	err := json.NewDecoder(io.LimitReader(r.Body, matrixMaxBody)).Decode(&transaction)
+
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"errcode": "M_NOT_JSON"})
+		return
+	}
+
+	bridge.mu.Lock()
+	repeat := bridge.seen[txn]
+
+	if len(bridge.seen) >= matrixSeenTxns {
+		clear(bridge.seen)
+	}
+
+	bridge.seen[txn] = true
+	bridge.mu.Unlock()
+
+	if repeat {
+		writeJSON(w, http.StatusOK, struct{}{})
+		return
+	}
+
+	for _, event := range transaction.Events {
+		room, bridged := bridge.rooms[event.RoomID]
+
+		if !bridged || event.Type != "m.room.message" || event.Sender == bridge.user {
+			continue
+		}
+
+		switch event.Content.MsgType {
+		case "m.text", "m.notice", "m.emote":
+		default:
+			continue
+		}
+
+		localpart, _, _ := strings.Cut(strings.TrimPrefix(event.Sender, "@"), ":")
+		now := time.Now()
+
+		// Lines here can't hold a newline, so a multi-line Matrix message
+		// becomes one message per line.
+		for _, line := range strings.Split(event.Content.Body, "\n") {
+			line = strings.TrimRight(line, "\r")
+
+			if line == "" {
+				continue
+			}
+
+			msg := &clusterMessage{Room: room, Nick: localpart + "@matrix", Text: line, Time: now}
+
+			server.call(func() {
+				server.DeliverRemote(msg)
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, struct{}{})
+}
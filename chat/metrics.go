@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are counters and gauges exposed in the Prometheus text format.
+// Everything is atomic since connections, rooms and the dispatcher all
+// update them from their own goroutines.
+type Metrics struct {
+	connections     atomic.Uint64
+	refusedBanned   atomic.Uint64
+	refusedPolicy   atomic.Uint64
+	refusedChurn    atomic.Uint64
+	refusedLimit    atomic.Uint64
+	clients         atomic.Int64
+	rooms           atomic.Int64
+	messages        atomic.Uint64
+	linesRead       atomic.Uint64
+	linesWritten    atomic.Uint64
+	bytesWritten    atomic.Uint64
+	dropped         atomic.Uint64
+	parseErrors     atomic.Uint64
+	broadcastFanout Histogram
+}
+
+var fanoutBuckets = [...]float64{0.00001, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// Histogram counts observations into fixed buckets, in seconds.
+type Histogram struct {
+	counts [len(fanoutBuckets) + 1]atomic.Uint64
+	sum    atomic.Int64
+	total  atomic.Uint64
+}
+
+func (histogram *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+
+	for i < len(fanoutBuckets) && seconds > fanoutBuckets[i] {
+		i++
+	}
+
+	histogram.counts[i].Add(1)
+	histogram.sum.Add(int64(d))
+	histogram.total.Add(1)
+}
+
+func (histogram *Histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+
+	var cumulative uint64
+
+	for i, bound := range fanoutBuckets {
+		cumulative += histogram.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+
+	cumulative += histogram.counts[len(fanoutBuckets)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %g\n", name, time.Duration(histogram.sum.Load()).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, histogram.total.Load())
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+func (metrics *Metrics) Expose(w io.Writer) {
+	writeMetric(w, "chatserver_connections_total", "counter", "Connections accepted.", metrics.connections.Load())
+
+	fmt.Fprintf(w, "# HELP chatserver_connections_refused_total Connections closed before serving them.\n")
+	fmt.Fprintf(w, "# TYPE chatserver_connections_refused_total counter\n")
+	fmt.Fprintf(w, "chatserver_connections_refused_total{reason=\"banned\"} %d\n", metrics.refusedBanned.Load())
+	fmt.Fprintf(w, "chatserver_connections_refused_total{reason=\"policy\"} %d\n", metrics.refusedPolicy.Load())
+	fmt.Fprintf(w, "chatserver_connections_refused_total{reason=\"churn\"} %d\n", metrics.refusedChurn.Load())
+	fmt.Fprintf(w, "chatserver_connections_refused_total{reason=\"limit\"} %d\n", metrics.refusedLimit.Load())
+
+	writeMetric(w, "chatserver_clients", "gauge", "Clients currently connected.", metrics.clients.Load())
+	writeMetric(w, "chatserver_rooms", "gauge", "Rooms currently open.", metrics.rooms.Load())
+	writeMetric(w, "chatserver_messages_total", "counter", "Messages broadcast to rooms.", metrics.messages.Load())
+	writeMetric(w, "chatserver_lines_read_total", "counter", "Lines read from clients.", metrics.linesRead.Load())
+	writeMetric(w, "chatserver_lines_written_total", "counter", "Lines written to clients.", metrics.linesWritten.Load())
+	writeMetric(w, "chatserver_bytes_written_total", "counter", "Bytes written to clients.", metrics.bytesWritten.Load())
+	writeMetric(w, "chatserver_dropped_events_total", "counter", "Events dropped because a client's buffer was full.", metrics.dropped.Load())
+	writeMetric(w, "chatserver_parse_errors_total", "counter", "Lines that could not be parsed as a command.", metrics.parseErrors.Load())
+
+	metrics.broadcastFanout.write(w, "chatserver_broadcast_fanout_seconds", "Time to hand a message to every member of a room.")
+}
+
+func (server *Server) ServeMetrics(listener net.Listener) error {
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/metrics":
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+				server.metrics.Expose(w)
+			case "/healthz":
+				server.serveHealth(w, false)
+			case "/readyz":
+				server.serveHealth(w, true)
+			default:
+				http.NotFound(w, r)
+			}
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return httpServer.Serve(listener)
+}
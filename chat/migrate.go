@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// MigrateCommand tells everyone connected to reconnect to another address,
+// for moving the server. JSON clients get a migrate event carrying the
+// address, so they can follow it without asking. With a grace period, the
+// clients told are disconnected once it is up.
+type MigrateCommand struct {
+	client *Client
+	addr   string
+	grace  time.Duration
+}
+
+func (cmd *MigrateCommand) Run(server *Server) {
+	clients := server.clients.Sorted()
+
+	cmd.client.logger().Info("migrating clients", "addr", cmd.addr, "clients", len(clients), "grace", cmd.grace)
+	server.audit(cmd.client.Name(), "migrate", "", "", cmd.addr)
+
+	for _, client := range clients {
+		client.Send(&Event{Type: EventMigrate, Text: cmd.addr})
+	}
+
+	if cmd.grace > 0 {
+		time.AfterFunc(cmd.grace, func() {
+			server.incoming <- &migrateCloseCommand{clients: clients, addr: cmd.addr}
+		})
+	}
+
+	cmd.client.Reply(fmt.Sprintf("Told %d clients to reconnect to %s", len(clients), cmd.addr))
+}
+
+// migrateCloseCommand disconnects the clients told to migrate that are
+// still connected.
+type migrateCloseCommand struct {
+	clients []*Client
+	addr    string
+}
+
+func (cmd *migrateCloseCommand) Run(server *Server) {
+	closed := 0
+
+	for _, client := range cmd.clients {
+		if !server.clients.Has(client) {
+			continue
+		}
+
+		server.dismiss(client, "Moved to "+cmd.addr)
+		closed++
+	}
+
+	slog.Info("closed migrated clients", "addr", cmd.addr, "clients", closed)
+}
+
+func parseMigrate(client *Client, args []string) Command {
+	var grace time.Duration
+
+	if args[1] != "" {
+		var err error
+		grace, err = time.ParseDuration(args[1])
+
+		if err != nil || grace <= 0 {
+			return nil
+		}
+	}
+
+	return &MigrateCommand{
+		client: client,
+		addr:   args[0],
+		grace:  grace,
+	}
+}
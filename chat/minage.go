@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accountAgeWait reports whether client's account is old enough to send
+// messages to room, and if not, how long until it will be. A wait of 0
+// means client isn't logged in, so waiting won't help. Operators and
+// voiced members are let through whatever their age.
+func (server *Server) accountAgeWait(room *Room, client *Client, now time.Time) (time.Duration, bool) {
+	if room.minAge == 0 || room.IsOp(client) || room.voiced[client] {
+		return 0, true
+	}
+
+	account, exists := server.accounts.Get(client.account)
+
+	if client.account == "" || !exists {
+		return 0, false
+	}
+
+	if age := now.Sub(account.Created); age < room.minAge {
+		return room.minAge - age, false
+	}
+
+	return 0, true
+}
+
+// CheckAccountAge reports whether client's account is old enough to send
+// messages to room, telling them if it isn't.
+func (server *Server) CheckAccountAge(room *Room, client *Client) bool {
+	wait, ok := server.accountAgeWait(room, client, time.Now())
+
+	if ok {
+		return true
+	}
+
+	text := fmt.Sprintf("Only accounts at least %s old can send messages to %s", formatAge(room.minAge), plainName(room.name))
+
+	if wait == 0 {
+		text += "; log in to one first"
+	} else {
+		text += fmt.Sprintf("; yours will be in %s", formatAge(wait))
+	}
+
+	client.Error(text)
+	return false
+}
+
+// MinAgeCommand sets how old an account must be to send messages to a
+// room. Anyone can still join and read it.
+type MinAgeCommand struct {
+	client *Client
+	room   string
+	age    time.Duration
+}
+
+func (cmd *MinAgeCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	cmd.client.logger().Info("changed room minimum account age", "room", room.name, "age", cmd.age)
+	room.minAge = cmd.age
+	server.saveRoom(room)
+
+	if cmd.age == 0 {
+		server.audit(cmd.client.Name(), "minage off", room.name, "", "")
+		room.Notice(fmt.Sprintf("%s let accounts of any age send messages to %s", plainName(cmd.client.Name()), plainName(room.name)))
+	} else {
+		server.audit(cmd.client.Name(), "minage "+formatAge(cmd.age), room.name, "", "")
+		room.Notice(fmt.Sprintf("%s made %s only take messages from accounts at least %s old", plainName(cmd.client.Name()), plainName(room.name), formatAge(cmd.age)))
+	}
+}
+
+// parseAge parses an account age, either a number of days like 7d or a
+// Go duration like 12h.
+func parseAge(text string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(text, "d"); found {
+		n, err := strconv.Atoi(days)
+
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", text)
+		}
+
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(text)
+}
+
+// formatAge writes age in days once it is at least one, otherwise to the
+// minute.
+func formatAge(age time.Duration) string {
+	switch {
+	case age >= 48*time.Hour:
+		return fmt.Sprintf("%d days", age/(24*time.Hour))
+	case age >= 24*time.Hour:
+		return "1 day"
+	case age < time.Minute:
+		return "1m"
+	default:
+		return strings.TrimSuffix(age.Truncate(time.Minute).String(), "0s")
+	}
+}
+
+func parseMinAge(client *Client, args []string) Command {
+	var age time.Duration
+
+	if args[1] != "off" {
+		var err error
+		age, err = parseAge(args[1])
+
+		if err != nil || age <= 0 {
+			return nil
+		}
+	}
+
+	return &MinAgeCommand{
+		client: client,
+		room:   args[0],
+		age:    age,
+	}
+}
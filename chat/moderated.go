@@ -0,0 +1,128 @@
+package chat
+
+import (
+	"fmt"
+)
+
+// In a moderated room only operators and members they have given voice
+// can send messages; everyone else can only read. Voice, like operator
+// status, lasts until the member leaves.
+
+const moderatedError = "That room is moderated, you need voice to send messages"
+
+// CanSpeak reports whether client may send messages to room.
+func (room *Room) CanSpeak(client *Client) bool {
+	return !room.moderated || room.voiced[client] || room.IsOp(client)
+}
+
+// ModeratedCommand makes a room moderated or opens it up again.
+type ModeratedCommand struct {
+	client *Client
+	room   string
+	on     bool
+}
+
+func (cmd *ModeratedCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil || room.moderated == cmd.on {
+		return
+	}
+
+	room.moderated = cmd.on
+	server.saveRoom(room)
+
+	mode, text := "+m", "%s made %s moderated; only operators and voiced members can send messages"
+
+	if !cmd.on {
+		mode, text = "-m", "%s let everyone send messages to %s again"
+	}
+
+	cmd.client.logger().Info("changed room mode", "room", room.name, "mode", mode)
+	server.audit(cmd.client.Name(), "mode "+mode, room.name, "", "")
+
+	room.Send(&Event{
+		Type: EventMode,
+		Nick: cmd.client.Name(),
+		Mode: mode,
+		Text: fmt.Sprintf(text, plainName(cmd.client.Name()), plainName(room.name)),
+	})
+}
+
+// VoiceCommand gives a member of a room voice or takes it away.
+type VoiceCommand struct {
+	client *Client
+	room   string
+	nick   string
+	voice  bool
+}
+
+func (cmd *VoiceCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	target, exists := server.LookupNick(cmd.nick)
+
+	if !exists {
+		cmd.client.Error("No such nick")
+		return
+	}
+
+	if !room.HasClient(target) {
+		cmd.client.Error("They aren't in that room")
+		return
+	}
+
+	if room.voiced[target] == cmd.voice {
+		return
+	}
+
+	mode, verb := "+v", "gave voice to"
+
+	if cmd.voice {
+		room.voiced[target] = true
+	} else {
+		delete(room.voiced, target)
+		mode, verb = "-v", "took voice from"
+	}
+
+	cmd.client.logger().Info("changed room mode", "room", room.name, "target", target.Name(), "mode", mode)
+	server.audit(cmd.client.Name(), "mode "+mode, room.name, target.Name(), "")
+
+	room.Send(&Event{
+		Type:   EventMode,
+		Nick:   cmd.client.Name(),
+		Target: target.Name(),
+		Mode:   mode,
+		Text:   fmt.Sprintf("%s %s %s", plainName(cmd.client.Name()), verb, plainName(target.Name())),
+	})
+}
+
+func parseModerated(client *Client, args []string) Command {
+	return &ModeratedCommand{
+		client: client,
+		room:   args[0],
+		on:     args[1] == "on",
+	}
+}
+
+func parseVoice(client *Client, args []string) Command {
+	return &VoiceCommand{
+		client: client,
+		room:   args[0],
+		nick:   args[1],
+		voice:  true,
+	}
+}
+
+func parseDevoice(client *Client, args []string) Command {
+	return &VoiceCommand{
+		client: client,
+		room:   args[0],
+		nick:   args[1],
+		voice:  false,
+	}
+}
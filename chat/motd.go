@@ -0,0 +1,70 @@
+package chat
+
+// version is reported in the message of the day. Release builds set it
+// with -ldflags "-X main.version=...".
+var version = "dev"
+
+const motdHints = "Pick a nick with 'nick <name>', see the rooms with 'list' and join or create one with 'join <room>'. Send 'help' for everything else"
+
+// MOTD is what a client is greeted with: the server version, the message
+// of the day file if there is one, and a few hints to get started.
+func (server *Server) MOTD() string {
+	motd := "chatserver " + version
+
+	if server.motd != "" {
+		motd += "\n" + server.motd
+	}
+
+	return motd + "\n" + motdHints
+}
+
+// ReloadMOTD reads the message of the day file again. On error the old
+// message is kept.
+func (server *Server) ReloadMOTD() error {
+	if server.motdPath == "" {
+		return nil
+	}
+
+	motd, err := loadTextFile(server.motdPath)
+
+	if err != nil {
+		return err
+	}
+
+	server.motd = motd
+	return nil
+}
+
+type MOTDCommand struct {
+	client *Client
+	reload bool
+}
+
+func (cmd *MOTDCommand) Run(server *Server) {
+	if !cmd.reload {
+		cmd.client.Reply(server.MOTD())
+		return
+	}
+
+	if !server.CheckRole(cmd.client, RoleAdmin, "Reloading the message of the day") {
+		return
+	}
+
+	err := server.ReloadMOTD()
+
+	if err != nil {
+		cmd.client.logger().Error("reloading motd", "err", err)
+		cmd.client.Error("Could not reload the message of the day")
+		return
+	}
+
+	cmd.client.logger().Info("reloaded motd", "path", server.motdPath)
+	cmd.client.Reply("Reloaded the message of the day")
+}
+
+func parseMOTD(client *Client, args []string) Command {
+	return &MOTDCommand{
+		client: client,
+		reload: args[0] != "",
+	}
+}
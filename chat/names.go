@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const maxNameLength = 32
+
+// bareNamePattern matches nicks and room names as they can be typed
+// without quotes: letters and digits from any script, combining marks and
+// a little punctuation.
+const bareNamePattern = "[\\pL\\pM\\p{Nd}_-]{1,32}"
+
+// namePattern matches a name written out in a message, as in an @mention,
+// either bare or in double quotes. A quoted name can also have spaces and
+// other punctuation, with \" and \\ standing for a quote and a backslash.
+const namePattern = "(?:" + bareNamePattern + "|\"(?:[^\"\\\\\\n]|\\\\[\"\\\\])+\")"
+
+// foldName is the form names are compared in, so that "Go" and "go" are
+// the same room, and so are an é typed as one character or as e and an
+// accent. Rooms and clients keep the casing they were named with for
+// display.
+func foldName(name string) string {
+	return norm.NFC.String(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// normalizeName puts a name a client sent into NFC, the form names are kept
+// in, so the same name always looks and compares the same however it was
+// typed.
+func normalizeName(name string) string {
+	return norm.NFC.String(name)
+}
+
+func sameName(a, b string) bool {
+	return foldName(a) == foldName(b)
+}
+
+// validName reports whether name can be a nick or room name: up to 32
+// printable characters, with spaces only between other characters.
+func validName(name string) bool {
+	length := utf8.RuneCountInString(name)
+
+	if length == 0 || length > maxNameLength || strings.TrimSpace(name) != name {
+		return false
+	}
+
+	for _, r := range name {
+		if r == utf8.RuneError || !unicode.IsGraphic(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// unquoteName turns a name matched by namePattern into the name it stands
+// for. It returns false if a quoted name isn't a valid name.
+func unquoteName(s string) (string, bool) {
+	quoted, ok := strings.CutPrefix(s, "\"")
+
+	if !ok {
+		return s, true
+	}
+
+	quoted, ok = strings.CutSuffix(quoted, "\"")
+
+	if !ok {
+		return "", false
+	}
+
+	var b strings.Builder
+	escaped := false
+
+	for _, r := range quoted {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+
+		escaped = false
+		b.WriteRune(r)
+	}
+
+	name := b.String()
+
+	return name, !escaped && validName(name)
+}
+
+// quoteName returns name as it has to be written in a command, quoting it
+// if it can't be written bare.
+func quoteName(name string) string {
+	if linkNameRegexp.MatchString(name) {
+		return name
+	}
+
+	replacer := strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+
+	return "\"" + replacer.Replace(name) + "\""
+}
+
+// plainName returns name as it is written in plain text output: bare unless
+// it has spaces, quotes or backslashes, which would make the line ambiguous.
+// Unlike quoteName it leaves other punctuation alone, so remote nicks like
+// alice@example stay readable.
+func plainName(name string) string {
+	if !strings.ContainsAny(name, " \"\\") {
+		return name
+	}
+
+	return quoteName(name)
+}
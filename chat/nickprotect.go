@@ -0,0 +1,188 @@
+package chat
+
+import (
+	"fmt"
+	"time"
+)
+
+// How a registered nick is enforced against clients who haven't logged in
+// to it. Block refuses the nick outright; rename and disconnect let them
+// take it but warn them, and rename them to a guest or disconnect them if
+// they haven't logged in when the grace period is up.
+const (
+	ProtectBlock      = "block"
+	ProtectRename     = "rename"
+	ProtectDisconnect = "disconnect"
+)
+
+// Protection is how account's nick is enforced. Accounts from before there
+// was a choice are blocked.
+func (account *Account) Protection() string {
+	if account.Protect == "" {
+		return ProtectBlock
+	}
+
+	return account.Protect
+}
+
+func (store *AccountStore) SetProtect(account *Account, mode string) error {
+	account.Protect = mode
+	return store.save()
+}
+
+// enforceNick warns client, which has just taken account's nick without
+// logging in, and comes back to it once the grace period is up.
+func (server *Server) enforceNick(client *Client, account *Account) {
+	what := "renamed"
+
+	if account.Protection() == ProtectDisconnect {
+		what = "disconnected"
+	}
+
+	client.Notice("", fmt.Sprintf("%s is registered to someone else; log in within %s or you will be %s", account.Nick, server.nickGrace, what))
+
+	time.AfterFunc(server.nickGrace, func() {
+		server.incoming <- &enforceNickCommand{client: client, nick: account.Nick}
+	})
+}
+
+type enforceNickCommand struct {
+	client *Client
+	nick   string
+}
+
+func (cmd *enforceNickCommand) Run(server *Server) {
+	client := cmd.client
+
+	if !server.clients.Has(client) || !sameName(client.nick(), cmd.nick) || sameName(client.account, cmd.nick) {
+		return
+	}
+
+	account, exists := server.accounts.Get(cmd.nick)
+
+	if !exists {
+		return
+	}
+
+	client.logger().Info("enforcing nick", "account", cmd.nick, "protect", account.Protection())
+	server.audit("server", "enforce nick", "", cmd.nick, "protection is "+account.Protection())
+
+	if account.Protection() == ProtectDisconnect {
+		server.evict(client, "Nick protection for "+cmd.nick)
+		return
+	}
+
+	server.ChangeNick(client, "")
+	client.Notice("", cmd.nick+" is registered; you are now "+client.Name())
+}
+
+type ProtectCommand struct {
+	client *Client
+	mode   string
+}
+
+func (cmd *ProtectCommand) Run(server *Server) {
+	account, exists := server.accounts.Get(cmd.client.account)
+
+	if cmd.client.account == "" || !exists {
+		cmd.client.Error("You must log in first")
+		return
+	}
+
+	if cmd.mode == "" {
+		cmd.client.Reply(fmt.Sprintf("Protection for %s is %s", account.Nick, account.Protection()))
+		return
+	}
+
+	err := server.accounts.SetProtect(account, cmd.mode)
+
+	if err != nil {
+		cmd.client.logger().Error("saving accounts", "err", err)
+		cmd.client.Error("Protection could not be saved")
+		return
+	}
+
+	cmd.client.Reply(fmt.Sprintf("Protection for %s is now %s", account.Nick, cmd.mode))
+}
+
+// GhostCommand disconnects a session holding a registered nick, such as a
+// stale connection of the owner's. The owner can ghost once logged in, and
+// anyone else with the account's password.
+type GhostCommand struct {
+	client   *Client
+	nick     string
+	password string
+}
+
+func (cmd *GhostCommand) Run(server *Server) {
+	account, exists := server.accounts.Get(cmd.nick)
+
+	if !exists {
+		cmd.client.Error("No such account")
+		return
+	}
+
+	if sameName(cmd.client.account, cmd.nick) {
+		server.Ghost(cmd.client, cmd.nick)
+		return
+	}
+
+	if cmd.password == "" {
+		cmd.client.Error("Log in or give the password to ghost " + cmd.nick)
+		return
+	}
+
+	server.checkPassword(cmd.client, account, cmd.password, func(ok bool) Command {
+		return &ghostCheckedCommand{client: cmd.client, account: account, ok: ok}
+	})
+}
+
+type ghostCheckedCommand struct {
+	client  *Client
+	account *Account
+	ok      bool
+}
+
+func (cmd *ghostCheckedCommand) Run(server *Server) {
+	if !server.clients.Has(cmd.client) {
+		return
+	}
+
+	if !cmd.ok {
+		cmd.client.logger().Warn("failed ghost", "account", cmd.account.Nick)
+		cmd.client.Error("Wrong password")
+		return
+	}
+
+	server.Ghost(cmd.client, cmd.account.Nick)
+}
+
+// Ghost disconnects whoever other than client holds nick.
+func (server *Server) Ghost(client *Client, nick string) {
+	holder, taken := server.LookupNick(nick)
+
+	if !taken || holder == client {
+		client.Error("Nobody else is using " + nick)
+		return
+	}
+
+	client.logger().Info("ghosted", "target", nick)
+	server.audit(client.Name(), "ghost", "", nick, "")
+	server.evict(holder, "Ghosted by "+client.Name())
+	client.Reply("Disconnected the session using " + nick)
+}
+
+func parseProtect(client *Client, args []string) Command {
+	return &ProtectCommand{
+		client: client,
+		mode:   args[0],
+	}
+}
+
+func parseGhost(client *Client, args []string) Command {
+	return &GhostCommand{
+		client:   client,
+		nick:     args[0],
+		password: args[1],
+	}
+}
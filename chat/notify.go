@@ -0,0 +1,139 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+const notifyQueueSize = 256
+
+// Kinds of notification.
+const (
+	NotifyMention = "mention"
+	NotifyPrivate = "private"
+)
+
+// A Notifier hears about messages for registered users who aren't online,
+// so a companion app can tell them. Notify is called from the goroutines
+// of the clients sending those messages, several at once, so it must be
+// safe for concurrent use, and mustn't block.
+type Notifier interface {
+	Notify(notification *Notification)
+}
+
+type Notification struct {
+	Type      string    `json:"type"`
+	Account   string    `json:"account"`
+	From      string    `json:"from"`
+	Room      string    `json:"room,omitempty"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// HTTPNotifier POSTs each notification as JSON to a URL, retrying the way
+// webhooks do.
+type HTTPNotifier struct {
+	url    string
+	queue  chan *Notification
+	client *http.Client
+}
+
+func NewHTTPNotifier(target string) (*HTTPNotifier, error) {
+	parsed, err := url.Parse(target)
+
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("bad notify URL %q, expected http(s)://host/path", target)
+	}
+
+	return &HTTPNotifier{
+		url:    target,
+		queue:  make(chan *Notification, notifyQueueSize),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (notifier *HTTPNotifier) Notify(notification *Notification) {
+	select {
+	case notifier.queue <- notification:
+	default:
+		slog.Warn("notify queue full, dropping notification", "url", notifier.url, "account", notification.Account)
+	}
+}
+
+// Run sends queued notifications until the process exits.
+func (notifier *HTTPNotifier) Run() {
+	for notification := range notifier.queue {
+		data, err := json.Marshal(notification)
+
+		if err != nil {
+			slog.Error("encoding notification", "err", err)
+			continue
+		}
+
+		attempts, err := postJSON(notifier.client, notifier.url, data)
+
+		if err != nil {
+			slog.Error("notification failed, dropping it", "url", notifier.url, "account", notification.Account, "err", err, "attempts", attempts)
+		}
+	}
+}
+
+// notifyMentions tells the notifier about registered users that message
+// mentions who aren't online. Nothing from private or encrypted rooms is
+// passed on, since the notifier can't tell who may read it.
+func (server *Server) notifyMentions(room *Room, message *Message) {
+	if server.notifier == nil || room.encrypted || room.inviteOnly || room.key != "" {
+		return
+	}
+
+	seen := make(map[string]bool)
+
+	for _, match := range mentionRegexp.FindAllStringSubmatch(message.text, -1) {
+		nick, _ := unquoteName(match[1])
+
+		if _, online := server.LookupNick(nick); online {
+			continue
+		}
+
+		account, registered := server.accounts.Get(nick)
+
+		if !registered || seen[foldName(account.Nick)] || foldName(account.Nick) == foldName(message.nick) {
+			continue
+		}
+
+		seen[foldName(account.Nick)] = true
+
+		if slices.Contains(account.Ignored, foldName(message.nick)) {
+			continue
+		}
+
+		server.notifier.Notify(&Notification{
+			Type:      NotifyMention,
+			Account:   account.Nick,
+			From:      message.nick,
+			Room:      room.name,
+			Message:   message.text,
+			Timestamp: message.time,
+		})
+	}
+}
+
+// notifyPrivate tells the notifier about mail left for account.
+func (server *Server) notifyPrivate(account *Account, mail *Mail) {
+	if server.notifier == nil {
+		return
+	}
+
+	server.notifier.Notify(&Notification{
+		Type:      NotifyPrivate,
+		Account:   account.Nick,
+		From:      mail.From,
+		Message:   mail.Text,
+		Timestamp: mail.Time,
+	})
+}
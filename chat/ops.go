@@ -0,0 +1,573 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRoomLimit is the most members setlimit can allow.
+const maxRoomLimit = 999999
+
+// IsOp reports whether client may moderate room. Moderators and admins
+// count as operators of every room.
+func (room *Room) IsOp(client *Client) bool {
+	return room.ops[client] || client.Role() >= RoleModerator
+}
+
+// A roomBan keeps a nick out of a room, until expires if it is set.
+type roomBan struct {
+	nick    string
+	by      string
+	set     time.Time
+	expires time.Time
+}
+
+func (ban *roomBan) expired(now time.Time) bool {
+	return !ban.expires.IsZero() && !now.Before(ban.expires)
+}
+
+// Banned reports whether nick is banned from room.
+func (room *Room) Banned(nick string) bool {
+	ban := room.banned[foldName(nick)]
+	return ban != nil && !ban.expired(time.Now())
+}
+
+// CheckKey reports whether key lets someone into room.
+func (room *Room) CheckKey(key string) bool {
+	return room.key == "" || subtle.ConstantTimeCompare([]byte(key), []byte(room.key)) == 1
+}
+
+// OperatedRoom looks up the room named by an operator command, replying
+// with an error and returning nil unless client is allowed to moderate it.
+func (server *Server) OperatedRoom(name string, client *Client) *Room {
+	room, exists := server.LookupRoom(name)
+
+	if !exists {
+		client.Error("Room doesn't exist")
+		return nil
+	}
+
+	if !room.IsOp(client) {
+		client.Error("You are not a room operator")
+		return nil
+	}
+
+	return room
+}
+
+// Kick removes target from room, telling everyone in it, target included,
+// on every node.
+func (server *Server) Kick(room *Room, by *Client, target string, reason string) {
+	by.logger().Info("kicked", "room", room.name, "target", target, "reason", reason)
+	server.audit(by.Name(), "kick", room.name, target, reason)
+	server.cluster.Kicked(room.name, by.Name(), target, reason)
+	server.kickOut(room.name, by.Name(), target, reason)
+}
+
+// kickOut tells the room's members here that by kicked target out of it,
+// and removes target if they are one of them.
+func (server *Server) kickOut(name, by, target, reason string) {
+	server.cluster.forget(name, target)
+
+	room, exists := server.LookupRoom(name)
+
+	if !exists {
+		return
+	}
+
+	text := fmt.Sprintf("%s was kicked by %s", plainName(target), plainName(by))
+
+	if reason != "" {
+		text += " (" + reason + ")"
+	}
+
+	room.Send(&Event{
+		Type:   EventKick,
+		Nick:   by,
+		Target: target,
+		Reason: reason,
+		Text:   text,
+	})
+
+	client, exists := server.LookupNick(target)
+
+	if !exists || !room.HasClient(client) {
+		return
+	}
+
+	room.RemoveClient(client)
+	delete(client.rooms, room.name)
+	server.parted(room.name, client.Name())
+
+	if len(room.clients) == 0 {
+		server.DeleteRoom(room)
+	}
+}
+
+// member finds nick among room's members, here or on another node, and
+// gives the name it goes by.
+func (server *Server) member(room *Room, nick string) (string, bool) {
+	if client, exists := server.LookupNick(nick); exists && room.HasClient(client) {
+		return client.Name(), true
+	}
+
+	return server.cluster.Member(room.name, nick)
+}
+
+type KickCommand struct {
+	client *Client
+	room   string
+	nick   string
+	reason string
+}
+
+func (cmd *KickCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	target, member := server.member(room, cmd.nick)
+
+	if !member {
+		if _, exists := server.LookupNick(cmd.nick); exists {
+			cmd.client.Error("They aren't in that room")
+		} else {
+			cmd.client.Error("No such nick")
+		}
+
+		return
+	}
+
+	server.Kick(room, cmd.client, target, cmd.reason)
+}
+
+type BanCommand struct {
+	client   *Client
+	room     string
+	nick     string
+	duration time.Duration
+}
+
+func (cmd *BanCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	ban := &roomBan{nick: cmd.nick, by: cmd.client.Name(), set: time.Now()}
+	text := fmt.Sprintf("%s was banned by %s", plainName(cmd.nick), plainName(cmd.client.Name()))
+	reason := ""
+
+	if cmd.duration > 0 {
+		ban.expires = ban.set.Add(cmd.duration)
+		reason = "for " + cmd.duration.String()
+		text += " " + reason
+	}
+
+	cmd.client.logger().Info("banned from room", "room", room.name, "target", cmd.nick, "duration", cmd.duration)
+	server.audit(cmd.client.Name(), "ban", room.name, cmd.nick, reason)
+	room.banned[foldName(cmd.nick)] = ban
+	server.saveRoom(room)
+	server.cluster.Banned(room.name, ban)
+	room.Notice(text)
+
+	if target, member := server.member(room, cmd.nick); member {
+		server.Kick(room, cmd.client, target, "Banned")
+	}
+}
+
+type UnbanCommand struct {
+	client *Client
+	room   string
+	nick   string
+}
+
+func (cmd *UnbanCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	if !room.Banned(cmd.nick) && !server.cluster.IsBanned(room.name, cmd.nick) {
+		cmd.client.Error("No such ban")
+		return
+	}
+
+	cmd.client.logger().Info("unbanned from room", "room", room.name, "target", cmd.nick)
+	server.audit(cmd.client.Name(), "unban", room.name, cmd.nick, "")
+	delete(room.banned, foldName(cmd.nick))
+	server.saveRoom(room)
+	server.cluster.Unbanned(room.name, cmd.nick, cmd.client.Name())
+	room.Notice(fmt.Sprintf("%s was unbanned by %s", plainName(cmd.nick), plainName(cmd.client.Name())))
+}
+
+// ModerationCommand shows a room's operators who is kept out of it or
+// can't be heard in it, who did it and until when. Shadow mutes are secret
+// and server wide, so only moderators and admins see those. What members
+// have chosen to ignore is their own business and isn't shown.
+type ModerationCommand struct {
+	client *Client
+	room   string
+}
+
+func (cmd *ModerationCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	now := time.Now()
+	var lines []string
+
+	bans := make([]*roomBan, 0, len(room.banned))
+
+	for _, ban := range room.banned {
+		if !ban.expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+
+	// Bans set on other nodes are only kept with the cluster's.
+	for _, ban := range server.cluster.RoomBans(room.name) {
+		if !ban.expired(now) && room.banned[foldName(ban.nick)] == nil {
+			bans = append(bans, ban)
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return foldName(bans[i].nick) < foldName(bans[j].nick)
+	})
+
+	for _, ban := range bans {
+		line := "Banned: " + plainName(ban.nick)
+
+		if ban.by != "" {
+			line += " by " + plainName(ban.by)
+		}
+
+		if !ban.set.IsZero() {
+			line += " at " + server.formatTime(ban.set)
+		}
+
+		if ban.expires.IsZero() {
+			line += ", until unbanned"
+		} else {
+			line += ", until " + server.formatTime(ban.expires)
+		}
+
+		lines = append(lines, line)
+	}
+
+	if room.moderated {
+		lines = append(lines, "Moderated: only operators and voiced members can send messages")
+	}
+
+	for _, member := range room.clients {
+		if now.Before(member.spam.mutedUntil) {
+			lines = append(lines, fmt.Sprintf("Muted: %s by the spam filter, until %s", plainName(member.Name()), server.formatTime(member.spam.mutedUntil)))
+		}
+
+		if by, muted := server.shadowMuted[member.shadowKey()]; muted && cmd.client.Role() >= RoleModerator {
+			lines = append(lines, fmt.Sprintf("Shadow muted: %s by %s, until lifted", plainName(member.Name()), plainName(by)))
+		}
+	}
+
+	if len(lines) == 0 {
+		cmd.client.Reply(fmt.Sprintf("Nobody is banned or muted in %s", plainName(room.name)))
+		return
+	}
+
+	cmd.client.Reply(strings.Join(lines, "\n"))
+}
+
+type OpCommand struct {
+	client *Client
+	room   string
+	nick   string
+	op     bool
+}
+
+func (cmd *OpCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	target, exists := server.LookupNick(cmd.nick)
+
+	if !exists {
+		cmd.client.Error("No such nick")
+		return
+	}
+
+	if !room.HasClient(target) {
+		cmd.client.Error("They aren't in that room")
+		return
+	}
+
+	if room.ops[target] == cmd.op {
+		return
+	}
+
+	server.setOp(room, target, cmd.op)
+
+	mode, verb := "+o", "gave operator status to"
+
+	if !cmd.op {
+		mode, verb = "-o", "took operator status from"
+	}
+
+	cmd.client.logger().Info("changed room mode", "room", room.name, "target", target.Name(), "mode", mode)
+	server.audit(cmd.client.Name(), "mode "+mode, room.name, target.Name(), "")
+
+	room.Send(&Event{
+		Type:   EventMode,
+		Nick:   cmd.client.Name(),
+		Target: target.Name(),
+		Mode:   mode,
+		Text:   fmt.Sprintf("%s %s %s", plainName(cmd.client.Name()), verb, plainName(target.Name())),
+	})
+}
+
+type SetKeyCommand struct {
+	client *Client
+	room   string
+	key    string
+}
+
+func (cmd *SetKeyCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	cmd.client.logger().Info("changed room key", "room", room.name, "keyed", cmd.key != "")
+
+	if cmd.key == "" {
+		server.audit(cmd.client.Name(), "mode -k", room.name, "", "")
+	} else {
+		server.audit(cmd.client.Name(), "mode +k", room.name, "", "")
+	}
+	room.key = cmd.key
+	server.saveRoom(room)
+
+	if cmd.key != "" {
+		room.closeStreams()
+	}
+
+	if cmd.key == "" {
+		room.Notice(fmt.Sprintf("%s removed the key from %s", plainName(cmd.client.Name()), plainName(room.name)))
+	} else {
+		room.Notice(fmt.Sprintf("%s set a key on %s", plainName(cmd.client.Name()), plainName(room.name)))
+	}
+}
+
+type SetLimitCommand struct {
+	client *Client
+	room   string
+	limit  int
+}
+
+func (cmd *SetLimitCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	cmd.client.logger().Info("changed room limit", "room", room.name, "limit", cmd.limit)
+	if cmd.limit == 0 {
+		server.audit(cmd.client.Name(), "mode -l", room.name, "", "")
+	} else {
+		server.audit(cmd.client.Name(), fmt.Sprintf("mode +l %d", cmd.limit), room.name, "", "")
+	}
+	room.limit = cmd.limit
+	server.saveRoom(room)
+
+	if cmd.limit == 0 {
+		room.Notice(fmt.Sprintf("%s removed the member limit from %s", plainName(cmd.client.Name()), plainName(room.name)))
+	} else {
+		room.Notice(fmt.Sprintf("%s limited %s to %d members", plainName(cmd.client.Name()), plainName(room.name), cmd.limit))
+	}
+}
+
+type InviteOnlyCommand struct {
+	client *Client
+	room   string
+	on     bool
+}
+
+func (cmd *InviteOnlyCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil || room.inviteOnly == cmd.on {
+		return
+	}
+
+	room.inviteOnly = cmd.on
+	server.saveRoom(room)
+
+	if cmd.on {
+		room.closeStreams()
+	}
+
+	mode, text := "+i", "%s made %s invite only"
+
+	if !cmd.on {
+		mode, text = "-i", "%s opened %s to everyone"
+	}
+
+	cmd.client.logger().Info("changed room mode", "room", room.name, "mode", mode)
+	server.audit(cmd.client.Name(), "mode "+mode, room.name, "", "")
+
+	room.Send(&Event{
+		Type: EventMode,
+		Nick: cmd.client.Name(),
+		Mode: mode,
+		Text: fmt.Sprintf(text, plainName(cmd.client.Name()), plainName(room.name)),
+	})
+}
+
+type InviteCommand struct {
+	client *Client
+	room   string
+	nick   string
+}
+
+func (cmd *InviteCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	target, exists := server.LookupNick(cmd.nick)
+
+	if !exists {
+		cmd.client.Error("No such nick")
+		return
+	}
+
+	room.invited[foldName(target.nick())] = true
+
+	target.Send(&Event{
+		Type:   EventInvite,
+		Room:   room.name,
+		Nick:   cmd.client.Name(),
+		Target: target.nick(),
+		Text:   fmt.Sprintf("%s invited you to %s", plainName(cmd.client.Name()), plainName(room.name)),
+	})
+
+	cmd.client.Reply(fmt.Sprintf("Invited %s to %s", target.nick(), room.name))
+}
+
+func parseKick(client *Client, args []string) Command {
+	return &KickCommand{
+		client: client,
+		room:   args[0],
+		nick:   args[1],
+		reason: args[2],
+	}
+}
+
+func parseRoomBan(client *Client, args []string) Command {
+	var duration time.Duration
+
+	if args[2] != "" {
+		var err error
+		duration, err = time.ParseDuration(args[2])
+
+		if err != nil || duration <= 0 {
+			return nil
+		}
+	}
+
+	return &BanCommand{
+		client:   client,
+		room:     args[0],
+		nick:     args[1],
+		duration: duration,
+	}
+}
+
+func parseModeration(client *Client, args []string) Command {
+	return &ModerationCommand{
+		client: client,
+		room:   args[0],
+	}
+}
+
+func parseRoomUnban(client *Client, args []string) Command {
+	return &UnbanCommand{
+		client: client,
+		room:   args[0],
+		nick:   args[1],
+	}
+}
+
+func parseSetKey(client *Client, args []string) Command {
+	return &SetKeyCommand{
+		client: client,
+		room:   args[0],
+		key:    args[1],
+	}
+}
+
+func parseSetLimit(client *Client, args []string) Command {
+	limit, err := strconv.Atoi(args[1])
+
+	if err != nil || limit > maxRoomLimit {
+		return nil
+	}
+
+	return &SetLimitCommand{
+		client: client,
+		room:   args[0],
+		limit:  limit,
+	}
+}
+
+func parseInviteOnly(client *Client, args []string) Command {
+	return &InviteOnlyCommand{
+		client: client,
+		room:   args[0],
+		on:     args[1] == "on",
+	}
+}
+
+func parseInvite(client *Client, args []string) Command {
+	return &InviteCommand{
+		client: client,
+		room:   args[0],
+		nick:   args[1],
+	}
+}
+
+func parseOp(client *Client, args []string) Command {
+	return &OpCommand{
+		client: client,
+		room:   args[0],
+		nick:   args[1],
+		op:     true,
+	}
+}
+
+func parseDeop(client *Client, args []string) Command {
+	return &OpCommand{
+		client: client,
+		room:   args[0],
+		nick:   args[1],
+		op:     false,
+	}
+}
@@ -0,0 +1,290 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownCommand is returned by Registry.Parse for a verb nothing
+// registered.
+var ErrUnknownCommand = errors.New("Unknown command")
+
+// ArgType is the kind of value a command argument takes.
+type ArgType int
+
+const (
+	// ArgWord is a single word, or anything in double quotes.
+	ArgWord ArgType = iota
+	// ArgName is a nick or room name. Names with spaces or punctuation
+	// have to be quoted.
+	ArgName
+	// ArgNumber is a whole number.
+	ArgNumber
+	// ArgText is the rest of the line, exactly as sent. It can only be
+	// the last argument.
+	ArgText
+)
+
+// Arg declares one of a command's arguments. Name says what it is in
+// error messages, like "room". Words with Choices must be one of them.
+// Optional arguments can only follow required ones, and are passed to
+// Parse as "" when left out.
+type Arg struct {
+	Name     string
+	Type     ArgType
+	Optional bool
+	Choices  []string
+}
+
+type CommandSpec struct {
+	Verb  string
+	Args  []Arg
+	Parse func(client *Client, args []string) Command
+	Help  string
+
+	// Role is the least role a client needs to use the command.
+	Role Role
+}
+
+type Plugin interface {
+	Commands() []CommandSpec
+}
+
+type Registry struct {
+	specs map[string]*CommandSpec
+	verbs []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		specs: make(map[string]*CommandSpec),
+		verbs: nil,
+	}
+}
+
+func (registry *Registry) Register(plugin Plugin) error {
+	specs := plugin.Commands()
+	seen := make(map[string]bool)
+
+	for i := range specs {
+		spec := &specs[i]
+
+		if spec.Verb == "" || spec.Parse == nil {
+			return fmt.Errorf("plugin %T: incomplete spec for verb %q", plugin, spec.Verb)
+		}
+
+		if _, exists := registry.specs[spec.Verb]; exists || seen[spec.Verb] {
+			return fmt.Errorf("plugin %T: verb %q already registered", plugin, spec.Verb)
+		}
+
+		for j, arg := range spec.Args {
+			if arg.Type == ArgText && j != len(spec.Args)-1 {
+				return fmt.Errorf("plugin %T: verb %q has text before its last argument", plugin, spec.Verb)
+			}
+
+			if j > 0 && spec.Args[j-1].Optional && !arg.Optional {
+				return fmt.Errorf("plugin %T: verb %q has a required argument after an optional one", plugin, spec.Verb)
+			}
+		}
+
+		seen[spec.Verb] = true
+	}
+
+	for i := range specs {
+		registry.specs[specs[i].Verb] = &specs[i]
+		registry.verbs = append(registry.verbs, specs[i].Verb)
+	}
+
+	return nil
+}
+
+func (registry *Registry) Lookup(verb string) (*CommandSpec, bool) {
+	spec, exists := registry.specs[verb]
+	return spec, exists
+}
+
+func (registry *Registry) Verbs() []string {
+	return registry.verbs
+}
+
+// Parse finds the command msg asks for and checks its arguments against
+// the command's spec. It is forgiving about what naive clients like telnet
+// send: surrounding whitespace, including a CR before the newline, is
+// ignored and the verb may be in any case. The error says what was wrong
+// with msg, in words that can be shown to the client.
+func (registry *Registry) Parse(client *Client, msg string) (Command, error) {
+	verb, rest, _ := strings.Cut(strings.TrimSpace(msg), " ")
+	verb = strings.ToLower(verb)
+
+	spec, exists := registry.Lookup(verb)
+
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, verb)
+	}
+
+	args, err := spec.parseArgs(rest)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := spec.Parse(client, args)
+
+	if cmd == nil {
+		usage, _, _ := strings.Cut(spec.Help, " - ")
+		return nil, fmt.Errorf("Usage: %s", usage)
+	}
+
+	if spec.Role > RoleGuest {
+		cmd = &permittedCommand{client: client, verb: spec.Verb, role: spec.Role, cmd: cmd}
+	}
+
+	return cmd, nil
+}
+
+func (spec *CommandSpec) parseArgs(rest string) ([]string, error) {
+	args := make([]string, len(spec.Args))
+
+	for i, arg := range spec.Args {
+		rest = strings.TrimLeft(rest, " ")
+
+		if rest == "" {
+			if !arg.Optional {
+				return nil, fmt.Errorf("%s requires %s", spec.Verb, describeArgs(spec.Args, false))
+			}
+
+			break
+		}
+
+		if arg.Type == ArgText {
+			args[i], rest = rest, ""
+			break
+		}
+
+		value, quoted, remaining, err := nextToken(rest)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if arg.Type == ArgName {
+			value = normalizeName(value)
+		}
+
+		err = spec.checkArg(arg, value, quoted)
+
+		if err != nil {
+			return nil, err
+		}
+
+		args[i], rest = value, remaining
+	}
+
+	if strings.TrimLeft(rest, " ") != "" {
+		if len(spec.Args) == 0 {
+			return nil, fmt.Errorf("%s takes no arguments", spec.Verb)
+		}
+
+		return nil, fmt.Errorf("%s takes only %s", spec.Verb, describeArgs(spec.Args, true))
+	}
+
+	return args, nil
+}
+
+func (spec *CommandSpec) checkArg(arg Arg, value string, quoted bool) error {
+	switch arg.Type {
+	case ArgName:
+		if (quoted && !validName(value)) || (!quoted && !linkNameRegexp.MatchString(value)) {
+			return fmt.Errorf("Invalid %s %s", arg.Name, quoteName(value))
+		}
+	case ArgNumber:
+		if strings.Trim(value, "0123456789") != "" {
+			return fmt.Errorf("%s must be a number", arg.Name)
+		}
+	}
+
+	if len(arg.Choices) == 0 {
+		return nil
+	}
+
+	for _, choice := range arg.Choices {
+		if value == choice {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s takes %s, not %s", spec.Verb, describeArg(arg), value)
+}
+
+// nextToken reads the word at the start of s, which must not start with a
+// space. A word starting with a double quote runs to the closing quote
+// and can have spaces in it; inside, a backslash stands for the character
+// after it.
+func nextToken(s string) (token string, quoted bool, rest string, err error) {
+	if !strings.HasPrefix(s, "\"") {
+		token, rest, _ = strings.Cut(s, " ")
+		return token, false, rest, nil
+	}
+
+	var b strings.Builder
+	escaped := false
+
+	for i, r := range s[1:] {
+		switch {
+		case escaped:
+			escaped = false
+			b.WriteRune(r)
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			rest = s[i+2:]
+
+			if rest != "" && !strings.HasPrefix(rest, " ") {
+				return "", false, "", errors.New("Expected a space after the closing quote")
+			}
+
+			return b.String(), true, rest, nil
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return "", false, "", errors.New("Missing closing quote")
+}
+
+// describeArg names arg for an error message, as in "a room" or "on or
+// off".
+func describeArg(arg Arg) string {
+	if len(arg.Choices) > 0 {
+		return joinWords(arg.Choices, "or")
+	}
+
+	if strings.ContainsAny(arg.Name[:1], "aeiou") {
+		return "an " + arg.Name
+	}
+
+	return "a " + arg.Name
+}
+
+// describeArgs lists the arguments a command requires, or all of them.
+func describeArgs(args []Arg, all bool) string {
+	var words []string
+
+	for _, arg := range args {
+		if all || !arg.Optional {
+			words = append(words, describeArg(arg))
+		}
+	}
+
+	return joinWords(words, "and")
+}
+
+// joinWords joins words into a list like "a, b and c".
+func joinWords(words []string, conjunction string) string {
+	if len(words) < 2 {
+		return strings.Join(words, "")
+	}
+
+	return strings.Join(words[:len(words)-1], ", ") + " " + conjunction + " " + words[len(words)-1]
+}
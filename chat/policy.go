@@ -0,0 +1,139 @@
+package chat
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ConnPolicy decides at accept time where connections may come from, by
+// CIDR range and, given a GeoIP database, by country. Denials win: an
+// address in a denied range or country is refused even if it is also
+// allowed. If anything is allowed at all, addresses that aren't are
+// refused too. It never changes once made, so accept loops share it
+// freely and a reload swaps in a new one.
+type ConnPolicy struct {
+	allow          []netip.Prefix
+	deny           []netip.Prefix
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+	geoip          *GeoIP
+}
+
+// connPolicy builds the policy config asks for, or nil if it doesn't ask
+// for one.
+func (config *Config) connPolicy() (*ConnPolicy, error) {
+	policy := &ConnPolicy{
+		allowCountries: parseCountries(config.AllowCountries),
+		denyCountries:  parseCountries(config.DenyCountries),
+	}
+
+	var err error
+
+	if policy.allow, err = parsePrefixes(config.AllowCIDRs); err != nil {
+		return nil, err
+	}
+
+	if policy.deny, err = parsePrefixes(config.DenyCIDRs); err != nil {
+		return nil, err
+	}
+
+	countries := len(policy.allowCountries) > 0 || len(policy.denyCountries) > 0
+
+	if countries && config.GeoIPPath == "" {
+		return nil, fmt.Errorf("allowing or denying countries needs a GeoIP database")
+	}
+
+	if countries {
+		if policy.geoip, err = LoadGeoIP(config.GeoIPPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(policy.allow) == 0 && len(policy.deny) == 0 && !countries {
+		return nil, nil
+	}
+
+	return policy, nil
+}
+
+// parsePrefixes reads comma separated IPs and CIDR ranges.
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		prefix, err := parseBan(entry)
+
+		if err != nil {
+			return nil, fmt.Errorf("bad address or range %q: %v", entry, err)
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+func parseCountries(list string) map[string]bool {
+	countries := make(map[string]bool)
+
+	for _, code := range strings.Split(list, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			countries[code] = true
+		}
+	}
+
+	return countries
+}
+
+// Allow reports whether ip may connect. Addresses that don't parse, like
+// those of in-process connections, aren't judged.
+func (policy *ConnPolicy) Allow(ip string) bool {
+	if policy == nil {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(ip)
+
+	if err != nil {
+		return true
+	}
+
+	addr = addr.Unmap()
+
+	if containsAddr(policy.deny, addr) {
+		return false
+	}
+
+	var country string
+
+	if policy.geoip != nil {
+		country = policy.geoip.Country(addr)
+	}
+
+	if country != "" && policy.denyCountries[country] {
+		return false
+	}
+
+	if len(policy.allow) == 0 && len(policy.allowCountries) == 0 {
+		return true
+	}
+
+	return containsAddr(policy.allow, addr) || (country != "" && policy.allowCountries[country])
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,222 @@
+package chat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Poll struct {
+	id       uint64
+	room     *Room
+	creator  string
+	question string
+	options  []string
+	votes    map[*Client]int
+	expires  time.Time
+}
+
+func (poll *Poll) Tally() string {
+	counts := make([]int, len(poll.options))
+
+	for _, choice := range poll.votes {
+		counts[choice]++
+	}
+
+	results := make([]string, len(poll.options))
+
+	for i, option := range poll.options {
+		results[i] = fmt.Sprintf("%s: %d", option, counts[i])
+	}
+
+	return strings.Join(results, ", ")
+}
+
+func (server *Server) OpenPoll(room *Room, creator *Client, question string, options []string) *Poll {
+	server.nextPollID++
+
+	poll := &Poll{
+		id:       server.nextPollID,
+		room:     room,
+		creator:  creator.nick(),
+		question: question,
+		options:  options,
+		votes:    make(map[*Client]int),
+		expires:  time.Now().Add(server.pollDuration),
+	}
+
+	room.polls[poll.id] = poll
+	server.polls[poll.id] = poll
+
+	time.AfterFunc(server.pollDuration, func() {
+		server.incoming <- &ClosePollCommand{poll: poll}
+	})
+
+	return poll
+}
+
+func (server *Server) ClosePoll(poll *Poll) {
+	delete(poll.room.polls, poll.id)
+	delete(server.polls, poll.id)
+}
+
+type PollCommand struct {
+	client   *Client
+	room     string
+	question string
+	options  []string
+}
+
+func (cmd *PollCommand) Run(server *Server) {
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		cmd.client.Error("Room doesn't exist")
+		return
+	}
+
+	if cmd.client.nick() == "" {
+		cmd.client.Error("Must set NICK first")
+		return
+	}
+
+	if !room.HasClient(cmd.client) {
+		cmd.client.Error("You are not in that room")
+		return
+	}
+
+	if len(cmd.options) < 2 {
+		cmd.client.Error("A poll needs at least two options")
+		return
+	}
+
+	poll := server.OpenPoll(room, cmd.client, cmd.question, cmd.options)
+
+	choices := make([]string, len(poll.options))
+
+	for i, option := range poll.options {
+		choices[i] = fmt.Sprintf("%d) %s", i+1, option)
+	}
+
+	room.Notice(fmt.Sprintf("Poll %d from %s: %s %s (vote with 'vote %d <n>' until %s)",
+		poll.id, poll.creator, poll.question, strings.Join(choices, " "), poll.id, poll.expires.In(server.timeLocation).Format(time.Kitchen)))
+}
+
+type VoteCommand struct {
+	client *Client
+	poll   uint64
+	choice int
+}
+
+func (cmd *VoteCommand) Run(server *Server) {
+	poll, exists := server.polls[cmd.poll]
+
+	if !exists {
+		cmd.client.Error("No such poll")
+		return
+	}
+
+	if !poll.room.HasClient(cmd.client) {
+		cmd.client.Error("You are not in that room")
+		return
+	}
+
+	if _, voted := poll.votes[cmd.client]; voted {
+		cmd.client.Error("You have already voted in that poll")
+		return
+	}
+
+	if cmd.choice < 1 || cmd.choice > len(poll.options) {
+		cmd.client.Error(fmt.Sprintf("Choose an option from 1 to %d", len(poll.options)))
+		return
+	}
+
+	poll.votes[cmd.client] = cmd.choice - 1
+	cmd.client.Reply("Vote recorded for " + poll.options[cmd.choice-1])
+}
+
+type PollResultCommand struct {
+	client *Client
+	poll   uint64
+}
+
+func (cmd *PollResultCommand) Run(server *Server) {
+	poll, exists := server.polls[cmd.poll]
+
+	if !exists {
+		cmd.client.Error("No such poll")
+		return
+	}
+
+	cmd.client.Reply(fmt.Sprintf("Poll %d: %s %s", poll.id, poll.question, poll.Tally()))
+}
+
+type ClosePollCommand struct {
+	poll *Poll
+}
+
+func (cmd *ClosePollCommand) Run(server *Server) {
+	poll := cmd.poll
+
+	server.ClosePoll(poll)
+	poll.room.Notice(fmt.Sprintf("Poll %d closed: %s %s", poll.id, poll.question, poll.Tally()))
+}
+
+func parsePoll(client *Client, args []string) Command {
+	question, rest, found := strings.Cut(args[1], "|")
+
+	if !found || strings.TrimSpace(question) == "" {
+		return nil
+	}
+
+	var options []string
+
+	for _, option := range strings.Split(rest, "|") {
+		option = strings.TrimSpace(option)
+
+		if option != "" {
+			options = append(options, option)
+		}
+	}
+
+	return &PollCommand{
+		client:   client,
+		room:     args[0],
+		question: strings.TrimSpace(question),
+		options:  options,
+	}
+}
+
+func parseVote(client *Client, args []string) Command {
+	id, err := strconv.ParseUint(args[0], 10, 64)
+
+	if err != nil {
+		return nil
+	}
+
+	choice, err := strconv.Atoi(args[1])
+
+	if err != nil {
+		return nil
+	}
+
+	return &VoteCommand{
+		client: client,
+		poll:   id,
+		choice: choice,
+	}
+}
+
+func parsePollResult(client *Client, args []string) Command {
+	id, err := strconv.ParseUint(args[0], 10, 64)
+
+	if err != nil {
+		return nil
+	}
+
+	return &PollResultCommand{
+		client: client,
+		poll:   id,
+	}
+}
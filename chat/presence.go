@@ -0,0 +1,141 @@
+package chat
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Seen records that account was last online at t.
+func (store *AccountStore) Seen(account *Account, t time.Time) error {
+	account.LastSeen = t
+	return store.save()
+}
+
+// markSeen updates the last seen time of the account client is logged in
+// to, if any.
+func (server *Server) markSeen(client *Client) {
+	account, exists := server.accounts.Get(client.account)
+
+	if client.account == "" || !exists {
+		return
+	}
+
+	err := server.accounts.Seen(account, time.Now())
+
+	if err != nil {
+		slog.Error("saving accounts", "err", err)
+	}
+}
+
+type WhoisCommand struct {
+	client *Client
+	nick   string
+}
+
+func (cmd *WhoisCommand) Run(server *Server) {
+	account, registered := server.accounts.Get(cmd.nick)
+	target, online := server.LookupNick(cmd.nick)
+
+	if !online {
+		if !registered {
+			cmd.client.Error("No such nick")
+			return
+		}
+
+		if account.LastSeen.IsZero() {
+			cmd.client.Reply(fmt.Sprintf("%s is offline and hasn't been seen", cmd.nick))
+		} else {
+			cmd.client.Reply(fmt.Sprintf("%s is offline, last seen %s", cmd.nick, server.formatTime(account.LastSeen)))
+		}
+
+		return
+	}
+
+	idle := time.Since(time.Unix(0, target.lastActive.Load())).Truncate(time.Second)
+	lines := []string{fmt.Sprintf("%s is online, idle %v", target.nick(), idle)}
+
+	if registered {
+		lines = append(lines, "Registered "+server.formatTime(account.Created))
+	}
+
+	if len(target.rooms) > 0 {
+		rooms := make([]string, 0, len(target.rooms))
+
+		for name := range target.rooms {
+			rooms = append(rooms, name)
+		}
+
+		sort.Strings(rooms)
+
+		lines = append(lines, "Rooms: "+strings.Join(rooms, ", "))
+	}
+
+	if target.away != "" {
+		lines = append(lines, "Away: "+target.away)
+	}
+
+	cmd.client.Reply(strings.Join(lines, "\n"))
+}
+
+// UserRoomsCommand lists the rooms someone is in for moderators, with
+// what they can do in each, when looking into what a user has been up to.
+type UserRoomsCommand struct {
+	client *Client
+	nick   string
+}
+
+func (cmd *UserRoomsCommand) Run(server *Server) {
+	target, online := server.LookupNick(cmd.nick)
+
+	if !online {
+		cmd.client.Error("No such nick")
+		return
+	}
+
+	if len(target.rooms) == 0 {
+		cmd.client.Reply(fmt.Sprintf("%s isn't in any rooms", plainName(target.Name())))
+		return
+	}
+
+	rooms := make([]string, 0, len(target.rooms))
+
+	for _, room := range target.rooms {
+		name := plainName(room.name)
+
+		switch {
+		case room.ops[target]:
+			name += " (operator)"
+		case room.voiced[target]:
+			name += " (voiced)"
+		case !room.CanSpeak(target):
+			name += " (can't speak)"
+		}
+
+		rooms = append(rooms, name)
+	}
+
+	sort.Strings(rooms)
+
+	cmd.client.Reply(fmt.Sprintf("%s is in %s", plainName(target.Name()), strings.Join(rooms, ", ")))
+}
+
+func (server *Server) formatTime(t time.Time) string {
+	return t.In(server.timeLocation).Format(server.timeFormat)
+}
+
+func parseWhois(client *Client, args []string) Command {
+	return &WhoisCommand{
+		client: client,
+		nick:   args[0],
+	}
+}
+
+func parseUserRooms(client *Client, args []string) Command {
+	return &UserRoomsCommand{
+		client: client,
+		nick:   args[0],
+	}
+}
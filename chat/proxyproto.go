@@ -0,0 +1,231 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	proxyV1MaxLength   = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener reads the PROXY protocol header (v1 or v2) a load balancer
+// such as HAProxy sends at the start of each connection, so the connection
+// reports the real client's address instead of the balancer's. Headers are
+// read off the accepting goroutine, so a connection that never sends one
+// can't hold up the others.
+type proxyListener struct {
+	net.Listener
+	ready chan net.Conn
+	err   chan error
+	once  sync.Once
+}
+
+func newProxyListener(listener net.Listener) *proxyListener {
+	return &proxyListener{
+		Listener: listener,
+		ready:    make(chan net.Conn),
+		err:      make(chan error, 1),
+	}
+}
+
+func (listener *proxyListener) Accept() (net.Conn, error) {
+	listener.once.Do(func() {
+		go listener.acceptRaw()
+	})
+
+	select {
+	case conn := <-listener.ready:
+		return conn, nil
+	case err := <-listener.err:
+		// Leave the error for any other caller of Accept too.
+		listener.err <- err
+		return nil, err
+	}
+}
+
+func (listener *proxyListener) acceptRaw() {
+	for {
+		conn, err := listener.Listener.Accept()
+
+		if err != nil {
+			listener.err <- err
+			return
+		}
+
+		go func() {
+			proxied, err := readProxyHeader(conn)
+
+			if err != nil {
+				slog.Info("refusing connection", "addr", conn.RemoteAddr().String(), "reason", "bad PROXY header", "err", err)
+				conn.Close()
+				return
+			}
+
+			select {
+			case listener.ready <- proxied:
+			case err := <-listener.err:
+				listener.err <- err
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// proxyConn is a connection whose PROXY header has been read. Anything the
+// client sent after the header is still in reader.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (conn *proxyConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+func (conn *proxyConn) RemoteAddr() net.Addr {
+	if conn.remote == nil {
+		return conn.Conn.RemoteAddr()
+	}
+
+	return conn.remote
+}
+
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// A v1 header can be shorter than the v2 signature, and the client
+	// may send nothing more until it hears from us, so only wait for as
+	// much as tells them apart.
+	reader := bufio.NewReader(conn)
+	start, err := reader.Peek(len("PROXY"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	proxied := &proxyConn{Conn: conn, reader: reader}
+
+	switch {
+	case bytes.Equal(start, []byte("PROXY")):
+		proxied.remote, err = readProxyV1(reader)
+	case bytes.HasPrefix(proxyV2Signature, start):
+		start, err = reader.Peek(len(proxyV2Signature))
+
+		if err == nil && !bytes.Equal(start, proxyV2Signature) {
+			err = errors.New("no PROXY header")
+		}
+
+		if err == nil {
+			proxied.remote, err = readProxyV2(reader)
+		}
+	default:
+		err = errors.New("no PROXY header")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return proxied, nil
+}
+
+// readProxyV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1
+// 56324 443\r\n". UNKNOWN means the balancer doesn't know who the client
+// is, and the connection keeps its own address.
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line, err := reader.ReadSlice('\n')
+
+	if err != nil || len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("bad v1 header")
+	}
+
+	fields := strings.Fields(string(line))
+
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("bad v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("bad v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("bad v1 source %s %s", fields[2], fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the binary header. LOCAL connections, such as the
+// balancer's own health checks, and address families other than IPv4 and
+// IPv6 keep the connection's own address.
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+
+	_, err := io.ReadFull(reader, header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	version, command := header[12]>>4, header[12]&0xf
+	family := header[13] >> 4
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if version != 2 || command > 1 {
+		return nil, fmt.Errorf("bad v2 version or command %#x", header[12])
+	}
+
+	body := make([]byte, length)
+
+	_, err = io.ReadFull(reader, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if command == 0 {
+		return nil, nil
+	}
+
+	switch {
+	case family == 1 && len(body) >= 12:
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case family == 2 && len(body) >= 36:
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// behindProxy wraps listener to read PROXY headers, if that is enabled.
+func behindProxy(listener net.Listener, enabled bool) net.Listener {
+	if !enabled {
+		return listener
+	}
+
+	return newProxyListener(listener)
+}
@@ -0,0 +1,42 @@
+package chat
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestProxyHeaderUnknown sends a bare "PROXY UNKNOWN" header, which is
+// shorter than the v2 signature, and nothing after it, as a client waiting
+// to hear from the server would.
+func TestProxyHeaderUnknown(t *testing.T) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	t.Cleanup(func() { server.Close() })
+
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+
+	start := time.Now()
+	proxied, err := readProxyHeader(server)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > proxyHeaderTimeout/2 {
+		t.Errorf("reading the header took %v", elapsed)
+	}
+
+	if proxied.RemoteAddr() != server.RemoteAddr() {
+		t.Errorf("remote address is %v, want the connection's own", proxied.RemoteAddr())
+	}
+
+	go client.Write([]byte("nick alice\n"))
+
+	line := make([]byte, 64)
+	n, err := proxied.Read(line)
+
+	if err != nil || string(line[:n]) != "nick alice\n" {
+		t.Errorf("read %q, %v after the header, want %q", line[:n], err, "nick alice\n")
+	}
+}
@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// purge looks through at most purgeScan of a room's latest messages, and
+// leaves alone any older than purgeWindow, so cleaning up after a spammer
+// can't rewrite a room's whole past.
+const (
+	purgeScan   = 500
+	purgeWindow = 24 * time.Hour
+)
+
+// PurgeCommand removes someone's recent messages from a room's history,
+// and from the store if there is one, telling members to drop them with a
+// delete event for each.
+type PurgeCommand struct {
+	client *Client
+	room   string
+	nick   string
+}
+
+func (cmd *PurgeCommand) Run(server *Server) {
+	client := cmd.client
+	room := server.OperatedRoom(cmd.room, client)
+
+	if room == nil {
+		return
+	}
+
+	by := client.Name()
+
+	room.do(func() {
+		messages, err := server.roomHistory(room, purgeScan)
+
+		if err != nil {
+			client.Error("History is unavailable")
+			return
+		}
+
+		cutoff := time.Now().Add(-purgeWindow)
+		var purged []uint64
+
+		for _, msg := range messages {
+			if !sameName(msg.nick, cmd.nick) || msg.time.Before(cutoff) {
+				continue
+			}
+
+			room.history.Remove(msg.id)
+			room.sendChange(&Event{
+				Type: EventDelete,
+				ID:   msg.id,
+				Time: time.Now().In(server.timeLocation),
+				Room: room.name,
+				Nick: by,
+			}, nil)
+
+			purged = append(purged, msg.id)
+		}
+
+		if server.store != nil {
+			err := server.store.DeleteMessages(room.name, purged...)
+
+			if err != nil {
+				slog.Error("saving deletion", "room", room.name, "err", err)
+			}
+		}
+
+		slog.Info("purged messages", "room", room.name, "target", cmd.nick, "messages", len(purged), "by", by)
+		server.audit(by, "purge", room.name, cmd.nick, fmt.Sprintf("%d messages", len(purged)))
+
+		client.Reply(fmt.Sprintf("Purged %d messages from %s in %s", len(purged), plainName(cmd.nick), plainName(room.name)))
+	})
+}
+
+func parsePurge(client *Client, args []string) Command {
+	return &PurgeCommand{
+		client: client,
+		room:   args[0],
+		nick:   args[1],
+	}
+}
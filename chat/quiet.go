@@ -0,0 +1,40 @@
+package chat
+
+// Quiet clients, usually bots, get room messages, private messages and
+// what is said in answer to their own commands, without the chatter meant
+// for people. A client is quiet from the moment it connects if it comes in
+// on a listener with the quiet option; an IRC client can also ask for the
+// quiet capability with CAP REQ, which quiets everything after it. Quiet
+// clients are not sent:
+//
+//   - the greeting on connecting: the server version, the message of the
+//     day and the getting-started hints, and the listener's hints about
+//     logging in or becoming an operator. The rules are still sent, since
+//     they must be accepted before joining rooms.
+//   - a session token, so they can't resume dropped sessions.
+//   - join, leave and quit notices, as if they had sent notices off, which
+//     they can undo with notices on. IRC clients quiet through CAP still
+//     get them, since IRC keeps track of channel members that way.
+//   - notices in rooms: welcome messages, trigger answers, poll results and
+//     the like.
+//
+// Everything else still arrives: replies and errors, server-wide notices
+// such as walls and maintenance warnings, and the events that change what
+// a client knows about a room or a message, like nick, topic and mode
+// changes, kicks, invites, edits, deletions and reactions. The motd
+// command still shows the message of the day.
+
+// quietCapability is the IRC capability that makes a client quiet.
+const quietCapability = "quiet"
+
+// quietens reports whether a quiet client should miss event. Presence is
+// left to hidePresence, and sessions to startSession.
+func quietens(event *Event) bool {
+	return event.Type == EventNotice && event.Room != ""
+}
+
+// quieten makes client quiet.
+func (client *Client) quieten() {
+	client.quiet.Store(true)
+	client.hidePresence.Store(true)
+}
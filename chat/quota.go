@@ -0,0 +1,177 @@
+package chat
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A RoleLimit caps how many messages, to rooms or in private, clients with
+// one role may send. Roles without one aren't limited beyond the usual
+// line rate limit.
+type RoleLimit struct {
+	// PerMinute is the average rate, with bursts of up to Burst, which
+	// defaults to a minute's worth.
+	PerMinute float64 `json:"per_minute"`
+	Burst     int     `json:"burst"`
+
+	// Daily is how many messages a day, in the server's time zone, each
+	// account may send, or for guests each address. 0 is no limit.
+	Daily int `json:"daily"`
+}
+
+func (limit RoleLimit) burst() int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+
+	return max(1, int(math.Ceil(limit.PerMinute)))
+}
+
+// roleLimitsFlag sets one role's limit with each -role-limit flag, written
+// role=per_minute or role=per_minute/daily. Like listenersFlag, String and
+// Set deal in several at once for LoadConfig to replay.
+type roleLimitsFlag struct {
+	limits *map[string]RoleLimit
+	given  []string
+}
+
+func (f *roleLimitsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+
+	return strings.Join(f.given, " ")
+}
+
+func (f *roleLimitsFlag) Set(value string) error {
+	for _, spec := range strings.Fields(value) {
+		role, rates, ok := strings.Cut(spec, "=")
+		perMinute, daily, hasDaily := strings.Cut(rates, "/")
+
+		var limit RoleLimit
+		var err error
+
+		if ok {
+			limit.PerMinute, err = strconv.ParseFloat(perMinute, 64)
+		}
+
+		if ok && err == nil && hasDaily {
+			limit.Daily, err = strconv.Atoi(daily)
+		}
+
+		if !ok || err != nil {
+			return fmt.Errorf("role limit %q should look like role=per_minute or role=per_minute/daily", spec)
+		}
+
+		if *f.limits == nil {
+			*f.limits = make(map[string]RoleLimit)
+		}
+
+		(*f.limits)[role] = limit
+		f.given = append(f.given, spec)
+	}
+
+	return nil
+}
+
+func (config *Config) roleLimits() (map[Role]RoleLimit, error) {
+	limits := make(map[Role]RoleLimit, len(config.RoleLimits))
+
+	for name, limit := range config.RoleLimits {
+		role, ok := parseRole(name)
+
+		if !ok {
+			return nil, fmt.Errorf("role limits: no role called %q", name)
+		}
+
+		if limit.PerMinute < 0 || limit.Burst < 0 || limit.Daily < 0 {
+			return nil, fmt.Errorf("role limits for %s can't be negative", role)
+		}
+
+		limits[role] = limit
+	}
+
+	return limits, nil
+}
+
+// clientQuota is a client's share of its role's per minute rate. It is
+// made again if the client's limit changes, when its role does or the
+// config is reloaded. Like spamState, only the client's own commands touch
+// it.
+type clientQuota struct {
+	limit  RoleLimit
+	bucket *TokenBucket
+}
+
+// identity is what a client is known by across reconnects, for daily
+// counts: its account if it is logged in, or else its address.
+func (client *Client) identity() string {
+	if client.account != "" {
+		return "account " + foldName(client.account)
+	}
+
+	if ip := remoteIP(client.conn); ip != "" && client.conn.LocalAddr().Network() != "unix" {
+		return "ip " + ip
+	}
+
+	return "client " + strconv.FormatUint(client.id, 10)
+}
+
+// sentTodayBy is how many messages client has sent today, as the daily
+// limit counts them.
+func (server *Server) sentTodayBy(client *Client, now time.Time) int {
+	server.quotaMu.Lock()
+	defer server.quotaMu.Unlock()
+
+	if now.In(server.timeLocation).Format(time.DateOnly) != server.quotaDay {
+		return 0
+	}
+
+	return server.sentToday[client.identity()]
+}
+
+// CheckQuota reports whether client may send another message under its
+// role's limit, counting it if so.
+func (server *Server) CheckQuota(client *Client) bool {
+	role := client.Role()
+	limit, exists := server.roleLimits[role]
+
+	if !exists {
+		return true
+	}
+
+	now := time.Now()
+	key := client.identity()
+
+	server.quotaMu.Lock()
+	defer server.quotaMu.Unlock()
+
+	day := now.In(server.timeLocation).Format(time.DateOnly)
+
+	if day != server.quotaDay {
+		server.quotaDay = day
+		server.sentToday = make(map[string]int)
+	}
+
+	if limit.Daily > 0 && server.sentToday[key] >= limit.Daily {
+		client.Error(fmt.Sprintf("You have sent the %d messages a %s may send in a day", limit.Daily, role))
+		return false
+	}
+
+	if limit.PerMinute > 0 {
+		if client.quota.bucket == nil || client.quota.limit != limit {
+			client.quota = clientQuota{limit: limit, bucket: NewTokenBucket(limit.PerMinute/60, limit.burst())}
+		}
+
+		if !client.quota.bucket.Allow(now) {
+			client.Error(fmt.Sprintf("A %s may send %g messages a minute, slow down", role, limit.PerMinute))
+			return false
+		}
+	}
+
+	server.sentToday[key]++
+	return true
+}
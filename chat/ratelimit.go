@@ -0,0 +1,218 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TokenBucket allows bursts of up to burst events, refilling at rate tokens
+// per second. It is not safe for concurrent use. Each client's line rate
+// bucket is only touched by the goroutine reading its commands, and its
+// message quota bucket only with quotaMu held.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Allow takes a token if one is available at now.
+func (bucket *TokenBucket) Allow(now time.Time) bool {
+	if !bucket.last.IsZero() {
+		elapsed := now.Sub(bucket.last).Seconds()
+		bucket.tokens = min(bucket.burst, bucket.tokens+elapsed*bucket.rate)
+	}
+
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// Wait is how long after now Allow would next let an event through. Unlike
+// Allow it leaves the bucket as it is.
+func (bucket *TokenBucket) Wait(now time.Time) time.Duration {
+	tokens := bucket.tokens
+
+	if !bucket.last.IsZero() {
+		tokens = min(bucket.burst, tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	}
+
+	if tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - tokens) / bucket.rate * float64(time.Second))
+}
+
+// RateLimits are the flood protection settings. A config reload can change
+// them while clients are connected, so readers check for new ones on every
+// line.
+type RateLimits struct {
+	rate  float64
+	burst int
+	flood int
+}
+
+func (config *Config) rateLimits() (*RateLimits, error) {
+	if config.RateLimit > 0 && config.RateBurst < 1 {
+		return nil, fmt.Errorf("rate burst must be at least 1")
+	}
+
+	return &RateLimits{
+		rate:  config.RateLimit,
+		burst: config.RateBurst,
+		flood: config.FloodLimit,
+	}, nil
+}
+
+// bucket returns a full bucket for the limits, or nil if lines aren't
+// limited.
+func (limits *RateLimits) bucket() *TokenBucket {
+	if limits.rate <= 0 {
+		return nil
+	}
+
+	return NewTokenBucket(limits.rate, limits.burst)
+}
+
+// floodCheck reports whether a line from client may go on to be parsed.
+// The first line refused in a row earns a warning; floodLimit refused in a
+// row disconnects the client.
+func (server *Server) floodCheck(client *Client, limits *RateLimits, bucket *TokenBucket, strikes *int) bool {
+	if bucket == nil || bucket.Allow(time.Now()) {
+		*strikes = 0
+		return true
+	}
+
+	*strikes++
+
+	if *strikes == 1 {
+		client.Error("You are sending too fast, slow down")
+	}
+
+	if limits.flood > 0 && *strikes >= limits.flood {
+		server.evict(client, "Excess flood")
+	}
+
+	return false
+}
+
+// CanSendCommand tells a client whether a message to a room would get
+// through right now, and if not, why and how long to wait, so client
+// developers can pace what they send. Nothing is sent and no limit is
+// counted against, except that cansend is a line like any other.
+type CanSendCommand struct {
+	client *Client
+	room   string
+
+	// lineWait is how long until the line rate limit lets another line
+	// through, taken when the command was parsed, on the goroutine that
+	// owns the client's line bucket.
+	lineWait time.Duration
+}
+
+func (cmd *CanSendCommand) Run(server *Server) {
+	client := cmd.client
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		client.Error("Room doesn't exist")
+		return
+	}
+
+	now := time.Now()
+	wait := cmd.lineWait
+
+	// Reasons that won't go away by waiting, and ones that will.
+	var blocked, limited []string
+
+	if client.nick() == "" {
+		blocked = append(blocked, "you haven't set a nick")
+	}
+
+	if server.rules != "" && !client.accepted {
+		blocked = append(blocked, "you haven't accepted the rules")
+	}
+
+	if !room.CanSpeak(client) {
+		blocked = append(blocked, "the room is moderated and you don't have voice")
+	}
+
+	if ageWait, ok := server.accountAgeWait(room, client, now); !ok {
+		reason := fmt.Sprintf("only accounts at least %s old can send messages there", formatAge(room.minAge))
+
+		if ageWait == 0 {
+			blocked = append(blocked, reason+" and you aren't logged in")
+		} else {
+			limited = append(limited, reason)
+			wait = max(wait, ageWait)
+		}
+	}
+
+	if cmd.lineWait > 0 {
+		limited = append(limited, "you are sending lines too fast")
+	}
+
+	if until := client.spam.mutedUntil; now.Before(until) {
+		limited = append(limited, "you are muted for spamming")
+		wait = max(wait, until.Sub(now))
+	}
+
+	if limit, exists := server.roleLimits[client.Role()]; exists {
+		if limit.Daily > 0 && server.sentTodayBy(client, now) >= limit.Daily {
+			limited = append(limited, fmt.Sprintf("you have sent the %d messages a %s may send in a day", limit.Daily, client.Role()))
+
+			local := now.In(server.timeLocation)
+			midnight := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, server.timeLocation)
+			wait = max(wait, midnight.Sub(now))
+		}
+
+		if limit.PerMinute > 0 && client.quota.bucket != nil && client.quota.limit == limit {
+			if quotaWait := client.quota.bucket.Wait(now); quotaWait > 0 {
+				limited = append(limited, fmt.Sprintf("a %s may send %g messages a minute", client.Role(), limit.PerMinute))
+				wait = max(wait, quotaWait)
+			}
+		}
+	}
+
+	if len(blocked) == 0 && len(limited) == 0 {
+		client.Reply(fmt.Sprintf("A message to %s would be sent now", plainName(room.name)))
+		return
+	}
+
+	reply := fmt.Sprintf("A message to %s would be refused: %s", plainName(room.name), strings.Join(append(blocked, limited...), "; "))
+
+	if len(blocked) == 0 {
+		reply += fmt.Sprintf(". Try again in %v", wait.Round(time.Second))
+	}
+
+	client.Reply(reply)
+}
+
+func parseCanSend(client *Client, args []string) Command {
+	var lineWait time.Duration
+
+	if client.lines != nil {
+		lineWait = client.lines.Wait(time.Now())
+	}
+
+	return &CanSendCommand{
+		client:   client,
+		room:     args[0],
+		lineWait: lineWait,
+	}
+}
@@ -0,0 +1,202 @@
+package chat
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxReactionLength    = 8
+	maxReactionsPerEmoji = 50
+	maxReactionEmoji     = 20
+)
+
+// ReactCommand toggles a member's reaction to a message in a room: the
+// first time they react with an emoji it is added, and the next time it
+// is taken back. Members are sent a react event with the message's new
+// counts, and history keeps them.
+type ReactCommand struct {
+	client *Client
+	room   string
+	id     uint64
+	emoji  string
+}
+
+func (cmd *ReactCommand) Run(server *Server) {
+	client := cmd.client
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		client.Error("Room doesn't exist")
+		return
+	}
+
+	if !room.HasClient(client) {
+		client.Error("You are not in that room")
+		return
+	}
+
+	nick := client.nick()
+	ignoring := server.ignoring(room, nick)
+
+	room.do(func() {
+		msg := room.history.Find(cmd.id)
+
+		if msg == nil {
+			client.Error("That message is no longer in history")
+			return
+		}
+
+		removed := msg.hasReacted(nick, cmd.emoji)
+
+		if !removed && !msg.canReact(cmd.emoji) {
+			client.Error("That message has too many reactions")
+			return
+		}
+
+		reacted := *msg
+		reacted.react(nick, cmd.emoji, removed)
+		room.history.Replace(&reacted)
+
+		if server.store != nil {
+			err := server.store.SaveReaction(room.name, reacted.id, nick, cmd.emoji, removed)
+
+			if err != nil {
+				slog.Error("saving reaction", "room", room.name, "err", err)
+			}
+		}
+
+		room.sendChange(&Event{
+			Type:      EventReact,
+			ID:        reacted.id,
+			Time:      time.Now().In(server.timeLocation),
+			Room:      room.name,
+			Nick:      nick,
+			Text:      cmd.emoji,
+			Reactions: reacted.reactionCounts(),
+			Removed:   removed,
+		}, ignoring)
+	})
+}
+
+func (msg *Message) hasReacted(nick, emoji string) bool {
+	return slices.ContainsFunc(msg.reactions[emoji], func(reactor string) bool {
+		return sameName(reactor, nick)
+	})
+}
+
+// canReact reports whether there is room for another reaction with emoji.
+func (msg *Message) canReact(emoji string) bool {
+	nicks, exists := msg.reactions[emoji]
+
+	if !exists {
+		return len(msg.reactions) < maxReactionEmoji
+	}
+
+	return len(nicks) < maxReactionsPerEmoji
+}
+
+// react adds or takes back nick's reaction with emoji. The map and its
+// lists are replaced rather than changed, so copies of msg made before
+// are left as they were.
+func (msg *Message) react(nick, emoji string, removed bool) {
+	reactions := maps.Clone(msg.reactions)
+
+	if reactions == nil {
+		reactions = make(map[string][]string)
+	}
+
+	nicks := slices.DeleteFunc(slices.Clone(reactions[emoji]), func(reactor string) bool {
+		return sameName(reactor, nick)
+	})
+
+	if !removed {
+		nicks = append(nicks, nick)
+	}
+
+	if len(nicks) == 0 {
+		delete(reactions, emoji)
+	} else {
+		reactions[emoji] = nicks
+	}
+
+	msg.reactions = reactions
+}
+
+func (msg *Message) reactionCounts() map[string]int {
+	if len(msg.reactions) == 0 {
+		return nil
+	}
+
+	counts := make(map[string]int, len(msg.reactions))
+
+	for emoji, nicks := range msg.reactions {
+		counts[emoji] = len(nicks)
+	}
+
+	return counts
+}
+
+// formatReactions renders reaction counts for plain text, like
+// "[👍 2, 🎉 1]", most popular first.
+func formatReactions(counts map[string]int) string {
+	emoji := slices.Collect(maps.Keys(counts))
+	slices.SortFunc(emoji, func(a, b string) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+
+		return strings.Compare(a, b)
+	})
+
+	parts := make([]string, len(emoji))
+
+	for i, e := range emoji {
+		parts[i] = fmt.Sprintf("%s %d", e, counts[e])
+	}
+
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// validReaction reports whether emoji is short enough to react with and
+// made of printable characters other than letters and digits, which keeps
+// reactions to emoji and symbols rather than words.
+func validReaction(emoji string) bool {
+	if !utf8.ValidString(emoji) || utf8.RuneCountInString(emoji) > maxReactionLength {
+		return false
+	}
+
+	for _, r := range emoji {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return false
+		}
+
+		if !unicode.IsPrint(r) && !unicode.Is(unicode.Join_Control, r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseReact(client *Client, args []string) Command {
+	id, err := strconv.ParseUint(args[1], 10, 64)
+
+	if err != nil || !validReaction(args[2]) {
+		return nil
+	}
+
+	return &ReactCommand{
+		client: client,
+		room:   args[0],
+		id:     id,
+		emoji:  args[2],
+	}
+}
@@ -0,0 +1,155 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// reloadOnSignal reloads the config whenever SIGHUP arrives.
+func (server *Server) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			server.call(func() {
+				server.reload()
+			})
+		}
+	}()
+}
+
+// reload reads the config file and command line again and applies what
+// can change while clients are connected: the message of the day, the word
+// filter, rate limits, per role message limits, the connection policy and
+// the log level. The message of the day and filter files are read again
+// even if they haven't moved. Errors are logged as well as returned. It
+// must be called on the dispatcher.
+func (server *Server) reload() error {
+	config, configErr := LoadConfig(os.Args[0], os.Args[1:])
+
+	if configErr == nil {
+		configErr = server.applyConfig(config)
+	}
+
+	if configErr != nil {
+		slog.Error("reloading config", "err", configErr)
+	}
+
+	motdErr := server.ReloadMOTD()
+
+	if motdErr != nil {
+		slog.Error("reloading motd", "err", motdErr)
+	} else {
+		slog.Info("reloaded motd", "path", server.motdPath)
+	}
+
+	filterErr := server.ReloadFilter()
+
+	if filterErr != nil {
+		slog.Error("reloading filter", "err", filterErr)
+	}
+
+	return errors.Join(configErr, motdErr, filterErr)
+}
+
+// applyConfig switches to the reloadable settings in config. If any of
+// them is invalid, none are changed.
+func (server *Server) applyConfig(config *Config) error {
+	limits, err := config.rateLimits()
+
+	if err != nil {
+		return err
+	}
+
+	roleLimits, err := config.roleLimits()
+
+	if err != nil {
+		return err
+	}
+
+	policy, err := config.connPolicy()
+
+	if err != nil {
+		return err
+	}
+
+	filter := server.filter
+
+	if config.FilterPath == "" {
+		filter = nil
+	} else if filter == nil || filter.path != config.FilterPath || filter.action != config.FilterAction {
+		filter, err = NewWordFilter(config.FilterPath, config.FilterAction)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	server.filter = filter
+	server.rateLimits.Store(limits)
+	server.connPolicy.Store(policy)
+	server.roleLimits = roleLimits
+	logLevel.Set(config.LogLevel)
+
+	if config.MOTDPath == "" {
+		server.motd = ""
+	}
+
+	server.motdPath = config.MOTDPath
+
+	for _, name := range needRestart(server.config, config) {
+		slog.Warn("config change needs a restart to take effect", "setting", name)
+	}
+
+	slog.Info("reloaded config", "log_level", config.LogLevel.String(), "rate_limit", config.RateLimit)
+	return nil
+}
+
+// needRestart names the settings that differ between the config the server
+// started with and a reloaded one but can't change without restarting:
+// mostly the addresses it listens on.
+func needRestart(running, reloaded *Config) []string {
+	settings := func(config *Config) map[string]string {
+		return map[string]string{
+			"addr":           config.Addr,
+			"tls-addr":       config.TLSAddr,
+			"tls-cert":       config.TLSCert,
+			"tls-key":        config.TLSKey,
+			"acme-domain":    config.ACMEDomain,
+			"acme-cache":     config.ACMECache,
+			"acme-http-addr": config.ACMEHTTPAddr,
+			"unix":           config.UnixPath,
+			"ws-addr":        config.WSAddr,
+			"irc-addr":       config.IRCAddr,
+			"grpc-addr":      config.GRPCAddr,
+			"admin-addr":     config.AdminAddr,
+			"console":        config.ConsoleAddr,
+			"metrics-addr":   config.MetricsAddr,
+			"link-addr":      config.LinkAddr,
+			"inbound-addr":   config.InboundAddr,
+			"stream-addr":    config.StreamAddr,
+			"upload-addr":    config.UploadAddr,
+			"matrix-addr":    config.MatrixAddr,
+			"log-format":     config.LogFormat,
+			"listen":         fmt.Sprint(config.Listeners),
+		}
+	}
+
+	before, after := settings(running), settings(reloaded)
+	var changed []string
+
+	for name, value := range before {
+		if after[name] != value {
+			changed = append(changed, name)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
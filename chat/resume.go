@@ -0,0 +1,242 @@
+package chat
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every client is given a session token when it connects. If its
+// connection drops, what it had is kept for the session grace period: a
+// client that reconnects in time and sends the token gets back its nick,
+// or its login, and its rooms, along with the messages it missed, as far
+// as room history goes back. Clients that quit, or that the server
+// disconnected on purpose, can't resume.
+//
+// A client with sequence numbers on can also say the last line it saw, to
+// get back the lines after it that the old connection wrote but that never
+// arrived, numbered as they were. Either way numbering carries on from the
+// old connection's.
+
+// replaySize is how many of the lines last written to a client with
+// sequence numbers on are kept for it.
+const replaySize = 100
+
+// replayLog is the lines last written to a client, the last of them
+// numbered seq. The client's writer adds to it, and the client resuming
+// the session reads it, so it is locked.
+type replayLog struct {
+	mu     sync.Mutex
+	seq    uint64
+	events []*Event
+}
+
+func (log *replayLog) add(seq uint64, event *Event) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	// Lines written with numbering off leave a gap.
+	if seq != log.seq+1 {
+		log.events = nil
+	}
+
+	log.events = append(log.events, event)
+
+	if len(log.events) > replaySize {
+		log.events = log.events[1:]
+	}
+
+	log.seq = seq
+}
+
+// after returns the lines kept from after seen, or none if seen is nil,
+// and the number of the line before the first of them, which is seen
+// unless some are no longer kept. last is the number of the last line
+// written, 0 if none were numbered.
+func (log *replayLog) after(seen *uint64) (events []*Event, before, last uint64) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if seen == nil || *seen >= log.seq {
+		return nil, log.seq, log.seq
+	}
+
+	first := log.seq - uint64(len(log.events)) + 1
+	before = max(*seen, first-1)
+
+	return append([]*Event(nil), log.events[before+1-first:]...), before, log.seq
+}
+
+// Of the reasons the server disconnects clients, these are the ones that
+// usually mean the connection was lost rather than that the client was
+// thrown out.
+var resumableReasons = map[string]bool{
+	"Ping timeout": true,
+	"Too slow":     true,
+}
+
+// A savedSession is what a disconnected client can come back to.
+type savedSession struct {
+	nick    string
+	account string
+	expires time.Time
+
+	// The ID of the last message in each room when the client dropped.
+	rooms map[string]uint64
+
+	sent *replayLog
+}
+
+// startSession gives a newly connected client its session token. Only a
+// hash of it is kept.
+func (server *Server) startSession(client *Client) {
+	if server.sessionGrace <= 0 || client.quiet.Load() {
+		return
+	}
+
+	secret := newSecret(24)
+	client.session = hashToken(secret)
+	client.Send(&Event{Type: EventSession, Text: secret})
+}
+
+// suspendSession keeps a disconnecting client's session for the grace
+// period, if there is anything to come back to.
+func (server *Server) suspendSession(client *Client) {
+	now := time.Now()
+
+	for hash, saved := range server.sessions {
+		if now.After(saved.expires) {
+			delete(server.sessions, hash)
+		}
+	}
+
+	if evicted := client.evicted.Load(); client.session == "" || (evicted != nil && !resumableReasons[*evicted]) {
+		return
+	}
+
+	if len(client.rooms) == 0 && client.account == "" && guestRegexp.MatchString(client.Name()) {
+		return
+	}
+
+	saved := &savedSession{
+		nick:    client.Name(),
+		account: client.account,
+		expires: now.Add(server.sessionGrace),
+		rooms:   make(map[string]uint64, len(client.rooms)),
+		sent:    client.sent,
+	}
+
+	for _, room := range client.rooms {
+		saved.rooms[room.name] = room.lastMessageID
+	}
+
+	server.sessions[client.session] = saved
+}
+
+// ResumeCommand picks up a session that was cut off. seen is the number
+// of the last line the client got, if it said.
+type ResumeCommand struct {
+	client *Client
+	secret string
+	seen   *uint64
+}
+
+func (cmd *ResumeCommand) Run(server *Server) {
+	hash := hashToken(cmd.secret)
+	saved, exists := server.sessions[hash]
+
+	if !exists || time.Now().After(saved.expires) {
+		delete(server.sessions, hash)
+		cmd.client.Error("No such session, or it has expired")
+		return
+	}
+
+	delete(server.sessions, hash)
+	cmd.client.logger().Info("resumed session", "nick", saved.nick, "rooms", len(saved.rooms))
+
+	account, exists := server.accounts.Get(saved.account)
+
+	switch {
+	case saved.account != "" && exists && !sameName(cmd.client.account, saved.account):
+		server.LogIn(cmd.client, account)
+	case saved.account == "" && !guestRegexp.MatchString(saved.nick):
+		(&NickCommand{client: cmd.client, nick: saved.nick}).Run(server)
+	}
+
+	server.replay(cmd.client, saved.sent, cmd.seen)
+
+	for name, lastID := range saved.rooms {
+		// They were already let in, so the room's key and invite list
+		// shouldn't keep them out now. Bans still do.
+		if room, exists := server.LookupRoom(name); exists {
+			room.invited[foldName(cmd.client.Name())] = true
+			server.joinRoom(name, cmd.client, room.key, lastID)
+		} else {
+			server.joinRoom(name, cmd.client, "", lastID)
+		}
+
+		room, exists := server.LookupRoom(name)
+
+		if !exists || !room.HasClient(cmd.client) {
+			continue
+		}
+
+		room.do(func() {
+			messages := room.history.Messages()
+
+			if len(messages) > 0 && messages[0].id > lastID+1 {
+				cmd.client.Notice(room.name, "Some of the messages you missed are no longer in history")
+			}
+
+			missed := 0
+
+			for _, msg := range messages {
+				if msg.id > lastID {
+					missed++
+				}
+			}
+
+			cmd.client.Notice(room.name, fmt.Sprintf("End of %d missed messages", missed))
+		})
+	}
+
+	cmd.client.Reply("Resumed your session")
+}
+
+// replay sends client the lines the old connection wrote after seen, and
+// has its numbering carry on from the old connection's.
+func (server *Server) replay(client *Client, sent *replayLog, seen *uint64) {
+	events, before, last := sent.after(seen)
+
+	if last == 0 {
+		return
+	}
+
+	if seen != nil && before > *seen {
+		client.Notice("", fmt.Sprintf("Lines %d to %d are no longer kept", *seen+1, before))
+	}
+
+	client.Send(&Event{renumber: true, Seq: before})
+
+	for _, event := range events {
+		client.Send(event)
+	}
+}
+
+func parseResume(client *Client, args []string) Command {
+	cmd := &ResumeCommand{
+		client: client,
+		secret: args[0],
+	}
+
+	if len(args) > 1 {
+		seen, err := strconv.ParseUint(args[1], 10, 64)
+
+		if err == nil {
+			cmd.seen = &seen
+		}
+	}
+
+	return cmd
+}
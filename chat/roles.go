@@ -0,0 +1,177 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Role is how much a client is trusted across the whole server. Guests
+// haven't logged in; everyone with an account is a user unless an admin
+// has made them a moderator or admin. Becoming an operator with the oper
+// password makes a client an admin until it disconnects.
+type Role int
+
+const (
+	RoleGuest Role = iota
+	RoleUser
+	RoleModerator
+	RoleAdmin
+)
+
+var roleNames = []string{"guest", "user", "moderator", "admin"}
+
+func (role Role) String() string {
+	return roleNames[role]
+}
+
+func parseRole(name string) (Role, bool) {
+	for i, roleName := range roleNames {
+		if strings.EqualFold(name, roleName) {
+			return Role(i), true
+		}
+	}
+
+	return RoleGuest, false
+}
+
+// holders names everyone with at least role, for error messages.
+func (role Role) holders() string {
+	names := make([]string, 0, len(roleNames))
+
+	for _, name := range roleNames[role:] {
+		names = append(names, name+"s")
+	}
+
+	return strings.Join(names, " and ")
+}
+
+// role is the role the account gives whoever is logged in to it.
+func (account *Account) role() Role {
+	role, ok := parseRole(account.Role)
+
+	if !ok || role < RoleUser {
+		return RoleUser
+	}
+
+	return role
+}
+
+// Role is the role the client has right now. Only the dispatcher changes
+// it.
+func (client *Client) Role() Role {
+	if client.oper {
+		return RoleAdmin
+	}
+
+	return client.role
+}
+
+// CheckRole reports whether client has at least role, telling it if not.
+func (server *Server) CheckRole(client *Client, role Role, what string) bool {
+	if client.Role() >= role {
+		return true
+	}
+
+	client.Error(fmt.Sprintf("%s is only for %s", what, role.holders()))
+	return false
+}
+
+// permittedCommand runs a command whose spec needs a role once the
+// dispatcher, which owns the client's role, has checked it.
+type permittedCommand struct {
+	client *Client
+	verb   string
+	role   Role
+	cmd    Command
+}
+
+func (cmd *permittedCommand) Run(server *Server) {
+	if server.CheckRole(cmd.client, cmd.role, cmd.verb) {
+		cmd.cmd.Run(server)
+	}
+}
+
+// RoleCommand shows or sets the role of a registered account. Clients
+// logged in to it get the new role straight away.
+type RoleCommand struct {
+	client  *Client
+	account string
+	role    string
+}
+
+func (cmd *RoleCommand) Run(server *Server) {
+	account, exists := server.accounts.Get(cmd.account)
+
+	if !exists {
+		cmd.client.Error("No such account")
+		return
+	}
+
+	if cmd.role == "" {
+		cmd.client.Reply(fmt.Sprintf("%s is a %s", account.Nick, account.role()))
+		return
+	}
+
+	role, ok := parseRole(cmd.role)
+
+	if !ok || role == RoleGuest {
+		cmd.client.Error("Accounts can be users, moderators or admins")
+		return
+	}
+
+	account.Role = role.String()
+
+	if role == RoleUser {
+		account.Role = ""
+	}
+
+	err := server.accounts.Put(account)
+
+	if err != nil {
+		cmd.client.logger().Error("saving accounts", "err", err)
+		cmd.client.Error("Could not save the role")
+		return
+	}
+
+	cmd.client.logger().Info("set role", "account", account.Nick, "role", role.String())
+	server.audit(cmd.client.Name(), "role "+role.String(), "", account.Nick, "")
+
+	for _, client := range server.clients.Sorted() {
+		if client.account != "" && sameName(client.account, account.Nick) {
+			client.role = role
+			client.Notice("", fmt.Sprintf("%s made you a %s", plainName(cmd.client.Name()), role))
+		}
+	}
+
+	cmd.client.Reply(fmt.Sprintf("%s is now a %s", account.Nick, role))
+}
+
+// WallCommand sends a notice to every connected client.
+type WallCommand struct {
+	client *Client
+	text   string
+}
+
+func (cmd *WallCommand) Run(server *Server) {
+	cmd.client.logger().Info("sent wall", "text", cmd.text)
+	server.audit(cmd.client.Name(), "wall", "", "", cmd.text)
+
+	for _, client := range server.clients.Sorted() {
+		client.Notice("", fmt.Sprintf("Server notice from %s: %s", plainName(cmd.client.Name()), cmd.text))
+	}
+}
+
+func parseRoleCommand(client *Client, args []string) Command {
+	return &RoleCommand{
+		client:  client,
+		account: args[0],
+		role:    args[1],
+	}
+}
+
+func parseWall(client *Client, args []string) Command {
+	return &WallCommand{
+		client: client,
+		text:   args[0],
+	}
+}
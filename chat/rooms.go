@@ -0,0 +1,331 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"sort"
+	"time"
+)
+
+// storedRoom is a registered room as saved in the rooms file. Operators
+// are kept as account names, since only logged in users can be recognised
+// when they come back.
+type storedRoom struct {
+	Name       string            `json:"name"`
+	Topic      string            `json:"topic,omitempty"`
+	Key        string            `json:"key,omitempty"`
+	Limit      int               `json:"limit,omitempty"`
+	InviteOnly bool              `json:"invite_only,omitempty"`
+	Unfiltered bool              `json:"unfiltered,omitempty"`
+	Encrypted  bool              `json:"encrypted,omitempty"`
+	Moderated  bool              `json:"moderated,omitempty"`
+	MinAge     Duration          `json:"min_age,omitzero"`
+	Welcome    string            `json:"welcome,omitempty"`
+	Triggers   map[string]string `json:"triggers,omitempty"`
+	Ops        []string          `json:"ops,omitempty"`
+	Bans       []storedBan       `json:"bans,omitempty"`
+}
+
+// storedBan is a room ban as saved in the rooms file. Files from before
+// bans recorded who set them and when they end list just the nick.
+type storedBan struct {
+	Nick    string    `json:"nick"`
+	By      string    `json:"by,omitempty"`
+	Set     time.Time `json:"set,omitzero"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+func (ban *storedBan) UnmarshalJSON(data []byte) error {
+	if json.Unmarshal(data, &ban.Nick) == nil {
+		return nil
+	}
+
+	type plain storedBan
+	return json.Unmarshal(data, (*plain)(ban))
+}
+
+// RoomStore holds registered rooms, saved as a single JSON file. Only the
+// dispatcher touches it.
+type RoomStore struct {
+	path  string
+	rooms map[string]*storedRoom
+}
+
+func LoadRoomStore(path string) (*RoomStore, error) {
+	store := &RoomStore{
+		path:  path,
+		rooms: make(map[string]*storedRoom),
+	}
+
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rooms []*storedRoom
+
+	err = json.Unmarshal(data, &rooms)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for _, room := range rooms {
+		store.rooms[room.Name] = room
+	}
+
+	return store, nil
+}
+
+func (store *RoomStore) Put(room *storedRoom) error {
+	store.rooms[room.Name] = room
+	return store.save()
+}
+
+func (store *RoomStore) Delete(name string) error {
+	delete(store.rooms, name)
+	return store.save()
+}
+
+func (store *RoomStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+
+	rooms := make([]*storedRoom, 0, len(store.rooms))
+
+	for _, room := range store.rooms {
+		rooms = append(rooms, room)
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+
+	data, err := json.MarshalIndent(rooms, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp := store.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, store.path)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+
+	for key := range set {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// restoreRooms recreates the registered rooms at startup.
+func (server *Server) restoreRooms() {
+	for _, stored := range server.roomStore.rooms {
+		room := NewRoom(stored.Name, server.historySize)
+		room.lastMessageID = server.lastMessageIDs[foldName(stored.Name)]
+		room.registered = true
+		room.topic = stored.Topic
+		room.key = stored.Key
+		room.limit = stored.Limit
+		room.inviteOnly = stored.InviteOnly
+		room.unfiltered = stored.Unfiltered
+		room.encrypted = stored.Encrypted
+		room.moderated = stored.Moderated
+		room.minAge = stored.MinAge.Duration
+		room.welcome = stored.Welcome
+		maps.Copy(room.triggers, stored.Triggers)
+
+		for _, account := range stored.Ops {
+			room.opAccounts[account] = true
+		}
+
+		for _, ban := range stored.Bans {
+			room.banned[foldName(ban.Nick)] = &roomBan{nick: ban.Nick, by: ban.By, set: ban.Set, expires: ban.Expires}
+		}
+
+		server.rooms.Set(foldName(room.name), room)
+		server.metrics.rooms.Add(1)
+
+		room.do(func() {
+			server.loadHistory(room)
+		})
+	}
+}
+
+// saveRoom writes room to the rooms file if it is registered. Commands
+// that change anything kept there call it afterwards.
+func (server *Server) saveRoom(room *Room) {
+	if !room.registered {
+		return
+	}
+
+	err := server.roomStore.Put(&storedRoom{
+		Name:       room.name,
+		Topic:      room.topic,
+		Key:        room.key,
+		Limit:      room.limit,
+		InviteOnly: room.inviteOnly,
+		Unfiltered: room.unfiltered,
+		Encrypted:  room.encrypted,
+		Moderated:  room.moderated,
+		MinAge:     Duration{room.minAge},
+		Welcome:    room.welcome,
+		Triggers:   maps.Clone(room.triggers),
+		Ops:        sortedKeys(room.opAccounts),
+		Bans:       storedBans(room.banned),
+	})
+
+	if err != nil {
+		slog.Error("saving rooms", "room", room.name, "err", err)
+	}
+}
+
+// storedBans lists the bans in banned that haven't run out, by nick.
+func storedBans(banned map[string]*roomBan) []storedBan {
+	now := time.Now()
+	bans := make([]storedBan, 0, len(banned))
+
+	for _, ban := range banned {
+		if !ban.expired(now) {
+			bans = append(bans, storedBan{Nick: ban.nick, By: ban.by, Set: ban.set, Expires: ban.expires})
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return foldName(bans[i].Nick) < foldName(bans[j].Nick)
+	})
+
+	return bans
+}
+
+// setOp makes client an operator of room or takes it away, remembering it
+// for registered rooms if client is logged in.
+func (server *Server) setOp(room *Room, client *Client, op bool) {
+	if op {
+		room.ops[client] = true
+	} else {
+		delete(room.ops, client)
+	}
+
+	if !room.registered || client.account == "" {
+		return
+	}
+
+	if op {
+		room.opAccounts[client.account] = true
+	} else {
+		delete(room.opAccounts, client.account)
+	}
+
+	server.saveRoom(room)
+}
+
+type RegisterRoomCommand struct {
+	client *Client
+	room   string
+}
+
+func (cmd *RegisterRoomCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	if cmd.client.account == "" {
+		cmd.client.Error("You must log in first")
+		return
+	}
+
+	if room.registered {
+		cmd.client.Error("Room is already registered")
+		return
+	}
+
+	room.registered = true
+	room.opAccounts[cmd.client.account] = true
+
+	for client := range room.ops {
+		if client.account != "" {
+			room.opAccounts[client.account] = true
+		}
+	}
+
+	server.saveRoom(room)
+	cmd.client.logger().Info("registered room", "room", room.name)
+	room.Notice(fmt.Sprintf("%s registered %s; it will stay open when empty and across restarts", plainName(cmd.client.Name()), plainName(room.name)))
+}
+
+type UnregisterRoomCommand struct {
+	client *Client
+	room   string
+}
+
+func (cmd *UnregisterRoomCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	if !room.registered {
+		cmd.client.Error("Room isn't registered")
+		return
+	}
+
+	room.registered = false
+	clear(room.opAccounts)
+
+	err := server.roomStore.Delete(room.name)
+
+	if err != nil {
+		slog.Error("saving rooms", "room", room.name, "err", err)
+	}
+
+	cmd.client.logger().Info("unregistered room", "room", room.name)
+	cmd.client.Reply("Unregistered " + room.name)
+
+	if len(room.clients) == 0 {
+		server.DeleteRoom(room)
+	} else {
+		room.Notice(fmt.Sprintf("%s unregistered %s", plainName(cmd.client.Name()), plainName(room.name)))
+	}
+}
+
+func parseRegisterRoom(client *Client, args []string) Command {
+	return &RegisterRoomCommand{
+		client: client,
+		room:   args[0],
+	}
+}
+
+func parseUnregisterRoom(client *Client, args []string) Command {
+	return &UnregisterRoomCommand{
+		client: client,
+		room:   args[0],
+	}
+}
@@ -0,0 +1,310 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Scripts are Lua files an operator drops into a directory to hook into
+// the server without rebuilding it. A script registers its hooks through
+// the chat table when it is loaded:
+//
+//	chat.on_message(function(room, nick, text) ... end)
+//	chat.command("roll", "roll - roll a die", function(nick, args) ... end)
+//	chat.log("something happened")
+//
+// An on_message hook sees every room message before it is sent. Returning
+// nothing lets it through, a string sends that instead, and false rejects
+// it, with an optional second value saying why. A command's function gets
+// the caller's nick and the rest of the line, and whatever string it
+// returns is the reply.
+//
+// Scripts run in a sandbox: only the base, string, table and math
+// libraries are loaded, without dofile, loadfile, load, loadstring or
+// require, so a script can't reach the filesystem, other processes or
+// other code. Every call, loading included, is cut off after the script
+// time limit. A script that fails or runs out of time lets the message
+// through unchanged, since a broken script shouldn't stop a room.
+type Scripts struct {
+	timeout time.Duration
+	scripts []*script
+}
+
+type script struct {
+	name string
+
+	// A Lua state can only be used by one goroutine at a time, and rooms
+	// send messages from their own.
+	mu        sync.Mutex
+	state     *lua.LState
+	onMessage []*lua.LFunction
+	commands  []scriptCommand
+}
+
+type scriptCommand struct {
+	verb string
+	help string
+	fn   *lua.LFunction
+}
+
+// Lua's standard functions that would let a script load other code.
+var unsafeLuaGlobals = []string{"dofile", "loadfile", "load", "loadstring", "require", "module"}
+
+// LoadScripts loads every .lua file in dir, in name order.
+func LoadScripts(dir string, timeout time.Duration) (*Scripts, error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("script time limit must be positive")
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.lua"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(paths)
+	scripts := &Scripts{timeout: timeout}
+
+	for _, path := range paths {
+		s, err := loadScript(path, timeout)
+
+		if err != nil {
+			scripts.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		slog.Info("loaded script", "path", path, "hooks", len(s.onMessage), "commands", len(s.commands))
+		scripts.scripts = append(scripts.scripts, s)
+	}
+
+	return scripts, nil
+}
+
+func loadScript(path string, timeout time.Duration) (*script, error) {
+	source, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &script{name: filepath.Base(path)}
+	s.state = lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   200,
+		RegistryMaxSize: 64 * 1024,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		s.state.Push(s.state.NewFunction(lib.open))
+		s.state.Push(lua.LString(lib.name))
+		s.state.Call(1, 0)
+	}
+
+	for _, name := range unsafeLuaGlobals {
+		s.state.SetGlobal(name, lua.LNil)
+	}
+
+	api := s.state.NewTable()
+	s.state.SetFuncs(api, map[string]lua.LGFunction{
+		"on_message": s.luaOnMessage,
+		"command":    s.luaCommand,
+		"log":        s.luaLog,
+	})
+	s.state.SetGlobal("chat", api)
+
+	fn, err := s.state.LoadString(string(source))
+
+	if err != nil {
+		s.state.Close()
+		return nil, err
+	}
+
+	_, err = s.call(timeout, fn, 0)
+
+	if err != nil {
+		s.state.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *script) luaOnMessage(state *lua.LState) int {
+	s.onMessage = append(s.onMessage, state.CheckFunction(1))
+	return 0
+}
+
+func (s *script) luaCommand(state *lua.LState) int {
+	verb := strings.ToLower(state.CheckString(1))
+
+	if !linkNameRegexp.MatchString(verb) {
+		state.ArgError(1, "commands are single words")
+	}
+
+	s.commands = append(s.commands, scriptCommand{
+		verb: verb,
+		help: state.CheckString(2),
+		fn:   state.CheckFunction(3),
+	})
+
+	return 0
+}
+
+func (s *script) luaLog(state *lua.LState) int {
+	slog.Info("script", "script", s.name, "msg", state.CheckString(1))
+	return 0
+}
+
+// call runs fn with args, stopping it after timeout, and returns what it
+// returned. The caller holds s.mu, or has s to itself while loading it.
+func (s *script) call(timeout time.Duration, fn *lua.LFunction, nret int, args ...lua.LValue) ([]lua.LValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	s.state.SetContext(ctx)
+	defer s.state.RemoveContext()
+
+	top := s.state.GetTop()
+	err := s.state.CallByParam(lua.P{Fn: fn, NRet: nret, Protect: true}, args...)
+
+	if err != nil {
+		s.state.SetTop(top)
+
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("ran for more than %v", timeout)
+		}
+
+		return nil, err
+	}
+
+	results := make([]lua.LValue, nret)
+
+	for i := range results {
+		results[i] = s.state.Get(top + 1 + i)
+	}
+
+	s.state.SetTop(top)
+
+	return results, nil
+}
+
+// Filter runs every script's on_message hooks over a message client is
+// sending to room, each seeing the text the one before left. It returns
+// the text to send, and false if a hook rejected it, in which case client
+// has been told.
+func (scripts *Scripts) Filter(room *Room, client *Client, text string) (string, bool) {
+	if scripts == nil {
+		return text, true
+	}
+
+	for _, s := range scripts.scripts {
+		s.mu.Lock()
+
+		for _, hook := range s.onMessage {
+			results, err := s.call(scripts.timeout, hook, 2, lua.LString(room.name), lua.LString(client.Name()), lua.LString(text))
+
+			if err != nil {
+				client.logger().Error("running script hook", "script", s.name, "room", room.name, "err", err)
+				continue
+			}
+
+			switch result := results[0].(type) {
+			case lua.LString:
+				text = string(result)
+			case lua.LBool:
+				if bool(result) {
+					continue
+				}
+
+				s.mu.Unlock()
+
+				reason := "Your message was rejected"
+
+				if why, ok := results[1].(lua.LString); ok && why != "" {
+					reason = string(why)
+				}
+
+				client.logger().Info("message rejected by script", "script", s.name, "room", room.name)
+				client.Error(reason)
+				return "", false
+			}
+		}
+
+		s.mu.Unlock()
+	}
+
+	return text, true
+}
+
+// Commands makes Scripts a Plugin, so the commands scripts define are
+// parsed and listed in help like any other.
+func (scripts *Scripts) Commands() []CommandSpec {
+	var specs []CommandSpec
+
+	for _, s := range scripts.scripts {
+		for _, command := range s.commands {
+			specs = append(specs, CommandSpec{
+				Verb: command.verb,
+				Args: []Arg{{Name: "arguments", Type: ArgText, Optional: true}},
+				Help: command.help,
+				Parse: func(client *Client, args []string) Command {
+					return &ScriptCommand{client: client, script: s, fn: command.fn, verb: command.verb, args: args[0]}
+				},
+			})
+		}
+	}
+
+	return specs
+}
+
+func (scripts *Scripts) Close() {
+	for _, s := range scripts.scripts {
+		s.mu.Lock()
+		s.state.Close()
+		s.mu.Unlock()
+	}
+}
+
+// ScriptCommand runs a command a script defined.
+type ScriptCommand struct {
+	client *Client
+	script *script
+	fn     *lua.LFunction
+	verb   string
+	args   string
+}
+
+func (cmd *ScriptCommand) Run(server *Server) {
+	s := cmd.script
+
+	s.mu.Lock()
+	results, err := s.call(server.scripts.timeout, cmd.fn, 1, lua.LString(cmd.client.Name()), lua.LString(cmd.args))
+	s.mu.Unlock()
+
+	if err != nil {
+		cmd.client.logger().Error("running script command", "script", s.name, "verb", cmd.verb, "err", err)
+		cmd.client.Error(fmt.Sprintf("%s failed", cmd.verb))
+		return
+	}
+
+	if reply, ok := results[0].(lua.LString); ok && reply != "" {
+		cmd.client.Reply(string(reply))
+	}
+}
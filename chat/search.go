@@ -0,0 +1,269 @@
+package chat
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Searches look through this many of a room's latest messages.
+	maxSearchScan = 10000
+	searchPage    = 20
+)
+
+// A search is a query split into the words a message must all contain,
+// in any case, and the ID its page of results comes before, or 0 for the
+// latest.
+type search struct {
+	terms  []string
+	before uint64
+}
+
+// parseSearch reads a query like "deploy failed before:120". Searching one
+// page at a time, the next page is before the oldest result on this one.
+func parseSearch(query string) (search, bool) {
+	var s search
+
+	for _, word := range strings.Fields(query) {
+		if id, ok := strings.CutPrefix(word, "before:"); ok {
+			before, err := strconv.ParseUint(id, 10, 64)
+
+			if err != nil {
+				return s, false
+			}
+
+			s.before = before
+			continue
+		}
+
+		s.terms = append(s.terms, strings.ToLower(word))
+	}
+
+	return s, len(s.terms) > 0
+}
+
+func (s search) matches(msg *Message) bool {
+	if s.before != 0 && msg.id >= s.before {
+		return false
+	}
+
+	text := strings.ToLower(msg.text)
+
+	for _, term := range s.terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// run returns the latest page of matches among messages, oldest first,
+// and whether there are earlier ones.
+func (s search) run(messages []*Message) ([]*Message, bool) {
+	var results []*Message
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		if !s.matches(messages[i]) {
+			continue
+		}
+
+		if len(results) == searchPage {
+			return reversed(results), true
+		}
+
+		results = append(results, messages[i])
+	}
+
+	return reversed(results), false
+}
+
+func reversed(messages []*Message) []*Message {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages
+}
+
+// searchable checks that room's messages can be searched by client.
+func searchable(room *Room, client *Client) bool {
+	if !room.HasClient(client) {
+		client.Error("You are not in that room")
+		return false
+	}
+
+	if room.encrypted {
+		client.Error("Encrypted rooms can't be searched")
+		return false
+	}
+
+	return true
+}
+
+// SearchCommand looks for messages in a room's history that contain every
+// word of a query.
+type SearchCommand struct {
+	client *Client
+	room   string
+	search search
+}
+
+func (cmd *SearchCommand) Run(server *Server) {
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		cmd.client.Error("Room doesn't exist")
+		return
+	}
+
+	if !searchable(room, cmd.client) {
+		return
+	}
+
+	room.do(func() {
+		messages, err := server.roomHistory(room, maxSearchScan)
+
+		if err != nil {
+			cmd.client.Error("History is unavailable")
+			return
+		}
+
+		results, more := cmd.search.run(messages)
+
+		for _, msg := range results {
+			cmd.client.Send(msg.Event(server.timeLocation, true))
+		}
+
+		if !more {
+			cmd.client.Notice(room.name, fmt.Sprintf("End of results, %d found", len(results)))
+			return
+		}
+
+		next := search{terms: cmd.search.terms, before: results[0].id}
+		cmd.client.Notice(room.name, fmt.Sprintf("More results with: search %s %s", quoteName(room.name), next))
+	})
+}
+
+func (s search) String() string {
+	query := strings.Join(s.terms, " ")
+
+	if s.before != 0 {
+		query += fmt.Sprintf(" before:%d", s.before)
+	}
+
+	return query
+}
+
+func parseSearchCommand(client *Client, args []string) Command {
+	s, ok := parseSearch(args[1])
+
+	if !ok {
+		return nil
+	}
+
+	return &SearchCommand{
+		client: client,
+		room:   args[0],
+		search: s,
+	}
+}
+
+type searchResponse struct {
+	Results []*Event `json:"results"`
+	Before  uint64   `json:"before,omitempty"`
+}
+
+// searchRoute answers "GET /rooms/<room>/search?q=<query>", with the
+// query as the search command takes it. It needs an account token, and
+// searches only rooms someone logged in to that account is in. When there
+// are more results, before says what to add to the query for the next
+// page.
+func (server *Server) searchRoute(w http.ResponseWriter, r *http.Request, name string) {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s, ok := parseSearch(r.URL.Query().Get("q"))
+
+	if !ok {
+		http.Error(w, "expected ?q=<query>", http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	var response searchResponse
+	done := make(chan struct{})
+
+	server.call(func() {
+		account, exists := server.accounts.Authenticate(secret)
+
+		if !exists {
+			status = http.StatusUnauthorized
+			close(done)
+			return
+		}
+
+		room, exists := server.LookupRoom(name)
+
+		if !exists {
+			status = http.StatusNotFound
+			close(done)
+			return
+		}
+
+		if !room.hasAccount(account.Nick) || room.encrypted {
+			status = http.StatusForbidden
+			close(done)
+			return
+		}
+
+		room.do(func() {
+			defer close(done)
+
+			messages, err := server.roomHistory(room, maxSearchScan)
+
+			if err != nil {
+				status = http.StatusInternalServerError
+				return
+			}
+
+			results, more := s.run(messages)
+			response.Results = make([]*Event, len(results))
+
+			for i, msg := range results {
+				response.Results[i] = msg.Event(server.timeLocation, true)
+			}
+
+			if more {
+				response.Before = results[0].id
+			}
+		})
+	})
+
+	<-done
+
+	if status != http.StatusOK {
+		http.Error(w, strings.ToLower(http.StatusText(status)), status)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &response)
+}
+
+// hasAccount reports whether a member of room is logged in to account.
+func (room *Room) hasAccount(account string) bool {
+	for _, client := range room.clients {
+		if client.account != "" && sameName(client.account, account) {
+			return true
+		}
+	}
+
+	return false
+}
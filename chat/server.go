@@ -0,0 +1,3420 @@
+package chat
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// roomQueueSize is how much work the dispatcher can queue for a room
+// before it has to wait for the room's goroutine to catch up.
+const roomQueueSize = 64
+
+// writeFlushInterval is the longest a client's writer keeps adding queued
+// events to a batch before flushing it.
+const writeFlushInterval = 5 * time.Millisecond
+
+// A client is disconnected for sending overlongLimit overlong lines within
+// overlongWindow, or for a single line that runs on for more than
+// endlessLine buffers full, which is never going to end.
+const (
+	overlongLimit  = 4
+	overlongWindow = 10 * time.Minute
+	endlessLine    = 16
+)
+
+// minLine is the shortest line limit allowed, so that every command still
+// fits.
+const minLine = 64
+
+// A Room's state is split between two goroutines. The dispatcher owns the
+// membership list, topic and polls, and is the only caller of Room's
+// methods. Delivering events and keeping history belong to the room's own
+// goroutine, which runs the work the dispatcher queues with do, so one busy
+// room doesn't hold up the rest of the server.
+type Room struct {
+	name    string
+	topic   string
+	clients []*Client
+	polls   map[uint64]*Poll
+	ops     map[*Client]bool
+	banned  map[string]*roomBan
+	key     string
+	limit   int
+
+	inviteOnly bool
+	invited    map[string]bool
+	unfiltered bool
+	encrypted  bool
+	moderated  bool
+	voiced     map[*Client]bool
+
+	// How old an account must be to send messages to the room, if set.
+	minAge time.Duration
+
+	// Sent to each client that joins.
+	welcome string
+
+	// Notices posted when a message mentions a keyword, by keyword, and
+	// when each was last posted, which only the room's goroutine touches.
+	triggers     map[string]string
+	triggerFired map[string]time.Time
+
+	// Registered rooms stay open when empty and are saved across restarts,
+	// along with which accounts are their operators.
+	registered bool
+	opAccounts map[string]bool
+
+	// The ID of the last message sent to the room. IDs count up from 1
+	// in each room, so members can tell if they missed any.
+	lastMessageID uint64
+
+	// When the room opened and how many messages it has had since, for
+	// stats.
+	opened   time.Time
+	messages uint64
+
+	// mu is held while a message is posted, so that messages sent off the
+	// dispatcher get their IDs, and reach the room's goroutine, in order.
+	// Concurrent commands also hold it to look at or change clients, ops
+	// and voiced; dispatcher commands have the room to themselves.
+	mu sync.Mutex
+
+	incoming chan func()
+	closed   bool
+
+	// Only touched on the room's goroutine.
+	recipients []*Client
+	history    *History
+	streams    map[chan *Event]bool
+}
+
+func (room *Room) run() {
+	for fn := range room.incoming {
+		fn()
+	}
+
+	for stream := range room.streams {
+		close(stream)
+	}
+}
+
+// do queues fn to run on the room's goroutine, after any work queued
+// before it.
+func (room *Room) do(fn func()) {
+	if room.closed {
+		return
+	}
+
+	room.incoming <- fn
+}
+
+// nextMessageID numbers a new message in the room.
+func (room *Room) nextMessageID() uint64 {
+	room.lastMessageID++
+	return room.lastMessageID
+}
+
+// Close stops the room's goroutine once it has finished the queued work.
+func (room *Room) Close() {
+	if room.closed {
+		return
+	}
+
+	room.closed = true
+	close(room.incoming)
+}
+
+func (room *Room) AddClient(client *Client) {
+	if room.HasClient(client) {
+		return
+	}
+
+	room.clients = append(room.clients, client)
+
+	room.do(func() {
+		room.recipients = append(room.recipients, client)
+	})
+}
+
+func (room *Room) RemoveClient(client *Client) {
+	for i, c := range room.clients {
+		if c == client {
+			room.clients = append(room.clients[:i], room.clients[i+1:]...)
+			break
+		}
+	}
+
+	delete(room.ops, client)
+	delete(room.voiced, client)
+
+	room.do(func() {
+		for i, c := range room.recipients {
+			if c == client {
+				room.recipients = append(room.recipients[:i], room.recipients[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+func (room *Room) HasClient(client *Client) bool {
+	for _, c := range room.clients {
+		if c == client {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (room *Room) Notice(msg string) {
+	room.Send(&Event{
+		Type: EventNotice,
+		Text: msg,
+	})
+}
+
+func (room *Room) Send(event *Event) {
+	event.Time = time.Now()
+	event.Room = room.name
+
+	room.do(func() {
+		for _, client := range room.recipients {
+			client.Send(event)
+		}
+	})
+}
+
+func (room *Room) SendPresence(event *Event) {
+	event.Time = time.Now()
+	event.Room = room.name
+
+	room.do(func() {
+		for _, client := range room.recipients {
+			if !client.hidePresence.Load() {
+				client.Send(event)
+			}
+		}
+	})
+}
+
+func (room *Room) TopicEvent() *Event {
+	event := &Event{
+		Type:  EventTopic,
+		Room:  room.name,
+		Topic: room.topic,
+		Text:  "Topic: " + room.topic,
+	}
+
+	if room.topic == "" {
+		event.Text = "No topic set"
+	}
+
+	return event
+}
+
+func NewRoom(name string, historySize int) *Room {
+	room := &Room{
+		name:     name,
+		clients:  nil,
+		polls:    make(map[uint64]*Poll),
+		ops:      make(map[*Client]bool),
+		banned:   make(map[string]*roomBan),
+		invited:  make(map[string]bool),
+		voiced:   make(map[*Client]bool),
+		incoming: make(chan func(), roomQueueSize),
+		history:  NewHistory(historySize),
+		streams:  make(map[chan *Event]bool),
+		opened:   time.Now(),
+
+		opAccounts:   make(map[string]bool),
+		triggers:     make(map[string]string),
+		triggerFired: make(map[string]time.Time),
+	}
+
+	go room.run()
+
+	return room
+}
+
+type Client struct {
+	id       uint64
+	conn     net.Conn
+	incoming chan string
+	outgoing chan *Event
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	deflater *gzip.Writer
+	codec    Codec
+	irc      *ircSession
+
+	// listener is the extra listener the client connected to, if it
+	// wasn't one of the usual ones.
+	listener *ListenerConfig
+
+	accepted bool
+	oper     bool
+	role     Role
+	account  string
+	rooms    map[string]*Room
+	ignored  map[string]bool
+	away     string
+
+	// nickname is nil for a guest. Other clients' commands read it while
+	// it may be changing, so it is atomic.
+	nickname atomic.Pointer[string]
+
+	// keyBundle is what the client published for encrypted rooms.
+	keyBundle string
+
+	// session is the hash of the token the client can resume with.
+	session string
+
+	lastTyping time.Time
+	spam       spamState
+	quota      clientQuota
+
+	// lines is the client's line rate limit, if there is one. Only the
+	// goroutine reading its commands touches it.
+	lines *TokenBucket
+
+	hidePresence atomic.Bool
+	quiet        atomic.Bool
+
+	json       atomic.Bool
+	sequenced  atomic.Bool
+	compressed atomic.Bool
+	color      atomic.Bool
+	seq        uint64
+
+	// sent keeps the last lines written with sequence numbers, for
+	// whoever resumes the session to get back what never arrived.
+	sent *replayLog
+
+	lastWrite atomic.Int64
+	lastLag   time.Time
+
+	connected  time.Time
+	lastRead   atomic.Int64
+	lastActive atomic.Int64
+	pinged     time.Time
+
+	overflow func(client *Client)
+	metrics  *Metrics
+	dropped  atomic.Uint64
+	evicted  atomic.Pointer[string]
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Read passes each line the client sends to its incoming channel. Lines
+// longer than the reader's buffer are thrown away with an error instead of
+// being buffered without limit, and a client that keeps sending them is
+// disconnected.
+func (client *Client) Read() {
+	// How many buffers full of the current line have been thrown away, and
+	// when the recent overlong lines started.
+	discarded := 0
+	var overlong []time.Time
+
+	for {
+		line, err := client.reader.ReadSlice('\n')
+
+		if err != nil && err != bufio.ErrBufferFull {
+			close(client.incoming)
+			return
+		}
+
+		now := time.Now()
+		client.lastRead.Store(now.UnixNano())
+
+		if err == bufio.ErrBufferFull {
+			if discarded == 0 {
+				client.Error(fmt.Sprintf("Line too long, the limit is %d bytes", client.reader.Size()))
+
+				for len(overlong) > 0 && now.Sub(overlong[0]) > overlongWindow {
+					overlong = overlong[1:]
+				}
+
+				overlong = append(overlong, now)
+			}
+
+			discarded++
+
+			if len(overlong) >= overlongLimit || discarded > endlessLine {
+				reason := "Lines too long"
+				client.evicted.CompareAndSwap(nil, &reason)
+				slog.Info("disconnecting client", client.connAttr(), "reason", reason)
+				close(client.incoming)
+				return
+			}
+
+			continue
+		}
+
+		if discarded > 0 {
+			discarded = 0
+			continue
+		}
+
+		if client.wantsCompression(string(line)) {
+			if client.inflate() != nil {
+				close(client.incoming)
+				return
+			}
+
+			continue
+		}
+
+		client.incoming <- string(line)
+	}
+}
+
+// Write sends the client's queued events until it is closed. Events that
+// pile up while a write is going on are written together and flushed once,
+// so a busy client costs a syscall per batch rather than per line.
+func (client *Client) Write() {
+	for {
+		select {
+		case event := <-client.outgoing:
+			client.writeBatch(event)
+		case <-client.done:
+			// Flush whatever was queued before the client was closed, such
+			// as the reply to quit.
+			for {
+				select {
+				case event := <-client.outgoing:
+					client.write(event)
+				default:
+					client.flush()
+
+					if client.deflater != nil {
+						client.deflater.Close()
+					}
+
+					client.conn.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeBatch writes event and then whatever else is queued, until the
+// queue is empty or writeFlushInterval has passed, and flushes the lot.
+// The interval keeps a client that is never quite caught up from waiting
+// on a buffer that never empties.
+func (client *Client) writeBatch(event *Event) {
+	start := time.Now()
+	client.write(event)
+
+	// Only the writer receives from outgoing, so this never blocks.
+	for len(client.outgoing) > 0 && time.Since(start) < writeFlushInterval {
+		client.write(<-client.outgoing)
+	}
+
+	client.flush()
+	client.lastWrite.Store(int64(time.Since(start)))
+}
+
+// write buffers event, leaving it to the caller to flush.
+func (client *Client) write(event *Event) {
+	if event.renumber {
+		client.seq = event.Seq
+		return
+	}
+
+	client.seq++
+
+	line := client.codec.Encode(client, event)
+
+	if line == "" {
+		client.seq--
+		return
+	}
+
+	if client.sequenced.Load() {
+		client.sent.add(client.seq, event)
+	}
+
+	client.writer.WriteString(line)
+
+	if event.compress {
+		client.flush()
+		client.deflate()
+	}
+
+	if client.metrics != nil {
+		client.metrics.linesWritten.Add(1)
+		client.metrics.bytesWritten.Add(uint64(len(line)))
+	}
+}
+
+func (client *Client) flush() {
+	client.writer.Flush()
+
+	if client.deflater != nil {
+		client.deflater.Flush()
+	}
+}
+
+// Send queues event for the client. It is safe to call from any goroutine,
+// and once the client is closed events are silently discarded.
+func (client *Client) Send(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if client.quiet.Load() && quietens(event) {
+		return
+	}
+
+	select {
+	case <-client.done:
+		return
+	default:
+	}
+
+	if client.overflow == nil {
+		select {
+		case client.outgoing <- event:
+		case <-client.done:
+		}
+
+		return
+	}
+
+	select {
+	case client.outgoing <- event:
+	default:
+		client.overflow(client)
+	}
+}
+
+// Close stops the client's writer, which closes the connection after
+// flushing any events already queued.
+func (client *Client) Close() {
+	client.closeOnce.Do(func() {
+		close(client.done)
+	})
+}
+
+func (client *Client) Reply(text string) {
+	client.Send(&Event{Type: EventReply, Text: text})
+}
+
+func (client *Client) Error(text string) {
+	client.Send(&Event{Type: EventError, Text: text})
+}
+
+func (client *Client) Notice(room, text string) {
+	client.Send(&Event{Type: EventNotice, Room: room, Text: text})
+}
+
+func (client *Client) Name() string {
+	nick := client.nick()
+
+	if nick == "" {
+		return fmt.Sprintf("guest%d", client.id)
+	}
+
+	return nick
+}
+
+// nick is the nick client chose, or "" for a guest.
+func (client *Client) nick() string {
+	if nick := client.nickname.Load(); nick != nil {
+		return *nick
+	}
+
+	return ""
+}
+
+func NewClient(id uint64, conn net.Conn, codec Codec, buffer, maxLine int) *Client {
+	c := &Client{
+		id:       id,
+		conn:     conn,
+		incoming: make(chan string),
+		outgoing: make(chan *Event, buffer),
+		done:     make(chan struct{}),
+		reader:   bufio.NewReaderSize(conn, maxLine),
+		writer:   bufio.NewWriter(conn),
+		codec:    codec,
+		rooms:    make(map[string]*Room),
+		ignored:  make(map[string]bool),
+		sent:     &replayLog{},
+	}
+
+	if session, ok := codec.(*ircSession); ok {
+		c.irc = session
+	}
+
+	c.connected = time.Now()
+	c.lastRead.Store(c.connected.UnixNano())
+	c.lastActive.Store(c.connected.UnixNano())
+
+	go c.Read()
+	go c.Write()
+
+	return c
+}
+
+type ClientSet map[uint64]*Client
+
+func (set ClientSet) Add(client *Client) {
+	set[client.id] = client
+}
+
+func (set ClientSet) Remove(client *Client) {
+	delete(set, client.id)
+}
+
+func (set ClientSet) Has(client *Client) bool {
+	return set[client.id] == client
+}
+
+func (set ClientSet) Sorted() []*Client {
+	clients := make([]*Client, 0, len(set))
+
+	for _, client := range set {
+		clients = append(clients, client)
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+
+	return clients
+}
+
+type Server struct {
+	// The config the server started with, which reloads compare the
+	// settings that need a restart against.
+	config *Config
+
+	clients   clientMap
+	nextID    atomic.Uint64
+	nicks     *shardedMap[string, *Client]
+	rooms     *shardedMap[string, *Room]
+	registry  *Registry
+	rules     string
+	motd      string
+	motdPath  string
+	metrics   *Metrics
+	started   time.Time
+	churn     *ChurnGuard
+	connLimit *ConnLimit
+	bans      *BanList
+	accounts  *AccountStore
+	passwords *PasswordChecker
+	roomStore *RoomStore
+	auditLog  *AuditLog
+
+	operPassword string
+	adminToken   string
+	inboundToken string
+	inboundNick  string
+	streamToken  string
+
+	historySize int
+	store       Store
+	cluster     *Cluster
+	federation  *Federation
+	bridge      *IRCBridge
+	matrix      *MatrixBridge
+	webhooks    *Webhooks
+	notifier    Notifier
+	uploads     *Uploads
+	filter      *WordFilter
+	scripts     *Scripts
+
+	bots       []*Bot
+	botEvents  botQueue
+	inBotHooks bool
+
+	timeFormat   string
+	stampFormat  string
+	timeLocation *time.Location
+
+	// The last message ID used in each room, by folded name, kept while
+	// the room is closed so a room that opens again carries on from it.
+	lastMessageIDs map[string]uint64
+
+	polls        map[uint64]*Poll
+	nextPollID   uint64
+	pollDuration time.Duration
+	nickGrace    time.Duration
+	editWindow   time.Duration
+
+	confusableNicks bool
+
+	outgoingBuffer int
+	dropSlow       bool
+
+	maxLine    int
+	maxMessage int
+
+	rateLimits atomic.Pointer[RateLimits]
+	connPolicy atomic.Pointer[ConnPolicy]
+
+	// Per role message limits, and how many messages each account or
+	// guest address has sent on quotaDay, which quotaMu guards.
+	roleLimits map[Role]RoleLimit
+	quotaMu    sync.Mutex
+	quotaDay   string
+	sentToday  map[string]int
+
+	// Accounts and guest connections that are shadow muted, and who by.
+	shadowMuted map[string]string
+
+	// mailMu guards accounts' mailboxes, which private messages add to off
+	// the dispatcher, along with how fast each sender is mailing and
+	// whether there is mail still to save.
+	mailMu      sync.Mutex
+	mailSenders map[string]*TokenBucket
+	mailPruned  time.Time
+	mailUnsaved bool
+
+	// Sessions of clients that dropped, by token hash, kept for
+	// sessionGrace.
+	sessions     map[string]*savedSession
+	sessionGrace time.Duration
+
+	spamWindow  time.Duration
+	spamRepeats int
+	spamRooms   int
+	spamStrikes int
+	spamMute    time.Duration
+
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+	idleTimeout  time.Duration
+
+	// The maintenance shutdown counting down, if any, and what closes Run's
+	// listeners when it gets to zero.
+	maintenance   *maintenance
+	stopListening func()
+
+	// mu is held by the dispatcher while it runs each command, and shared
+	// by commands that run concurrently.
+	mu           sync.RWMutex
+	incoming     chan Command
+	dispatchOnce sync.Once
+	connections  sync.WaitGroup
+
+	// Rooms concurrent commands have left empty, for the dispatcher to
+	// close.
+	emptyMu    sync.Mutex
+	emptyRooms []*Room
+
+	// How many listeners are accepting connections, and whether a health
+	// check is waiting on the dispatcher.
+	accepting   atomic.Int64
+	healthProbe atomic.Bool
+}
+
+func (server *Server) JoinRoom(name string, client *Client, key string) {
+	server.joinRoom(name, client, key, 0)
+}
+
+// joinRoom sends the joining client the room's history after the message
+// with ID since, all of it if since is 0.
+func (server *Server) joinRoom(name string, client *Client, key string, since uint64) {
+	room, created := server.rooms.GetOrAdd(foldName(name), func() *Room {
+		room := NewRoom(name, server.historySize)
+		room.lastMessageID = server.lastMessageIDs[foldName(name)]
+
+		return room
+	})
+
+	if created {
+		server.metrics.rooms.Add(1)
+
+		room.do(func() {
+			server.loadHistory(room)
+		})
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.HasClient(client) {
+		return
+	}
+
+	if room.Banned(client.Name()) || server.cluster.IsBanned(room.name, client.Name()) {
+		client.Error("You are banned from that room")
+		return
+	}
+
+	if room.inviteOnly && !room.invited[foldName(client.Name())] {
+		client.Error("That room is invite only")
+		return
+	}
+
+	if room.limit > 0 && len(room.clients) >= room.limit {
+		client.Error("That room is full")
+		return
+	}
+
+	if !room.CheckKey(key) {
+		if key == "" {
+			client.Error("That room needs a key")
+		} else {
+			client.Error("Wrong room key")
+		}
+
+		return
+	}
+
+	// Whoever creates a room runs it.
+	if created {
+		room.ops[client] = true
+	}
+
+	room.AddClient(client)
+	client.rooms[room.name] = room
+
+	if client.account != "" && room.opAccounts[client.account] {
+		room.ops[client] = true
+	}
+
+	room.SendPresence(&Event{
+		Type: EventJoin,
+		Nick: client.Name(),
+		Text: fmt.Sprintf("%s joined %s", plainName(client.Name()), plainName(room.name)),
+	})
+
+	if room.encrypted && client.keyBundle != "" {
+		room.Send(client.keyEvent(room))
+	}
+
+	var topic *Event
+
+	if room.topic != "" {
+		topic = room.TopicEvent()
+	}
+
+	room.do(func() {
+		if topic != nil {
+			client.Send(topic)
+		}
+
+		for _, msg := range room.history.Messages() {
+			if msg.id > since {
+				client.Send(msg.Event(server.timeLocation, true))
+			}
+		}
+	})
+
+	// IRC clients ask for the names list after joining, and get the
+	// welcome after that.
+	if client.irc == nil {
+		server.sendWelcome(room, client)
+	}
+
+	// Last, so anything a bot says in answer comes after the history.
+	server.joined(room.name, client.Name())
+}
+
+// loadHistory runs on the room's goroutine.
+func (server *Server) loadHistory(room *Room) {
+	if server.store == nil || server.historySize <= 0 {
+		return
+	}
+
+	messages, err := server.store.History(room.name, server.historySize)
+
+	if err != nil {
+		slog.Error("loading history", "room", room.name, "err", err)
+		return
+	}
+
+	for _, msg := range messages {
+		room.history.Add(msg)
+	}
+}
+
+func (server *Server) LeaveRoom(name string, client *Client) {
+	room, exists := server.LookupRoom(name)
+
+	if !exists {
+		client.Error("Room doesn't exist")
+		return
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if !room.HasClient(client) {
+		client.Error("You are not in that room")
+		return
+	}
+
+	room.SendPresence(&Event{
+		Type: EventPart,
+		Nick: client.Name(),
+		Text: fmt.Sprintf("%s left %s", plainName(client.Name()), plainName(room.name)),
+	})
+
+	room.RemoveClient(client)
+	delete(client.rooms, room.name)
+	server.parted(room.name, client.Name())
+
+	if len(room.clients) == 0 {
+		server.roomEmptied(room)
+	}
+}
+
+// joined and parted tell everything outside the room itself that nick
+// came or went: other nodes, linked servers, webhooks and bots.
+func (server *Server) joined(room, nick string) {
+	server.cluster.Joined(room, nick)
+	server.federation.Joined(room, nick)
+	server.webhooks.Joined(room, nick)
+	server.notifyBots(&Event{Type: EventJoin, Room: room, Nick: nick, Time: time.Now()})
+}
+
+func (server *Server) parted(room, nick string) {
+	server.cluster.Parted(room, nick)
+	server.federation.Parted(room, nick)
+	server.webhooks.Parted(room, nick)
+	server.notifyBots(&Event{Type: EventPart, Room: room, Nick: nick, Time: time.Now()})
+}
+
+func (server *Server) RemoveClient(client *Client, reason string) {
+	peers := server.Peers(client)
+
+	for _, room := range client.rooms {
+		room.RemoveClient(client)
+		server.parted(room.name, client.Name())
+
+		if len(room.clients) == 0 {
+			server.DeleteRoom(room)
+		}
+	}
+
+	client.rooms = make(map[string]*Room)
+	server.clients.Remove(client)
+	server.ReleaseNick(client)
+
+	text := fmt.Sprintf("%s quit", plainName(client.Name()))
+
+	if reason != "" {
+		text += " (" + reason + ")"
+	}
+
+	event := &Event{
+		Type:   EventQuit,
+		Nick:   client.Name(),
+		Reason: reason,
+		Text:   text,
+	}
+
+	for _, peer := range peers {
+		if !peer.hidePresence.Load() {
+			peer.Send(event)
+		}
+	}
+}
+
+// Peers returns every other client that shares at least one room with
+// client, each listed once.
+func (server *Server) Peers(client *Client) []*Client {
+	peers := make(ClientSet)
+
+	for _, room := range client.rooms {
+		room.mu.Lock()
+
+		for _, c := range room.clients {
+			if c != client {
+				peers.Add(c)
+			}
+		}
+
+		room.mu.Unlock()
+	}
+
+	return peers.Sorted()
+}
+
+// ChangeNick renames client, telling it and everyone who shares a room with
+// it. An empty nick turns the client back into a guest.
+func (server *Server) ChangeNick(client *Client, nick string) {
+	old := client.Name()
+
+	server.SetNick(client, nick)
+
+	if old == client.Name() {
+		return
+	}
+
+	event := &Event{
+		Type:    EventNick,
+		Nick:    old,
+		NewNick: client.Name(),
+		Text:    fmt.Sprintf("%s is now known as %s", plainName(old), plainName(client.Name())),
+	}
+
+	client.Send(event)
+
+	for _, peer := range server.Peers(client) {
+		peer.Send(event)
+	}
+
+	rooms := make([]string, 0, len(client.rooms))
+
+	for _, room := range client.rooms {
+		rooms = append(rooms, room.name)
+	}
+
+	server.cluster.Renamed(old, client.Name(), rooms)
+	server.federation.Renamed(old, client.Name())
+	server.notifyBots(&Event{Type: EventNick, Nick: old, NewNick: client.Name(), Time: time.Now()})
+}
+
+// SetNick gives client nick, whether or not someone else has it, here or
+// on another node.
+func (server *Server) SetNick(client *Client, nick string) {
+	if nick != "" {
+		server.nicks.Set(foldName(nick), client)
+	}
+
+	if !sameName(client.nick(), nick) {
+		server.ReleaseNick(client)
+
+		if nick != "" {
+			server.cluster.TookNick(nick)
+		}
+	}
+
+	client.nickname.Store(&nick)
+
+	if client.irc != nil {
+		client.irc.NickChanged(server, client)
+	}
+}
+
+// claimNick takes nick for client unless someone else has it, and reports
+// whether client has it now.
+func (server *Server) claimNick(client *Client, nick string) bool {
+	holder, _ := server.nicks.GetOrAdd(foldName(nick), func() *Client {
+		return client
+	})
+
+	return holder == client
+}
+
+func (server *Server) ReleaseNick(client *Client) {
+	if server.nicks.DeleteIf(foldName(client.nick()), client) {
+		server.cluster.ReleasedNick(client.nick())
+	}
+}
+
+// LookupRoom finds the room called name, in any case.
+func (server *Server) LookupRoom(name string) (*Room, bool) {
+	return server.rooms.Get(foldName(name))
+}
+
+// LookupNick finds the client using nick, in any case.
+func (server *Server) LookupNick(nick string) (*Client, bool) {
+	return server.nicks.Get(foldName(nick))
+}
+
+func (server *Server) PrivateMessage(nick string, from *Client, msg string) {
+	if from.nick() == "" {
+		from.Error("Must set NICK first")
+		return
+	}
+
+	to, exists := server.LookupNick(nick)
+
+	if !exists {
+		server.mailOffline(nick, from, msg)
+		return
+	}
+
+	if !server.CheckQuota(from) || to.Ignores(from.nick()) || server.isShadowMuted(from) {
+		return
+	}
+
+	to.Send(&Event{
+		Type: EventPrivate,
+		Nick: from.nick(),
+		Text: msg,
+	})
+
+	if to.away != "" {
+		from.Reply(fmt.Sprintf("%s is away: %s", to.nick(), to.away))
+	}
+}
+
+func (server *Server) DeleteRoom(room *Room) {
+	if room.registered {
+		return
+	}
+
+	for _, poll := range room.polls {
+		server.ClosePoll(poll)
+	}
+
+	server.rooms.DeleteIf(foldName(room.name), room)
+	server.lastMessageIDs[foldName(room.name)] = room.lastMessageID
+	server.metrics.rooms.Add(-1)
+	room.Close()
+}
+
+// CloseRoom takes everyone out of room and deletes it.
+func (server *Server) CloseRoom(room *Room, reason string) {
+	room.Notice(reason)
+
+	for _, client := range append([]*Client(nil), room.clients...) {
+		event := &Event{
+			Type:   EventPart,
+			Time:   time.Now(),
+			Room:   room.name,
+			Nick:   client.Name(),
+			Reason: reason,
+			Text:   fmt.Sprintf("%s left %s", plainName(client.Name()), plainName(room.name)),
+		}
+
+		room.do(func() {
+			client.Send(event)
+		})
+
+		room.RemoveClient(client)
+		delete(client.rooms, room.name)
+		server.parted(room.name, client.Name())
+	}
+
+	server.DeleteRoom(room)
+}
+
+func (server *Server) CheckAccepted(client *Client) bool {
+	if server.rules == "" || client.accepted {
+		return true
+	}
+
+	client.Error("You must accept the rules first")
+	return false
+}
+
+func (server *Server) CheckLength(client *Client, msg string) bool {
+	if server.maxMessage <= 0 || utf8.RuneCountInString(msg) <= server.maxMessage {
+		return true
+	}
+
+	client.Error(fmt.Sprintf("Message too long, the limit is %d characters", server.maxMessage))
+	return false
+}
+
+// Broadcast sends from's message to the room called name. A parent other
+// than 0 makes the message a reply to the room's message with that ID.
+func (server *Server) Broadcast(name string, from *Client, msg string, parent uint64) {
+	room, exists := server.LookupRoom(name)
+
+	if !exists {
+		from.Error("Room doesn't exist")
+		return
+	}
+
+	if from.nick() == "" {
+		from.Error("Must set NICK first")
+		return
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if parent > room.lastMessageID {
+		from.Error(fmt.Sprintf("There is no message %d in %s", parent, room.name))
+		return
+	}
+
+	if !room.CanSpeak(from) {
+		from.Error(moderatedError)
+		return
+	}
+
+	if !server.CheckAccountAge(room, from) {
+		return
+	}
+
+	if !server.CheckQuota(from) {
+		return
+	}
+
+	msg, ok := server.FilterMessage(room, from, msg)
+
+	if !ok {
+		return
+	}
+
+	var message *Message
+
+	if server.isShadowMuted(from) {
+		message = server.shadowPost(room, from, msg, parent)
+	} else {
+		message = server.PostReply(room, from.nick(), msg, parent)
+		server.fireTriggers(room, msg)
+	}
+
+	from.Send(&Event{
+		Type: EventAck,
+		ID:   message.id,
+		Time: message.time,
+		Room: room.name,
+	})
+}
+
+// Post sends a message that originates on this server to room, and on to
+// wherever else the room is shared.
+func (server *Server) Post(room *Room, nick, text string) *Message {
+	return server.PostReply(room, nick, text, 0)
+}
+
+// PostReply is Post for a reply to the room's message with ID parent.
+// Other servers number messages their own way, so they get the reply
+// without its parent.
+func (server *Server) PostReply(room *Room, nick, text string, parent uint64) *Message {
+	message := &Message{
+		id:     room.nextMessageID(),
+		room:   room.name,
+		nick:   nick,
+		text:   text,
+		time:   time.Now(),
+		parent: parent,
+	}
+
+	server.deliver(room, message)
+	server.cluster.Publish(message)
+	server.federation.Message(message)
+	server.bridge.Message(message)
+	server.matrix.Message(message)
+	server.webhooks.Message(message)
+	server.notifyMentions(room, message)
+	server.notifyBots(message.Event(server.timeLocation, false))
+
+	return message
+}
+
+// deliver records message in room's history and sends it to the room's
+// members.
+func (server *Server) deliver(room *Room, message *Message) {
+	event := message.Event(server.timeLocation, false)
+	mentioned := server.Mentioned(room, message.nick, message.text)
+	server.metrics.messages.Add(1)
+	room.messages++
+	ignoring := server.ignoring(room, message.nick)
+
+	room.do(func() {
+		room.history.Add(message)
+
+		if server.store != nil {
+			err := server.store.SaveMessage(message)
+
+			if err != nil {
+				slog.Error("saving message", "room", room.name, "err", err)
+			}
+		}
+
+		start := time.Now()
+
+		for _, client := range room.recipients {
+			if !ignoring[client] {
+				client.Send(event)
+			}
+		}
+
+		room.sendStreams(event)
+
+		server.metrics.broadcastFanout.Observe(time.Since(start))
+
+		for _, client := range mentioned {
+			client.Send(&Event{
+				Type: EventMention,
+				ID:   event.ID,
+				Time: event.Time,
+				Room: room.name,
+				Nick: message.nick,
+				Text: fmt.Sprintf("%s mentioned you: %s", plainName(message.nick), message.text),
+			})
+		}
+	})
+}
+
+// ignoring finds the members of room who ignore nick. It has to be worked
+// out before handing a message to the room's goroutine, which can't look at
+// its members' ignore lists.
+func (server *Server) ignoring(room *Room, nick string) map[*Client]bool {
+	var ignoring map[*Client]bool
+
+	for _, client := range room.clients {
+		if client.Ignores(nick) {
+			if ignoring == nil {
+				ignoring = make(map[*Client]bool)
+			}
+
+			ignoring[client] = true
+		}
+	}
+
+	return ignoring
+}
+
+// Mentioned returns the members of room that msg mentions with @nick,
+// leaving out the sender, from, and anyone ignoring them.
+func (server *Server) Mentioned(room *Room, from, msg string) []*Client {
+	if room.encrypted {
+		return nil
+	}
+
+	var mentioned []*Client
+	seen := make(map[*Client]bool)
+
+	for _, match := range mentionRegexp.FindAllStringSubmatch(msg, -1) {
+		nick, _ := unquoteName(match[1])
+		client, exists := server.LookupNick(nick)
+
+		if !exists || client.nick() == from || seen[client] || !room.HasClient(client) || client.Ignores(from) {
+			continue
+		}
+
+		seen[client] = true
+		mentioned = append(mentioned, client)
+	}
+
+	return mentioned
+}
+
+// Options are what NewServer builds a server from. Config is required.
+// Store and Notifier, when set, are used instead of the ones Config would
+// open, so a program embedding the server can supply its own.
+type Options struct {
+	Config   *Config
+	Store    Store
+	Notifier Notifier
+}
+
+func NewServer(opts Options) (*Server, error) {
+	config := opts.Config
+	server := &Server{
+		config:    config,
+		clients:   newClientMap(),
+		nicks:     newShardedMap[string, *Client](),
+		rooms:     newShardedMap[string, *Room](),
+		registry:  NewRegistry(),
+		metrics:   &Metrics{},
+		started:   time.Now(),
+		churn:     NewChurnGuard(config.ChurnLimit, config.ChurnWindow.Duration, config.ChurnPenalty.Duration),
+		connLimit: NewConnLimit(config.MaxConnsPerIP),
+		passwords: NewPasswordChecker(),
+
+		operPassword: config.OperPassword,
+		adminToken:   config.AdminToken,
+		inboundToken: config.InboundToken,
+		inboundNick:  config.InboundNick,
+		streamToken:  config.StreamToken,
+
+		historySize: config.HistorySize,
+
+		timeFormat:  config.TimeFormat,
+		stampFormat: config.StampFormat,
+
+		lastMessageIDs: make(map[string]uint64),
+		shadowMuted:    make(map[string]string),
+		sessions:       make(map[string]*savedSession),
+		mailSenders:    make(map[string]*TokenBucket),
+
+		polls:        make(map[uint64]*Poll),
+		pollDuration: config.PollDuration.Duration,
+		nickGrace:    config.NickGrace.Duration,
+		sessionGrace: config.SessionGrace.Duration,
+		editWindow:   config.EditWindow.Duration,
+
+		confusableNicks: config.ConfusableNicks,
+
+		outgoingBuffer: config.OutgoingBuffer,
+
+		maxLine:    config.MaxLine,
+		maxMessage: config.MaxMessage,
+
+		spamWindow:  config.SpamWindow.Duration,
+		spamRepeats: config.SpamRepeats,
+		spamRooms:   config.SpamRooms,
+		spamStrikes: config.SpamStrikes,
+		spamMute:    config.SpamMute.Duration,
+
+		pingInterval: config.PingInterval.Duration,
+		pingTimeout:  config.PingTimeout.Duration,
+		idleTimeout:  config.IdleTimeout.Duration,
+
+		motdPath: config.MOTDPath,
+
+		incoming: make(chan Command),
+	}
+
+	switch config.SlowClients {
+	case "drop":
+		server.dropSlow = true
+	case "disconnect":
+	default:
+		return nil, fmt.Errorf("slow clients policy must be drop or disconnect, not %q", config.SlowClients)
+	}
+
+	if config.OutgoingBuffer < 1 {
+		return nil, fmt.Errorf("outgoing buffer must be at least 1")
+	}
+
+	if config.MaxLine < minLine {
+		return nil, fmt.Errorf("max line length must be at least %d", minLine)
+	}
+
+	if config.AdminAddr != "" && config.AdminToken == "" {
+		return nil, fmt.Errorf("the admin API needs an admin token")
+	}
+
+	if config.ConsoleAddr != "" {
+		err := checkConsoleAddr(config.ConsoleAddr)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.InboundAddr != "" && config.InboundToken == "" {
+		return nil, fmt.Errorf("the inbound webhook endpoint needs an inbound token")
+	}
+
+	if config.InboundAddr != "" && !linkNameRegexp.MatchString(config.InboundNick) {
+		return nil, fmt.Errorf("inbound nick %q can only have letters, digits, _ and -", config.InboundNick)
+	}
+
+	if config.SpamMute.Duration > 0 && config.SpamStrikes < 1 {
+		return nil, fmt.Errorf("spam strikes must be at least 1")
+	}
+
+	if config.PingInterval.Duration > 0 && config.PingTimeout.Duration <= 0 {
+		return nil, fmt.Errorf("ping timeout must be positive")
+	}
+
+	var err error
+
+	limits, err := config.rateLimits()
+
+	if err != nil {
+		return nil, err
+	}
+
+	server.rateLimits.Store(limits)
+
+	policy, err := config.connPolicy()
+
+	if err != nil {
+		return nil, err
+	}
+
+	server.connPolicy.Store(policy)
+
+	server.roleLimits, err = config.roleLimits()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkListeners(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	server.timeLocation, err = time.LoadLocation(config.Timezone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if config.RulesPath != "" {
+		server.rules, err = loadTextFile(config.RulesPath)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = server.ReloadMOTD()
+
+	if err != nil {
+		return nil, err
+	}
+
+	server.bans, err = LoadBanList(config.BansPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	server.accounts, err = LoadAccountStore(config.AccountsPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	server.roomStore, err = LoadRoomStore(config.RoomsPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	server.auditLog, err = OpenAuditLog(config.AuditPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Store != nil {
+		server.store = opts.Store
+	} else if isSQLitePath(config.StorePath) {
+		server.store, err = OpenSQLiteStore(config.StorePath)
+
+		if err != nil {
+			return nil, err
+		}
+	} else if config.StorePath != "" {
+		server.store, err = OpenFileStore(config.StorePath)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if server.store != nil {
+		server.lastMessageIDs, err = server.store.LastIDs()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.RedisAddr != "" {
+		server.cluster = NewCluster(config.RedisAddr, config.RedisPassword)
+	}
+
+	if config.LinkAddr != "" || config.Links != "" {
+		if config.LinkPassword == "" {
+			return nil, fmt.Errorf("linking servers needs a link password")
+		}
+
+		if !linkNameRegexp.MatchString(config.ServerName) {
+			return nil, fmt.Errorf("server name %q can only have letters, digits, _ and -", config.ServerName)
+		}
+
+		server.federation = NewFederation(config.ServerName, config.LinkPassword)
+	}
+
+	if config.BridgeAddr != "" {
+		server.bridge, err = NewIRCBridge(config.BridgeAddr, config.BridgeTLS, config.BridgeNick, config.BridgeChannels)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.FilterPath != "" {
+		server.filter, err = NewWordFilter(config.FilterPath, config.FilterAction)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Webhooks != "" {
+		server.webhooks, err = NewWebhooks(config.Webhooks)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Notifier != nil {
+		server.notifier = opts.Notifier
+	} else if config.NotifyURL != "" {
+		server.notifier, err = NewHTTPNotifier(config.NotifyURL)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.MatrixAddr != "" {
+		server.matrix, err = NewMatrixBridge(config.MatrixHomeserver, config.MatrixUser, config.MatrixASToken, config.MatrixHSToken, config.MatrixRooms)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.UploadAddr != "" {
+		if config.UploadDir == "" {
+			return nil, fmt.Errorf("the upload endpoint needs an upload directory")
+		}
+
+		if config.MaxUpload < 1 {
+			return nil, fmt.Errorf("max upload must be at least 1 byte")
+		}
+
+		baseURL := config.UploadURL
+
+		if baseURL == "" {
+			baseURL = "http://" + config.UploadAddr
+		}
+
+		server.uploads, err = LoadUploads(config.UploadDir, baseURL, config.MaxUpload, config.UploadRetention.Duration)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	server.restoreRooms()
+
+	if err := server.RegisterPlugin(&BuiltinPlugin{}); err != nil {
+		return nil, err
+	}
+
+	if config.ScriptsDir != "" {
+		server.scripts, err = LoadScripts(config.ScriptsDir, config.ScriptTimeout.Duration)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := server.RegisterPlugin(server.scripts); err != nil {
+			server.scripts.Close()
+			return nil, err
+		}
+	}
+
+	return server, nil
+}
+
+func (server *Server) Close() error {
+	if server.scripts != nil {
+		server.scripts.Close()
+	}
+
+	server.saveMail()
+
+	if server.store == nil {
+		return nil
+	}
+
+	return server.store.Close()
+}
+
+// RegisterPlugin adds plugin's commands, and if it is an EventHandler,
+// starts sending it events as a bot.
+func (server *Server) RegisterPlugin(plugin Plugin) error {
+	handler, isBot := plugin.(EventHandler)
+
+	if isBot && !linkNameRegexp.MatchString(handler.Nick()) {
+		return fmt.Errorf("plugin %T: bad nick %q", plugin, handler.Nick())
+	}
+
+	err := server.registry.Register(plugin)
+
+	if err != nil {
+		return err
+	}
+
+	if isBot {
+		server.bots = append(server.bots, &Bot{server: server, handler: handler})
+	}
+
+	return nil
+}
+
+func (server *Server) dispatch() {
+	if server.pingInterval > 0 || server.idleTimeout > 0 {
+		go server.keepalive()
+	}
+
+	for cmd := range server.incoming {
+		server.mu.Lock()
+		server.closeEmptyRooms()
+		cmd.Run(server)
+		server.mu.Unlock()
+	}
+}
+
+func (server *Server) HandleConnections(listener net.Listener) error {
+	return server.acceptLoop(listener, server.HandleConnection)
+}
+
+// maxAcceptDelay is the longest acceptLoop waits before trying again after
+// a temporary error.
+const maxAcceptDelay = time.Second
+
+// acceptLoop hands each connection on listener to handle until the listener
+// is closed, when it returns nil. Temporary errors, like running out of file
+// descriptors, are retried after a delay that doubles each time, as
+// net/http does; anything else is returned.
+func (server *Server) acceptLoop(listener net.Listener, handle func(conn net.Conn)) error {
+	server.accepting.Add(1)
+	defer server.accepting.Add(-1)
+
+	var delay time.Duration
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			var netErr net.Error
+
+			if !errors.As(err, &netErr) || !netErr.Temporary() {
+				return err
+			}
+
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(2*delay, maxAcceptDelay)
+			}
+
+			slog.Warn("accepting connections", "err", err, "retry", delay)
+			time.Sleep(delay)
+			continue
+		}
+
+		delay = 0
+		handle(conn)
+	}
+}
+
+func (server *Server) HandleConnection(conn net.Conn) {
+	server.serve(conn, nativeCodec{stampFormat: server.stampFormat}, nil)
+}
+
+// serve runs a client on conn. Clients from one of the configured extra
+// listeners have its policies applied to their commands.
+func (server *Server) serve(conn net.Conn, codec Codec, listener *ListenerConfig) {
+	server.dispatchOnce.Do(func() {
+		go server.dispatch()
+	})
+
+	ip := remoteIP(conn)
+
+	// Clients on the Unix socket are local, and all share the same empty
+	// address, so the per-IP checks don't apply to them. Nor do they to
+	// in-process clients on a net.Pipe.
+	network := conn.LocalAddr().Network()
+	local := network == "unix" || network == "pipe"
+
+	if !local && !server.connPolicy.Load().Allow(ip) {
+		slog.Info("refusing connection", "addr", ip, "reason", "policy")
+		server.metrics.refusedPolicy.Add(1)
+		conn.Close()
+		return
+	}
+
+	if !local && server.bans.Banned(ip) {
+		slog.Info("refusing connection", "addr", ip, "reason", "banned")
+		server.metrics.refusedBanned.Add(1)
+		conn.Close()
+		return
+	}
+
+	if !local && !server.churn.Allow(ip, time.Now()) {
+		slog.Info("refusing connection", "addr", ip, "reason", "churn")
+		server.metrics.refusedChurn.Add(1)
+		conn.Close()
+		return
+	}
+
+	if !local && !server.connLimit.Acquire(ip) {
+		slog.Info("refusing connection", "addr", ip, "reason", "too many connections")
+		server.metrics.refusedLimit.Add(1)
+		conn.Close()
+		return
+	}
+
+	server.metrics.connections.Add(1)
+
+	client := NewClient(server.nextID.Add(1), conn, codec, server.outgoingBuffer, server.maxLine)
+	client.overflow = server.overflow
+	client.metrics = server.metrics
+	client.listener = listener
+
+	if listener != nil && listener.Quiet {
+		client.quieten()
+	}
+
+	if listener != nil {
+		slog.Info("connection opened", client.connAttr(), "listener", listener.Name)
+	} else {
+		slog.Info("connection opened", client.connAttr())
+	}
+
+	server.connections.Add(1)
+
+	go func() {
+		defer server.connections.Done()
+
+		if !local {
+			defer server.connLimit.Release(ip)
+		}
+
+		server.incoming <- &ConnectCommand{client: client, certNick: certIdentity(conn)}
+
+		// Whether commands sent to the dispatcher may not have run yet.
+		queued := true
+
+		var limits *RateLimits
+		var strikes int
+
+		for msg := range client.incoming {
+			server.metrics.linesRead.Add(1)
+
+			if current := server.rateLimits.Load(); current != limits {
+				limits = current
+				client.lines = limits.bucket()
+			}
+
+			if !server.floodCheck(client, limits, client.lines, &strikes) {
+				continue
+			}
+
+			cmds, err := client.codec.Decode(server, client, msg)
+
+			if err != nil {
+				slog.Debug("bad command", client.connAttr(), "err", err)
+				server.metrics.parseErrors.Add(1)
+				client.Error(err.Error())
+			}
+
+			for _, cmd := range cmds {
+				if _, pong := cmd.(*PongCommand); !pong {
+					client.lastActive.Store(time.Now().UnixNano())
+				}
+
+				slog.Debug("command", client.connAttr(), "command", commandName(cmd))
+
+				if listener != nil && (listener.RequireAccount || listener.OpersOnly) {
+					cmd = &guardedCommand{client: client, listener: listener, cmd: cmd}
+				}
+
+				if server.isConcurrent(cmd) {
+					// Let the client's earlier commands, like joining
+					// the room, finish first.
+					if queued {
+						server.call(func() {})
+						queued = false
+					}
+
+					server.runConcurrently(cmd)
+					continue
+				}
+
+				server.incoming <- cmd
+				queued = true
+			}
+		}
+
+		server.incoming <- &DisconnectCommand{client: client}
+	}()
+}
+
+// overflow is called when a client's outgoing buffer is full, usually
+// because its connection has stalled. The event is dropped so the sender,
+// often the dispatcher, never blocks, and unless the server is set to only
+// drop, the client is disconnected.
+func (server *Server) overflow(client *Client) {
+	server.metrics.dropped.Add(1)
+	client.dropped.Add(1)
+
+	if !server.dropSlow {
+		server.evict(client, "Too slow")
+	}
+}
+
+// evict disconnects client from any goroutine. Peers are told reason; only
+// the first reason given sticks.
+func (server *Server) evict(client *Client, reason string) {
+	if !client.evicted.CompareAndSwap(nil, &reason) {
+		return
+	}
+
+	slog.Info("disconnecting client", client.connAttr(), "reason", reason)
+
+	// Fails any blocked read or write straight away, which tears the client
+	// down through the usual DisconnectCommand path.
+	client.conn.SetDeadline(time.Now())
+}
+
+// dismiss disconnects client like evict, but only stops reading, as quit
+// does, so events already queued for it are still sent.
+func (server *Server) dismiss(client *Client, reason string) {
+	if !client.evicted.CompareAndSwap(nil, &reason) {
+		return
+	}
+
+	slog.Info("disconnecting client", client.connAttr(), "reason", reason)
+	client.conn.SetReadDeadline(time.Now())
+}
+
+func (server *Server) parse(client *Client, line string) (Command, error) {
+	if client.json.Load() {
+		decoded, err := decodeJSONCommand(line)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JSON command: %v", err)
+		}
+
+		line = decoded
+	}
+
+	return server.registry.Parse(client, line)
+}
+
+func (server *Server) Drain(timeout time.Duration) {
+	done := make(chan struct{})
+
+	go func() {
+		server.connections.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("drain timed out, closing remaining connections")
+	}
+}
+
+var mentionRegexp, _ = regexp.Compile("@(" + namePattern + ")")
+var guestRegexp, _ = regexp.Compile("(?i)^guest\\d+$")
+
+// The arguments most commands share.
+var (
+	roomArg  = Arg{Name: "room", Type: ArgName}
+	nickArg  = Arg{Name: "nick", Type: ArgName}
+	onOffArg = Arg{Name: "on or off", Choices: []string{"on", "off"}}
+)
+
+type BuiltinPlugin struct{}
+
+func (plugin *BuiltinPlugin) Commands() []CommandSpec {
+	return []CommandSpec{
+		{
+			Verb: "nick",
+			Args: []Arg{nickArg},
+			Help: "nick <name> - set your nickname",
+			Parse: func(client *Client, args []string) Command {
+				return &NickCommand{
+					client: client,
+					nick:   args[0],
+				}
+			},
+		},
+		{
+			Verb: "join",
+			Args: []Arg{roomArg, {Name: "key", Optional: true}},
+			Help: "join <room> [key] - join a room, creating it if needed",
+			Parse: func(client *Client, args []string) Command {
+				return &JoinCommand{
+					client: client,
+					room:   args[0],
+					key:    args[1],
+				}
+			},
+		},
+		{
+			Verb: "msg",
+			Args: []Arg{roomArg, {Name: "message", Type: ArgText}},
+			Help: "msg <room> <message> - send a message to a room",
+			Parse: func(client *Client, args []string) Command {
+				return &MsgCommand{
+					client:  client,
+					room:    args[0],
+					message: args[1],
+				}
+			},
+		},
+		{
+			Verb: "pm",
+			Args: []Arg{nickArg, {Name: "message", Type: ArgText}},
+			Help: "pm <nick> <message> - send a private message to a user",
+			Parse: func(client *Client, args []string) Command {
+				return &PmCommand{
+					client:  client,
+					nick:    args[0],
+					message: args[1],
+				}
+			},
+		},
+		{
+			Verb: "send",
+			Args: []Arg{{Name: "room or nick", Type: ArgName}, {Name: "file", Type: ArgWord}},
+			Help: "send <room|nick> <file> - share a file you uploaded, by the ID the upload endpoint gave it",
+			Parse: func(client *Client, args []string) Command {
+				return &SendCommand{
+					client: client,
+					target: args[0],
+					id:     args[1],
+				}
+			},
+		},
+		{
+			Verb: "list",
+			Help: "list - show all rooms and how many members they have",
+			Parse: func(client *Client, args []string) Command {
+				return &ListCommand{
+					client: client,
+				}
+			},
+		},
+		{
+			Verb: "who",
+			Args: []Arg{roomArg},
+			Help: "who <room> - show who is in a room",
+			Parse: func(client *Client, args []string) Command {
+				return &WhoCommand{
+					client: client,
+					room:   args[0],
+				}
+			},
+		},
+		{
+			Verb: "topic",
+			Args: []Arg{roomArg, {Name: "topic", Type: ArgText, Optional: true}},
+			Help: "topic <room> [topic] - show or set a room's topic",
+			Parse: func(client *Client, args []string) Command {
+				return &TopicCommand{
+					client: client,
+					room:   args[0],
+					topic:  strings.TrimSpace(args[1]),
+				}
+			},
+		},
+		{
+			Verb: "history",
+			Args: []Arg{roomArg, {Name: "count", Type: ArgNumber}},
+			Help: "history <room> <n> - show the last n messages sent to a room",
+			Parse: func(client *Client, args []string) Command {
+				n, err := strconv.Atoi(args[1])
+
+				if err != nil {
+					return nil
+				}
+
+				return &HistoryCommand{
+					client: client,
+					room:   args[0],
+					n:      n,
+				}
+			},
+		},
+		{
+			Verb:  "search",
+			Args:  []Arg{roomArg, {Name: "query", Type: ArgText}},
+			Help:  "search <room> <words> - find messages in a room containing all the words, latest first; add before:<id> for earlier ones",
+			Parse: parseSearchCommand,
+		},
+		{
+			Verb:  "reply",
+			Args:  []Arg{roomArg, {Name: "id", Type: ArgNumber}, {Name: "message", Type: ArgText}},
+			Help:  "reply <room> <id> <message> - reply to a message, starting a thread or adding to one",
+			Parse: parseReply,
+		},
+		{
+			Verb:  "thread",
+			Args:  []Arg{roomArg, {Name: "id", Type: ArgNumber}},
+			Help:  "thread <room> <id> - show the thread a message is part of",
+			Parse: parseThread,
+		},
+		{
+			Verb:  "edit",
+			Args:  []Arg{roomArg, {Name: "id", Type: ArgNumber}, {Name: "message", Type: ArgText}},
+			Help:  "edit <room> <id> <message> - change the text of a message you sent recently",
+			Parse: parseEdit,
+		},
+		{
+			Verb:  "delete",
+			Args:  []Arg{roomArg, {Name: "id", Type: ArgNumber}},
+			Help:  "delete <room> <id> - delete a message you sent recently, or any message if you are a room operator",
+			Parse: parseDelete,
+		},
+		{
+			Verb:  "react",
+			Args:  []Arg{roomArg, {Name: "id", Type: ArgNumber}, {Name: "emoji", Type: ArgWord}},
+			Help:  "react <room> <id> <emoji> - react to a message with an emoji, or take your reaction back",
+			Parse: parseReact,
+		},
+		{
+			Verb: "leave",
+			Args: []Arg{roomArg},
+			Help: "leave <room> - leave a room",
+			Parse: func(client *Client, args []string) Command {
+				return &LeaveCommand{
+					client: client,
+					room:   args[0],
+				}
+			},
+		},
+		{
+			Verb: "quit",
+			Args: []Arg{{Name: "reason", Type: ArgText, Optional: true}},
+			Help: "quit [reason] - disconnect from the server",
+			Parse: func(client *Client, args []string) Command {
+				return &QuitCommand{
+					client: client,
+					reason: strings.TrimSpace(args[0]),
+				}
+			},
+		},
+		{
+			Verb: "accept",
+			Help: "accept - accept the server rules",
+			Parse: func(client *Client, args []string) Command {
+				return &AcceptCommand{
+					client: client,
+				}
+			},
+		},
+		{
+			Verb:  "cansend",
+			Args:  []Arg{roomArg},
+			Help:  "cansend <room> - check whether a message to a room would get through now, or how long to wait",
+			Parse: parseCanSend,
+		},
+		{
+			Verb: "lag",
+			Help: "lag - show how much output is queued for you and how long delivery takes",
+			Parse: func(client *Client, args []string) Command {
+				return &LagCommand{
+					client: client,
+				}
+			},
+		},
+		{
+			Verb:  "pong",
+			Args:  []Arg{{Name: "token", Optional: true}},
+			Help:  "pong [token] - answer a PING from the server",
+			Parse: parsePong,
+		},
+		{
+			Verb: "help",
+			Args: []Arg{{Name: "command", Optional: true}},
+			Help: "help [command] - list the commands, or show how to use one",
+			Parse: func(client *Client, args []string) Command {
+				return &HelpCommand{
+					client: client,
+					verb:   args[0],
+				}
+			},
+		},
+		{
+			Verb:  "motd",
+			Args:  []Arg{{Name: "reload", Optional: true, Choices: []string{"reload"}}},
+			Help:  "motd [reload] - show the message of the day, or reload it from its file (admins only)",
+			Parse: parseMOTD,
+		},
+		{
+			Verb: "time",
+			Help: "time - show the server's current time",
+			Parse: func(client *Client, args []string) Command {
+				return &TimeCommand{
+					client: client,
+				}
+			},
+		},
+		{
+			Verb:  "poll",
+			Args:  []Arg{roomArg, {Name: "question", Type: ArgText}},
+			Help:  "poll <room> <question>|<option>|<option>... - start a poll in a room",
+			Parse: parsePoll,
+		},
+		{
+			Verb:  "vote",
+			Args:  []Arg{{Name: "poll", Type: ArgNumber}, {Name: "option", Type: ArgNumber}},
+			Help:  "vote <poll> <n> - vote for option n in a poll",
+			Parse: parseVote,
+		},
+		{
+			Verb:  "pollresult",
+			Args:  []Arg{{Name: "poll", Type: ArgNumber}},
+			Help:  "pollresult <poll> - show the current tally of a poll",
+			Parse: parsePollResult,
+		},
+		{
+			Verb: "notices",
+			Args: []Arg{onOffArg},
+			Help: "notices on|off - show or hide join, leave and quit notices",
+			Parse: func(client *Client, args []string) Command {
+				return &NoticesCommand{
+					client: client,
+					on:     args[0] == "on",
+				}
+			},
+		},
+		{
+			Verb:  "color",
+			Args:  []Arg{onOffArg},
+			Help:  "color on|off - show rooms, nicks and notices in color, for terminals",
+			Parse: parseColor,
+		},
+		{
+			Verb: "proto",
+			Args: []Arg{{Name: "json or text", Choices: []string{"json", "text"}}},
+			Help: "proto json|text - switch between JSON and plain text lines",
+			Parse: func(client *Client, args []string) Command {
+				// Switch while parsing rather than in Run so the very
+				// next line is already read in the new format.
+				client.json.Store(args[0] == "json")
+
+				return &ProtoCommand{
+					client: client,
+					proto:  args[0],
+				}
+			},
+		},
+		{
+			Verb: "compress",
+			Args: []Arg{{Name: "mode", Choices: []string{"on"}}},
+			Help: "compress on - gzip everything sent both ways on this connection, starting right after this line",
+			Parse: func(client *Client, args []string) Command {
+				return &CompressCommand{client: client}
+			},
+		},
+		{
+			Verb: "seq",
+			Args: []Arg{onOffArg},
+			Help: "seq on|off - prefix every line sent to you with a sequence number",
+			Parse: func(client *Client, args []string) Command {
+				return &SeqCommand{
+					client: client,
+					on:     args[0] == "on",
+				}
+			},
+		},
+		{
+			Verb:  "away",
+			Args:  []Arg{{Name: "message", Type: ArgText, Optional: true}},
+			Help:  "away [message] - mark yourself away, or back if no message is given",
+			Parse: parseAway,
+		},
+		{
+			Verb:  "typing",
+			Args:  []Arg{roomArg, {Name: "start or stop", Choices: []string{"start", "stop"}}},
+			Help:  "typing <room> start|stop - tell JSON clients in a room that you are typing",
+			Parse: parseTyping,
+		},
+		{
+			Verb:  "whois",
+			Args:  []Arg{nickArg},
+			Help:  "whois <nick> - show someone's rooms, idle time and away status, or when they were last seen",
+			Parse: parseWhois,
+		},
+		{
+			Verb:  "stats",
+			Args:  []Arg{{Name: "room", Type: ArgName, Optional: true}},
+			Help:  "stats [room] - show uptime, connections, rooms and message counts, or how busy one room has been",
+			Parse: parseStats,
+		},
+		{
+			Verb:  "mailbox",
+			Args:  []Arg{{Name: "action", Optional: true, Choices: []string{"clear"}}},
+			Help:  "mailbox [clear] - show the private messages sent to you while you were offline, or clear them",
+			Parse: parseMailbox,
+		},
+		{
+			Verb:  "ignore",
+			Args:  []Arg{{Name: "nick", Type: ArgName, Optional: true}},
+			Help:  "ignore [nick] - stop seeing messages from someone, or list who you ignore",
+			Parse: parseIgnore,
+		},
+		{
+			Verb:  "unignore",
+			Args:  []Arg{nickArg},
+			Help:  "unignore <nick> - see someone's messages again",
+			Parse: parseUnignore,
+		},
+		{
+			Verb:  "register",
+			Args:  []Arg{{Name: "password", Type: ArgText}},
+			Help:  "register <password> - claim your current nick so only you can use it",
+			Parse: parseRegister,
+		},
+		{
+			Verb:  "login",
+			Args:  []Arg{nickArg, {Name: "password", Type: ArgText}},
+			Help:  "login <nick> <password> - log in to a registered nick, taking it back if needed",
+			Parse: parseLogin,
+		},
+		{
+			Verb:  "protect",
+			Args:  []Arg{{Name: "mode", Optional: true, Choices: []string{"block", "rename", "disconnect"}}},
+			Help:  "protect [block|rename|disconnect] - show or set what happens to others who take your registered nick: refuse it, or rename or disconnect them if they don't log in",
+			Parse: parseProtect,
+		},
+		{
+			Verb:  "ghost",
+			Args:  []Arg{nickArg, {Name: "password", Type: ArgText, Optional: true}},
+			Help:  "ghost <nick> [password] - disconnect a session using your registered nick; the password is needed unless you're logged in",
+			Parse: parseGhost,
+		},
+		{
+			Verb:  "resume",
+			Args:  []Arg{{Name: "token"}, {Name: "seq", Type: ArgNumber, Optional: true}},
+			Help:  "resume <token> [seq] - after reconnecting, get back the nick, rooms and missed messages of a dropped connection, and with sequence numbers on, the lines after seq that never arrived",
+			Parse: parseResume,
+		},
+		{
+			Verb:  "auth",
+			Args:  []Arg{{Name: "token"}},
+			Help:  "auth <token> - log in with an API token",
+			Parse: parseAuth,
+		},
+		{
+			Verb:  "sessions",
+			Help:  "sessions - list where your account is connected, and dropped sessions you can still resume",
+			Parse: parseSessions,
+		},
+		{
+			Verb:  "revoke",
+			Args:  []Arg{{Name: "session"}},
+			Help:  "revoke <session> - disconnect one of your account's sessions, or stop a dropped one being resumed",
+			Parse: parseRevoke,
+		},
+		{
+			Verb:  "token",
+			Args:  []Arg{{Name: "action", Choices: []string{"new", "list", "revoke"}}, {Name: "label or id", Type: ArgText, Optional: true}},
+			Help:  "token new [label] | token list | token revoke <id> - manage API tokens for your account",
+			Parse: parseToken,
+		},
+		{
+			Verb: "oper",
+			Args: []Arg{{Name: "password", Type: ArgText}},
+			Help: "oper <password> - become a server operator, with the admin role until you disconnect",
+			Parse: func(client *Client, args []string) Command {
+				return &OperCommand{
+					client:   client,
+					password: args[0],
+				}
+			},
+		},
+		{
+			Verb: "audit",
+			Args: []Arg{{Name: "nick or room", Type: ArgName, Optional: true}},
+			Help: "audit [nick|room] - show the latest moderation and admin actions, or those involving a nick or room (moderators only)",
+			Role: RoleModerator,
+			Parse: func(client *Client, args []string) Command {
+				return &AuditCommand{
+					client: client,
+					name:   args[0],
+				}
+			},
+		},
+		{
+			Verb: "ban-ip",
+			Args: []Arg{{Name: "address"}},
+			Help: "ban-ip <ip or cidr> - refuse connections from an address (moderators only)",
+			Role: RoleModerator,
+			Parse: func(client *Client, args []string) Command {
+				return &BanIPCommand{
+					client: client,
+					ban:    args[0],
+				}
+			},
+		},
+		{
+			Verb: "unban-ip",
+			Args: []Arg{{Name: "address"}},
+			Help: "unban-ip <ip or cidr> - lift an address ban (moderators only)",
+			Role: RoleModerator,
+			Parse: func(client *Client, args []string) Command {
+				return &UnbanIPCommand{
+					client: client,
+					ban:    args[0],
+				}
+			},
+		},
+		{
+			Verb: "list-bans",
+			Help: "list-bans - show banned addresses (moderators only)",
+			Role: RoleModerator,
+			Parse: func(client *Client, args []string) Command {
+				return &ListBansCommand{client: client}
+			},
+		},
+		{
+			Verb:  "userrooms",
+			Args:  []Arg{nickArg},
+			Help:  "userrooms <nick> - list every room someone is in and what they can do there (moderators only)",
+			Role:  RoleModerator,
+			Parse: parseUserRooms,
+		},
+		{
+			Verb:  "role",
+			Args:  []Arg{nickArg, {Name: "role", Optional: true, Choices: []string{"user", "moderator", "admin"}}},
+			Help:  "role <nick> [user|moderator|admin] - show or set the role of a registered nick (admins only)",
+			Role:  RoleAdmin,
+			Parse: parseRoleCommand,
+		},
+		{
+			Verb:  "diag",
+			Args:  []Arg{roomArg},
+			Help:  "diag <room> - show each member's queue, liveness and whether a message to the room would reach them (admins only)",
+			Role:  RoleAdmin,
+			Parse: parseDiag,
+		},
+		{
+			Verb:  "wall",
+			Args:  []Arg{{Name: "message", Type: ArgText}},
+			Help:  "wall <message> - send a notice to everyone on the server (admins only)",
+			Role:  RoleAdmin,
+			Parse: parseWall,
+		},
+		{
+			Verb:  "maintenance",
+			Args:  []Arg{{Name: "minutes or cancel"}},
+			Help:  "maintenance <minutes>|cancel - warn everyone of a shutdown for maintenance, then shut down, or cancel it (admins only)",
+			Role:  RoleAdmin,
+			Parse: parseMaintenance,
+		},
+		{
+			Verb:  "migrate",
+			Args:  []Arg{{Name: "address"}, {Name: "grace", Optional: true}},
+			Help:  "migrate <address> [grace] - tell everyone to reconnect to another address, disconnecting them after the grace period if given, e.g. 5m (admins only)",
+			Role:  RoleAdmin,
+			Parse: parseMigrate,
+		},
+		{
+			Verb:  "shadowmute",
+			Args:  []Arg{nickArg, onOffArg},
+			Help:  "shadowmute <nick> on|off - let someone's messages reach only themselves, without telling them (moderators only)",
+			Role:  RoleModerator,
+			Parse: parseShadowMute,
+		},
+		{
+			Verb:  "kick",
+			Args:  []Arg{roomArg, nickArg, {Name: "reason", Type: ArgText, Optional: true}},
+			Help:  "kick <room> <nick> [reason] - remove someone from a room (room operators only)",
+			Parse: parseKick,
+		},
+		{
+			Verb:  "ban",
+			Args:  []Arg{roomArg, nickArg, {Name: "duration", Optional: true}},
+			Help:  "ban <room> <nick> [duration] - kick someone and keep them out of a room, for good or for a while like 30m (room operators only)",
+			Parse: parseRoomBan,
+		},
+		{
+			Verb:  "unban",
+			Args:  []Arg{roomArg, nickArg},
+			Help:  "unban <room> <nick> - let a banned nick join a room again (room operators only)",
+			Parse: parseRoomUnban,
+		},
+		{
+			Verb:  "moderation",
+			Args:  []Arg{roomArg},
+			Help:  "moderation <room> - list who is banned or muted in a room, by whom and until when (room operators only)",
+			Parse: parseModeration,
+		},
+		{
+			Verb:  "purge",
+			Args:  []Arg{roomArg, nickArg},
+			Help:  "purge <room> <nick> - remove someone's messages from the last day of a room's history (room operators only)",
+			Parse: parsePurge,
+		},
+		{
+			Verb:  "op",
+			Args:  []Arg{roomArg, nickArg},
+			Help:  "op <room> <nick> - make someone a room operator (room operators only)",
+			Parse: parseOp,
+		},
+		{
+			Verb:  "deop",
+			Args:  []Arg{roomArg, nickArg},
+			Help:  "deop <room> <nick> - take away someone's room operator status (room operators only)",
+			Parse: parseDeop,
+		},
+		{
+			Verb:  "setkey",
+			Args:  []Arg{roomArg, {Name: "key", Optional: true}},
+			Help:  "setkey <room> [key] - require a key to join a room, or remove it (room operators only)",
+			Parse: parseSetKey,
+		},
+		{
+			Verb:  "register-room",
+			Args:  []Arg{roomArg},
+			Help:  "register-room <room> - keep a room and its settings when it empties and across restarts (room operators only, must be logged in)",
+			Parse: parseRegisterRoom,
+		},
+		{
+			Verb:  "unregister-room",
+			Args:  []Arg{roomArg},
+			Help:  "unregister-room <room> - stop keeping a room (room operators only)",
+			Parse: parseUnregisterRoom,
+		},
+		{
+			Verb:  "setlimit",
+			Args:  []Arg{roomArg, {Name: "limit", Type: ArgNumber}},
+			Help:  "setlimit <room> <n> - let at most n members into a room, 0 for no limit (room operators only)",
+			Parse: parseSetLimit,
+		},
+		{
+			Verb:  "set",
+			Args:  []Arg{roomArg, {Name: "setting", Choices: []string{"welcome", "trigger"}}, {Name: "value", Type: ArgText, Optional: true}},
+			Help:  "set <room> welcome [text] | set <room> trigger [keyword [response]] - set the message sent to everyone who joins a room, or a notice answering messages that mention a keyword; leave out the text to clear it, or the keyword to list triggers (room operators only)",
+			Parse: parseSet,
+		},
+		{
+			Verb:  "minage",
+			Args:  []Arg{roomArg, {Name: "age or off"}},
+			Help:  "minage <room> <age>|off - only take messages from accounts at least this old, e.g. 7d or 12h (room operators only)",
+			Parse: parseMinAge,
+		},
+		{
+			Verb:  "invite-only",
+			Args:  []Arg{roomArg, onOffArg},
+			Help:  "invite-only <room> on|off - only let invited nicks join a room (room operators only)",
+			Parse: parseInviteOnly,
+		},
+		{
+			Verb:  "moderated",
+			Args:  []Arg{roomArg, onOffArg},
+			Help:  "moderated <room> on|off - only let operators and voiced members send messages to a room (room operators only)",
+			Parse: parseModerated,
+		},
+		{
+			Verb:  "voice",
+			Args:  []Arg{roomArg, nickArg},
+			Help:  "voice <room> <nick> - let someone send messages to a moderated room (room operators only)",
+			Parse: parseVoice,
+		},
+		{
+			Verb:  "devoice",
+			Args:  []Arg{roomArg, nickArg},
+			Help:  "devoice <room> <nick> - take away someone's voice (room operators only)",
+			Parse: parseDevoice,
+		},
+		{
+			Verb:  "filter",
+			Args:  []Arg{roomArg, {Name: "on or off", Optional: true, Choices: []string{"on", "off"}}},
+			Help:  "filter <room> on|off | filter reload - turn the word filter on or off in a room (room operators only), or reload the word list (admins only)",
+			Parse: parseFilter,
+		},
+		{
+			Verb:  "encrypted",
+			Args:  []Arg{roomArg, onOffArg},
+			Help:  "encrypted <room> on|off - only pass on base64 encrypted payloads in a room, untouched (room operators only)",
+			Parse: parseEncrypted,
+		},
+		{
+			Verb:  "publish-keys",
+			Args:  []Arg{{Name: "bundle"}},
+			Help:  "publish-keys <bundle> - hand your base64 key bundle to members of the encrypted rooms you are in",
+			Parse: parsePublishKeys,
+		},
+		{
+			Verb:  "keys",
+			Args:  []Arg{roomArg},
+			Help:  "keys <room> - show the key bundles members of an encrypted room have published",
+			Parse: parseKeys,
+		},
+		{
+			Verb:  "invite",
+			Args:  []Arg{roomArg, nickArg},
+			Help:  "invite <room> <nick> - invite someone to a room (room operators only)",
+			Parse: parseInvite,
+		},
+	}
+}
+
+type Command interface {
+	Run(server *Server)
+}
+
+type ConnectCommand struct {
+	client   *Client
+	certNick string
+}
+
+func (cmd *ConnectCommand) Run(server *Server) {
+	server.clients.Add(cmd.client)
+	server.metrics.clients.Add(1)
+
+	if !cmd.client.quiet.Load() {
+		cmd.client.Reply(server.MOTD())
+
+		if cmd.client.listener != nil {
+			cmd.client.listener.greet(cmd.client)
+		}
+	}
+
+	if server.rules != "" {
+		cmd.client.Reply(server.rules)
+		cmd.client.Reply("Send 'accept' to accept the rules before joining rooms")
+	}
+
+	if cmd.certNick != "" {
+		server.certLogIn(cmd.client, cmd.certNick)
+	}
+
+	server.startSession(cmd.client)
+}
+
+type DisconnectCommand struct {
+	client *Client
+}
+
+func (cmd *DisconnectCommand) Run(server *Server) {
+	reason := "Connection closed"
+
+	if evicted := cmd.client.evicted.Load(); evicted != nil {
+		reason = *evicted
+	}
+
+	cmd.client.logger().Info("connection closed", "reason", reason)
+	server.markSeen(cmd.client)
+	server.forgetShadowMute(cmd.client)
+	server.suspendSession(cmd.client)
+
+	server.RemoveClient(cmd.client, reason)
+	server.metrics.clients.Add(-1)
+	cmd.client.Close()
+}
+
+type NickCommand struct {
+	client *Client
+	nick   string
+}
+
+func (cmd *NickCommand) concurrent(server *Server) bool {
+	return true
+}
+
+func (cmd *NickCommand) Run(server *Server) {
+	if owner, taken := server.LookupNick(cmd.nick); taken && owner != cmd.client {
+		cmd.client.Error("Nick already in use")
+		return
+	}
+
+	if guestRegexp.MatchString(cmd.nick) {
+		cmd.client.Error("Nick is reserved")
+		return
+	}
+
+	if server.confusableNicks {
+		if other := server.confusableNick(cmd.client, cmd.nick); other != "" {
+			cmd.client.Error(fmt.Sprintf("Nick is too similar to %s", plainName(other)))
+			return
+		}
+	}
+
+	account, registered := server.accounts.Get(cmd.nick)
+	registered = registered && !sameName(cmd.client.account, cmd.nick)
+
+	if registered && account.Protection() == ProtectBlock {
+		cmd.client.Error("Nick is registered, use login")
+		return
+	}
+
+	// Someone else may have taken it since the first check.
+	if !server.claimNick(cmd.client, cmd.nick) {
+		cmd.client.Error("Nick already in use")
+		return
+	}
+
+	// Or have it on another node.
+	if !sameName(cmd.client.nick(), cmd.nick) && !server.cluster.ClaimNick(cmd.nick) {
+		server.nicks.DeleteIf(foldName(cmd.nick), cmd.client)
+		cmd.client.Error("Nick already in use")
+		return
+	}
+
+	server.ChangeNick(cmd.client, cmd.nick)
+
+	if registered {
+		server.enforceNick(cmd.client, account)
+	}
+}
+
+type JoinCommand struct {
+	client *Client
+	room   string
+	key    string
+}
+
+func (cmd *JoinCommand) concurrent(server *Server) bool {
+	return true
+}
+
+func (cmd *JoinCommand) Run(server *Server) {
+	if !server.CheckAccepted(cmd.client) {
+		return
+	}
+
+	server.JoinRoom(cmd.room, cmd.client, cmd.key)
+}
+
+type MsgCommand struct {
+	client  *Client
+	room    string
+	message string
+}
+
+func (cmd *MsgCommand) concurrent(server *Server) bool {
+	return true
+}
+
+func (cmd *MsgCommand) Run(server *Server) {
+	if !server.CheckAccepted(cmd.client) || !server.CheckLength(cmd.client, cmd.message) || !server.CheckSpam(cmd.client, cmd.room, cmd.message) {
+		return
+	}
+
+	server.Broadcast(cmd.room, cmd.client, cmd.message, 0)
+}
+
+type PmCommand struct {
+	client  *Client
+	nick    string
+	message string
+}
+
+func (cmd *PmCommand) concurrent(server *Server) bool {
+	return true
+}
+
+func (cmd *PmCommand) Run(server *Server) {
+	if !server.CheckLength(cmd.client, cmd.message) {
+		return
+	}
+
+	server.PrivateMessage(cmd.nick, cmd.client, cmd.message)
+}
+
+type ListCommand struct {
+	client *Client
+}
+
+func (cmd *ListCommand) Run(server *Server) {
+	open := server.Rooms()
+	remote := server.cluster.Rooms()
+
+	if len(open) == 0 && len(remote) == 0 {
+		cmd.client.Reply("No rooms")
+		return
+	}
+
+	rooms := make([]string, 0, len(open)+len(remote))
+
+	for _, room := range open {
+		away := 0
+
+		for _, client := range room.clients {
+			if client.away != "" {
+				away++
+			}
+		}
+
+		members := len(room.clients)
+
+		for name, count := range remote {
+			if sameName(name, room.name) {
+				members += count
+				delete(remote, name)
+			}
+		}
+
+		if away > 0 {
+			rooms = append(rooms, fmt.Sprintf("%s (%d, %d away)", room.name, members, away))
+		} else {
+			rooms = append(rooms, fmt.Sprintf("%s (%d)", room.name, members))
+		}
+	}
+
+	// Rooms only open on other nodes.
+	for name, count := range remote {
+		rooms = append(rooms, fmt.Sprintf("%s (%d)", name, count))
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return foldName(rooms[i]) < foldName(rooms[j])
+	})
+
+	cmd.client.Reply("Rooms: " + strings.Join(rooms, ", "))
+}
+
+type WhoCommand struct {
+	client *Client
+	room   string
+}
+
+func (cmd *WhoCommand) Run(server *Server) {
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		cmd.client.Error("Room doesn't exist")
+		return
+	}
+
+	names := make([]string, len(room.clients))
+	shown := make([]string, len(room.clients))
+
+	for i, client := range room.clients {
+		names[i] = client.Name()
+
+		if room.ops[client] {
+			names[i] = "@" + names[i]
+		} else if room.voiced[client] {
+			names[i] = "+" + names[i]
+		}
+
+		shown[i] = awayName(client, names[i])
+	}
+
+	remote := append(server.cluster.Members(room.name), server.federation.Members(room.name)...)
+	names = append(names, remote...)
+	shown = append(shown, remote...)
+
+	event := &Event{
+		Type:  EventNames,
+		Room:  room.name,
+		Names: names,
+		Text:  fmt.Sprintf("%s: %s", room.name, strings.Join(shown, ", ")),
+	}
+
+	// Queued behind the room's own events, so a client that has just
+	// joined sees its join before the names list.
+	room.do(func() {
+		cmd.client.Send(event)
+	})
+}
+
+type TopicCommand struct {
+	client *Client
+	room   string
+	topic  string
+}
+
+func (cmd *TopicCommand) Run(server *Server) {
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		cmd.client.Error("Room doesn't exist")
+		return
+	}
+
+	if cmd.topic == "" {
+		cmd.client.Send(room.TopicEvent())
+		return
+	}
+
+	if !room.HasClient(cmd.client) {
+		cmd.client.Error("You are not in that room")
+		return
+	}
+
+	room.topic = cmd.topic
+	server.saveRoom(room)
+	room.Send(&Event{
+		Type:  EventTopic,
+		Nick:  cmd.client.Name(),
+		Topic: room.topic,
+		Text:  fmt.Sprintf("%s set the topic to: %s", plainName(cmd.client.Name()), room.topic),
+	})
+}
+
+const maxHistoryRequest = 100
+
+type HistoryCommand struct {
+	client *Client
+	room   string
+	n      int
+}
+
+func (cmd *HistoryCommand) Run(server *Server) {
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		cmd.client.Error("Room doesn't exist")
+		return
+	}
+
+	if !room.HasClient(cmd.client) {
+		cmd.client.Error("You are not in that room")
+		return
+	}
+
+	n := min(cmd.n, maxHistoryRequest)
+
+	room.do(func() {
+		messages, err := server.roomHistory(room, n)
+
+		if err != nil {
+			cmd.client.Error("History is unavailable")
+			return
+		}
+
+		for _, msg := range messages {
+			cmd.client.Send(msg.Event(server.timeLocation, true))
+		}
+
+		cmd.client.Notice(room.name, "End of history")
+	})
+}
+
+// roomHistory returns up to the last n messages sent to room, from the
+// store if there is one. It must be called on the room's goroutine.
+func (server *Server) roomHistory(room *Room, n int) ([]*Message, error) {
+	messages := room.history.Messages()
+
+	if server.store != nil {
+		var err error
+		messages, err = server.store.History(room.name, n)
+
+		if err != nil {
+			slog.Error("loading history", "room", room.name, "err", err)
+			return nil, err
+		}
+	}
+
+	if len(messages) > n {
+		messages = messages[len(messages)-n:]
+	}
+
+	return messages, nil
+}
+
+type LeaveCommand struct {
+	client *Client
+	room   string
+}
+
+func (cmd *LeaveCommand) concurrent(server *Server) bool {
+	return true
+}
+
+func (cmd *LeaveCommand) Run(server *Server) {
+	server.LeaveRoom(cmd.room, cmd.client)
+}
+
+type QuitCommand struct {
+	client *Client
+	reason string
+}
+
+func (cmd *QuitCommand) Run(server *Server) {
+	cmd.client.session = ""
+	server.RemoveClient(cmd.client, cmd.reason)
+
+	cmd.client.Reply("Goodbye")
+	cmd.client.conn.SetReadDeadline(time.Now())
+}
+
+type HelpCommand struct {
+	client *Client
+	verb   string
+}
+
+func (cmd *HelpCommand) Run(server *Server) {
+	if cmd.verb == "" {
+		verbs := append([]string(nil), server.registry.Verbs()...)
+		sort.Strings(verbs)
+
+		cmd.client.Reply("Commands: " + strings.Join(verbs, ", ") + "\nSend 'help <command>' to see how to use one\nNames with spaces go in double quotes, e.g. join \"general chat\"")
+		return
+	}
+
+	spec, exists := server.registry.Lookup(cmd.verb)
+
+	if !exists {
+		cmd.client.Error("No such command")
+		return
+	}
+
+	cmd.client.Reply(spec.Help)
+}
+
+type AcceptCommand struct {
+	client *Client
+}
+
+func (cmd *AcceptCommand) Run(server *Server) {
+	cmd.client.accepted = true
+	cmd.client.Reply("Rules accepted")
+}
+
+const lagInterval = 5 * time.Second
+
+type LagCommand struct {
+	client *Client
+}
+
+func (cmd *LagCommand) Run(server *Server) {
+	client := cmd.client
+
+	if time.Since(client.lastLag) < lagInterval {
+		client.Error("lag can only be checked every 5 seconds")
+		return
+	}
+
+	client.lastLag = time.Now()
+
+	lastWrite := time.Duration(client.lastWrite.Load())
+	client.Reply(fmt.Sprintf("Lag: %d/%d lines queued, %d dropped, last write took %v", len(client.outgoing), cap(client.outgoing), client.dropped.Load(), lastWrite))
+}
+
+type TimeCommand struct {
+	client *Client
+}
+
+func (cmd *TimeCommand) Run(server *Server) {
+	now := time.Now().In(server.timeLocation)
+	cmd.client.Reply("Time: " + now.Format(server.timeFormat))
+}
+
+type NoticesCommand struct {
+	client *Client
+	on     bool
+}
+
+func (cmd *NoticesCommand) Run(server *Server) {
+	cmd.client.hidePresence.Store(!cmd.on)
+
+	if cmd.on {
+		cmd.client.Reply("Join and leave notices on")
+	} else {
+		cmd.client.Reply("Join and leave notices off")
+	}
+}
+
+type ProtoCommand struct {
+	client *Client
+	proto  string
+}
+
+func (cmd *ProtoCommand) Run(server *Server) {
+	cmd.client.Reply("Protocol " + cmd.proto)
+}
+
+type SeqCommand struct {
+	client *Client
+	on     bool
+}
+
+func (cmd *SeqCommand) Run(server *Server) {
+	cmd.client.sequenced.Store(cmd.on)
+
+	if cmd.on {
+		cmd.client.Reply("Sequence numbers on")
+	} else {
+		cmd.client.Reply("Sequence numbers off")
+	}
+}
+
+// freshListener listens on address. For a Unix socket, a socket file left
+// behind by a process that didn't exit cleanly is removed first.
+func freshListener(network, address string) (net.Listener, error) {
+	if network == "unix" {
+		if info, err := os.Lstat(address); err == nil && info.Mode()&fs.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+
+	return net.Listen(network, address)
+}
+
+func loadTextFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\n"), nil
+}
+
+// Run is the chatserver program: it loads the config from the command line
+// arguments args, listens everywhere the config says to, and serves until
+// the listeners are handed off or closed.
+func Run(name string, args []string) {
+	config, err := LoadConfig(name, args)
+
+	if err != nil {
+		fatal("loading config", err)
+	}
+
+	logger, err := NewLogger(os.Stderr, config)
+
+	if err != nil {
+		fatal("configuring logging", err)
+	}
+
+	slog.SetDefault(logger)
+
+	listener, err := listen("tcp", "tcp", config.Addr)
+
+	if err != nil {
+		fatal("listening", err)
+	}
+
+	listeners := map[string]net.Listener{"tcp": listener}
+	serving := []net.Listener{behindProxy(listener, config.ProxyProtocol)}
+
+	if config.UnixPath != "" {
+		raw, err := listen("unix", "unix", config.UnixPath)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["unix"] = raw
+		serving = append(serving, raw)
+	}
+
+	var tlsConfig *tls.Config
+	var acme *autocert.Manager
+
+	if config.ACMEDomain != "" {
+		acme = newACMEManager(config)
+	}
+
+	if config.usesTLS() {
+		tlsConfig, err = newTLSConfig(config, acme)
+
+		if err != nil {
+			fatal("loading TLS certificate", err)
+		}
+	}
+
+	if config.TLSAddr != "" {
+		raw, err := listen("tls", "tcp", config.TLSAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["tls"] = raw
+		serving = append(serving, tls.NewListener(behindProxy(raw, config.ProxyProtocol), tlsConfig))
+	}
+
+	server, err := NewServer(Options{Config: config})
+
+	if err != nil {
+		fatal("starting server", err)
+	}
+
+	defer server.Close()
+
+	server.reloadOnSignal()
+
+	if server.cluster != nil {
+		go server.cluster.Run(server)
+	}
+
+	if server.bridge != nil {
+		go server.bridge.Run(server)
+	}
+
+	if server.matrix != nil {
+		go server.matrix.Run()
+	}
+
+	if server.webhooks != nil {
+		server.webhooks.Start()
+	}
+
+	if notifier, ok := server.notifier.(*HTTPNotifier); ok {
+		go notifier.Run()
+	}
+
+	if server.uploads != nil {
+		go server.uploads.Run()
+	}
+
+	for _, addr := range strings.Split(config.Links, ",") {
+		if addr != "" {
+			go server.DialLink(strings.TrimSpace(addr))
+		}
+	}
+
+	var accepting sync.WaitGroup
+
+	if config.WSAddr != "" {
+		raw, err := listen("ws", "tcp", config.WSAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["ws"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+			server.ServeWebSocket(behindProxy(raw, config.ProxyProtocol))
+		}()
+	}
+
+	if config.GRPCAddr != "" {
+		raw, err := listen("grpc", "tcp", config.GRPCAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["grpc"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+			server.ServeGRPC(behindProxy(raw, config.ProxyProtocol))
+		}()
+	}
+
+	if config.IRCAddr != "" {
+		raw, err := listen("irc", "tcp", config.IRCAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["irc"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+
+			if err := server.HandleIRCConnections(behindProxy(raw, config.ProxyProtocol)); err != nil {
+				fatal("accepting IRC connections", err)
+			}
+		}()
+	}
+
+	if config.AdminAddr != "" {
+		raw, err := listen("admin", "tcp", config.AdminAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["admin"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+			server.ServeAdmin(raw)
+		}()
+	}
+
+	for _, extra := range config.Listeners {
+		raw, err := listen("listen-"+extra.Name, addrNetwork(extra.Addr), extra.Addr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["listen-"+extra.Name] = raw
+		l := raw
+
+		if addrNetwork(extra.Addr) == "tcp" {
+			l = behindProxy(raw, config.ProxyProtocol)
+		}
+
+		if extra.TLS {
+			l = tls.NewListener(l, tlsConfig)
+		}
+
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+
+			if err := server.ServeListener(l, &extra); err != nil {
+				fatal("accepting connections", err)
+			}
+		}()
+	}
+
+	if config.ConsoleAddr != "" {
+		raw, err := listen("console", addrNetwork(config.ConsoleAddr), config.ConsoleAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["console"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+
+			if err := server.ServeConsole(raw); err != nil {
+				fatal("accepting console connections", err)
+			}
+		}()
+	}
+
+	if config.MetricsAddr != "" {
+		raw, err := listen("metrics", "tcp", config.MetricsAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["metrics"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+			server.ServeMetrics(raw)
+		}()
+	}
+
+	if config.ACMEHTTPAddr != "" {
+		raw, err := listen("acme-http", "tcp", config.ACMEHTTPAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["acme-http"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+			ServeACME(raw, acme)
+		}()
+	}
+
+	if config.LinkAddr != "" {
+		raw, err := listen("link", "tcp", config.LinkAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["link"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+			server.ServeLinks(raw)
+		}()
+	}
+
+	if config.InboundAddr != "" {
+		raw, err := listen("inbound", "tcp", config.InboundAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["inbound"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+			server.ServeInbound(raw)
+		}()
+	}
+
+	if config.StreamAddr != "" {
+		raw, err := listen("stream", "tcp", config.StreamAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["stream"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+			server.ServeStreams(raw)
+		}()
+	}
+
+	if config.UploadAddr != "" {
+		raw, err := listen("upload", "tcp", config.UploadAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["upload"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+			server.ServeUploads(raw)
+		}()
+	}
+
+	if config.MatrixAddr != "" {
+		raw, err := listen("matrix", "tcp", config.MatrixAddr)
+
+		if err != nil {
+			fatal("listening", err)
+		}
+
+		listeners["matrix"] = raw
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+			server.ServeMatrix(raw)
+		}()
+	}
+
+	server.call(func() {
+		server.stopListening = func() {
+			for _, l := range listeners {
+				l.Close()
+			}
+		}
+	})
+
+	if config.Handoff {
+		handoffOnSignal(listeners)
+	}
+
+	for _, l := range serving {
+		accepting.Add(1)
+
+		go func() {
+			defer accepting.Done()
+
+			if err := server.HandleConnections(l); err != nil {
+				fatal("accepting connections", err)
+			}
+		}()
+	}
+
+	accepting.Wait()
+	server.Drain(config.DrainTimeout.Duration)
+}
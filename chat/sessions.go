@@ -0,0 +1,165 @@
+package chat
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Sessions of an account are its connected clients, known by client ID,
+// and the dropped sessions it can still resume, known by the start of
+// their token's hash, which is all the server keeps of the token.
+const savedSessionIDLength = 8
+
+// SessionsCommand lists the sessions of the account the client is logged
+// in to, so someone who has lost a device can find the one to revoke.
+type SessionsCommand struct {
+	client *Client
+}
+
+func (cmd *SessionsCommand) Run(server *Server) {
+	if cmd.client.account == "" {
+		cmd.client.Error("You must log in first")
+		return
+	}
+
+	now := time.Now()
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNICK\tFROM\tCONNECTED\tIDLE\tROOMS")
+
+	for _, client := range server.clients.Sorted() {
+		if !sameName(client.account, cmd.client.account) {
+			continue
+		}
+
+		rooms := make([]string, 0, len(client.rooms))
+
+		for _, room := range client.rooms {
+			rooms = append(rooms, plainName(room.name))
+		}
+
+		sort.Strings(rooms)
+
+		id := strconv.FormatUint(client.id, 10)
+
+		if client == cmd.client {
+			id += " (this one)"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%s\n",
+			id,
+			plainName(client.Name()),
+			client.conn.RemoteAddr(),
+			server.formatTime(client.connected),
+			now.Sub(time.Unix(0, client.lastActive.Load())).Truncate(time.Second),
+			strings.Join(rooms, ", "))
+	}
+
+	for _, hash := range sortedSessions(server.sessions) {
+		saved := server.sessions[hash]
+
+		if !sameName(saved.account, cmd.client.account) || now.After(saved.expires) {
+			continue
+		}
+
+		rooms := make([]string, 0, len(saved.rooms))
+
+		for name := range saved.rooms {
+			rooms = append(rooms, plainName(name))
+		}
+
+		sort.Strings(rooms)
+
+		fmt.Fprintf(w, "%s\t%s\t(dropped)\tresumable until %s\t\t%s\n",
+			hash[:savedSessionIDLength],
+			plainName(saved.nick),
+			server.formatTime(saved.expires),
+			strings.Join(rooms, ", "))
+	}
+
+	w.Flush()
+
+	cmd.client.Reply(strings.TrimSuffix(b.String(), "\n"))
+}
+
+func sortedSessions(sessions map[string]*savedSession) []string {
+	hashes := make([]string, 0, len(sessions))
+
+	for hash := range sessions {
+		hashes = append(hashes, hash)
+	}
+
+	sort.Strings(hashes)
+
+	return hashes
+}
+
+// RevokeCommand ends one of the sessions of the account the client is
+// logged in to. A connected one is disconnected the way the server
+// disconnects anyone, and can't be resumed; a dropped one is forgotten.
+type RevokeCommand struct {
+	client *Client
+	id     string
+}
+
+func (cmd *RevokeCommand) Run(server *Server) {
+	account := cmd.client.account
+
+	if account == "" {
+		cmd.client.Error("You must log in first")
+		return
+	}
+
+	if id, err := strconv.ParseUint(cmd.id, 10, 64); err == nil {
+		client, exists := server.clients.Get(id)
+
+		if !exists || !sameName(client.account, account) {
+			cmd.client.Error("No such session")
+			return
+		}
+
+		if client == cmd.client {
+			cmd.client.Error("That is this session; use quit to end it")
+			return
+		}
+
+		cmd.client.logger().Info("revoked session", "account", account, "session", client.id)
+		server.audit(cmd.client.Name(), "revoke session", "", client.Name(), "")
+		server.evict(client, "Session revoked")
+		cmd.client.Reply(fmt.Sprintf("Revoked session %d", client.id))
+		return
+	}
+
+	if len(cmd.id) == savedSessionIDLength {
+		for hash, saved := range server.sessions {
+			if !strings.HasPrefix(hash, cmd.id) || !sameName(saved.account, account) {
+				continue
+			}
+
+			delete(server.sessions, hash)
+
+			cmd.client.logger().Info("revoked session", "account", account, "session", cmd.id)
+			server.audit(cmd.client.Name(), "revoke session", "", saved.nick, "")
+			cmd.client.Reply("Revoked session " + cmd.id)
+			return
+		}
+	}
+
+	cmd.client.Error("No such session")
+}
+
+func parseSessions(client *Client, args []string) Command {
+	return &SessionsCommand{client: client}
+}
+
+func parseRevoke(client *Client, args []string) Command {
+	return &RevokeCommand{
+		client: client,
+		id:     strings.ToLower(args[0]),
+	}
+}
@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SetCommand changes one of a room's settings that are text rather than on
+// or off: its welcome message, or its triggers. An empty value clears the
+// setting.
+type SetCommand struct {
+	client  *Client
+	room    string
+	setting string
+	value   string
+}
+
+func (cmd *SetCommand) Run(server *Server) {
+	room := server.OperatedRoom(cmd.room, cmd.client)
+
+	if room == nil {
+		return
+	}
+
+	switch cmd.setting {
+	case "welcome":
+		if !server.CheckLength(cmd.client, cmd.value) {
+			return
+		}
+
+		room.welcome = cmd.value
+		server.saveRoom(room)
+
+		cmd.client.logger().Info("changed room welcome", "room", room.name, "welcome", cmd.value)
+		server.audit(cmd.client.Name(), "set welcome", room.name, "", cmd.value)
+
+		if cmd.value == "" {
+			cmd.client.Reply(fmt.Sprintf("Removed the welcome message from %s", plainName(room.name)))
+		} else {
+			cmd.client.Reply(fmt.Sprintf("Set the welcome message for %s", plainName(room.name)))
+		}
+	case "trigger":
+		keyword, response, _ := strings.Cut(cmd.value, " ")
+
+		if keyword == "" {
+			server.listTriggers(cmd.client, room)
+		} else {
+			server.setTrigger(cmd.client, room, keyword, strings.TrimSpace(response))
+		}
+	}
+}
+
+// sendWelcome sends client, which has just joined room, the room's welcome
+// message, after what joining already queued for it.
+func (server *Server) sendWelcome(room *Room, client *Client) {
+	if room.welcome == "" {
+		return
+	}
+
+	welcome := room.welcome
+
+	room.do(func() {
+		client.Notice(room.name, welcome)
+	})
+}
+
+// welcomeCommand sends a client that has joined a room its welcome message.
+// IRC clients get it this way, after the names list their JOIN asks for.
+type welcomeCommand struct {
+	client *Client
+	room   string
+}
+
+func (cmd *welcomeCommand) Run(server *Server) {
+	room, exists := server.LookupRoom(cmd.room)
+
+	if exists && room.HasClient(cmd.client) {
+		server.sendWelcome(room, cmd.client)
+	}
+}
+
+func parseSet(client *Client, args []string) Command {
+	return &SetCommand{
+		client:  client,
+		room:    args[0],
+		setting: args[1],
+		value:   args[2],
+	}
+}
@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"strconv"
+	"time"
+)
+
+// A shadow muted client's messages look to it as though they were sent
+// as usual, but nobody else gets them: they aren't kept in history or
+// passed on to other servers, and private messages are dropped. Unlike a
+// kick, nothing tells a troll to try again under another nick. A logged in
+// client's mute is kept by account, so it lasts across reconnects until
+// the server restarts. A guest's only lasts for its connection: muting by
+// address would catch everyone else behind the same NAT.
+
+func (client *Client) shadowKey() string {
+	if client.account != "" {
+		return client.identity()
+	}
+
+	return "client " + strconv.FormatUint(client.id, 10)
+}
+
+func (server *Server) isShadowMuted(client *Client) bool {
+	_, muted := server.shadowMuted[client.shadowKey()]
+	return muted
+}
+
+// forgetShadowMute drops a disconnecting guest's mute.
+func (server *Server) forgetShadowMute(client *Client) {
+	if client.account == "" {
+		delete(server.shadowMuted, client.shadowKey())
+	}
+}
+
+// shadowPost gives a shadow muted client back the message it sent to room
+// without sending it anywhere else.
+func (server *Server) shadowPost(room *Room, from *Client, text string, parent uint64) *Message {
+	message := &Message{
+		id:     room.nextMessageID(),
+		room:   room.name,
+		nick:   from.nick(),
+		text:   text,
+		time:   time.Now(),
+		parent: parent,
+	}
+
+	event := message.Event(server.timeLocation, false)
+
+	room.do(func() {
+		from.Send(event)
+	})
+
+	return message
+}
+
+// ShadowMuteCommand shadow mutes a client or lifts the mute.
+type ShadowMuteCommand struct {
+	client *Client
+	nick   string
+	on     bool
+}
+
+func (cmd *ShadowMuteCommand) Run(server *Server) {
+	target, exists := server.LookupNick(cmd.nick)
+
+	if !exists {
+		cmd.client.Error("No such nick")
+		return
+	}
+
+	if target.Role() >= RoleModerator {
+		cmd.client.Error("Moderators and admins can't be shadow muted")
+		return
+	}
+
+	key := target.shadowKey()
+
+	if cmd.on {
+		server.shadowMuted[key] = cmd.client.Name()
+		cmd.client.logger().Info("shadow muted", "target", target.Name(), "key", key)
+		server.audit(cmd.client.Name(), "shadowmute on", "", target.Name(), "")
+		cmd.client.Reply(target.Name() + " is shadow muted")
+		return
+	}
+
+	delete(server.shadowMuted, key)
+	cmd.client.logger().Info("lifted shadow mute", "target", target.Name(), "key", key)
+	server.audit(cmd.client.Name(), "shadowmute off", "", target.Name(), "")
+	cmd.client.Reply(target.Name() + " is no longer shadow muted")
+}
+
+func parseShadowMute(client *Client, args []string) Command {
+	return &ShadowMuteCommand{
+		client: client,
+		nick:   args[0],
+		on:     args[1] == "on",
+	}
+}
@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"fmt"
+	"time"
+)
+
+// spamState is what the spam check remembers about one client. Only the
+// client's own commands touch it, and they run one at a time.
+type spamState struct {
+	recent     []spamMessage
+	strikes    int
+	lastStrike time.Time
+	mutedUntil time.Time
+}
+
+type spamMessage struct {
+	room string
+	text string
+	time time.Time
+}
+
+// CheckSpam reports whether client may send text to room. Sending the same
+// text more than spamRepeats times, or to more than spamRooms rooms, within
+// spamWindow counts as spam: the message is dropped with a warning, and
+// after spamStrikes of those in a row the client is muted for spamMute.
+// Moderators and admins are never checked.
+func (server *Server) CheckSpam(client *Client, room, text string) bool {
+	if client.Role() >= RoleModerator || server.spamWindow <= 0 {
+		return true
+	}
+
+	state := &client.spam
+	now := time.Now()
+
+	if now.Before(state.mutedUntil) {
+		client.Error(fmt.Sprintf("You are muted for spamming for another %s", state.mutedUntil.Sub(now).Round(time.Second)))
+		return false
+	}
+
+	kept := state.recent[:0]
+
+	for _, msg := range state.recent {
+		if now.Sub(msg.time) < server.spamWindow {
+			kept = append(kept, msg)
+		}
+	}
+
+	state.recent = kept
+
+	repeats := 0
+	rooms := map[string]bool{foldName(room): true}
+
+	for _, msg := range state.recent {
+		if msg.text == text {
+			repeats++
+		}
+
+		rooms[foldName(msg.room)] = true
+	}
+
+	if (server.spamRepeats <= 0 || repeats < server.spamRepeats) && (server.spamRooms <= 0 || len(rooms) <= server.spamRooms) {
+		state.recent = append(state.recent, spamMessage{room: room, text: text, time: now})
+		return true
+	}
+
+	if now.Sub(state.lastStrike) > server.spamWindow {
+		state.strikes = 0
+	}
+
+	state.strikes++
+	state.lastStrike = now
+
+	if server.spamMute > 0 && state.strikes >= server.spamStrikes {
+		state.strikes = 0
+		state.mutedUntil = now.Add(server.spamMute)
+		client.logger().Warn("muted for spam", "room", room, "duration", server.spamMute)
+		client.Error(fmt.Sprintf("You have been muted for %s for spamming", server.spamMute))
+		return false
+	}
+
+	client.logger().Info("dropped spam", "room", room, "strikes", state.strikes)
+	client.Error("That looks like spam, your message was not sent")
+	return false
+}
@@ -0,0 +1,263 @@
+package chat
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	room_key TEXT NOT NULL,
+	id       INTEGER NOT NULL,
+	room     TEXT NOT NULL,
+	nick     TEXT NOT NULL,
+	text     TEXT NOT NULL,
+	time     INTEGER NOT NULL,
+	parent   INTEGER NOT NULL DEFAULT 0,
+	edited   INTEGER NOT NULL DEFAULT 0,
+	deleted  INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (room_key, id)
+);
+
+CREATE TABLE IF NOT EXISTS reactions (
+	seq      INTEGER PRIMARY KEY AUTOINCREMENT,
+	room_key TEXT NOT NULL,
+	id       INTEGER NOT NULL,
+	nick_key TEXT NOT NULL,
+	nick     TEXT NOT NULL,
+	emoji    TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS reactions_message ON reactions (room_key, id);
+`
+
+// SQLiteStore keeps messages in a SQLite database, so history can be read
+// back without scanning everything ever said. Rooms are keyed by their
+// folded names. Deleted messages keep their rows, so their IDs are never
+// reused, but lose their text and reactions, and secure_delete has SQLite
+// overwrite what they took up on disk.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// isSQLitePath reports whether a -store path names a SQLite database
+// rather than a JSON lines file.
+func isSQLitePath(path string) bool {
+	switch filepath.Ext(path) {
+	case ".db", ".sqlite", ".sqlite3":
+		return true
+	}
+
+	return false
+}
+
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=secure_delete(1)")
+
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows one writer at a time, and rooms save from their own
+	// goroutines, so they take turns on a single connection rather than
+	// failing with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(sqliteSchema)
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func (store *SQLiteStore) SaveMessage(msg *Message) error {
+	_, err := store.db.Exec(
+		`INSERT OR REPLACE INTO messages (room_key, id, room, nick, text, time, parent) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		foldName(msg.room), msg.id, msg.room, msg.nick, msg.text, msg.time.UnixNano(), msg.parent,
+	)
+
+	return err
+}
+
+func (store *SQLiteStore) EditMessage(msg *Message) error {
+	_, err := store.db.Exec(
+		`UPDATE messages SET text = ?, edited = 1 WHERE room_key = ? AND id = ?`,
+		msg.text, foldName(msg.room), msg.id,
+	)
+
+	return err
+}
+
+func (store *SQLiteStore) DeleteMessages(room string, ids ...uint64) error {
+	tx, err := store.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		_, err = tx.Exec(
+			`UPDATE messages SET text = '', deleted = 1 WHERE room_key = ? AND id = ?`,
+			foldName(room), id,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`DELETE FROM reactions WHERE room_key = ? AND id = ?`,
+			foldName(room), id,
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) SaveReaction(room string, id uint64, nick, emoji string, removed bool) error {
+	tx, err := store.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`DELETE FROM reactions WHERE room_key = ? AND id = ? AND nick_key = ? AND emoji = ?`,
+		foldName(room), id, foldName(nick), emoji,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if !removed {
+		_, err = tx.Exec(
+			`INSERT INTO reactions (room_key, id, nick_key, nick, emoji) VALUES (?, ?, ?, ?, ?)`,
+			foldName(room), id, foldName(nick), nick, emoji,
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) History(room string, n int) ([]*Message, error) {
+	rows, err := store.db.Query(
+		`SELECT id, room, nick, text, time, parent, edited FROM messages
+		WHERE room_key = ? AND deleted = 0 ORDER BY id DESC LIMIT ?`,
+		foldName(room), n,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var messages []*Message
+	byID := make(map[uint64]*Message)
+
+	for rows.Next() {
+		var msg Message
+		var nanos int64
+
+		err := rows.Scan(&msg.id, &msg.room, &msg.nick, &msg.text, &nanos, &msg.parent, &msg.edited)
+
+		if err != nil {
+			return nil, err
+		}
+
+		msg.time = time.Unix(0, nanos)
+		messages = append(messages, &msg)
+		byID[msg.id] = &msg
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(messages)
+
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	reactions, err := store.db.Query(
+		`SELECT id, nick, emoji FROM reactions WHERE room_key = ? AND id >= ? ORDER BY seq`,
+		foldName(room), messages[0].id,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer reactions.Close()
+
+	for reactions.Next() {
+		var id uint64
+		var nick, emoji string
+
+		if err := reactions.Scan(&id, &nick, &emoji); err != nil {
+			return nil, err
+		}
+
+		if msg := byID[id]; msg != nil {
+			msg.react(nick, emoji, false)
+		}
+	}
+
+	return messages, reactions.Err()
+}
+
+// LastIDs finds the ID of the last message saved in each room, deleted or
+// not, keyed by the room's folded name.
+func (store *SQLiteStore) LastIDs() (map[string]uint64, error) {
+	rows, err := store.db.Query(`SELECT room_key, MAX(id) FROM messages GROUP BY room_key`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ids := make(map[string]uint64)
+
+	for rows.Next() {
+		var room string
+		var id uint64
+
+		if err := rows.Scan(&room, &id); err != nil {
+			return nil, err
+		}
+
+		ids[room] = id
+	}
+
+	return ids, rows.Err()
+}
+
+func (store *SQLiteStore) Ping() error {
+	return store.db.Ping()
+}
+
+func (store *SQLiteStore) Close() error {
+	return store.db.Close()
+}
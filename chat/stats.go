@@ -0,0 +1,58 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StatsCommand reports how busy the server, or one room, has been.
+type StatsCommand struct {
+	client *Client
+	room   string
+}
+
+func (cmd *StatsCommand) Run(server *Server) {
+	if cmd.room != "" {
+		room, exists := server.LookupRoom(cmd.room)
+
+		if !exists {
+			cmd.client.Error("Room doesn't exist")
+			return
+		}
+
+		cmd.client.Reply(roomStats(room))
+		return
+	}
+
+	lines := []string{
+		fmt.Sprintf("Up %v", time.Since(server.started).Truncate(time.Second)),
+		fmt.Sprintf("%d connections, %d clients online", server.metrics.connections.Load(), server.metrics.clients.Load()),
+		fmt.Sprintf("%d rooms, %d messages", server.rooms.Len(), server.metrics.messages.Load()),
+	}
+
+	for _, room := range server.Rooms() {
+		lines = append(lines, roomStats(room))
+	}
+
+	cmd.client.Reply(strings.Join(lines, "\n"))
+}
+
+// roomStats describes room's members and messages, with its average
+// message rate since it opened.
+func roomStats(room *Room) string {
+	open := time.Since(room.opened)
+	rate := float64(room.messages) / max(open.Minutes(), 1)
+
+	return fmt.Sprintf("%s: %d members, %d messages in %v (%.1f/min)", room.name, len(room.clients), room.messages, open.Truncate(time.Second), rate)
+}
+
+func parseStats(client *Client, args []string) Command {
+	cmd := &StatsCommand{client: client}
+
+	if len(args) > 0 {
+		cmd.room = args[0]
+	}
+
+	return cmd
+}
@@ -0,0 +1,406 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type Store interface {
+	SaveMessage(msg *Message) error
+	EditMessage(msg *Message) error
+
+	// DeleteMessages removes the messages' text for good, while keeping
+	// their IDs from being used again.
+	DeleteMessages(room string, ids ...uint64) error
+
+	SaveReaction(room string, id uint64, nick, emoji string, removed bool) error
+	History(room string, n int) ([]*Message, error)
+	LastIDs() (map[string]uint64, error)
+	Ping() error
+	Close() error
+}
+
+// Kinds of stored records after the message itself.
+const (
+	storedEdit    = "edit"
+	storedDelete  = "delete"
+	storedReact   = "react"
+	storedUnreact = "unreact"
+)
+
+type storedMessage struct {
+	Kind string    `json:"kind,omitempty"`
+	ID   uint64    `json:"id,omitempty"`
+	Room string    `json:"room"`
+	Nick string    `json:"nick,omitempty"`
+	Text string    `json:"text,omitempty"`
+	Time time.Time `json:"time"`
+
+	Parent uint64 `json:"parent,omitempty"`
+}
+
+// FileStore keeps messages as JSON lines appended to a single file. Edits
+// and reactions are appended as records of their own, applied to the
+// message with their ID when history is read back. Deleting messages
+// rewrites the file without them, their edits or their reactions, leaving
+// a deletion record in their place.
+// The file is read through once when the store is opened, to index where
+// each room's records are, so reading a room's history only reads that
+// room's records. Rooms save and query from their own goroutines, so
+// access to the file is locked.
+type FileStore struct {
+	mu   sync.RWMutex
+	path string
+	file *os.File
+
+	// Where each room's records are, by the room's folded name, and how
+	// long the file is.
+	rooms map[string][]storedSpan
+	size  int64
+}
+
+// storedSpan is where a record's line is in the file, including its
+// newline.
+type storedSpan struct {
+	offset int64
+	length int
+}
+
+func OpenFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	store := &FileStore{
+		path:  path,
+		file:  file,
+		rooms: make(map[string][]storedSpan),
+	}
+
+	if err := store.buildIndex(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *FileStore) buildIndex() error {
+	file, err := os.Open(store.path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		store.index(line, store.size, len(line))
+		store.size += int64(len(line))
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// index notes that record is at offset in the file, on a line length long.
+func (store *FileStore) index(record []byte, offset int64, length int) {
+	var stored storedMessage
+
+	if json.Unmarshal(record, &stored) != nil {
+		return
+	}
+
+	room := foldName(stored.Room)
+	store.rooms[room] = append(store.rooms[room], storedSpan{offset: offset, length: length})
+}
+
+func (store *FileStore) SaveMessage(msg *Message) error {
+	return store.append(&storedMessage{
+		ID:   msg.id,
+		Room: msg.room,
+		Nick: msg.nick,
+		Text: msg.text,
+		Time: msg.time,
+
+		Parent: msg.parent,
+	})
+}
+
+func (store *FileStore) EditMessage(msg *Message) error {
+	return store.append(&storedMessage{
+		Kind: storedEdit,
+		ID:   msg.id,
+		Room: msg.room,
+		Text: msg.text,
+		Time: time.Now(),
+	})
+}
+
+func (store *FileStore) DeleteMessages(room string, ids ...uint64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	deleted := make(map[uint64]bool, len(ids))
+
+	for _, id := range ids {
+		deleted[id] = true
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	file, err := os.Open(store.path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	temp, err := os.OpenFile(store.path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	w := bufio.NewWriter(temp)
+
+	// Offsets change, so the index is built again for the new file.
+	rewritten := &FileStore{rooms: make(map[string][]storedSpan)}
+
+	write := func(record []byte) {
+		w.Write(record)
+		w.WriteByte('\n')
+		rewritten.index(record, rewritten.size, len(record)+1)
+		rewritten.size += int64(len(record) + 1)
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+
+	for scanner.Scan() {
+		var stored storedMessage
+
+		if json.Unmarshal(scanner.Bytes(), &stored) == nil && deleted[stored.ID] && sameName(stored.Room, room) && stored.Kind != storedDelete {
+			continue
+		}
+
+		write(scanner.Bytes())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, id := range ids {
+		data, err := json.Marshal(&storedMessage{Kind: storedDelete, ID: id, Room: room, Time: now})
+
+		if err != nil {
+			return err
+		}
+
+		write(data)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := temp.Sync(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(temp.Name(), store.path); err != nil {
+		return err
+	}
+
+	// Appends went to the file that was replaced.
+	appending, err := os.OpenFile(store.path, os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	store.file.Close()
+	store.file = appending
+	store.rooms = rewritten.rooms
+	store.size = rewritten.size
+
+	return nil
+}
+
+func (store *FileStore) SaveReaction(room string, id uint64, nick, emoji string, removed bool) error {
+	kind := storedReact
+
+	if removed {
+		kind = storedUnreact
+	}
+
+	return store.append(&storedMessage{
+		Kind: kind,
+		ID:   id,
+		Room: room,
+		Nick: nick,
+		Text: emoji,
+		Time: time.Now(),
+	})
+}
+
+func (store *FileStore) append(stored *storedMessage) error {
+	data, err := json.Marshal(stored)
+
+	if err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	n, err := store.file.Write(append(data, '\n'))
+
+	if err == nil {
+		store.index(data, store.size, n)
+	}
+
+	store.size += int64(n)
+	return err
+}
+
+func (store *FileStore) History(room string, n int) ([]*Message, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	file, err := os.Open(store.path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	// Edits can come long after the message, so the whole room is read
+	// before cutting it down to the last n.
+	var messages []*Message
+	byID := make(map[uint64]*Message)
+	deleted := make(map[*Message]bool)
+
+	for _, span := range store.rooms[foldName(room)] {
+		line := make([]byte, span.length)
+
+		if _, err := file.ReadAt(line, span.offset); err != nil {
+			return nil, err
+		}
+
+		var stored storedMessage
+
+		if json.Unmarshal(line, &stored) != nil {
+			continue
+		}
+
+		msg := byID[stored.ID]
+
+		switch stored.Kind {
+		case storedEdit:
+			if msg != nil {
+				msg.text = stored.Text
+				msg.edited = true
+			}
+		case storedDelete:
+			if msg != nil {
+				deleted[msg] = true
+				delete(byID, stored.ID)
+			}
+		case storedReact, storedUnreact:
+			if msg != nil {
+				msg.react(stored.Nick, stored.Text, stored.Kind == storedUnreact)
+			}
+		default:
+			msg = &Message{
+				id:   stored.ID,
+				room: stored.Room,
+				nick: stored.Nick,
+				text: stored.Text,
+				time: stored.Time,
+
+				parent: stored.Parent,
+			}
+
+			messages = append(messages, msg)
+			byID[msg.id] = msg
+		}
+	}
+
+	history := NewHistory(n)
+
+	for _, msg := range messages {
+		if !deleted[msg] {
+			history.Add(msg)
+		}
+	}
+
+	return history.Messages(), nil
+}
+
+// LastIDs finds the ID of the last message saved in each room, keyed by
+// the room's folded name, so that rooms carry on numbering their messages
+// where they left off.
+func (store *FileStore) LastIDs() (map[string]uint64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	file, err := os.Open(store.path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	ids := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+
+	for scanner.Scan() {
+		var stored storedMessage
+
+		if json.Unmarshal(scanner.Bytes(), &stored) != nil {
+			continue
+		}
+
+		room := foldName(stored.Room)
+		ids[room] = max(ids[room], stored.ID)
+	}
+
+	return ids, scanner.Err()
+}
+
+// Ping checks the file is still where messages are read back from.
+func (store *FileStore) Ping() error {
+	_, err := os.Stat(store.path)
+	return err
+}
+
+func (store *FileStore) Close() error {
+	return store.file.Close()
+}
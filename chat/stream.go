@@ -0,0 +1,188 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	streamBuffer    = 64
+	streamKeepalive = 30 * time.Second
+)
+
+// ServeStreams lets dashboards and status pages follow a room without a
+// chat connection, with "GET /rooms/<room>/stream". Each message in the
+// room is sent as a server-sent event whose data is the message's JSON
+// event. Invite-only and keyed rooms can't be followed, and streams end
+// when their room becomes one. If there is a stream token, requests need
+// it, either as "Authorization: Bearer <token>" or as ?token=, since
+// browsers' EventSource can't set headers. The same listener searches
+// rooms' history with "GET /rooms/<room>/search".
+func (server *Server) ServeStreams(listener net.Listener) error {
+	httpServer := &http.Server{
+		Handler:           http.HandlerFunc(server.streamRoute),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return httpServer.Serve(listener)
+}
+
+func (server *Server) streamRoute(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if r.Method != http.MethodGet || len(parts) != 3 || parts[0] != "rooms" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[2] {
+	case "stream":
+		server.streamAuthorized(w, r, parts[1])
+	case "search":
+		server.searchRoute(w, r, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (server *Server) streamAuthorized(w http.ResponseWriter, r *http.Request, name string) {
+	if server.streamToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if !ok {
+			token = r.URL.Query().Get("token")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(server.streamToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	server.streamRoom(w, r, name)
+}
+
+func (server *Server) streamRoom(w http.ResponseWriter, r *http.Request, name string) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	stream := make(chan *Event, streamBuffer)
+	var room *Room
+	var private bool
+
+	server.call(func() {
+		found, exists := server.LookupRoom(name)
+
+		if !exists {
+			return
+		}
+
+		if found.inviteOnly || found.key != "" {
+			private = true
+			return
+		}
+
+		room = found
+		room.do(func() {
+			room.streams[stream] = true
+		})
+	})
+
+	if private {
+		http.Error(w, "room is private", http.StatusForbidden)
+		return
+	}
+
+	if room == nil {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+
+	defer server.call(func() {
+		room.do(func() {
+			delete(room.streams, stream)
+		})
+	})
+
+	slog.Info("streaming room", "room", name, "addr", r.RemoteAddr)
+	defer slog.Info("stopped streaming room", "room", name, "addr", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamKeepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-stream:
+			if !ok {
+				// The room was closed or made private, or we fell too
+				// far behind.
+				return
+			}
+
+			data, err := json.Marshal(event)
+
+			if err != nil {
+				slog.Error("encoding stream event", "room", name, "err", err)
+				continue
+			}
+
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			_, err := fmt.Fprint(w, ": keepalive\n\n")
+
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// closeStreams ends the room's streams, once it has become private. Like
+// sending, it is queued on the room's goroutine, so nothing sent after the
+// room's mode changed reaches them.
+func (room *Room) closeStreams() {
+	room.do(func() {
+		for stream := range room.streams {
+			delete(room.streams, stream)
+			close(stream)
+		}
+	})
+}
+
+// sendStreams passes event on to the room's streams. A stream that isn't
+// keeping up is closed rather than holding up the room. It must be called
+// on the room's goroutine.
+func (room *Room) sendStreams(event *Event) {
+	for stream := range room.streams {
+		select {
+		case stream <- event:
+		default:
+			delete(room.streams, stream)
+			close(stream)
+		}
+	}
+}
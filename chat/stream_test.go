@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStreamClosesWhenPrivate follows a room, makes it invite only, and
+// checks the stream ends before anything said afterwards reaches it.
+func TestStreamClosesWhenPrivate(t *testing.T) {
+	config := DefaultConfig()
+	config.RateLimit = 0
+
+	server, l, _, _ := newTestServer(t, config)
+
+	alice := dialTest(t, l)
+	alice.send("nick alice")
+	alice.expect("is now known as alice")
+	alice.send("join lobby")
+	alice.expect("alice joined lobby")
+
+	web := httptest.NewServer(http.HandlerFunc(server.streamRoute))
+	t.Cleanup(web.Close)
+
+	resp, err := http.Get(web.URL + "/rooms/lobby/stream")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream status %d, want 200", resp.StatusCode)
+	}
+
+	lines := make(chan string)
+
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	next := func() (string, bool) {
+		select {
+		case line, ok := <-lines:
+			return line, ok
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out reading the stream")
+			return "", false
+		}
+	}
+
+	alice.send("msg lobby before")
+
+	for {
+		line, ok := next()
+
+		if !ok {
+			t.Fatal("stream ended before the first message")
+		}
+
+		if strings.Contains(line, "before") {
+			break
+		}
+	}
+
+	alice.send("invite-only lobby on")
+	alice.expect("made lobby invite only")
+	alice.send("msg lobby after")
+	alice.expect("alice: after")
+
+	for {
+		line, ok := next()
+
+		if !ok {
+			break
+		}
+
+		if strings.Contains(line, "after") {
+			t.Fatalf("stream got %q after the room was made private", line)
+		}
+	}
+}
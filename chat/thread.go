@@ -0,0 +1,138 @@
+package chat
+
+import (
+	"strconv"
+)
+
+// Threads are looked for among this many of a room's latest messages.
+const maxThreadScan = 1000
+
+// ReplyCommand sends a message to a room as a reply to one of the room's
+// earlier messages.
+type ReplyCommand struct {
+	client  *Client
+	room    string
+	parent  uint64
+	message string
+}
+
+func (cmd *ReplyCommand) Run(server *Server) {
+	if !server.CheckAccepted(cmd.client) || !server.CheckLength(cmd.client, cmd.message) || !server.CheckSpam(cmd.client, cmd.room, cmd.message) {
+		return
+	}
+
+	server.Broadcast(cmd.room, cmd.client, cmd.message, cmd.parent)
+}
+
+// ThreadCommand sends a client the thread a message is part of: the
+// message the thread started with and every reply to it, or to those
+// replies, in the order they were sent.
+type ThreadCommand struct {
+	client *Client
+	room   string
+	id     uint64
+}
+
+func (cmd *ThreadCommand) Run(server *Server) {
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		cmd.client.Error("Room doesn't exist")
+		return
+	}
+
+	if !room.HasClient(cmd.client) {
+		cmd.client.Error("You are not in that room")
+		return
+	}
+
+	room.do(func() {
+		messages, err := server.roomHistory(room, maxThreadScan)
+
+		if err != nil {
+			cmd.client.Error("History is unavailable")
+			return
+		}
+
+		thread := findThread(messages, cmd.id)
+
+		if thread == nil {
+			cmd.client.Error("That message is no longer in history")
+			return
+		}
+
+		if len(thread) > maxHistoryRequest {
+			thread = thread[len(thread)-maxHistoryRequest:]
+		}
+
+		for _, msg := range thread {
+			cmd.client.Send(msg.Event(server.timeLocation, true))
+		}
+
+		cmd.client.Notice(room.name, "End of thread")
+	})
+}
+
+// findThread picks the thread the message with the given ID belongs to
+// out of messages, which are in the order they were sent. A thread starts
+// with the earliest message in messages that its replies lead back to.
+func findThread(messages []*Message, id uint64) []*Message {
+	byID := make(map[uint64]*Message, len(messages))
+
+	for _, msg := range messages {
+		byID[msg.id] = msg
+	}
+
+	root, exists := byID[id]
+
+	if !exists {
+		return nil
+	}
+
+	for byID[root.parent] != nil {
+		root = byID[root.parent]
+	}
+
+	// Replies always come after their parents, so one pass finds them
+	// all.
+	inThread := map[uint64]bool{root.id: true}
+	var thread []*Message
+
+	for _, msg := range messages {
+		if msg == root || (msg.parent != 0 && inThread[msg.parent]) {
+			inThread[msg.id] = true
+			thread = append(thread, msg)
+		}
+	}
+
+	return thread
+}
+
+func parseReply(client *Client, args []string) Command {
+	parent, err := strconv.ParseUint(args[1], 10, 64)
+
+	if err != nil || parent == 0 {
+		return nil
+	}
+
+	return &ReplyCommand{
+		client:  client,
+		room:    args[0],
+		parent:  parent,
+		message: args[2],
+	}
+}
+
+func parseThread(client *Client, args []string) Command {
+	id, err := strconv.ParseUint(args[1], 10, 64)
+
+	if err != nil {
+		return nil
+	}
+
+	return &ThreadCommand{
+		client: client,
+		room:   args[0],
+		id:     id,
+	}
+}
@@ -0,0 +1,167 @@
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const tokenPrefix = "cs_"
+
+// Token is a long-lived secret that logs in to an account without its
+// password, for bots and scripts. Only a hash is kept; the token itself is
+// shown once, when it is created.
+type Token struct {
+	ID      string    `json:"id"`
+	Label   string    `json:"label,omitempty"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// Tokens are random enough that a plain hash is as good as a slow one.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSecret(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// IssueToken creates a token for account and returns the secret to show
+// its owner.
+func (store *AccountStore) IssueToken(account *Account, label string) (*Token, string, error) {
+	secret := tokenPrefix + newSecret(32)
+
+	token := &Token{
+		ID:      newSecret(6),
+		Label:   label,
+		Hash:    hashToken(secret),
+		Created: time.Now(),
+	}
+
+	account.Tokens = append(account.Tokens, token)
+	store.tokens[token.Hash] = account
+
+	return token, secret, store.save()
+}
+
+// RevokeToken reports whether account had a token with id.
+func (store *AccountStore) RevokeToken(account *Account, id string) (bool, error) {
+	for i, token := range account.Tokens {
+		if token.ID == id {
+			account.Tokens = append(account.Tokens[:i], account.Tokens[i+1:]...)
+			delete(store.tokens, token.Hash)
+
+			return true, store.save()
+		}
+	}
+
+	return false, nil
+}
+
+func (store *AccountStore) Authenticate(secret string) (*Account, bool) {
+	account, exists := store.tokens[hashToken(secret)]
+	return account, exists
+}
+
+type AuthCommand struct {
+	client *Client
+	secret string
+}
+
+func (cmd *AuthCommand) Run(server *Server) {
+	account, exists := server.accounts.Authenticate(cmd.secret)
+
+	if !exists {
+		cmd.client.Error("Invalid token")
+		return
+	}
+
+	server.LogIn(cmd.client, account)
+}
+
+type TokenCommand struct {
+	client *Client
+	action string
+	arg    string
+}
+
+func (cmd *TokenCommand) Run(server *Server) {
+	account, exists := server.accounts.Get(cmd.client.account)
+
+	if cmd.client.account == "" || !exists {
+		cmd.client.Error("You must log in first")
+		return
+	}
+
+	switch cmd.action {
+	case "new":
+		token, secret, err := server.accounts.IssueToken(account, cmd.arg)
+
+		if err != nil {
+			slog.Error("saving accounts", "err", err)
+			cmd.client.Error("Token could not be saved")
+			return
+		}
+
+		cmd.client.Reply(fmt.Sprintf("Token %s: %s (it will not be shown again)", token.ID, secret))
+	case "list":
+		if len(account.Tokens) == 0 {
+			cmd.client.Reply("No tokens")
+			return
+		}
+
+		tokens := make([]string, len(account.Tokens))
+
+		for i, token := range account.Tokens {
+			tokens[i] = token.ID
+
+			if token.Label != "" {
+				tokens[i] += " " + token.Label
+			}
+
+			tokens[i] += " (created " + token.Created.Format(time.DateTime) + ")"
+		}
+
+		cmd.client.Reply("Tokens:\n" + strings.Join(tokens, "\n"))
+	case "revoke":
+		revoked, err := server.accounts.RevokeToken(account, cmd.arg)
+
+		if !revoked {
+			cmd.client.Error("No such token")
+			return
+		}
+
+		if err != nil {
+			slog.Error("saving accounts", "err", err)
+			cmd.client.Error("Token revoked but could not be saved")
+			return
+		}
+
+		cmd.client.Reply("Revoked token " + cmd.arg)
+	}
+}
+
+func parseAuth(client *Client, args []string) Command {
+	return &AuthCommand{
+		client: client,
+		secret: args[0],
+	}
+}
+
+func parseToken(client *Client, args []string) Command {
+	return &TokenCommand{
+		client: client,
+		action: args[0],
+		arg:    args[1],
+	}
+}
@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// triggerCooldown is how long a trigger stays quiet after answering, so a
+// busy room isn't flooded with the same answer.
+const triggerCooldown = 30 * time.Second
+
+// maxRoomTriggers is the most triggers a room can have.
+const maxRoomTriggers = 50
+
+// isTriggerWordRune reports whether r can be part of a trigger keyword.
+// Anything else separates words in the messages triggers look through.
+func isTriggerWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+func validTriggerKeyword(keyword string) bool {
+	return keyword != "" && strings.IndexFunc(keyword, func(r rune) bool { return !isTriggerWordRune(r) }) < 0
+}
+
+// setTrigger makes room answer messages containing keyword with response,
+// or stops it if response is empty.
+func (server *Server) setTrigger(client *Client, room *Room, keyword, response string) {
+	if !validTriggerKeyword(keyword) {
+		client.Error("A trigger keyword is a single word of letters, digits and underscores")
+		return
+	}
+
+	keyword = strings.ToLower(keyword)
+	_, exists := room.triggers[keyword]
+
+	if response == "" {
+		if !exists {
+			client.Error(fmt.Sprintf("%s has no trigger for %s", plainName(room.name), keyword))
+			return
+		}
+
+		delete(room.triggers, keyword)
+		server.saveRoom(room)
+
+		client.logger().Info("removed room trigger", "room", room.name, "keyword", keyword)
+		server.audit(client.Name(), "set trigger", room.name, "", keyword)
+		client.Reply(fmt.Sprintf("Removed the trigger for %s from %s", keyword, plainName(room.name)))
+		return
+	}
+
+	if !exists && len(room.triggers) >= maxRoomTriggers {
+		client.Error(fmt.Sprintf("A room can have at most %d triggers", maxRoomTriggers))
+		return
+	}
+
+	if !server.CheckLength(client, response) {
+		return
+	}
+
+	room.triggers[keyword] = response
+	server.saveRoom(room)
+
+	client.logger().Info("set room trigger", "room", room.name, "keyword", keyword)
+	server.audit(client.Name(), "set trigger", room.name, "", keyword+" "+response)
+	client.Reply(fmt.Sprintf("Messages to %s mentioning %s will now be answered", plainName(room.name), keyword))
+}
+
+// listTriggers tells client the triggers room has.
+func (server *Server) listTriggers(client *Client, room *Room) {
+	if len(room.triggers) == 0 {
+		client.Reply(fmt.Sprintf("%s has no triggers", plainName(room.name)))
+		return
+	}
+
+	keywords := make([]string, 0, len(room.triggers))
+
+	for keyword := range room.triggers {
+		keywords = append(keywords, keyword)
+	}
+
+	sort.Strings(keywords)
+
+	lines := []string{"Triggers in " + plainName(room.name) + ":"}
+
+	for _, keyword := range keywords {
+		lines = append(lines, keyword+": "+room.triggers[keyword])
+	}
+
+	client.Reply(strings.Join(lines, "\n"))
+}
+
+// fireTriggers posts the answers of room's triggers whose keywords appear
+// as words in text, a message just sent there, as notices after it. Each
+// trigger answers at most once every triggerCooldown.
+func (server *Server) fireTriggers(room *Room, text string) {
+	if len(room.triggers) == 0 {
+		return
+	}
+
+	var keywords, responses []string
+
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !isTriggerWordRune(r) }) {
+		response, exists := room.triggers[word]
+
+		if exists && !slices.Contains(keywords, word) {
+			keywords = append(keywords, word)
+			responses = append(responses, response)
+		}
+	}
+
+	if len(keywords) == 0 {
+		return
+	}
+
+	room.do(func() {
+		now := time.Now()
+
+		for i, keyword := range keywords {
+			if now.Sub(room.triggerFired[keyword]) < triggerCooldown {
+				continue
+			}
+
+			room.triggerFired[keyword] = now
+			event := &Event{Type: EventNotice, Time: now, Room: room.name, Text: responses[i]}
+
+			for _, client := range room.recipients {
+				client.Send(event)
+			}
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"time"
+)
+
+// typingInterval is how often a client may tell a room it has started
+// typing. Clients usually resend start while the user keeps typing, so
+// anything faster is dropped without complaint.
+const typingInterval = 2 * time.Second
+
+// TypingCommand relays a typing indicator to the rest of a room. Only JSON
+// clients are sent these, and they are never kept in history.
+type TypingCommand struct {
+	client *Client
+	room   string
+	state  string
+}
+
+func (cmd *TypingCommand) Run(server *Server) {
+	client := cmd.client
+	room, exists := server.LookupRoom(cmd.room)
+
+	if !exists {
+		client.Error("Room doesn't exist")
+		return
+	}
+
+	if !room.HasClient(client) {
+		client.Error("You are not in that room")
+		return
+	}
+
+	if cmd.state == "start" {
+		if time.Since(client.lastTyping) < typingInterval {
+			return
+		}
+
+		client.lastTyping = time.Now()
+	} else {
+		client.lastTyping = time.Time{}
+	}
+
+	event := &Event{
+		Type: EventTyping,
+		Time: time.Now(),
+		Room: room.name,
+		Nick: client.Name(),
+		Text: cmd.state,
+	}
+
+	room.do(func() {
+		for _, member := range room.recipients {
+			if member != client {
+				member.Send(event)
+			}
+		}
+	})
+}
+
+func parseTyping(client *Client, args []string) Command {
+	return &TypingCommand{
+		client: client,
+		room:   args[0],
+		state:  args[1],
+	}
+}
@@ -0,0 +1,399 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	uploadSweepInterval = time.Hour
+	maxUploadName       = 100
+)
+
+// An Upload is a file someone shared through the upload endpoint. The
+// file is kept in the upload directory under its ID, next to this record
+// of it as <id>.json.
+type Upload struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Account string    `json:"account"`
+	Time    time.Time `json:"time"`
+}
+
+// Uploads keeps the files shared through the upload endpoint until they
+// are older than the retention. It is used from HTTP handlers as well as
+// the dispatcher, so it is locked.
+type Uploads struct {
+	dir       string
+	baseURL   string
+	maxSize   int64
+	retention time.Duration
+
+	mu    sync.Mutex
+	files map[string]*Upload
+}
+
+func LoadUploads(dir, baseURL string, maxSize int64, retention time.Duration) (*Uploads, error) {
+	err := os.MkdirAll(dir, 0700)
+
+	if err != nil {
+		return nil, err
+	}
+
+	uploads := &Uploads{
+		dir:       dir,
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		maxSize:   maxSize,
+		retention: retention,
+		files:     make(map[string]*Upload),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var upload Upload
+
+		err = json.Unmarshal(data, &upload)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		uploads.files[upload.ID] = &upload
+	}
+
+	uploads.expire(time.Now())
+
+	return uploads, nil
+}
+
+func (uploads *Uploads) Get(id string) (*Upload, bool) {
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+
+	upload, exists := uploads.files[id]
+	return upload, exists
+}
+
+// URL is the short link upload can be downloaded from.
+func (uploads *Uploads) URL(upload *Upload) string {
+	return uploads.baseURL + "/files/" + upload.ID
+}
+
+// Save reads a file called name from r into the upload directory on
+// behalf of account.
+func (uploads *Uploads) Save(account, name string, r io.Reader) (*Upload, error) {
+	temp, err := os.CreateTemp(uploads.dir, "upload-*.tmp")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(temp.Name())
+
+	size, err := io.Copy(temp, r)
+
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &Upload{
+		ID:      newSecret(6),
+		Name:    name,
+		Size:    size,
+		Account: account,
+		Time:    time.Now(),
+	}
+
+	data, err := json.Marshal(upload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Rename(temp.Name(), filepath.Join(uploads.dir, upload.ID))
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(filepath.Join(uploads.dir, upload.ID+".json"), data, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	uploads.mu.Lock()
+	uploads.files[upload.ID] = upload
+	uploads.mu.Unlock()
+
+	return upload, nil
+}
+
+// Run deletes files once they are past the retention, until the process
+// exits.
+func (uploads *Uploads) Run() {
+	ticker := time.NewTicker(uploadSweepInterval)
+
+	for now := range ticker.C {
+		uploads.expire(now)
+	}
+}
+
+func (uploads *Uploads) expire(now time.Time) {
+	if uploads.retention <= 0 {
+		return
+	}
+
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+
+	for id, upload := range uploads.files {
+		if now.Sub(upload.Time) < uploads.retention {
+			continue
+		}
+
+		delete(uploads.files, id)
+
+		for _, path := range []string{filepath.Join(uploads.dir, id), filepath.Join(uploads.dir, id+".json")} {
+			err := os.Remove(path)
+
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Error("removing expired upload", "path", path, "err", err)
+			}
+		}
+
+		slog.Info("upload expired", "id", id, "name", upload.Name)
+	}
+}
+
+// ServeUploads lets users share files and long pastes. "POST
+// /files?name=<filename>" with the file as the body stores it and returns
+// its short link, which "GET /files/<id>" downloads from. Uploading needs
+// an account token, sent as "Authorization: Bearer <token>"; the send
+// command then announces the file in a room or to a nick.
+func (server *Server) ServeUploads(listener net.Listener) error {
+	httpServer := &http.Server{
+		Handler:           http.HandlerFunc(server.uploadRoute),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return httpServer.Serve(listener)
+}
+
+func (server *Server) uploadRoute(w http.ResponseWriter, r *http.Request) {
+	id, isDownload := strings.CutPrefix(r.URL.Path, "/files/")
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/files":
+		server.receiveUpload(w, r)
+	case r.Method == http.MethodGet && isDownload && id != "" && !strings.Contains(id, "/"):
+		server.sendUpload(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type uploadResponse struct {
+	ID   string `json:"id"`
+	URL  string `json:"url"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func (server *Server) receiveUpload(w http.ResponseWriter, r *http.Request) {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	var account string
+
+	if ok {
+		server.call(func() {
+			if found, exists := server.accounts.Authenticate(secret); exists {
+				account = found.Nick
+			}
+		})
+	}
+
+	if account == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name, ok := cleanUploadName(r.URL.Query().Get("name"))
+
+	if !ok {
+		http.Error(w, "expected ?name=<filename>", http.StatusBadRequest)
+		return
+	}
+
+	uploads := server.uploads
+
+	if r.ContentLength > uploads.maxSize {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	upload, err := uploads.Save(account, name, http.MaxBytesReader(w, r.Body, uploads.maxSize))
+
+	var tooLarge *http.MaxBytesError
+
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		slog.Error("saving upload", "account", account, "err", err)
+		http.Error(w, "upload failed", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("file uploaded", "account", account, "id", upload.ID, "name", upload.Name, "size", upload.Size)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&uploadResponse{
+		ID:   upload.ID,
+		URL:  uploads.URL(upload),
+		Name: upload.Name,
+		Size: upload.Size,
+	})
+}
+
+// sendUpload serves plain text inline, so pastes can be read in the
+// browser, and everything else as a download. Nothing is served with a
+// type the browser would run.
+func (server *Server) sendUpload(w http.ResponseWriter, r *http.Request, id string) {
+	upload, exists := server.uploads.Get(id)
+
+	if !exists {
+		http.Error(w, "no such file", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(server.uploads.dir, upload.ID))
+
+	if err != nil {
+		http.Error(w, "no such file", http.StatusNotFound)
+		return
+	}
+
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	disposition := "attachment"
+
+	if strings.HasPrefix(http.DetectContentType(head[:n]), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		disposition = "inline"
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	w.Header().Set("Content-Disposition", disposition+"; filename*=UTF-8''"+url.PathEscape(upload.Name))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+
+	http.ServeContent(w, r, "", upload.Time, file)
+}
+
+// cleanUploadName keeps the last element of a file name, without
+// characters that would garble a chat line.
+func cleanUploadName(name string) (string, bool) {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+
+		return r
+	}, name)
+
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+
+	if name == "" || name == "." || name == "/" || len([]rune(name)) > maxUploadName {
+		return "", false
+	}
+
+	return name, true
+}
+
+// formatSize renders a number of bytes the way people read them, like
+// "340 B" or "1.2 MB".
+func formatSize(size int64) string {
+	if size < 1000 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value, unit := float64(size)/1000, "kB"
+
+	for _, larger := range []string{"MB", "GB"} {
+		if value < 1000 {
+			break
+		}
+
+		value, unit = value/1000, larger
+	}
+
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
+
+// SendCommand announces a file its sender uploaded in a room they are in,
+// or to a nick, with its name, size and link.
+type SendCommand struct {
+	client *Client
+	target string
+	id     string
+}
+
+func (cmd *SendCommand) Run(server *Server) {
+	client := cmd.client
+
+	if server.uploads == nil {
+		client.Error("Uploads are turned off")
+		return
+	}
+
+	upload, exists := server.uploads.Get(cmd.id)
+
+	if !exists || client.account == "" || !sameName(upload.Account, client.account) {
+		client.Error("You have no upload " + cmd.id)
+		return
+	}
+
+	text := fmt.Sprintf("shared %s (%s): %s", upload.Name, formatSize(upload.Size), server.uploads.URL(upload))
+
+	if room, exists := server.LookupRoom(cmd.target); exists && room.HasClient(client) {
+		(&MsgCommand{client: client, room: room.name, message: text}).Run(server)
+		return
+	}
+
+	(&PmCommand{client: client, nick: cmd.target, message: text}).Run(server)
+}
@@ -0,0 +1,172 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	webhookQueueSize  = 256
+	webhookRetries    = 5
+	webhookMaxBackoff = time.Minute
+
+	// webhookAllRooms stands for every room in the webhook configuration.
+	webhookAllRooms = "*"
+)
+
+// Webhooks POSTs room events as JSON to the URLs configured for the room.
+// Each URL has its own queue and goroutine, so one slow endpoint only holds
+// up its own deliveries. Events are added by commands both on the
+// dispatcher and running concurrently, and adding one never blocks.
+type Webhooks struct {
+	hooks  map[string][]*webhook
+	client *http.Client
+}
+
+type webhook struct {
+	url   string
+	queue chan *webhookEvent
+}
+
+type webhookEvent struct {
+	Event     string    `json:"event"`
+	Room      string    `json:"room"`
+	Nick      string    `json:"nick"`
+	Message   string    `json:"message,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewWebhooks takes hooks given as "room=url", separated by commas, where
+// a room of * means every room.
+func NewWebhooks(spec string) (*Webhooks, error) {
+	webhooks := &Webhooks{
+		hooks:  make(map[string][]*webhook),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		room, target, _ := strings.Cut(entry, "=")
+		parsed, err := url.Parse(target)
+
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("bad webhook %q, expected room=http(s)://host/path", entry)
+		}
+
+		if room != webhookAllRooms && !validName(room) {
+			return nil, fmt.Errorf("bad webhook room %q", room)
+		}
+
+		webhooks.hooks[foldName(room)] = append(webhooks.hooks[foldName(room)], &webhook{
+			url:   target,
+			queue: make(chan *webhookEvent, webhookQueueSize),
+		})
+	}
+
+	return webhooks, nil
+}
+
+// Start sends queued events until the process exits.
+func (webhooks *Webhooks) Start() {
+	for _, hooks := range webhooks.hooks {
+		for _, hook := range hooks {
+			go hook.run(webhooks.client)
+		}
+	}
+}
+
+func (webhooks *Webhooks) send(event *webhookEvent) {
+	if webhooks == nil {
+		return
+	}
+
+	for _, room := range []string{event.Room, webhookAllRooms} {
+		for _, hook := range webhooks.hooks[foldName(room)] {
+			select {
+			case hook.queue <- event:
+			default:
+				slog.Warn("webhook queue full, dropping event", "url", hook.url, "room", event.Room)
+			}
+		}
+	}
+}
+
+// Joined, Parted and Message queue an event for the room's webhooks.
+func (webhooks *Webhooks) Joined(room, nick string) {
+	webhooks.send(&webhookEvent{Event: "join", Room: room, Nick: nick, Timestamp: time.Now()})
+}
+
+func (webhooks *Webhooks) Parted(room, nick string) {
+	webhooks.send(&webhookEvent{Event: "part", Room: room, Nick: nick, Timestamp: time.Now()})
+}
+
+func (webhooks *Webhooks) Message(message *Message) {
+	webhooks.send(&webhookEvent{Event: "message", Room: message.room, Nick: message.nick, Message: message.text, Timestamp: message.time})
+}
+
+func (hook *webhook) run(client *http.Client) {
+	for event := range hook.queue {
+		data, err := json.Marshal(event)
+
+		if err != nil {
+			slog.Error("encoding webhook event", "err", err)
+			continue
+		}
+
+		attempts, err := postJSON(client, hook.url, data)
+
+		if err != nil {
+			slog.Error("webhook failed, dropping event", "url", hook.url, "room", event.Room, "err", err, "attempts", attempts)
+		}
+	}
+}
+
+// postJSON POSTs data to target, backing off and trying again while the
+// failure looks temporary. It returns how many attempts it made.
+func postJSON(client *http.Client, target string, data []byte) (int, error) {
+	backoff := time.Second
+
+	for attempt := 1; ; attempt++ {
+		retry, err := postOnce(client, target, data)
+
+		if err == nil || !retry || attempt == webhookRetries {
+			return attempt, err
+		}
+
+		time.Sleep(backoff)
+		backoff = min(2*backoff, webhookMaxBackoff)
+	}
+}
+
+// postOnce makes one attempt. Server errors and rate limiting are worth
+// retrying; any other refusal won't get better by asking again.
+func postOnce(client *http.Client, target string, data []byte) (bool, error) {
+	resp, err := client.Post(target, "application/json", bytes.NewReader(data))
+
+	if err != nil {
+		return true, err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+
+	return retry, fmt.Errorf("endpoint answered %s", resp.Status)
+}
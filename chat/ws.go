@@ -0,0 +1,270 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const maxFrameSize = 64 << 10
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+func (server *Server) ServeWebSocket(listener net.Listener) error {
+	httpServer := &http.Server{
+		Handler:           http.HandlerFunc(server.upgradeWebSocket),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return httpServer.Serve(listener)
+}
+
+func (server *Server) upgradeWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+
+	if !ok {
+		http.Error(w, "WebSocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+
+	if err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+
+	if rw.Flush() != nil {
+		conn.Close()
+		return
+	}
+
+	server.HandleConnection(newWSConn(conn, rw.Reader))
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsConn presents a WebSocket as the line-oriented byte stream the rest of
+// the server expects. Each incoming data message becomes one line, and each
+// line written is sent as a text frame of its own, however the writes that
+// carry it are split up or batched together.
+type wsConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	pending []byte
+
+	// partial is the start of a line whose end hasn't been written yet.
+	partial []byte
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+func newWSConn(conn net.Conn, reader *bufio.Reader) *wsConn {
+	return &wsConn{
+		Conn:   conn,
+		reader: reader,
+	}
+}
+
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		fin, opcode, payload, err := ws.readFrame()
+
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case opText, opBinary, opContinuation:
+			if fin && (len(payload) == 0 || payload[len(payload)-1] != '\n') {
+				payload = append(payload, '\n')
+			}
+
+			ws.pending = payload
+		case opClose:
+			ws.closeOnce.Do(func() {
+				ws.writeFrame(opClose, payload[:min(len(payload), 2)])
+			})
+
+			return 0, io.EOF
+		case opPing:
+			ws.writeFrame(opPong, payload)
+		}
+	}
+
+	n := copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+
+	return n, nil
+}
+
+func (ws *wsConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if !masked {
+		return false, 0, nil, errors.New("websocket: unmasked client frame")
+	}
+
+	if length > maxFrameSize || (opcode >= opClose && length > 125) {
+		return false, 0, nil, errors.New("websocket: frame too large")
+	}
+
+	var mask [4]byte
+
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	frame := []byte{0x80 | opcode}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	_, err := ws.Conn.Write(append(frame, payload...))
+	return err
+}
+
+func (ws *wsConn) Write(p []byte) (int, error) {
+	rest := p
+
+	for {
+		end := bytes.IndexByte(rest, '\n')
+
+		if end < 0 {
+			ws.partial = append(ws.partial, rest...)
+			return len(p), nil
+		}
+
+		line := rest[:end+1]
+
+		if len(ws.partial) > 0 {
+			line = append(ws.partial, line...)
+			ws.partial = nil
+		}
+
+		if err := ws.writeFrame(opText, line); err != nil {
+			return len(p) - len(rest), err
+		}
+
+		rest = rest[end+1:]
+	}
+}
+
+func (ws *wsConn) Close() error {
+	ws.closeOnce.Do(func() {
+		ws.writeFrame(opClose, []byte{0x03, 0xe8})
+	})
+
+	return ws.Conn.Close()
+}
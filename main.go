@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+
+	"github.com/davidbalbert/chatserver/chat"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		chat.RunBench(os.Args[0], os.Args[2:])
+		return
+	}
+
+	chat.Run(os.Args[0], os.Args[1:])
+}